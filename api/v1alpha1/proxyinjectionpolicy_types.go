@@ -0,0 +1,116 @@
+package v1alpha1
+
+import (
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	ProxyInjectionPolicyKubeKind = "proxyinjectionpolicy"
+)
+
+func init() {
+	SchemeBuilder.Register(&ProxyInjectionPolicy{}, &ProxyInjectionPolicyList{})
+}
+
+//+kubebuilder:object:root=true
+
+// ProxyInjectionPolicy is the Schema for the proxyinjectionpolicies API. It supplies defaults for the
+// injection settings of the connect-injected pods it selects in its namespace. Annotations on a pod
+// take precedence over the policy, which takes precedence over namespace labels and the flags of the
+// connect injector.
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp",description="The age of the resource"
+type ProxyInjectionPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ProxyInjectionPolicySpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ProxyInjectionPolicyList contains a list of ProxyInjectionPolicy
+type ProxyInjectionPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ProxyInjectionPolicy `json:"items"`
+}
+
+// ProxyInjectionPolicySpec defines the desired state of ProxyInjectionPolicy
+type ProxyInjectionPolicySpec struct {
+	// Selector selects the pods in the namespace of the policy that it applies to.
+	// An empty selector selects all pods in the namespace. When several policies select
+	// a pod, the first one by name is applied.
+	Selector metav1.LabelSelector `json:"selector,omitempty"`
+	// SidecarProxy configures the Envoy sidecar.
+	SidecarProxy SidecarProxyPolicy `json:"sidecarProxy,omitempty"`
+	// Metrics configures the metrics of the Envoy sidecar and the service.
+	Metrics MetricsPolicy `json:"metrics,omitempty"`
+	// TransparentProxy configures transparent proxy.
+	TransparentProxy TransparentProxyPolicy `json:"transparentProxy,omitempty"`
+}
+
+// SidecarProxyPolicy configures the Envoy sidecar.
+type SidecarProxyPolicy struct {
+	// CPURequest is the CPU request of the Envoy sidecar.
+	CPURequest *resource.Quantity `json:"cpuRequest,omitempty"`
+	// CPULimit is the CPU limit of the Envoy sidecar.
+	CPULimit *resource.Quantity `json:"cpuLimit,omitempty"`
+	// MemoryRequest is the memory request of the Envoy sidecar.
+	MemoryRequest *resource.Quantity `json:"memoryRequest,omitempty"`
+	// MemoryLimit is the memory limit of the Envoy sidecar.
+	MemoryLimit *resource.Quantity `json:"memoryLimit,omitempty"`
+	// EnvoyExtraArgs is a space-separated list of arguments to pass to Envoy,
+	// e.g. "--log-level debug --disable-hot-restart".
+	EnvoyExtraArgs string `json:"envoyExtraArgs,omitempty"`
+}
+
+// MetricsPolicy configures where Prometheus scrapes metrics from and whether
+// the metrics of the Envoy sidecar and the service are merged.
+type MetricsPolicy struct {
+	// EnableMetrics enables metrics for the Envoy sidecar.
+	EnableMetrics *bool `json:"enableMetrics,omitempty"`
+	// EnableMetricsMerging runs a merged metrics endpoint that serves both
+	// the metrics of the Envoy sidecar and the service.
+	EnableMetricsMerging *bool `json:"enableMetricsMerging,omitempty"`
+	// MergedMetricsPort is the port of the merged metrics endpoint.
+	// +kubebuilder:validation:Minimum=1024
+	// +kubebuilder:validation:Maximum=65535
+	MergedMetricsPort int32 `json:"mergedMetricsPort,omitempty"`
+	// PrometheusScrapePort is the port Prometheus scrapes metrics from.
+	// +kubebuilder:validation:Minimum=1024
+	// +kubebuilder:validation:Maximum=65535
+	PrometheusScrapePort int32 `json:"prometheusScrapePort,omitempty"`
+	// PrometheusScrapePath is the path Prometheus scrapes metrics from.
+	PrometheusScrapePath string `json:"prometheusScrapePath,omitempty"`
+	// ServiceMetricsPort is the port, or the name of the port, the service serves its metrics on.
+	ServiceMetricsPort string `json:"serviceMetricsPort,omitempty"`
+	// ServiceMetricsPath is the path the service serves its metrics on.
+	ServiceMetricsPath string `json:"serviceMetricsPath,omitempty"`
+}
+
+// TransparentProxyPolicy configures transparent proxy.
+type TransparentProxyPolicy struct {
+	// Enabled enables transparent proxy.
+	Enabled *bool `json:"enabled,omitempty"`
+	// ExcludeInboundPorts are the inbound ports to exclude from traffic redirection.
+	ExcludeInboundPorts []string `json:"excludeInboundPorts,omitempty"`
+	// ExcludeOutboundPorts are the outbound ports to exclude from traffic redirection.
+	ExcludeOutboundPorts []string `json:"excludeOutboundPorts,omitempty"`
+	// ExcludeOutboundCIDRs are the outbound CIDRs to exclude from traffic redirection.
+	ExcludeOutboundCIDRs []string `json:"excludeOutboundCIDRs,omitempty"`
+	// ExcludeUIDs are additional user IDs to exclude from traffic redirection.
+	ExcludeUIDs []string `json:"excludeUIDs,omitempty"`
+	// OverwriteProbes overwrites the Kubernetes HTTP probes of the pod to point to the Envoy sidecar.
+	OverwriteProbes *bool `json:"overwriteProbes,omitempty"`
+}
+
+// Matches returns true if the policy's selector selects the given pod labels.
+func (in *ProxyInjectionPolicy) Matches(podLabels map[string]string) (bool, error) {
+	selector, err := metav1.LabelSelectorAsSelector(&in.Spec.Selector)
+	if err != nil {
+		return false, err
+	}
+	return selector.Matches(labels.Set(podLabels)), nil
+}
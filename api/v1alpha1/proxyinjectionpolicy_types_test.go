@@ -0,0 +1,60 @@
+package v1alpha1
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestProxyInjectionPolicy_Matches(t *testing.T) {
+	cases := map[string]struct {
+		selector  metav1.LabelSelector
+		podLabels map[string]string
+		matches   bool
+		expErr    string
+	}{
+		"empty selector matches all pods": {
+			podLabels: map[string]string{"app": "web"},
+			matches:   true,
+		},
+		"empty selector matches pods without labels": {
+			matches: true,
+		},
+		"match labels": {
+			selector:  metav1.LabelSelector{MatchLabels: map[string]string{"tier": "backend"}},
+			podLabels: map[string]string{"app": "web", "tier": "backend"},
+			matches:   true,
+		},
+		"match labels mismatch": {
+			selector:  metav1.LabelSelector{MatchLabels: map[string]string{"tier": "backend"}},
+			podLabels: map[string]string{"app": "web", "tier": "frontend"},
+			matches:   false,
+		},
+		"match expressions": {
+			selector: metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+				{Key: "tier", Operator: metav1.LabelSelectorOpIn, Values: []string{"backend", "batch"}},
+			}},
+			podLabels: map[string]string{"tier": "batch"},
+			matches:   true,
+		},
+		"invalid selector": {
+			selector: metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+				{Key: "tier", Operator: "Near"},
+			}},
+			expErr: `"Near" is not a valid pod selector operator`,
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			policy := ProxyInjectionPolicy{Spec: ProxyInjectionPolicySpec{Selector: c.selector}}
+			matches, err := policy.Matches(c.podLabels)
+			if c.expErr != "" {
+				require.EqualError(t, err, c.expErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.matches, matches)
+		})
+	}
+}
@@ -527,6 +527,31 @@ func (in *MeshSpec) DeepCopy() *MeshSpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MetricsPolicy) DeepCopyInto(out *MetricsPolicy) {
+	*out = *in
+	if in.EnableMetrics != nil {
+		in, out := &in.EnableMetrics, &out.EnableMetrics
+		*out = new(bool)
+		**out = **in
+	}
+	if in.EnableMetricsMerging != nil {
+		in, out := &in.EnableMetricsMerging, &out.EnableMetricsMerging
+		*out = new(bool)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MetricsPolicy.
+func (in *MetricsPolicy) DeepCopy() *MetricsPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(MetricsPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *PassiveHealthCheck) DeepCopyInto(out *PassiveHealthCheck) {
 	*out = *in
@@ -634,6 +659,83 @@ func (in *ProxyDefaultsSpec) DeepCopy() *ProxyDefaultsSpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProxyInjectionPolicy) DeepCopyInto(out *ProxyInjectionPolicy) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProxyInjectionPolicy.
+func (in *ProxyInjectionPolicy) DeepCopy() *ProxyInjectionPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(ProxyInjectionPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ProxyInjectionPolicy) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProxyInjectionPolicyList) DeepCopyInto(out *ProxyInjectionPolicyList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]ProxyInjectionPolicy, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProxyInjectionPolicyList.
+func (in *ProxyInjectionPolicyList) DeepCopy() *ProxyInjectionPolicyList {
+	if in == nil {
+		return nil
+	}
+	out := new(ProxyInjectionPolicyList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ProxyInjectionPolicyList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProxyInjectionPolicySpec) DeepCopyInto(out *ProxyInjectionPolicySpec) {
+	*out = *in
+	in.Selector.DeepCopyInto(&out.Selector)
+	in.SidecarProxy.DeepCopyInto(&out.SidecarProxy)
+	in.Metrics.DeepCopyInto(&out.Metrics)
+	in.TransparentProxy.DeepCopyInto(&out.TransparentProxy)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProxyInjectionPolicySpec.
+func (in *ProxyInjectionPolicySpec) DeepCopy() *ProxyInjectionPolicySpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ProxyInjectionPolicySpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *RingHashConfig) DeepCopyInto(out *RingHashConfig) {
 	*out = *in
@@ -1337,6 +1439,41 @@ func (in *ServiceSplitterSpec) DeepCopy() *ServiceSplitterSpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SidecarProxyPolicy) DeepCopyInto(out *SidecarProxyPolicy) {
+	*out = *in
+	if in.CPURequest != nil {
+		in, out := &in.CPURequest, &out.CPURequest
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.CPULimit != nil {
+		in, out := &in.CPULimit, &out.CPULimit
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.MemoryRequest != nil {
+		in, out := &in.MemoryRequest, &out.MemoryRequest
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.MemoryLimit != nil {
+		in, out := &in.MemoryLimit, &out.MemoryLimit
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SidecarProxyPolicy.
+func (in *SidecarProxyPolicy) DeepCopy() *SidecarProxyPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(SidecarProxyPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SourceIntention) DeepCopyInto(out *SourceIntention) {
 	*out = *in
@@ -1523,6 +1660,51 @@ func (in *TransparentProxyMeshConfig) DeepCopy() *TransparentProxyMeshConfig {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TransparentProxyPolicy) DeepCopyInto(out *TransparentProxyPolicy) {
+	*out = *in
+	if in.Enabled != nil {
+		in, out := &in.Enabled, &out.Enabled
+		*out = new(bool)
+		**out = **in
+	}
+	if in.ExcludeInboundPorts != nil {
+		in, out := &in.ExcludeInboundPorts, &out.ExcludeInboundPorts
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.ExcludeOutboundPorts != nil {
+		in, out := &in.ExcludeOutboundPorts, &out.ExcludeOutboundPorts
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.ExcludeOutboundCIDRs != nil {
+		in, out := &in.ExcludeOutboundCIDRs, &out.ExcludeOutboundCIDRs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.ExcludeUIDs != nil {
+		in, out := &in.ExcludeUIDs, &out.ExcludeUIDs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.OverwriteProbes != nil {
+		in, out := &in.OverwriteProbes, &out.OverwriteProbes
+		*out = new(bool)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TransparentProxyPolicy.
+func (in *TransparentProxyPolicy) DeepCopy() *TransparentProxyPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(TransparentProxyPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Upstream) DeepCopyInto(out *Upstream) {
 	*out = *in
@@ -9,6 +9,7 @@ import (
 	cmdController "github.com/hashicorp/consul-k8s/subcommand/controller"
 	cmdCreateFederationSecret "github.com/hashicorp/consul-k8s/subcommand/create-federation-secret"
 	cmdDeleteCompletedJob "github.com/hashicorp/consul-k8s/subcommand/delete-completed-job"
+	cmdEnvoyLifecycle "github.com/hashicorp/consul-k8s/subcommand/envoy-lifecycle"
 	cmdGetConsulClientCA "github.com/hashicorp/consul-k8s/subcommand/get-consul-client-ca"
 	cmdInjectConnect "github.com/hashicorp/consul-k8s/subcommand/inject-connect"
 	cmdServerACLInit "github.com/hashicorp/consul-k8s/subcommand/server-acl-init"
@@ -40,10 +41,18 @@ func init() {
 			return &cmdInjectConnect.Command{UI: ui}, nil
 		},
 
+		"inject-preview": func() (cli.Command, error) {
+			return &cmdInjectConnect.PreviewCommand{UI: ui}, nil
+		},
+
 		"consul-sidecar": func() (cli.Command, error) {
 			return &cmdConsulSidecar.Command{UI: ui}, nil
 		},
 
+		"envoy-lifecycle": func() (cli.Command, error) {
+			return &cmdEnvoyLifecycle.Command{UI: ui}, nil
+		},
+
 		"server-acl-init": func() (cli.Command, error) {
 			return &cmdServerACLInit.Command{UI: ui}, nil
 		},
@@ -0,0 +1,135 @@
+package connectinject
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-multierror"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// loginTokenDescriptionPrefix is how Consul starts the description of the tokens it creates
+	// when logging in with an auth method. It's followed by the login meta encoded as JSON.
+	loginTokenDescriptionPrefix = "token created via login: "
+
+	// loginMetaKeyPod is the login meta that connect-init sets to the <namespace>/<name> of its pod.
+	loginMetaKeyPod = "pod"
+
+	// aclTokenGracePeriod is how long tokens are left alone after they're created. The pod
+	// they were created for may not be in the cache of the cleaner yet, and the clocks of the
+	// Consul servers and of the Kubernetes API server may differ.
+	aclTokenGracePeriod = 1 * time.Minute
+)
+
+// ACLTokenCleaner periodically deletes the ACL tokens that connect-init created by logging in with
+// the auth method of the connect injector for pods that no longer exist. connect-init logs in each
+// time a pod starts, and the sidecars log out when the pod shuts down gracefully, so tokens are
+// left behind when pods are killed, evicted or lost with their node.
+// It implements controller-runtime's manager.Runnable and only runs on the leader.
+type ACLTokenCleaner struct {
+	// Controller is the endpoints controller whose Kubernetes and Consul clients are used.
+	Controller *EndpointsController
+	// AuthMethod is the name of the auth method connect-init logs in with.
+	AuthMethod string
+	// Interval is the time between cleanups.
+	Interval time.Duration
+	Log      logr.Logger
+}
+
+// Start runs a cleanup every interval until the context is cancelled.
+func (c *ACLTokenCleaner) Start(ctx context.Context) error {
+	for {
+		select {
+		case <-time.After(c.Interval):
+			if err := c.cleanup(ctx); err != nil {
+				c.Log.Error(err, "failed to clean up ACL tokens")
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// cleanup deletes the tokens created by logins with the auth method whose pod no longer exists.
+func (c *ACLTokenCleaner) cleanup(ctx context.Context) error {
+	r := c.Controller
+	// Tokens are created in the namespaces the auth method binds them to, so all of them are listed.
+	opts := &api.QueryOptions{}
+	if r.EnableConsulNamespaces {
+		opts.Namespace = "*"
+	}
+	tokens, _, err := r.ConsulClient.ACL().TokenList(opts.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	var errs error
+	now := time.Now()
+	for _, token := range tokens {
+		if token.AuthMethod != c.AuthMethod {
+			continue
+		}
+		reason, err := c.staleReason(ctx, token, now)
+		if err != nil {
+			errs = multierror.Append(errs, err)
+			continue
+		}
+		if reason == "" {
+			continue
+		}
+		c.Log.Info("deleting ACL token", "accessor-id", token.AccessorID, "description", token.Description, "reason", reason)
+		_, err = r.ConsulClient.ACL().TokenDelete(token.AccessorID, (&api.WriteOptions{Namespace: token.Namespace}).WithContext(ctx))
+		if err != nil {
+			c.Log.Error(err, "failed to delete ACL token", "accessor-id", token.AccessorID)
+			errs = multierror.Append(errs, err)
+		}
+	}
+	return errs
+}
+
+// staleReason returns why the token no longer belongs to a pod, or an empty string if its pod still
+// exists or if it wasn't created by connect-init. Tokens created before their pod, beyond the grace
+// period, belong to a previous pod with the same name, e.g. of a StatefulSet.
+func (c *ACLTokenCleaner) staleReason(ctx context.Context, token *api.ACLTokenListEntry, now time.Time) (string, error) {
+	if now.Sub(token.CreateTime) < aclTokenGracePeriod {
+		return "", nil
+	}
+	namespace, name, ok := loginPod(token.Description)
+	if !ok {
+		return "", nil
+	}
+	var pod corev1.Pod
+	err := c.Controller.Client.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, &pod)
+	if k8serrors.IsNotFound(err) {
+		return "pod not found", nil
+	} else if err != nil {
+		return "", err
+	}
+	if token.CreateTime.Add(aclTokenGracePeriod).Before(pod.CreationTimestamp.Time) {
+		return "pod was replaced by a pod with the same name", nil
+	}
+	return "", nil
+}
+
+// loginPod returns the namespace and name of the pod in the login meta of a token's description.
+func loginPod(description string) (string, string, bool) {
+	if !strings.HasPrefix(description, loginTokenDescriptionPrefix) {
+		return "", "", false
+	}
+	var meta map[string]string
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(description, loginTokenDescriptionPrefix)), &meta); err != nil {
+		return "", "", false
+	}
+	parts := strings.SplitN(meta[loginMetaKeyPod], "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
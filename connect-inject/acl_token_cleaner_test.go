@@ -0,0 +1,119 @@
+package connectinject
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	logrtest "github.com/go-logr/logr/testing"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestLoginPod(t *testing.T) {
+	t.Parallel()
+	cases := map[string]struct {
+		description  string
+		expNamespace string
+		expName      string
+		expOK        bool
+	}{
+		"pod meta": {
+			description:  `token created via login: {"pod":"default/pod1"}`,
+			expNamespace: "default",
+			expName:      "pod1",
+			expOK:        true,
+		},
+		"no login": {
+			description: "token created by an operator",
+		},
+		"login without meta": {
+			description: "token created via login",
+		},
+		"no pod meta": {
+			description: `token created via login: {"component":"sync-catalog"}`,
+		},
+		"pod meta without namespace": {
+			description: `token created via login: {"pod":"pod1"}`,
+		},
+		"invalid meta": {
+			description: `token created via login: {"pod":`,
+		},
+	}
+	for name, c := range cases {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			namespace, podName, ok := loginPod(c.description)
+			require.Equal(t, c.expOK, ok)
+			require.Equal(t, c.expNamespace, namespace)
+			require.Equal(t, c.expName, podName)
+		})
+	}
+}
+
+func TestACLTokenCleaner_StaleReason(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	pod1 := createPod("pod1", "1.2.3.4", true, true)
+	pod1.CreationTimestamp = metav1.NewTime(now.Add(-time.Hour))
+	replaced := createPod("pod2", "2.3.4.5", true, true)
+	replaced.CreationTimestamp = metav1.NewTime(now.Add(-10 * time.Minute))
+
+	cases := map[string]struct {
+		description string
+		age         time.Duration
+		expReason   string
+	}{
+		"pod exists": {
+			description: `token created via login: {"pod":"default/pod1"}`,
+			age:         30 * time.Minute,
+		},
+		"pod not found": {
+			description: `token created via login: {"pod":"default/pod3"}`,
+			age:         30 * time.Minute,
+			expReason:   "pod not found",
+		},
+		"new token of a pod not found": {
+			description: `token created via login: {"pod":"default/pod3"}`,
+			age:         10 * time.Second,
+		},
+		"pod replaced": {
+			description: `token created via login: {"pod":"default/pod2"}`,
+			age:         30 * time.Minute,
+			expReason:   "pod was replaced by a pod with the same name",
+		},
+		"token created shortly before the pod": {
+			description: `token created via login: {"pod":"default/pod2"}`,
+			age:         10*time.Minute + 30*time.Second,
+		},
+		"token not created by connect-init": {
+			description: `token created via login: {"component":"sync-catalog"}`,
+			age:         30 * time.Minute,
+		},
+	}
+	for name, c := range cases {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			cleaner := &ACLTokenCleaner{
+				Controller: &EndpointsController{
+					Client: fake.NewClientBuilder().WithRuntimeObjects([]runtime.Object{pod1, replaced}...).Build(),
+					Log:    logrtest.TestLogger{T: t},
+				},
+				AuthMethod: "consul-k8s-auth-method",
+				Log:        logrtest.TestLogger{T: t},
+			}
+			token := &api.ACLTokenListEntry{
+				AccessorID:  "accessor-id",
+				AuthMethod:  "consul-k8s-auth-method",
+				Description: c.description,
+				CreateTime:  now.Add(-c.age),
+			}
+			reason, err := cleaner.staleReason(context.Background(), token, now)
+			require.NoError(t, err)
+			require.Equal(t, c.expReason, reason)
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package connectinject
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/consul-k8s/consul"
+	"github.com/hashicorp/consul/api"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// agentClientKey identifies a Consul API client by the address it points at and its Consul namespace.
+type agentClientKey struct {
+	address   string
+	namespace string
+}
+
+// agentClientPool caches the Consul API clients of the controller, one per address and Consul
+// namespace, so that a client isn't created, with its TLS configuration read from disk, for every
+// call to an agent. Clients are safe for concurrent use. The clients of an agent are removed once
+// its pod is deleted.
+type agentClientPool struct {
+	mu      sync.Mutex
+	clients map[agentClientKey]*api.Client
+}
+
+// client returns the client for the address and the Consul namespace of the config, creating it
+// from the config if it isn't in the pool yet.
+func (p *agentClientPool) client(cfg api.Config) (*api.Client, error) {
+	key := agentClientKey{address: cfg.Address, namespace: cfg.Namespace}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if client, ok := p.clients[key]; ok {
+		return client, nil
+	}
+	client, err := consul.NewClient(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	if p.clients == nil {
+		p.clients = make(map[agentClientKey]*api.Client)
+	}
+	p.clients[key] = client
+	return client, nil
+}
+
+// remove removes the clients that point at the host, in any Consul namespace.
+func (p *agentClientPool) remove(host string) {
+	if host == "" {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key := range p.clients {
+		if hostOfAddress(key.address) == host {
+			delete(p.clients, key)
+		}
+	}
+}
+
+// hostOfAddress returns the host of an address like [scheme://]host[:port].
+func hostOfAddress(address string) string {
+	if i := strings.Index(address, "://"); i >= 0 {
+		address = address[i+len("://"):]
+	}
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
+
+// agentInstanceIndex records the Kubernetes nodes whose Consul client agents hold the service
+// instances that the controller registered for each Kubernetes service, so that deregistering the
+// instances of a service only queries the agents on those nodes instead of every agent. The agents
+// on the nodes are looked up in the informer cache of the agent pods.
+// The index isn't persisted. It's filled from one lookup of the instances on all agents when the
+// controller starts, see warmAgentInstanceIndex. Until then, or if that lookup failed, the nodes of a
+// Kubernetes service are unknown until its instances have been looked up on all agents once, and
+// every agent is queried.
+type agentInstanceIndex struct {
+	mu sync.Mutex
+	// nodes are the nodes of each Kubernetes service whose nodes are known.
+	nodes map[types.NamespacedName]map[string]bool
+	// warming are the nodes that instances were registered on, for each Kubernetes service whose nodes
+	// are unknown, while the index is being filled. It's nil otherwise.
+	warming map[types.NamespacedName]map[string]bool
+}
+
+// lookup returns the nodes with instances of the Kubernetes service, and false if they're unknown.
+func (i *agentInstanceIndex) lookup(k8sService types.NamespacedName) (map[string]bool, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	nodes, ok := i.nodes[k8sService]
+	if !ok {
+		return nil, false
+	}
+	copied := make(map[string]bool, len(nodes))
+	for node := range nodes {
+		copied[node] = true
+	}
+	return copied, true
+}
+
+// add records that an instance of the Kubernetes service is registered on the node. Nothing is
+// recorded if the nodes of the service are unknown, since they'll all be queried anyway, unless the
+// index is being filled, in which case the lookup may have missed the instance.
+func (i *agentInstanceIndex) add(k8sService types.NamespacedName, node string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if nodes, ok := i.nodes[k8sService]; ok {
+		nodes[node] = true
+	} else if i.warming != nil {
+		if i.warming[k8sService] == nil {
+			i.warming[k8sService] = make(map[string]bool)
+		}
+		i.warming[k8sService][node] = true
+	}
+}
+
+// startWarming starts recording the nodes that instances are registered on for the Kubernetes
+// services whose nodes are unknown, before the instances on all agents are looked up to fill the index.
+func (i *agentInstanceIndex) startWarming() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.warming = make(map[types.NamespacedName]map[string]bool)
+}
+
+// finishWarming records the nodes with instances of each Kubernetes service that were looked up on
+// all agents, along with the nodes of the instances registered since startWarming. Services whose
+// nodes were looked up by the controller in the meantime are left alone. If nodes is nil, because the
+// lookup failed, the nodes of the services stay unknown.
+func (i *agentInstanceIndex) finishWarming(nodes map[types.NamespacedName]map[string]bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	warming := i.warming
+	i.warming = nil
+	if nodes == nil {
+		return
+	}
+	if i.nodes == nil {
+		i.nodes = make(map[types.NamespacedName]map[string]bool)
+	}
+	for k8sService, serviceNodes := range nodes {
+		if _, ok := i.nodes[k8sService]; ok {
+			continue
+		}
+		for node := range warming[k8sService] {
+			serviceNodes[node] = true
+		}
+		i.nodes[k8sService] = serviceNodes
+	}
+}
+
+// set records the nodes with instances of the Kubernetes service, once they've been looked up.
+func (i *agentInstanceIndex) set(k8sService types.NamespacedName, nodes map[string]bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.nodes == nil {
+		i.nodes = make(map[types.NamespacedName]map[string]bool)
+	}
+	i.nodes[k8sService] = nodes
+}
+
+// forget makes the nodes of the Kubernetes service unknown, e.g. once it's deleted.
+func (i *agentInstanceIndex) forget(k8sService types.NamespacedName) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	delete(i.nodes, k8sService)
+}
@@ -0,0 +1,332 @@
+package connectinject
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	logrtest "github.com/go-logr/logr/testing"
+	"github.com/hashicorp/consul-k8s/consul"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestAgentClientPool(t *testing.T) {
+	t.Parallel()
+	var pool agentClientPool
+	cfg := api.Config{Address: "http://1.2.3.4:8500"}
+	client, err := pool.client(cfg)
+	require.NoError(t, err)
+
+	same, err := pool.client(cfg)
+	require.NoError(t, err)
+	require.Same(t, client, same)
+
+	cfg.Namespace = "ns"
+	other, err := pool.client(cfg)
+	require.NoError(t, err)
+	require.NotSame(t, client, other)
+
+	pool.remove("1.2.3.4")
+	require.Empty(t, pool.clients)
+}
+
+func TestHostOfAddress(t *testing.T) {
+	t.Parallel()
+	require.Equal(t, "1.2.3.4", hostOfAddress("https://1.2.3.4:8501"))
+	require.Equal(t, "1.2.3.4", hostOfAddress("1.2.3.4:8500"))
+	require.Equal(t, "1.2.3.4", hostOfAddress("1.2.3.4"))
+}
+
+func TestAgentInstanceIndex(t *testing.T) {
+	t.Parallel()
+	var index agentInstanceIndex
+	web := types.NamespacedName{Name: "web", Namespace: "default"}
+
+	// Nodes aren't recorded until the nodes of the service are known.
+	index.add(web, "node1")
+	_, ok := index.lookup(web)
+	require.False(t, ok)
+
+	index.set(web, map[string]bool{})
+	index.add(web, "node1")
+	nodes, ok := index.lookup(web)
+	require.True(t, ok)
+	require.Equal(t, map[string]bool{"node1": true}, nodes)
+
+	index.forget(web)
+	_, ok = index.lookup(web)
+	require.False(t, ok)
+}
+
+// Test that registrations made while the index is filled are kept, and that services looked up by
+// the controller in the meantime aren't overwritten.
+func TestAgentInstanceIndex_Warming(t *testing.T) {
+	t.Parallel()
+	var index agentInstanceIndex
+	web := types.NamespacedName{Name: "web", Namespace: "default"}
+	backend := types.NamespacedName{Name: "backend", Namespace: "default"}
+	db := types.NamespacedName{Name: "db", Namespace: "default"}
+
+	index.startWarming()
+	index.add(web, "node2")
+	index.set(backend, map[string]bool{"node3": true})
+	index.finishWarming(map[types.NamespacedName]map[string]bool{
+		web:     {"node1": true},
+		backend: {"node1": true},
+	})
+	nodes, ok := index.lookup(web)
+	require.True(t, ok)
+	require.Equal(t, map[string]bool{"node1": true, "node2": true}, nodes)
+	nodes, _ = index.lookup(backend)
+	require.Equal(t, map[string]bool{"node3": true}, nodes)
+
+	// Nodes stay unknown if the lookup failed.
+	index.startWarming()
+	index.add(db, "node1")
+	index.finishWarming(nil)
+	_, ok = index.lookup(db)
+	require.False(t, ok)
+	index.add(db, "node1")
+	_, ok = index.lookup(db)
+	require.False(t, ok)
+}
+
+// Test that the index is filled from the instances on all agents, so that the first deregistration
+// of a service only queries the agents of its nodes.
+func TestWarmAgentInstanceIndex(t *testing.T) {
+	t.Parallel()
+	agents := startFakeAgents(t, 3)
+	r := agents.endpointsController()
+	web := types.NamespacedName{Name: "web", Namespace: "default"}
+	agents.register(agents.ips[1], "pod1-web", "10.0.0.1")
+
+	r.warmAgentInstanceIndex(context.Background())
+	require.Equal(t, map[string]int{"node-0": 1, "node-1": 1, "node-2": 1}, agents.takeRequests())
+	nodes, ok := r.agentInstances.lookup(web)
+	require.True(t, ok)
+	require.Equal(t, map[string]bool{"node-1": true}, nodes)
+
+	err := r.deregisterServiceOnAllAgents(context.Background(), "web", "default", map[string]bool{"10.0.0.1": true})
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{"node-1": 1}, agents.takeRequests())
+}
+
+// Test that the instances of a Kubernetes service are looked up on every agent the first time,
+// and then only on the agents of the nodes that hold instances of the service.
+func TestDeregisterServiceOnAllAgents_AgentInstances(t *testing.T) {
+	t.Parallel()
+	agents := startFakeAgents(t, 5)
+	r := agents.endpointsController()
+	web := types.NamespacedName{Name: "web", Namespace: "default"}
+	agents.register(agents.ips[2], "pod1-web", "10.0.0.1")
+	agents.register(agents.ips[3], "pod2-web", "10.0.0.2")
+
+	err := r.deregisterServiceOnAllAgents(context.Background(), "web", "default", map[string]bool{"10.0.0.1": true})
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{"node-0": 1, "node-1": 1, "node-2": 1, "node-3": 2, "node-4": 1}, agents.takeRequests())
+	nodes, ok := r.agentInstances.lookup(web)
+	require.True(t, ok)
+	require.Equal(t, map[string]bool{"node-2": true}, nodes)
+
+	// Only the agents of the nodes in the index are queried, including those of new registrations.
+	agents.register(agents.ips[4], "pod3-web", "10.0.0.3")
+	r.agentInstances.add(web, "node-4")
+	err = r.deregisterServiceOnAllAgents(context.Background(), "web", "default", map[string]bool{"10.0.0.1": true})
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{"node-2": 1, "node-4": 2}, agents.takeRequests())
+	nodes, _ = r.agentInstances.lookup(web)
+	require.Equal(t, map[string]bool{"node-2": true}, nodes)
+
+	// The nodes of a deleted service are forgotten once its instances are deregistered.
+	err = r.deregisterServiceOnAllAgents(context.Background(), "web", "default", nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{"node-2": 2}, agents.takeRequests())
+	_, ok = r.agentInstances.lookup(web)
+	require.False(t, ok)
+}
+
+// BenchmarkDeregisterServiceOnAllAgents measures the deregistration of the instances of a Kubernetes
+// service whose pod runs on a single node, with the nodes of the service unknown, as when the index
+// couldn't be filled when the controller started, and with the nodes of the service in the index.
+func BenchmarkDeregisterServiceOnAllAgents(b *testing.B) {
+	for _, count := range []int{10, 100, 500} {
+		agents := startFakeAgents(b, count)
+		r := agents.endpointsController()
+		agents.register(agents.ips[0], "pod1-web", "10.0.0.1")
+		endpointsAddressesMap := map[string]bool{"10.0.0.1": true}
+
+		for _, indexed := range []bool{false, true} {
+			b.Run(fmt.Sprintf("agents=%d/indexed=%t", count, indexed), func(b *testing.B) {
+				web := types.NamespacedName{Name: "web", Namespace: "default"}
+				r.agentInstances.forget(web)
+				require.NoError(b, r.deregisterServiceOnAllAgents(context.Background(), "web", "default", endpointsAddressesMap))
+				agents.takeRequests()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if !indexed {
+						r.agentInstances.forget(web)
+					}
+					if err := r.deregisterServiceOnAllAgents(context.Background(), "web", "default", endpointsAddressesMap); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.StopTimer()
+				requests := 0
+				for _, n := range agents.takeRequests() {
+					requests += n
+				}
+				b.ReportMetric(float64(requests)/float64(b.N), "requests/op")
+			})
+		}
+	}
+}
+
+// BenchmarkRemoteConsulClient compares getting the client of an agent from the pool with creating it.
+func BenchmarkRemoteConsulClient(b *testing.B) {
+	r := &EndpointsController{ConsulClientCfg: &api.Config{}, ConsulScheme: "http", ConsulPort: "8500"}
+	b.Run("pool", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := r.remoteConsulClient("1.2.3.4", ""); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("new", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			cfg := *r.ConsulClientCfg
+			cfg.Address = "http://1.2.3.4:8500"
+			if _, err := consul.NewClient(&cfg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// fakeAgents serves the agent API of Consul client agents that listen on loopback addresses
+// 127.0.x.y on the same port, as agents listen on the same port on each node. It ignores filters,
+// so each agent should only have instances of the same Kubernetes service.
+type fakeAgents struct {
+	ips   []string
+	nodes map[string]string
+	port  string
+
+	mu       sync.Mutex
+	services map[string]map[string]*api.AgentService
+	requests map[string]int
+}
+
+// startFakeAgents starts count fake agents, on nodes node-0 to node-<count-1>. It skips the test if
+// loopback addresses other than 127.0.0.1 can't be reached, as on macOS.
+func startFakeAgents(t testing.TB, count int) *fakeAgents {
+	t.Helper()
+	listener, err := net.Listen("tcp", "0.0.0.0:0")
+	require.NoError(t, err)
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	require.NoError(t, err)
+
+	agents := &fakeAgents{
+		nodes:    make(map[string]string),
+		port:     port,
+		services: make(map[string]map[string]*api.AgentService),
+		requests: make(map[string]int),
+	}
+	for i := 0; i < count; i++ {
+		ip := fmt.Sprintf("127.0.%d.%d", i/250, i%250+1)
+		agents.ips = append(agents.ips, ip)
+		agents.nodes[ip] = fmt.Sprintf("node-%d", i)
+		agents.services[ip] = make(map[string]*api.AgentService)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(agents.serveHTTP))
+	server.Listener.Close()
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+
+	if count > 1 {
+		conn, err := net.Dial("tcp", net.JoinHostPort(agents.ips[1], port))
+		if err != nil {
+			t.Skipf("loopback address %s can't be reached: %s", agents.ips[1], err)
+		}
+		conn.Close()
+	}
+	return agents
+}
+
+func (a *fakeAgents) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ip := hostOfAddress(req.Host)
+	a.requests[a.nodes[ip]]++
+	switch {
+	case req.Method == http.MethodGet && req.URL.Path == "/v1/agent/services":
+		json.NewEncoder(w).Encode(a.services[ip])
+	case req.Method == http.MethodPut && strings.HasPrefix(req.URL.Path, "/v1/agent/service/deregister/"):
+		delete(a.services[ip], strings.TrimPrefix(req.URL.Path, "/v1/agent/service/deregister/"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// register registers an instance of the Kubernetes service web with the agent.
+func (a *fakeAgents) register(ip, id, address string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.services[ip][id] = &api.AgentService{
+		ID:      id,
+		Service: "web",
+		Address: address,
+		Meta: map[string]string{
+			MetaKeyKubeServiceName: "web",
+			MetaKeyKubeNS:          "default",
+			MetaKeyManagedBy:       managedByValue,
+		},
+	}
+}
+
+// takeRequests returns the number of requests that each node's agent received and resets them.
+func (a *fakeAgents) takeRequests() map[string]int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	requests := a.requests
+	a.requests = make(map[string]int)
+	return requests
+}
+
+// endpointsController returns an endpoints controller with a Consul client agent pod for each agent.
+func (a *fakeAgents) endpointsController() *EndpointsController {
+	var objects []runtime.Object
+	for _, ip := range a.ips {
+		objects = append(objects, &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "consul-client-" + a.nodes[ip],
+				Namespace: "default",
+				Labels:    map[string]string{"component": "client", "app": "consul", "release": "consul"},
+			},
+			Spec:   corev1.PodSpec{NodeName: a.nodes[ip]},
+			Status: corev1.PodStatus{PodIP: ip, HostIP: ip, Phase: corev1.PodRunning},
+		})
+	}
+	return &EndpointsController{
+		Client:           fake.NewClientBuilder().WithRuntimeObjects(objects...).Build(),
+		Log:              logrtest.NullLogger{},
+		ConsulClientCfg:  &api.Config{},
+		ConsulScheme:     "http",
+		ConsulPort:       a.port,
+		ReleaseName:      "consul",
+		ReleaseNamespace: "default",
+		Context:          context.Background(),
+	}
+}
@@ -0,0 +1,326 @@
+package connectinject
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/shlex"
+	"github.com/hashicorp/go-multierror"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// annotationPrefix is the prefix of all annotations that configure the injection of a pod.
+const annotationPrefix = "consul.hashicorp.com/"
+
+// deprecatedAnnotations maps deprecated annotations to the admission warning that is
+// returned when a pod sets them.
+var deprecatedAnnotations = map[string]string{
+	annotationProtocol: fmt.Sprintf("the %q annotation is no longer supported and is ignored. Instead, create a ServiceDefaults resource (see www.consul.io/docs/k8s/crds/upgrade-to-crds)",
+		annotationProtocol),
+	annotationSyncPeriod: fmt.Sprintf("the %q annotation is no longer supported and is ignored because consul-sidecar is no longer injected to periodically register services",
+		annotationSyncPeriod),
+	annotationConnectTags: fmt.Sprintf("the %q annotation is deprecated, use %q instead", annotationConnectTags, annotationTags),
+}
+
+// knownAnnotations are the annotations that can be set on a pod, in addition to the
+// deprecated ones. Annotations with annotationPrefix that aren't known are most likely
+// typos and are reported as admission warnings.
+var knownAnnotations = map[string]bool{
+	keyInjectStatus:                                           true,
+	annotationInject:                                          true,
+	annotationService:                                         true,
+	annotationPort:                                            true,
+	annotationKubernetesService:                               true,
+	annotationConnectNative:                                   true,
+	annotationUpstreams:                                       true,
+	annotationUpstreamsV2:                                     true,
+	annotationTags:                                            true,
+	annotationServiceWeightsPassing:                           true,
+	annotationServiceWeightsWarning:                           true,
+	annotationSidecarProxyCPULimit:                            true,
+	annotationSidecarProxyCPURequest:                          true,
+	annotationSidecarProxyMemoryLimit:                         true,
+	annotationSidecarProxyMemoryRequest:                       true,
+	annotationSidecarProxyPublicListenerPort:                  true,
+	annotationSidecarProxyCheckInterval:                       true,
+	annotationSidecarProxyCheckTimeout:                        true,
+	annotationSidecarProxyDeregisterCriticalServiceAfter:      true,
+	annotationEnableMetrics:                                   true,
+	annotationEnableMetricsMerging:                            true,
+	annotationMergedMetricsPort:                               true,
+	annotationPrometheusScrapePort:                            true,
+	annotationPrometheusScrapePath:                            true,
+	annotationServiceMetricsPort:                              true,
+	annotationServiceMetricsPath:                              true,
+	annotationEnableSidecarProxyLifecycle:                     true,
+	keyStopSidecarsOnAppExit:                                  true,
+	annotationAppExited:                                       true,
+	annotationEnvoyExtraArgs:                                  true,
+	annotationConsulNamespace:                                 true,
+	keyTransparentProxy:                                       true,
+	annotationTProxyExcludeInboundPorts:                       true,
+	annotationTProxyExcludeOutboundPorts:                      true,
+	annotationTProxyExcludeOutboundCIDRs:                      true,
+	annotationTProxyExcludeUIDs:                               true,
+	annotationTransparentProxyOverwriteProbes:                 true,
+	annotationTransparentProxyReadinessListenerPort:           true,
+	annotationTransparentProxyLivenessListenerPort:            true,
+	annotationOriginalLivenessProbePort:                       true,
+	annotationOriginalReadinessProbePort:                      true,
+	annotationOriginalStartupProbePort:                        true,
+	annotationEnableProbeChecks:                               true,
+	annotationProxyInjectionPolicy:                            true,
+	annotationSidecarProxyLifecycleShutdownGracePeriodSeconds: true,
+}
+
+// validateAnnotations checks the values of all consul.hashicorp.com annotations of the pod.
+// Rather than stopping at the first invalid annotation, every problem is collected in the
+// returned error so that they can all be fixed at once. The returned warnings report
+// annotations that are deprecated or unknown; they don't prevent the pod from being created.
+func validateAnnotations(pod corev1.Pod, enableNamespaces bool) ([]string, error) {
+	var warnings []string
+	var errs error
+
+	// Sort the keys so that problems are always reported in the same order.
+	var keys []string
+	for key := range pod.Annotations {
+		if strings.HasPrefix(key, annotationPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		raw := pod.Annotations[key]
+		if warning, ok := deprecatedAnnotations[key]; ok {
+			warnings = append(warnings, warning)
+			continue
+		}
+
+		var err error
+		switch {
+		case key == annotationInject,
+			key == annotationConnectNative,
+			key == annotationEnableMetrics,
+			key == annotationEnableMetricsMerging,
+			key == annotationEnableSidecarProxyLifecycle,
+			key == keyStopSidecarsOnAppExit,
+			key == keyTransparentProxy,
+			key == annotationTransparentProxyOverwriteProbes,
+			key == annotationEnableProbeChecks:
+			err = validateBool(raw)
+		case key == annotationPort:
+			err = validateServicePorts(pod, raw)
+		case key == annotationUpstreams || strings.HasPrefix(key, annotationUpstreams+"."):
+			err = validateUpstreams(pod, raw)
+		case key == annotationUpstreamsV2 || strings.HasPrefix(key, annotationUpstreamsV2+"."):
+			// The structured and the string annotations for the same service can't both be set.
+			v1Key := annotationUpstreams + strings.TrimPrefix(key, annotationUpstreamsV2)
+			if _, ok := pod.Annotations[v1Key]; ok {
+				err = fmt.Errorf("cannot be set together with %q", v1Key)
+			} else {
+				_, err = parseUpstreamsV2(pod, raw, enableNamespaces)
+			}
+		case key == annotationSidecarProxyCPULimit,
+			key == annotationSidecarProxyCPURequest,
+			key == annotationSidecarProxyMemoryLimit,
+			key == annotationSidecarProxyMemoryRequest:
+			_, err = resource.ParseQuantity(raw)
+		case key == annotationMergedMetricsPort,
+			key == annotationPrometheusScrapePort:
+			err = validatePort(pod, raw, 1024)
+		case key == annotationServiceMetricsPort:
+			err = validatePort(pod, raw, 1)
+		case key == annotationTransparentProxyReadinessListenerPort,
+			key == annotationTransparentProxyLivenessListenerPort,
+			key == annotationSidecarProxyPublicListenerPort:
+			err = validatePortRange(raw, 1)
+		case key == annotationTProxyExcludeInboundPorts,
+			key == annotationTProxyExcludeOutboundPorts:
+			err = validateList(raw, func(item string) error { return validatePortRange(item, 1) })
+		case key == annotationTProxyExcludeOutboundCIDRs:
+			err = validateList(raw, validateCIDR)
+		case key == annotationTProxyExcludeUIDs:
+			err = validateList(raw, validateUID)
+		case key == annotationSidecarProxyLifecycleShutdownGracePeriodSeconds:
+			if seconds, parseErr := strconv.Atoi(raw); parseErr != nil || seconds < 0 {
+				err = fmt.Errorf("%q is not a non-negative number of seconds", raw)
+			}
+		case key == annotationSidecarProxyCheckInterval,
+			key == annotationSidecarProxyDeregisterCriticalServiceAfter:
+			err = validateDuration(raw)
+		case key == annotationSidecarProxyCheckTimeout:
+			// A zero timeout stands for Consul's default.
+			if d, parseErr := time.ParseDuration(raw); parseErr != nil || d < 0 {
+				err = fmt.Errorf("%q is not a non-negative duration", raw)
+			}
+		case key == annotationServiceWeightsPassing:
+			if weight, parseErr := strconv.Atoi(raw); parseErr != nil || weight < 1 {
+				err = fmt.Errorf("%q is not a positive integer", raw)
+			}
+		case key == annotationServiceWeightsWarning:
+			if weight, parseErr := strconv.Atoi(raw); parseErr != nil || weight < 0 {
+				err = fmt.Errorf("%q is not a non-negative integer", raw)
+			}
+		case strings.HasPrefix(key, annotationTaggedAddress):
+			if err = validateTaggedAddressName(strings.TrimPrefix(key, annotationTaggedAddress)); err == nil {
+				_, _, err = parseTaggedAddress(raw)
+			}
+		case key == annotationKubernetesService:
+			if isMultiPort(pod) {
+				err = fmt.Errorf("multi-port pods are registered for the Kubernetes service of each of their services")
+			} else if msgs := validation.IsDNS1035Label(raw); len(msgs) > 0 {
+				err = fmt.Errorf("%q is not a valid Kubernetes service name: %s", raw, strings.Join(msgs, ", "))
+			}
+		case key == annotationEnvoyExtraArgs:
+			_, err = shlex.Split(raw)
+		case !knownAnnotations[unscopedAnnotation(key)] && !strings.HasPrefix(key, annotationMeta):
+			warnings = append(warnings, fmt.Sprintf("unknown annotation %q is ignored", key))
+		}
+		if err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("%q annotation is invalid: %s", key, err))
+		}
+	}
+
+	if err := validateUpstreamEnvVars(pod, enableNamespaces); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+
+	// Multi-port pods must list a valid port for each of their services.
+	if isMultiPort(pod) {
+		if _, err := multiPortServices(pod); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+		// Connect native pods register a single service without a proxy.
+		if native, _ := strconv.ParseBool(pod.Annotations[annotationConnectNative]); native {
+			errs = multierror.Append(errs, fmt.Errorf("%q annotation is invalid: Connect native pods can only register a single service", annotationConnectNative))
+		}
+	}
+
+	return warnings, errs
+}
+
+// unscopedAnnotation returns the key of an annotation without the ".<name>" suffix that
+// scopes some annotations to a service or container, e.g.
+// consul.hashicorp.com/original-liveness-probe-port.<container>.
+func unscopedAnnotation(key string) string {
+	if i := strings.Index(strings.TrimPrefix(key, annotationPrefix), "."); i >= 0 {
+		return key[:len(annotationPrefix)+i]
+	}
+	return key
+}
+
+func validateBool(raw string) error {
+	if _, err := strconv.ParseBool(raw); err != nil {
+		return fmt.Errorf("%q is not a boolean", raw)
+	}
+	return nil
+}
+
+// validateServicePorts validates the ports of the consul.hashicorp.com/connect-service-port
+// annotation. Multi-port pods list a port for each service, which is validated together
+// with the services by multiPortServices.
+func validateServicePorts(pod corev1.Pod, raw string) error {
+	if isMultiPort(pod) {
+		return nil
+	}
+	return validatePort(pod, raw, 1)
+}
+
+// validateUpstreams validates the syntax and the ports of the comma-separated upstreams of
+// the consul.hashicorp.com/connect-service-upstreams annotation. Each upstream is either
+// "<service>[.<namespace>]:<port>[:<datacenter>]" or "prepared_query:<query>:<port>".
+func validateUpstreams(pod corev1.Pod, raw string) error {
+	if raw == "" {
+		return nil
+	}
+	return validateList(raw, func(upstream string) error {
+		parts := strings.SplitN(upstream, ":", 3)
+		if strings.TrimSpace(parts[0]) == "prepared_query" {
+			if len(parts) != 3 || strings.TrimSpace(parts[1]) == "" {
+				return fmt.Errorf("upstream %q must be in the form prepared_query:<query>:<port>", upstream)
+			}
+			return validatePort(pod, strings.TrimSpace(parts[2]), 1)
+		}
+		if len(parts) < 2 || strings.TrimSpace(parts[0]) == "" {
+			return fmt.Errorf("upstream %q must be in the form <service>:<port>[:<datacenter>]", upstream)
+		}
+		if len(parts) == 3 && strings.TrimSpace(parts[2]) == "" {
+			return fmt.Errorf("upstream %q has an empty datacenter", upstream)
+		}
+		return validatePort(pod, strings.TrimSpace(parts[1]), 1)
+	})
+}
+
+// validatePort validates that raw is a named port of the pod or a port number, and that
+// the port is between min and 65535.
+func validatePort(pod corev1.Pod, raw string, min int32) error {
+	port, err := portValue(pod, raw)
+	if err != nil {
+		return fmt.Errorf("%q is not a named port on the pod or a port number", raw)
+	}
+	if port < min || port > 65535 {
+		return fmt.Errorf("%d is not in the valid port range %d-65535", port, min)
+	}
+	return nil
+}
+
+// validatePortRange validates that raw is a port number between min and 65535.
+func validatePortRange(raw string, min int) error {
+	port, err := strconv.Atoi(raw)
+	if err != nil {
+		return fmt.Errorf("%q is not a port number", raw)
+	}
+	if port < min || port > 65535 {
+		return fmt.Errorf("%d is not in the valid port range %d-65535", port, min)
+	}
+	return nil
+}
+
+// validateDuration validates that raw is a positive duration, e.g. 5s.
+func validateDuration(raw string) error {
+	if d, err := time.ParseDuration(raw); err != nil || d <= 0 {
+		return fmt.Errorf("%q is not a positive duration", raw)
+	}
+	return nil
+}
+
+// validateCIDR validates that raw is a CIDR or an IP address.
+func validateCIDR(raw string) error {
+	if _, _, err := net.ParseCIDR(raw); err == nil {
+		return nil
+	}
+	if net.ParseIP(raw) != nil {
+		return nil
+	}
+	return fmt.Errorf("%q is not a CIDR or an IP address", raw)
+}
+
+// validateUID validates that raw is a user ID.
+func validateUID(raw string) error {
+	if uid, err := strconv.Atoi(raw); err != nil || uid < 0 {
+		return fmt.Errorf("%q is not a user ID", raw)
+	}
+	return nil
+}
+
+// validateList validates each item of a comma-separated list with validate. Problems
+// with all items are reported rather than only the first one.
+func validateList(raw string, validate func(string) error) error {
+	var problems []string
+	for _, item := range strings.Split(raw, ",") {
+		if err := validate(strings.TrimSpace(item)); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
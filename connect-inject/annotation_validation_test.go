@@ -0,0 +1,198 @@
+package connectinject
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestValidateAnnotations(t *testing.T) {
+	t.Parallel()
+	cases := map[string]struct {
+		annotations map[string]string
+		expErrs     []string
+		expWarnings []string
+	}{
+		"no annotations": {},
+		"valid annotations": {
+			annotations: map[string]string{
+				annotationInject:                                "true",
+				annotationService:                               "web",
+				annotationPort:                                  "http",
+				annotationUpstreams:                             "db:1234,cache.ns:1235:dc2,prepared_query:query:1236",
+				annotationSidecarProxyCPULimit:                  "100m",
+				annotationSidecarProxyMemoryRequest:             "64Mi",
+				annotationSidecarProxyPublicListenerPort:        "21000",
+				annotationSidecarProxyCheckTimeout:              "2s",
+				annotationEnableMetricsMerging:                  "false",
+				annotationMergedMetricsPort:                     "20100",
+				annotationServiceMetricsPort:                    "http",
+				keyTransparentProxy:                             "true",
+				annotationTProxyExcludeInboundPorts:             "8080, 9090",
+				annotationTProxyExcludeOutboundCIDRs:            "10.0.0.0/8,1.1.1.1",
+				annotationTProxyExcludeUIDs:                     "0,5996",
+				annotationTransparentProxyReadinessListenerPort: "21000",
+				annotationEnvoyExtraArgs:                        "--log-level debug",
+				annotationServiceWeightsPassing:                 "10",
+				annotationTaggedAddress + "wan":                 "203.0.113.10:8080",
+				annotationMeta + "owner":                        "team",
+				annotationKubernetesService:                     "web",
+				"example.com/other":                             "anything",
+			},
+		},
+		"invalid booleans": {
+			annotations: map[string]string{
+				annotationInject:         "yes",
+				keyStopSidecarsOnAppExit: "1.0",
+			},
+			expErrs: []string{
+				`"consul.hashicorp.com/connect-inject" annotation is invalid: "yes" is not a boolean`,
+				`"consul.hashicorp.com/stop-sidecars-on-app-exit" annotation is invalid: "1.0" is not a boolean`,
+			},
+		},
+		"invalid service port": {
+			annotations: map[string]string{
+				annotationPort: "grpc",
+			},
+			expErrs: []string{
+				`"consul.hashicorp.com/connect-service-port" annotation is invalid: "grpc" is not a named port on the pod or a port number`,
+			},
+		},
+		"invalid upstreams": {
+			annotations: map[string]string{
+				annotationUpstreams:          "db,cache:grpc,prepared_query:1234",
+				annotationUpstreams + ".api": "db:70000",
+			},
+			expErrs: []string{
+				`"consul.hashicorp.com/connect-service-upstreams" annotation is invalid: upstream "db" must be in the form <service>:<port>[:<datacenter>]; "grpc" is not a named port on the pod or a port number; upstream "prepared_query:1234" must be in the form prepared_query:<query>:<port>`,
+				`"consul.hashicorp.com/connect-service-upstreams.api" annotation is invalid: 70000 is not in the valid port range 1-65535`,
+			},
+		},
+		"invalid resources": {
+			annotations: map[string]string{
+				annotationSidecarProxyMemoryLimit: "lots",
+			},
+			expErrs: []string{
+				`"consul.hashicorp.com/sidecar-proxy-memory-limit" annotation is invalid: quantities must match the regular expression`,
+			},
+		},
+		"invalid metrics ports": {
+			annotations: map[string]string{
+				annotationMergedMetricsPort:    "80",
+				annotationPrometheusScrapePort: "abc",
+			},
+			expErrs: []string{
+				`"consul.hashicorp.com/merged-metrics-port" annotation is invalid: 80 is not in the valid port range 1024-65535`,
+				`"consul.hashicorp.com/prometheus-scrape-port" annotation is invalid: "abc" is not a named port on the pod or a port number`,
+			},
+		},
+		"invalid sidecar proxy public listener": {
+			annotations: map[string]string{
+				annotationSidecarProxyPublicListenerPort:             "0",
+				annotationSidecarProxyCheckInterval:                  "10",
+				annotationSidecarProxyDeregisterCriticalServiceAfter: "-1m",
+			},
+			expErrs: []string{
+				`"consul.hashicorp.com/sidecar-proxy-check-interval" annotation is invalid: "10" is not a positive duration`,
+				`"consul.hashicorp.com/sidecar-proxy-deregister-critical-service-after" annotation is invalid: "-1m" is not a positive duration`,
+				`"consul.hashicorp.com/sidecar-proxy-public-listener-port" annotation is invalid: 0 is not in the valid port range 1-65535`,
+			},
+		},
+		"invalid weights and tagged addresses": {
+			annotations: map[string]string{
+				annotationServiceWeightsPassing:     "0",
+				annotationServiceWeightsWarning:     "-1",
+				annotationTaggedAddress + "virtual": "10.0.0.1",
+				annotationTaggedAddress + "wan":     "203.0.113.10:http",
+			},
+			expErrs: []string{
+				`"consul.hashicorp.com/service-tagged-address-virtual" annotation is invalid: the "virtual" tagged address is reserved`,
+				`"consul.hashicorp.com/service-tagged-address-wan" annotation is invalid: "http" is not a valid port`,
+				`"consul.hashicorp.com/service-weights-passing" annotation is invalid: "0" is not a positive integer`,
+				`"consul.hashicorp.com/service-weights-warning" annotation is invalid: "-1" is not a non-negative integer`,
+			},
+		},
+		"invalid transparent proxy exclusions": {
+			annotations: map[string]string{
+				annotationTProxyExcludeOutboundPorts: "8080,0",
+				annotationTProxyExcludeOutboundCIDRs: "10.0.0.0/33",
+				annotationTProxyExcludeUIDs:          "-1",
+			},
+			expErrs: []string{
+				`"consul.hashicorp.com/transparent-proxy-exclude-outbound-ports" annotation is invalid: 0 is not in the valid port range 1-65535`,
+				`"consul.hashicorp.com/transparent-proxy-exclude-outbound-cidrs" annotation is invalid: "10.0.0.0/33" is not a CIDR or an IP address`,
+				`"consul.hashicorp.com/transparent-proxy-exclude-uids" annotation is invalid: "-1" is not a user ID`,
+			},
+		},
+		"invalid multi-port services": {
+			annotations: map[string]string{
+				annotationService: "web,web-admin",
+				annotationPort:    "http",
+			},
+			expErrs: []string{
+				`consul.hashicorp.com/connect-service-port annotation must list a port for each of the 2 services`,
+			},
+		},
+		"invalid Kubernetes service": {
+			annotations: map[string]string{annotationKubernetesService: "Web"},
+			expErrs: []string{
+				`"consul.hashicorp.com/kubernetes-service" annotation is invalid: "Web" is not a valid Kubernetes service name`,
+			},
+		},
+		"Kubernetes service on a multi-port pod": {
+			annotations: map[string]string{
+				annotationService:           "web,web-admin",
+				annotationPort:              "8080,9090",
+				annotationKubernetesService: "web",
+			},
+			expErrs: []string{
+				`"consul.hashicorp.com/kubernetes-service" annotation is invalid: multi-port pods are registered for the Kubernetes service of each of their services`,
+			},
+		},
+		"deprecated and unknown annotations": {
+			annotations: map[string]string{
+				annotationProtocol:                   "http",
+				annotationConnectTags:                "abc",
+				"consul.hashicorp.com/conect-inject": "true",
+			},
+			expWarnings: []string{
+				`unknown annotation "consul.hashicorp.com/conect-inject" is ignored`,
+				`the "consul.hashicorp.com/connect-service-protocol" annotation is no longer supported and is ignored. Instead, create a ServiceDefaults resource (see www.consul.io/docs/k8s/crds/upgrade-to-crds)`,
+				`the "consul.hashicorp.com/connect-service-tags" annotation is deprecated, use "consul.hashicorp.com/service-tags" instead`,
+			},
+		},
+	}
+	for name, c := range cases {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			pod := corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Annotations: c.annotations},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+							Ports: []corev1.ContainerPort{
+								{
+									Name:          "http",
+									ContainerPort: 8080,
+								},
+							},
+						},
+					},
+				},
+			}
+			warnings, err := validateAnnotations(pod, false)
+			require.Equal(t, c.expWarnings, warnings)
+			if len(c.expErrs) == 0 {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			for _, expErr := range c.expErrs {
+				require.Contains(t, err.Error(), expErr)
+			}
+		})
+	}
+}
@@ -17,13 +17,24 @@ const (
 	annotationInject = "consul.hashicorp.com/connect-inject"
 
 	// annotationService is the name of the service to proxy. This defaults
-	// to the name of the first container.
+	// to the name of the first container. Multi-port pods set it to a
+	// comma-separated list of service names, e.g. "web,web-admin", and list
+	// the port of each service in annotationPort. An Envoy sidecar is injected
+	// for each service. Multi-port pods must set keyTransparentProxy to "false"
+	// and are rejected when ACLs are enabled.
 	annotationService = "consul.hashicorp.com/connect-service"
 
 	// annotationPort is the name or value of the port to proxy incoming
-	// connections to.
+	// connections to. Multi-port pods set it to a comma-separated list of
+	// ports in the same order as the services in annotationService, e.g.
+	// "8080,9090".
 	annotationPort = "consul.hashicorp.com/connect-service-port"
 
+	// annotationConnectNative registers the service as Connect native, i.e. an application that
+	// speaks Connect itself using a Consul SDK. No Envoy sidecar is injected for such pods.
+	// This annotation takes a boolean value (true/false).
+	annotationConnectNative = "consul.hashicorp.com/connect-native"
+
 	// annotationProtocol contains the protocol that should be used for
 	// the service that is being injected. Valid values are "http", "http2",
 	// "grpc" and "tcp".
@@ -38,6 +49,13 @@ const (
 	// be a named port.
 	annotationUpstreams = "consul.hashicorp.com/connect-service-upstreams"
 
+	// annotationUpstreamsV2 is a JSON or YAML list of upstreams to register with
+	// the proxy. Each upstream supports the fields of Consul's upstream configuration,
+	// e.g. `[{"destinationName": "db", "localBindPort": 1234, "config": {"protocol": "grpc"}}]`.
+	// The local bind port can be a named port. It can't be set together with
+	// annotationUpstreams.
+	annotationUpstreamsV2 = "consul.hashicorp.com/connect-service-upstreams-v2"
+
 	// annotationTags is a list of tags to register with the service
 	// this is specified as a comma separated list e.g. abc,123
 	annotationTags = "consul.hashicorp.com/service-tags"
@@ -56,6 +74,24 @@ const (
 	// e.g. consul.hashicorp.com/service-meta-foo:bar
 	annotationMeta = "consul.hashicorp.com/service-meta-"
 
+	// annotationServiceWeightsPassing and annotationServiceWeightsWarning are the weights of the
+	// service and proxy registrations in DNS SRV responses when they're passing or warning,
+	// e.g. to shift traffic to canaries. They default to 1.
+	annotationServiceWeightsPassing = "consul.hashicorp.com/service-weights-passing"
+	annotationServiceWeightsWarning = "consul.hashicorp.com/service-weights-warning"
+
+	// annotationTaggedAddress is the prefix of the annotations that add tagged addresses to the
+	// service and proxy registrations, in the format `<address>[:<port>]`,
+	// e.g. consul.hashicorp.com/service-tagged-address-wan: 203.0.113.10:8080. The port defaults
+	// to the port of each registration.
+	annotationTaggedAddress = "consul.hashicorp.com/service-tagged-address-"
+
+	// annotationKubernetesService is the name of the Kubernetes service that the pod is registered
+	// for when more than one Kubernetes service selects it. Pods register a single Consul service,
+	// except for multi-port pods, and it defaults to the first of those Kubernetes services in
+	// alphabetical order.
+	annotationKubernetesService = "consul.hashicorp.com/kubernetes-service"
+
 	// annotationSyncPeriod controls the -sync-period flag passed to the
 	// consul-k8s consul-sidecar command. This flag controls how often the
 	// service is synced (i.e. re-registered) with the local agent.
@@ -69,6 +105,14 @@ const (
 	annotationSidecarProxyMemoryLimit   = "consul.hashicorp.com/sidecar-proxy-memory-limit"
 	annotationSidecarProxyMemoryRequest = "consul.hashicorp.com/sidecar-proxy-memory-request"
 
+	// annotations for the public listener of the sidecar proxy and its Consul check. The port
+	// is offset by the index of each service on multi-port pods. The check interval, timeout and
+	// deregister critical service after durations are specified as Go durations, e.g. 5s.
+	annotationSidecarProxyPublicListenerPort             = "consul.hashicorp.com/sidecar-proxy-public-listener-port"
+	annotationSidecarProxyCheckInterval                  = "consul.hashicorp.com/sidecar-proxy-check-interval"
+	annotationSidecarProxyCheckTimeout                   = "consul.hashicorp.com/sidecar-proxy-check-timeout"
+	annotationSidecarProxyDeregisterCriticalServiceAfter = "consul.hashicorp.com/sidecar-proxy-deregister-critical-service-after"
+
 	// annotations for metrics to configure where Prometheus scrapes
 	// metrics from, whether to run a merged metrics endpoint on the consul
 	// sidecar, and configure the connect service metrics.
@@ -80,6 +124,29 @@ const (
 	annotationServiceMetricsPort   = "consul.hashicorp.com/service-metrics-port"
 	annotationServiceMetricsPath   = "consul.hashicorp.com/service-metrics-path"
 
+	// annotations for the lifecycle of the Envoy sidecar. When enabled, application
+	// containers aren't started until Envoy is ready and Envoy's listeners are drained
+	// on termination, after which Envoy keeps running for the shutdown grace period.
+	annotationEnableSidecarProxyLifecycle                     = "consul.hashicorp.com/enable-sidecar-proxy-lifecycle"
+	annotationSidecarProxyLifecycleShutdownGracePeriodSeconds = "consul.hashicorp.com/sidecar-proxy-lifecycle-shutdown-grace-period-seconds"
+
+	// annotationDefaultContainer is the container that kubectl logs, exec and attach use when
+	// no container is given. It's set to the first application container when the Envoy
+	// sidecars come first in the pod.
+	annotationDefaultContainer = "kubectl.kubernetes.io/default-container"
+
+	// keyStopSidecarsOnAppExit stops the injected sidecars once the application containers of a pod
+	// have exited so that the pods of Jobs and CronJobs can complete. It can also be set as a label
+	// on a namespace to define the default behaviour for connect-injected pods which do not otherwise
+	// override this setting with their own annotation.
+	// This annotation/label takes a boolean value (true/false).
+	keyStopSidecarsOnAppExit = "consul.hashicorp.com/stop-sidecars-on-app-exit"
+
+	// annotationAppExited is set to "true" by the connect injector's controller on pods that stop their
+	// sidecars when the application exits, once none of their application containers will run again.
+	// The consul-sidecar reads it from a downward API volume.
+	annotationAppExited = "consul.hashicorp.com/app-exited"
+
 	// annotationEnvoyExtraArgs is a space-separated list of arguments to be passed to the
 	// envoy binary. See list of args here: https://www.envoyproxy.io/docs/envoy/latest/operations/cli
 	// e.g. consul.hashicorp.com/envoy-extra-args: "--log-level debug --disable-hot-restart"
@@ -128,6 +195,18 @@ const (
 	// of the pod before we overwrote it.
 	annotationOriginalReadinessProbePort = "consul.hashicorp.com/original-readiness-probe-port"
 
+	// annotationOriginalStartupProbePort is the value of the port originally defined on the startup probe
+	// of the pod before we overwrote it.
+	annotationOriginalStartupProbePort = "consul.hashicorp.com/original-startup-probe-port"
+
+	// annotationEnableProbeChecks controls whether the endpoints controller registers Consul checks
+	// for the HTTP and TCP readiness and liveness probes of the pod's application containers.
+	annotationEnableProbeChecks = "consul.hashicorp.com/enable-probe-checks"
+
+	// annotationProxyInjectionPolicy is the name of the ProxyInjectionPolicy that supplied
+	// defaults for the pod's injection settings. It's set by the handler.
+	annotationProxyInjectionPolicy = "consul.hashicorp.com/proxy-injection-policy"
+
 	// injected is used as the annotation value for annotationInjected.
 	injected = "injected"
 
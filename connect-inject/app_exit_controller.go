@@ -0,0 +1,73 @@
+package connectinject
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// AppExitController marks the pods that stop their sidecars when the application exits with the
+// consul.hashicorp.com/app-exited annotation once none of their application containers will run
+// again, given the pod's restart policy. The consul-sidecar of the pod reads the annotation from a
+// downward API volume and then stops the Envoy sidecars so that the pod can complete. Application
+// containers that are restarted in place are only briefly terminated, so they can't be told apart
+// from exited ones from within the pod.
+type AppExitController struct {
+	Client client.Client
+	Log    logr.Logger
+}
+
+func (r *AppExitController) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var pod corev1.Pod
+	err := r.Client.Get(ctx, req.NamespacedName, &pod)
+	if k8serrors.IsNotFound(err) {
+		return ctrl.Result{}, nil
+	} else if err != nil {
+		r.Log.Error(err, "failed to get pod", "name", req.Name, "ns", req.Namespace)
+		return ctrl.Result{}, err
+	}
+
+	// The sidecars of pods that have completed are no longer running.
+	if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return ctrl.Result{}, nil
+	}
+	if pod.Annotations[annotationAppExited] == "true" || !appExited(pod) {
+		return ctrl.Result{}, nil
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{annotationAppExited: "true"},
+		},
+	})
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	r.Log.Info("marking pod whose application has exited", "name", pod.Name, "ns", pod.Namespace)
+	if err := r.Client.Patch(ctx, &pod, client.RawPatch(types.MergePatchType, patch)); err != nil {
+		r.Log.Error(err, "failed to mark pod whose application has exited", "name", pod.Name, "ns", pod.Namespace)
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+func (r *AppExitController) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("app-exit").
+		For(&corev1.Pod{}, builder.WithPredicates(predicate.NewPredicateFuncs(stopsSidecarsOnAppExit))).
+		Complete(r)
+}
+
+// stopsSidecarsOnAppExit returns true if the handler injected the pod to stop its sidecars
+// when the application exits.
+func stopsSidecarsOnAppExit(object client.Object) bool {
+	return object.GetAnnotations()[keyStopSidecarsOnAppExit] == "true"
+}
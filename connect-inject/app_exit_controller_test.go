@@ -0,0 +1,91 @@
+package connectinject
+
+import (
+	"context"
+	"testing"
+
+	logrtest "github.com/go-logr/logr/testing"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestAppExitController_Reconcile(t *testing.T) {
+	t.Parallel()
+	running := corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}
+	failed := corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 1}}
+	succeeded := corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 0}}
+	cases := map[string]struct {
+		restartPolicy corev1.RestartPolicy
+		appState      corev1.ContainerState
+		expMarked     bool
+	}{
+		"app running": {
+			restartPolicy: corev1.RestartPolicyNever,
+			appState:      running,
+			expMarked:     false,
+		},
+		"app failed, never restarted": {
+			restartPolicy: corev1.RestartPolicyNever,
+			appState:      failed,
+			expMarked:     true,
+		},
+		"app failed, restarted on failure": {
+			restartPolicy: corev1.RestartPolicyOnFailure,
+			appState:      failed,
+			expMarked:     false,
+		},
+		"app succeeded, restarted on failure": {
+			restartPolicy: corev1.RestartPolicyOnFailure,
+			appState:      succeeded,
+			expMarked:     true,
+		},
+		"app succeeded, always restarted": {
+			restartPolicy: corev1.RestartPolicyAlways,
+			appState:      succeeded,
+			expMarked:     false,
+		},
+	}
+	for name, c := range cases {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "job-1",
+					Namespace:   "default",
+					Annotations: map[string]string{keyStopSidecarsOnAppExit: "true"},
+				},
+				Spec: corev1.PodSpec{
+					RestartPolicy: c.restartPolicy,
+				},
+				Status: corev1.PodStatus{
+					Phase: corev1.PodRunning,
+					ContainerStatuses: []corev1.ContainerStatus{
+						{Name: "job", State: c.appState},
+						{Name: envoySidecarContainer, State: running},
+						{Name: consulSidecarContainer, State: running},
+					},
+				},
+			}
+			client := fake.NewClientBuilder().WithRuntimeObjects(pod).Build()
+			controller := &AppExitController{
+				Client: client,
+				Log:    logrtest.TestLogger{T: t},
+			}
+			name := types.NamespacedName{Name: pod.Name, Namespace: pod.Namespace}
+			_, err := controller.Reconcile(context.Background(), ctrl.Request{NamespacedName: name})
+			require.NoError(t, err)
+
+			var updated corev1.Pod
+			require.NoError(t, client.Get(context.Background(), name, &updated))
+			if c.expMarked {
+				require.Equal(t, "true", updated.Annotations[annotationAppExited])
+			} else {
+				require.NotContains(t, updated.Annotations, annotationAppExited)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package connectinject
+
+import (
+	"fmt"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// connectNative returns true if the pod's service speaks Connect natively, in which case
+// no Envoy sidecar is injected and no connect-proxy service is registered for it.
+func connectNative(pod corev1.Pod) (bool, error) {
+	if raw, ok := pod.Annotations[annotationConnectNative]; ok {
+		native, err := strconv.ParseBool(raw)
+		if err != nil {
+			return false, fmt.Errorf("%s annotation value of %s was invalid: %s", annotationConnectNative, raw, err)
+		}
+		return native, nil
+	}
+	return false, nil
+}
+
+// connectNativeEnvVars returns the environment variables that let a Connect native
+// application reach the Consul client on its node with the ACL token obtained by the
+// init container and the CA certificate it wrote to the shared volume. Variables that
+// the container already defines are left to the container.
+func (h *Handler) connectNativeEnvVars(container corev1.Container) []corev1.EnvVar {
+	envVars := []corev1.EnvVar{
+		{
+			Name: "HOST_IP",
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.hostIP"},
+			},
+		},
+	}
+	if h.ConsulCACert != "" {
+		envVars = append(envVars,
+			corev1.EnvVar{Name: "CONSUL_HTTP_ADDR", Value: "https://$(HOST_IP):8501"},
+			corev1.EnvVar{Name: "CONSUL_CACERT", Value: "/consul/connect-inject/consul-ca.pem"},
+		)
+	} else {
+		envVars = append(envVars, corev1.EnvVar{Name: "CONSUL_HTTP_ADDR", Value: "$(HOST_IP):8500"})
+	}
+	if h.AuthMethod != "" {
+		envVars = append(envVars, corev1.EnvVar{Name: "CONSUL_HTTP_TOKEN_FILE", Value: "/consul/connect-inject/acl-token"})
+	}
+
+	defined := make(map[string]bool)
+	for _, envVar := range container.Env {
+		defined[envVar.Name] = true
+	}
+	var result []corev1.EnvVar
+	for _, envVar := range envVars {
+		if !defined[envVar.Name] {
+			result = append(result, envVar)
+		}
+	}
+	return result
+}
@@ -0,0 +1,283 @@
+package connectinject
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	mapset "github.com/deckarep/golang-set"
+	logrtest "github.com/go-logr/logr/testing"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	ctrlfake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestConnectNative(t *testing.T) {
+	t.Parallel()
+	cases := map[string]struct {
+		annotations map[string]string
+		expNative   bool
+		expErr      string
+	}{
+		"unset": {},
+		"true": {
+			annotations: map[string]string{annotationConnectNative: "true"},
+			expNative:   true,
+		},
+		"false": {
+			annotations: map[string]string{annotationConnectNative: "false"},
+		},
+		"invalid": {
+			annotations: map[string]string{annotationConnectNative: "native"},
+			expErr:      "consul.hashicorp.com/connect-native annotation value of native was invalid: strconv.ParseBool: parsing \"native\": invalid syntax",
+		},
+	}
+	for name, c := range cases {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			native, err := connectNative(corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: c.annotations}})
+			if c.expErr != "" {
+				require.EqualError(t, err, c.expErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.expNative, native)
+		})
+	}
+}
+
+func TestConnectNativeEnvVars(t *testing.T) {
+	t.Parallel()
+	hostIP := corev1.EnvVar{
+		Name: "HOST_IP",
+		ValueFrom: &corev1.EnvVarSource{
+			FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.hostIP"},
+		},
+	}
+	cases := map[string]struct {
+		handler    Handler
+		container  corev1.Container
+		expEnvVars []corev1.EnvVar
+	}{
+		"without TLS and ACLs": {
+			// HOST_IP must come first so that Kubernetes can expand it in the other variables.
+			expEnvVars: []corev1.EnvVar{
+				hostIP,
+				{Name: "CONSUL_HTTP_ADDR", Value: "$(HOST_IP):8500"},
+			},
+		},
+		"with TLS and ACLs": {
+			handler: Handler{
+				ConsulCACert: "ca",
+				AuthMethod:   "auth-method",
+			},
+			expEnvVars: []corev1.EnvVar{
+				hostIP,
+				{Name: "CONSUL_HTTP_ADDR", Value: "https://$(HOST_IP):8501"},
+				{Name: "CONSUL_CACERT", Value: "/consul/connect-inject/consul-ca.pem"},
+				{Name: "CONSUL_HTTP_TOKEN_FILE", Value: "/consul/connect-inject/acl-token"},
+			},
+		},
+		"container defines HOST_IP": {
+			container: corev1.Container{
+				Env: []corev1.EnvVar{{Name: "HOST_IP", Value: "10.0.0.1"}},
+			},
+			expEnvVars: []corev1.EnvVar{
+				{Name: "CONSUL_HTTP_ADDR", Value: "$(HOST_IP):8500"},
+			},
+		},
+		"container defines CONSUL_HTTP_ADDR": {
+			container: corev1.Container{
+				Env: []corev1.EnvVar{{Name: "CONSUL_HTTP_ADDR", Value: "consul:8500"}},
+			},
+			expEnvVars: []corev1.EnvVar{hostIP},
+		},
+	}
+	for name, c := range cases {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, c.expEnvVars, c.handler.connectNativeEnvVars(c.container))
+		})
+	}
+}
+
+func TestHandlerHandle_ConnectNative(t *testing.T) {
+	s := runtime.NewScheme()
+	s.AddKnownTypes(schema.GroupVersion{Group: "", Version: "v1"}, &corev1.Pod{})
+	decoder, err := admission.NewDecoder(s)
+	require.NoError(t, err)
+
+	ns := corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	h := Handler{
+		Log:                   logrtest.TestLogger{T: t},
+		AllowK8sNamespacesSet: mapset.NewSetWith("*"),
+		DenyK8sNamespacesSet:  mapset.NewSet(),
+		decoder:               decoder,
+		Clientset:             fake.NewSimpleClientset(&ns),
+		// Neither transparent proxy nor the Envoy metrics apply to Connect native pods.
+		EnableTransparentProxy: true,
+		MetricsConfig: MetricsConfig{
+			DefaultEnableMetrics:        true,
+			DefaultEnableMetricsMerging: true,
+			DefaultMergedMetricsPort:    "20100",
+			DefaultPrometheusScrapePort: "20200",
+		},
+		LifecycleConfig: LifecycleConfig{DefaultEnableProxyLifecycle: true},
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				annotationConnectNative: "true",
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "web",
+				},
+			},
+		},
+	}
+	resp := h.Handle(context.Background(), admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Namespace: ns.Name,
+			Object:    encodeRaw(t, pod),
+		},
+	})
+	require.True(t, resp.Allowed, resp.Result)
+
+	patched := applyPatches(t, pod, resp.Patches)
+	require.Len(t, patched.Spec.Containers, 1)
+	web := patched.Spec.Containers[0]
+	require.Equal(t, "web", web.Name)
+	require.Contains(t, web.VolumeMounts, corev1.VolumeMount{
+		Name:      volumeName,
+		MountPath: "/consul/connect-inject",
+		ReadOnly:  true,
+	})
+	require.Contains(t, web.Env, corev1.EnvVar{Name: "CONSUL_HTTP_ADDR", Value: "$(HOST_IP):8500"})
+	require.NotContains(t, patched.Annotations, annotationPrometheusScrape)
+
+	require.Len(t, patched.Spec.InitContainers, 2)
+	initCmd := patched.Spec.InitContainers[1].Command[2]
+	require.Contains(t, initCmd, "-connect-native=true")
+	require.NotContains(t, initCmd, "consul connect envoy")
+	require.NotContains(t, initCmd, "redirect-traffic")
+	require.NotContains(t, initCmd, "cp /bin/consul-k8s")
+	require.Nil(t, patched.Spec.InitContainers[1].SecurityContext)
+}
+
+func TestHandlerHandle_ConnectNativeMultiPort(t *testing.T) {
+	s := runtime.NewScheme()
+	s.AddKnownTypes(schema.GroupVersion{Group: "", Version: "v1"}, &corev1.Pod{})
+	decoder, err := admission.NewDecoder(s)
+	require.NoError(t, err)
+
+	h := Handler{
+		Log:                   logrtest.TestLogger{T: t},
+		AllowK8sNamespacesSet: mapset.NewSetWith("*"),
+		DenyK8sNamespacesSet:  mapset.NewSet(),
+		decoder:               decoder,
+	}
+	resp := h.Handle(context.Background(), admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Namespace: "default",
+			Object: encodeRaw(t, &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						annotationConnectNative: "true",
+						annotationService:       "web,web-admin",
+						annotationPort:          "8080,9090",
+					},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}),
+		},
+	})
+	require.False(t, resp.Allowed)
+	require.Contains(t, resp.Result.Message, "Connect native pods can only register a single service")
+}
+
+func TestCreateServiceRegistrations_ConnectNative(t *testing.T) {
+	t.Parallel()
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "pod1",
+			Namespace: "default",
+			Annotations: map[string]string{
+				annotationConnectNative: "true",
+				annotationPort:          "8080",
+			},
+		},
+		Status: corev1.PodStatus{
+			PodIP: "1.2.3.4",
+		},
+	}
+	endpoints := corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web",
+			Namespace: "default",
+		},
+	}
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	ep := EndpointsController{
+		Client:                 ctrlfake.NewClientBuilder().WithRuntimeObjects(ns).Build(),
+		EnableTransparentProxy: true,
+		Log:                    logrtest.TestLogger{T: t},
+		Context:                context.Background(),
+	}
+	service, proxyService, err := ep.createServiceRegistrations(*pod, endpoints)
+	require.NoError(t, err)
+	require.Nil(t, proxyService)
+	require.Equal(t, "web", service.Name)
+	require.Equal(t, 8080, service.Port)
+	require.Equal(t, &api.AgentServiceConnect{Native: true}, service.Connect)
+}
+
+func TestHandlerContainerInit_ConnectNative(t *testing.T) {
+	t.Parallel()
+	h := Handler{
+		AuthMethod: "auth-method",
+	}
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				annotationConnectNative: "true",
+				annotationService:       "web",
+			},
+		},
+		Spec: corev1.PodSpec{
+			ServiceAccountName: "web",
+			Containers: []corev1.Container{
+				{
+					Name: "web",
+					VolumeMounts: []corev1.VolumeMount{
+						{
+							Name:      "sa",
+							MountPath: "/var/run/secrets/kubernetes.io/serviceaccount",
+						},
+					},
+				},
+			},
+		},
+	}
+	container, err := h.containerInit(corev1.Namespace{}, pod)
+	require.NoError(t, err)
+	actual := strings.Join(container.Command, " ")
+	require.Contains(t, actual, `-acl-auth-method="auth-method"`)
+	require.Contains(t, actual, "-connect-native=true")
+	require.NotContains(t, actual, "/consul/connect-inject/consul connect envoy")
+}
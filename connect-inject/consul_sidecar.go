@@ -2,40 +2,133 @@ package connectinject
 
 import (
 	"fmt"
+	"strconv"
 
 	corev1 "k8s.io/api/core/v1"
 )
 
-// consulSidecar starts the consul-sidecar command to only run
-// the metrics merging server when metrics merging feature is enabled.
+// consulSidecarContainer is the name of the injected consul-sidecar container.
+const consulSidecarContainer = "consul-sidecar"
+
+// consulSidecar starts the consul-sidecar command to run the metrics merging server
+// when metrics merging feature is enabled and to stop the Envoy sidecars when the
+// application exits when stopOnAppExit is true, in which case it also logs out of
+// Consul if ACLs are enabled.
 // It always disables service registration because for connect we no longer
 // need to keep services registered as this is handled in the endpoints-controller.
-func (h *Handler) consulSidecar(pod corev1.Pod) (corev1.Container, error) {
-	metricsPorts, err := h.MetricsConfig.mergedMetricsServerConfiguration(pod)
-	if err != nil {
-		return corev1.Container{}, err
-	}
-
+func (h *Handler) consulSidecar(pod corev1.Pod, enableMetricsMerging, stopOnAppExit bool, envoyServices []multiPortInfo) (corev1.Container, error) {
 	command := []string{
 		"consul-k8s",
 		"consul-sidecar",
 		"-enable-service-registration=false",
-		"-enable-metrics-merging=true",
-		fmt.Sprintf("-merged-metrics-port=%s", metricsPorts.mergedPort),
-		fmt.Sprintf("-service-metrics-port=%s", metricsPorts.servicePort),
-		fmt.Sprintf("-service-metrics-path=%s", metricsPorts.servicePath),
+		fmt.Sprintf("-enable-metrics-merging=%t", enableMetricsMerging),
 	}
 
-	return corev1.Container{
-		Name:  "consul-sidecar",
-		Image: h.ImageConsulK8S,
-		VolumeMounts: []corev1.VolumeMount{
-			{
-				Name:      volumeName,
-				MountPath: "/consul/connect-inject",
-			},
+	if enableMetricsMerging {
+		metricsPorts, err := h.MetricsConfig.mergedMetricsServerConfiguration(pod)
+		if err != nil {
+			return corev1.Container{}, err
+		}
+		command = append(command,
+			fmt.Sprintf("-merged-metrics-port=%s", metricsPorts.mergedPort),
+			fmt.Sprintf("-service-metrics-port=%s", metricsPorts.servicePort),
+			fmt.Sprintf("-service-metrics-path=%s", metricsPorts.servicePath),
+		)
+	}
+
+	volumeMounts := []corev1.VolumeMount{
+		{
+			Name:      volumeName,
+			MountPath: "/consul/connect-inject",
 		},
-		Command:   command,
-		Resources: h.ConsulSidecarResources,
+	}
+	if stopOnAppExit {
+		command = append(command, "-stop-on-app-exit=true")
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      appExitVolumeName,
+			MountPath: "/consul/app-exit",
+			ReadOnly:  true,
+		})
+		for _, svc := range envoyServices {
+			command = append(command, fmt.Sprintf("-envoy-admin-addr=127.0.0.1:%d", defaultEnvoyAdminPort+svc.serviceIndex))
+		}
+	}
+
+	// Envoy's pre-stop hook doesn't run when the sidecars are stopped because the application
+	// exited, so consul-sidecar logs out of Consul instead.
+	var env []corev1.EnvVar
+	if stopOnAppExit && h.AuthMethod != "" {
+		command = append(command, "-logout-on-app-exit=true", "-token-file="+aclTokenFile)
+		env = append([]corev1.EnvVar{{
+			Name: "HOST_IP",
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.hostIP"},
+			},
+		}}, h.consulHTTPEnvVars()...)
+	}
+
+	return corev1.Container{
+		Name:         consulSidecarContainer,
+		Env:          env,
+		Image:        h.ImageConsulK8S,
+		VolumeMounts: volumeMounts,
+		Command:      command,
+		Resources:    h.ConsulSidecarResources,
 	}, nil
 }
+
+// stopSidecarsOnAppExit returns whether the injected sidecars should be stopped once the
+// application containers have exited. The pod annotation overrides the namespace label.
+func stopSidecarsOnAppExit(namespace corev1.Namespace, pod corev1.Pod) (bool, error) {
+	if raw, ok := pod.Annotations[keyStopSidecarsOnAppExit]; ok {
+		return strconv.ParseBool(raw)
+	}
+	if raw, ok := namespace.Labels[keyStopSidecarsOnAppExit]; ok {
+		return strconv.ParseBool(raw)
+	}
+	return false, nil
+}
+
+// appExited returns true if the pod stops its sidecars when the application exits and
+// none of its application containers will run again, i.e. they've all terminated and
+// won't be restarted given the pod's restart policy. Such pods are no longer registered
+// with Consul because their sidecars are shutting down or have already exited.
+func appExited(pod corev1.Pod) bool {
+	// The handler records whether the pod stops its sidecars in its annotations
+	// so that the namespace doesn't need to be looked up here.
+	if stop, _ := strconv.ParseBool(pod.Annotations[keyStopSidecarsOnAppExit]); !stop {
+		return false
+	}
+	if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return true
+	}
+	exited := false
+	for _, status := range pod.Status.ContainerStatuses {
+		if isInjectedContainer(status.Name) {
+			continue
+		}
+		if !terminatedForGood(pod.Spec.RestartPolicy, status) {
+			return false
+		}
+		exited = true
+	}
+	return exited
+}
+
+// terminatedForGood returns true if the container has terminated and won't be restarted
+// given the restart policy of its pod. Containers that restart in place with the OnFailure
+// policy are only briefly terminated.
+func terminatedForGood(restartPolicy corev1.RestartPolicy, status corev1.ContainerStatus) bool {
+	terminated := status.State.Terminated
+	if terminated == nil {
+		return false
+	}
+	switch restartPolicy {
+	case corev1.RestartPolicyNever:
+		return true
+	case corev1.RestartPolicyOnFailure:
+		return terminated.ExitCode == 0
+	default:
+		return false
+	}
+}
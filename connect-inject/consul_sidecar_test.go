@@ -35,7 +35,7 @@ func TestConsulSidecar_MetricsFlags(t *testing.T) {
 				},
 			},
 		},
-	})
+	}, true, false, []multiPortInfo{{}})
 
 	require.NoError(t, err)
 	require.Contains(t, container.Command, "-enable-metrics-merging=true")
@@ -43,3 +43,214 @@ func TestConsulSidecar_MetricsFlags(t *testing.T) {
 	require.Contains(t, container.Command, "-service-metrics-port=8080")
 	require.Contains(t, container.Command, "-service-metrics-path=/metrics")
 }
+
+// Test that when sidecars are stopped on application exit, the consul sidecar
+// is passed the admin address of each Envoy sidecar.
+func TestConsulSidecar_StopOnAppExitFlags(t *testing.T) {
+	handler := Handler{
+		Log:            logrtest.TestLogger{T: t},
+		ImageConsulK8S: "hashicorp/consul-k8s:9.9.9",
+	}
+	container, err := handler.consulSidecar(corev1.Pod{}, false, true, []multiPortInfo{
+		{serviceIndex: 0, serviceName: "web"},
+		{serviceIndex: 1, serviceName: "web-admin"},
+	})
+
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"consul-k8s",
+		"consul-sidecar",
+		"-enable-service-registration=false",
+		"-enable-metrics-merging=false",
+		"-stop-on-app-exit=true",
+		"-envoy-admin-addr=127.0.0.1:19000",
+		"-envoy-admin-addr=127.0.0.1:19001",
+	}, container.Command)
+	require.Contains(t, container.VolumeMounts, corev1.VolumeMount{
+		Name:      appExitVolumeName,
+		MountPath: "/consul/app-exit",
+		ReadOnly:  true,
+	})
+}
+
+// Test that consul-sidecar logs out of Consul once it stops the Envoy sidecars
+// when ACLs are enabled.
+func TestConsulSidecar_LogoutOnAppExitFlags(t *testing.T) {
+	handler := Handler{
+		Log:            logrtest.TestLogger{T: t},
+		ImageConsulK8S: "hashicorp/consul-k8s:9.9.9",
+		AuthMethod:     "consul-k8s-auth-method",
+	}
+	container, err := handler.consulSidecar(corev1.Pod{}, false, true, []multiPortInfo{{serviceName: "web"}})
+
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"consul-k8s",
+		"consul-sidecar",
+		"-enable-service-registration=false",
+		"-enable-metrics-merging=false",
+		"-stop-on-app-exit=true",
+		"-envoy-admin-addr=127.0.0.1:19000",
+		"-logout-on-app-exit=true",
+		"-token-file=/consul/connect-inject/acl-token",
+	}, container.Command)
+	require.Equal(t, []corev1.EnvVar{
+		{
+			Name: "HOST_IP",
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.hostIP"},
+			},
+		},
+		{Name: "CONSUL_HTTP_ADDR", Value: "$(HOST_IP):8500"},
+	}, container.Env)
+}
+
+func TestStopSidecarsOnAppExit(t *testing.T) {
+	cases := map[string]struct {
+		nsLabels    map[string]string
+		annotations map[string]string
+		exp         bool
+		expErr      string
+	}{
+		"default": {
+			exp: false,
+		},
+		"namespace label": {
+			nsLabels: map[string]string{keyStopSidecarsOnAppExit: "true"},
+			exp:      true,
+		},
+		"annotation": {
+			annotations: map[string]string{keyStopSidecarsOnAppExit: "true"},
+			exp:         true,
+		},
+		"annotation overrides namespace label": {
+			nsLabels:    map[string]string{keyStopSidecarsOnAppExit: "true"},
+			annotations: map[string]string{keyStopSidecarsOnAppExit: "false"},
+			exp:         false,
+		},
+		"invalid annotation": {
+			annotations: map[string]string{keyStopSidecarsOnAppExit: "yes"},
+			expErr:      `strconv.ParseBool: parsing "yes": invalid syntax`,
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			ns := corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default", Labels: c.nsLabels}}
+			pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: c.annotations}}
+			stop, err := stopSidecarsOnAppExit(ns, pod)
+			if c.expErr != "" {
+				require.EqualError(t, err, c.expErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.exp, stop)
+		})
+	}
+}
+
+func TestAppExited(t *testing.T) {
+	running := corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}
+	terminated := corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 0}}
+	failed := corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 1}}
+	cases := map[string]struct {
+		annotations   map[string]string
+		restartPolicy corev1.RestartPolicy
+		phase         corev1.PodPhase
+		statuses      []corev1.ContainerStatus
+		exp           bool
+	}{
+		"app terminated": {
+			annotations:   map[string]string{keyStopSidecarsOnAppExit: "true"},
+			restartPolicy: corev1.RestartPolicyNever,
+			phase:         corev1.PodRunning,
+			statuses: []corev1.ContainerStatus{
+				{Name: "web", State: terminated},
+				{Name: envoySidecarContainer, State: running},
+				{Name: consulSidecarContainer, State: running},
+			},
+			exp: true,
+		},
+		"app failed and restarts on failure": {
+			annotations:   map[string]string{keyStopSidecarsOnAppExit: "true"},
+			restartPolicy: corev1.RestartPolicyOnFailure,
+			phase:         corev1.PodRunning,
+			statuses: []corev1.ContainerStatus{
+				{Name: "web", State: failed},
+				{Name: envoySidecarContainer, State: running},
+			},
+			exp: false,
+		},
+		"app succeeded and restarts on failure": {
+			annotations:   map[string]string{keyStopSidecarsOnAppExit: "true"},
+			restartPolicy: corev1.RestartPolicyOnFailure,
+			phase:         corev1.PodRunning,
+			statuses: []corev1.ContainerStatus{
+				{Name: "web", State: terminated},
+				{Name: envoySidecarContainer, State: running},
+			},
+			exp: true,
+		},
+		"app terminated and always restarts": {
+			annotations:   map[string]string{keyStopSidecarsOnAppExit: "true"},
+			restartPolicy: corev1.RestartPolicyAlways,
+			phase:         corev1.PodRunning,
+			statuses: []corev1.ContainerStatus{
+				{Name: "web", State: terminated},
+				{Name: envoySidecarContainer, State: running},
+			},
+			exp: false,
+		},
+		"app running": {
+			annotations: map[string]string{keyStopSidecarsOnAppExit: "true"},
+			phase:       corev1.PodRunning,
+			statuses: []corev1.ContainerStatus{
+				{Name: "web", State: running},
+				{Name: envoySidecarContainer, State: running},
+			},
+			exp: false,
+		},
+		"one of several apps terminated": {
+			annotations:   map[string]string{keyStopSidecarsOnAppExit: "true"},
+			restartPolicy: corev1.RestartPolicyNever,
+			phase:         corev1.PodRunning,
+			statuses: []corev1.ContainerStatus{
+				{Name: "web", State: terminated},
+				{Name: "worker", State: running},
+				{Name: envoySidecarContainer, State: running},
+			},
+			exp: false,
+		},
+		"pod succeeded": {
+			annotations: map[string]string{keyStopSidecarsOnAppExit: "true"},
+			phase:       corev1.PodSucceeded,
+			exp:         true,
+		},
+		"no container statuses": {
+			annotations: map[string]string{keyStopSidecarsOnAppExit: "true"},
+			phase:       corev1.PodPending,
+			exp:         false,
+		},
+		"app terminated without annotation": {
+			restartPolicy: corev1.RestartPolicyNever,
+			phase:         corev1.PodRunning,
+			statuses: []corev1.ContainerStatus{
+				{Name: "web", State: terminated},
+				{Name: envoySidecarContainer, State: running},
+			},
+			exp: false,
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			pod := corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Annotations: c.annotations},
+				Spec:       corev1.PodSpec{RestartPolicy: c.restartPolicy},
+				Status: corev1.PodStatus{
+					Phase:             c.phase,
+					ContainerStatuses: c.statuses,
+				},
+			}
+			require.Equal(t, c.exp, appExited(pod))
+		})
+	}
+}
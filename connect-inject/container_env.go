@@ -5,33 +5,202 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-multierror"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 func (h *Handler) containerEnvVars(pod corev1.Pod) []corev1.EnvVar {
-	raw, ok := pod.Annotations[annotationUpstreams]
-	if !ok || raw == "" {
+	var result []corev1.EnvVar
+	for _, upstream := range injectedUpstreams(pod, h.EnableNamespaces) {
+		result = append(result, upstream.envVars()...)
+	}
+	if len(result) == 0 {
 		return []corev1.EnvVar{}
 	}
 
-	var result []corev1.EnvVar
-	for _, raw := range strings.Split(raw, ",") {
-		parts := strings.SplitN(raw, ":", 3)
-		port, _ := portValue(pod, strings.TrimSpace(parts[1]))
-		if port > 0 {
-			name := strings.TrimSpace(parts[0])
-			name = strings.ToUpper(strings.Replace(name, "-", "_", -1))
-			portStr := strconv.Itoa(int(port))
-
-			result = append(result, corev1.EnvVar{
-				Name:  fmt.Sprintf("%s_CONNECT_SERVICE_HOST", name),
-				Value: "127.0.0.1",
-			}, corev1.EnvVar{
-				Name:  fmt.Sprintf("%s_CONNECT_SERVICE_PORT", name),
-				Value: portStr,
-			})
+	return result
+}
+
+// upstreamEnvVarPrefix returns the prefix of the environment variables of an upstream.
+// The destination name is upper-cased and every character that isn't valid in a shell
+// variable name is replaced with an underscore, e.g. "static-server" becomes "STATIC_SERVER".
+func upstreamEnvVarPrefix(name string) string {
+	prefix := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		default:
+			return '_'
+		}
+	}, name)
+	if prefix == "" || (prefix[0] >= '0' && prefix[0] <= '9') {
+		prefix = "_" + prefix
+	}
+	return prefix
+}
+
+// validateUpstreamEnvVars checks that no two upstreams of the pod set the same environment
+// variables, e.g. the same service in two namespaces or datacenters. Such upstreams are
+// only told apart by the upstreams manifest.
+func validateUpstreamEnvVars(pod corev1.Pod, enableNamespaces bool) error {
+	var errs error
+	owners := make(map[string]injectedUpstream)
+	for _, upstream := range injectedUpstreams(pod, enableNamespaces) {
+		for _, envVar := range upstream.envVars() {
+			if owner, ok := owners[envVar.Name]; ok {
+				errs = multierror.Append(errs, fmt.Errorf("upstreams %s and %s both set the %s environment variable",
+					owner.description(), upstream.description(), envVar.Name))
+				break
+			}
+			owners[envVar.Name] = upstream
 		}
 	}
+	return errs
+}
+
+// upstreamEnvVars returns the environment variables that let applications discover
+// the local address of an upstream, and its namespace and datacenter if they are set.
+func upstreamEnvVars(prefix string, upstream injectedUpstream) []corev1.EnvVar {
+	envVars := []corev1.EnvVar{
+		{
+			Name:  fmt.Sprintf("%s_CONNECT_SERVICE_HOST", prefix),
+			Value: upstream.LocalBindAddress,
+		},
+		{
+			Name:  fmt.Sprintf("%s_CONNECT_SERVICE_PORT", prefix),
+			Value: strconv.Itoa(upstream.LocalBindPort),
+		},
+	}
+	if upstream.DestinationNamespace != "" {
+		envVars = append(envVars, corev1.EnvVar{
+			Name:  fmt.Sprintf("%s_CONNECT_SERVICE_NAMESPACE", prefix),
+			Value: upstream.DestinationNamespace,
+		})
+	}
+	if upstream.Datacenter != "" {
+		envVars = append(envVars, corev1.EnvVar{
+			Name:  fmt.Sprintf("%s_CONNECT_SERVICE_DATACENTER", prefix),
+			Value: upstream.Datacenter,
+		})
+	}
+	return envVars
+}
+
+// injectedUpstream is an upstream of the pod as seen by its application, i.e. the
+// destination and the local address that the Envoy sidecar listens on for it. It's
+// also an entry of the upstreams manifest.
+type injectedUpstream struct {
+	// Service is the service of a multi-port pod that the upstream is configured for.
+	Service              string `json:"service,omitempty"`
+	DestinationType      string `json:"destinationType"`
+	DestinationName      string `json:"destinationName"`
+	DestinationNamespace string `json:"destinationNamespace,omitempty"`
+	Datacenter           string `json:"datacenter,omitempty"`
+	LocalBindAddress     string `json:"localBindAddress,omitempty"`
+	LocalBindPort        int    `json:"localBindPort,omitempty"`
+	LocalBindSocketPath  string `json:"localBindSocketPath,omitempty"`
+
+	// legacyEnvVarPrefix is the prefix of the environment variables that upstreams of the
+	// string annotation were given before they were named after their destination, i.e.
+	// the upper-cased upstream as written in the annotation, e.g. "WEB.NS" for "web.ns:1234".
+	legacyEnvVarPrefix string
+}
 
+// envVars returns the environment variables of the upstream. Upstreams that bind a Unix
+// socket have no host and port. The variables that upstreams of the string annotation
+// used to have are kept as aliases of the host and port.
+func (u injectedUpstream) envVars() []corev1.EnvVar {
+	if u.LocalBindPort == 0 {
+		return nil
+	}
+	prefix := upstreamEnvVarPrefix(u.DestinationName)
+	envVars := upstreamEnvVars(prefix, u)
+	if u.legacyEnvVarPrefix != "" && u.legacyEnvVarPrefix != prefix {
+		envVars = append(envVars,
+			corev1.EnvVar{Name: fmt.Sprintf("%s_CONNECT_SERVICE_HOST", u.legacyEnvVarPrefix), Value: u.LocalBindAddress},
+			corev1.EnvVar{Name: fmt.Sprintf("%s_CONNECT_SERVICE_PORT", u.legacyEnvVarPrefix), Value: strconv.Itoa(u.LocalBindPort)},
+		)
+	}
+	return envVars
+}
+
+// description returns the destination of the upstream for error messages.
+func (u injectedUpstream) description() string {
+	name := u.DestinationName
+	if u.DestinationNamespace != "" {
+		name += "." + u.DestinationNamespace
+	}
+	if u.Datacenter != "" {
+		return fmt.Sprintf("%q in datacenter %q", name, u.Datacenter)
+	}
+	return fmt.Sprintf("%q", name)
+}
+
+// legacyUpstreamEnvVarPrefix returns the prefix of the environment variables that an upstream
+// of the string annotation used to have, or an empty string if it had none, i.e. if it's a
+// prepared query or the prefix isn't valid in variable names.
+func legacyUpstreamEnvVarPrefix(raw string) string {
+	name := strings.TrimSpace(strings.SplitN(raw, ":", 2)[0])
+	if name == "prepared_query" {
+		return ""
+	}
+	prefix := strings.ToUpper(strings.Replace(name, "-", "_", -1))
+	if len(validation.IsEnvVarName(prefix+"_CONNECT_SERVICE_HOST")) > 0 {
+		return ""
+	}
+	return prefix
+}
+
+// injectedUpstreams returns the upstreams of all services of the pod. Errors are ignored
+// here since the services and upstreams have already been validated by the handler, and
+// upstreams of the string annotation without a valid port are skipped as they are by the
+// endpoints controller.
+func injectedUpstreams(pod corev1.Pod, enableNamespaces bool) []injectedUpstream {
+	// Multi-port pods configure upstreams per service.
+	services := []multiPortInfo{{}}
+	if isMultiPort(pod) {
+		services, _ = multiPortServices(pod)
+	}
+
+	var result []injectedUpstream
+	for _, svc := range services {
+		var upstreams []api.Upstream
+		// legacyPrefixes holds the legacy environment variable prefix of each upstream.
+		var legacyPrefixes []string
+		if raw, ok := serviceAnnotation(pod, annotationUpstreamsV2, svc); ok {
+			upstreams, _ = parseUpstreamsV2(pod, raw, enableNamespaces)
+			legacyPrefixes = make([]string, len(upstreams))
+		} else if raw, ok := serviceAnnotation(pod, annotationUpstreams, svc); ok && raw != "" {
+			for _, raw := range strings.Split(raw, ",") {
+				if upstream := parseUpstream(pod, raw, enableNamespaces); upstream.LocalBindPort > 0 {
+					upstreams = append(upstreams, upstream)
+					legacyPrefixes = append(legacyPrefixes, legacyUpstreamEnvVarPrefix(raw))
+				}
+			}
+		}
+
+		for i, upstream := range upstreams {
+			u := injectedUpstream{
+				Service:              svc.serviceName,
+				DestinationType:      string(upstream.DestinationType),
+				DestinationName:      upstream.DestinationName,
+				DestinationNamespace: upstream.DestinationNamespace,
+				Datacenter:           upstream.Datacenter,
+				LocalBindAddress:     upstream.LocalBindAddress,
+				LocalBindPort:        upstream.LocalBindPort,
+				LocalBindSocketPath:  upstream.LocalBindSocketPath,
+				legacyEnvVarPrefix:   legacyPrefixes[i],
+			}
+			// Envoy listens on the loopback address unless another address is configured.
+			if u.LocalBindPort > 0 && u.LocalBindAddress == "" {
+				u.LocalBindAddress = "127.0.0.1"
+			}
+			result = append(result, u)
+		}
+	}
 	return result
 }
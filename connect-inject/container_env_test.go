@@ -11,16 +11,112 @@ import (
 func TestContainerEnvVars(t *testing.T) {
 
 	cases := []struct {
-		Name     string
-		Upstream string
+		Name             string
+		Upstream         string
+		EnableNamespaces bool
+		Expected         []corev1.EnvVar
 	}{
 		{
 			"Upstream with datacenter",
 			"static-server:7890:dc1",
+			false,
+			[]corev1.EnvVar{
+				{
+					Name:  "STATIC_SERVER_CONNECT_SERVICE_HOST",
+					Value: "127.0.0.1",
+				}, {
+					Name:  "STATIC_SERVER_CONNECT_SERVICE_PORT",
+					Value: "7890",
+				}, {
+					Name:  "STATIC_SERVER_CONNECT_SERVICE_DATACENTER",
+					Value: "dc1",
+				},
+			},
 		},
 		{
 			"Upstream without datacenter",
 			"static-server:7890",
+			false,
+			[]corev1.EnvVar{
+				{
+					Name:  "STATIC_SERVER_CONNECT_SERVICE_HOST",
+					Value: "127.0.0.1",
+				}, {
+					Name:  "STATIC_SERVER_CONNECT_SERVICE_PORT",
+					Value: "7890",
+				},
+			},
+		},
+		{
+			"Upstream with namespace",
+			"static-server.ns1:7890",
+			true,
+			[]corev1.EnvVar{
+				{
+					Name:  "STATIC_SERVER_CONNECT_SERVICE_HOST",
+					Value: "127.0.0.1",
+				}, {
+					Name:  "STATIC_SERVER_CONNECT_SERVICE_PORT",
+					Value: "7890",
+				}, {
+					Name:  "STATIC_SERVER_CONNECT_SERVICE_NAMESPACE",
+					Value: "ns1",
+				}, {
+					Name:  "STATIC_SERVER.NS1_CONNECT_SERVICE_HOST",
+					Value: "127.0.0.1",
+				}, {
+					Name:  "STATIC_SERVER.NS1_CONNECT_SERVICE_PORT",
+					Value: "7890",
+				},
+			},
+		},
+		{
+			"Upstream with dots when namespaces are disabled",
+			"static-server.ns1:7890",
+			false,
+			[]corev1.EnvVar{
+				{
+					Name:  "STATIC_SERVER_NS1_CONNECT_SERVICE_HOST",
+					Value: "127.0.0.1",
+				}, {
+					Name:  "STATIC_SERVER_NS1_CONNECT_SERVICE_PORT",
+					Value: "7890",
+				}, {
+					Name:  "STATIC_SERVER.NS1_CONNECT_SERVICE_HOST",
+					Value: "127.0.0.1",
+				}, {
+					Name:  "STATIC_SERVER.NS1_CONNECT_SERVICE_PORT",
+					Value: "7890",
+				},
+			},
+		},
+		{
+			"Prepared query upstream",
+			"prepared_query:static-server-query:7890",
+			false,
+			[]corev1.EnvVar{
+				{
+					Name:  "STATIC_SERVER_QUERY_CONNECT_SERVICE_HOST",
+					Value: "127.0.0.1",
+				}, {
+					Name:  "STATIC_SERVER_QUERY_CONNECT_SERVICE_PORT",
+					Value: "7890",
+				},
+			},
+		},
+		{
+			"Upstream whose name starts with a digit",
+			"2fa:7890",
+			false,
+			[]corev1.EnvVar{
+				{
+					Name:  "_2FA_CONNECT_SERVICE_HOST",
+					Value: "127.0.0.1",
+				}, {
+					Name:  "_2FA_CONNECT_SERVICE_PORT",
+					Value: "7890",
+				},
+			},
 		},
 	}
 
@@ -28,7 +124,7 @@ func TestContainerEnvVars(t *testing.T) {
 		t.Run(tt.Name, func(t *testing.T) {
 			require := require.New(t)
 
-			var h Handler
+			h := Handler{EnableNamespaces: tt.EnableNamespaces}
 			envVars := h.containerEnvVars(corev1.Pod{
 				ObjectMeta: metav1.ObjectMeta{
 					Annotations: map[string]string{
@@ -38,15 +134,86 @@ func TestContainerEnvVars(t *testing.T) {
 				},
 			})
 
-			require.ElementsMatch(envVars, []corev1.EnvVar{
-				{
-					Name:  "STATIC_SERVER_CONNECT_SERVICE_HOST",
-					Value: "127.0.0.1",
-				}, {
-					Name:  "STATIC_SERVER_CONNECT_SERVICE_PORT",
-					Value: "7890",
+			require.ElementsMatch(envVars, tt.Expected)
+		})
+	}
+}
+
+func TestUpstreamEnvVarPrefix(t *testing.T) {
+	cases := map[string]string{
+		"static-server": "STATIC_SERVER",
+		"db.v2":         "DB_V2",
+		"under_score":   "UNDER_SCORE",
+		"1db":           "_1DB",
+		"":              "_",
+	}
+	for name, expected := range cases {
+		require.Equal(t, expected, upstreamEnvVarPrefix(name), name)
+	}
+}
+
+func TestValidateUpstreamEnvVars(t *testing.T) {
+	cases := map[string]struct {
+		upstreams        string
+		enableNamespaces bool
+		expErr           string
+	}{
+		"distinct upstreams": {
+			upstreams: "static-server:7890,db:7891:dc2",
+		},
+		"same upstream in two datacenters": {
+			upstreams: "static-server:7890:dc1,static-server:7891:dc2",
+			expErr:    `upstreams "static-server" in datacenter "dc1" and "static-server" in datacenter "dc2" both set the STATIC_SERVER_CONNECT_SERVICE_HOST environment variable`,
+		},
+		"same upstream in two namespaces": {
+			upstreams:        "web.ns1:7890,web.ns2:7891",
+			enableNamespaces: true,
+			expErr:           `upstreams "web.ns1" and "web.ns2" both set the WEB_CONNECT_SERVICE_HOST environment variable`,
+		},
+		"names that map to the same prefix": {
+			upstreams: "static-server:7890,static_server:7891",
+			expErr:    `upstreams "static-server" and "static_server" both set the STATIC_SERVER_CONNECT_SERVICE_HOST environment variable`,
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := validateUpstreamEnvVars(corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						annotationUpstreams: c.upstreams,
+					},
 				},
-			})
+			}, c.enableNamespaces)
+			if c.expErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Contains(t, err.Error(), c.expErr)
 		})
 	}
 }
+
+func TestContainerEnvVars_UpstreamsV2(t *testing.T) {
+	var h Handler
+	envVars := h.containerEnvVars(corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				annotationService: "foo",
+				annotationUpstreamsV2: `[{"destinationName": "static-server", "localBindPort": 7890, "localBindAddress": "127.0.0.2"},
+					{"destinationName": "socket-server", "localBindSocketPath": "/consul/socket-server.sock"}]`,
+			},
+		},
+	})
+
+	// Upstreams bound to a Unix socket don't get environment variables.
+	require.ElementsMatch(t, envVars, []corev1.EnvVar{
+		{
+			Name:  "STATIC_SERVER_CONNECT_SERVICE_HOST",
+			Value: "127.0.0.2",
+		}, {
+			Name:  "STATIC_SERVER_CONNECT_SERVICE_PORT",
+			Value: "7890",
+		},
+	})
+}
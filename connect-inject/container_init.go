@@ -2,6 +2,7 @@ package connectinject
 
 import (
 	"bytes"
+	"fmt"
 	"strconv"
 	"strings"
 	"text/template"
@@ -16,6 +17,13 @@ const (
 	envoyUserAndGroupID         = 5995
 	copyContainerUserAndGroupID = 5996
 	netAdminCapability          = "NET_ADMIN"
+
+	// defaultEnvoyAdminPort is the port Envoy's admin API listens on. Multi-port pods
+	// run one Envoy per service and offset this port by the service index.
+	defaultEnvoyAdminPort = 19000
+
+	// aclTokenFile is where connect-init writes the ACL token it logs in for when ACLs are enabled.
+	aclTokenFile = "/consul/connect-inject/acl-token"
 )
 
 type initContainerCommandData struct {
@@ -62,6 +70,42 @@ type initContainerCommandData struct {
 	// TProxyExcludeUIDs is a list of additional user IDs to exclude from traffic redirection via
 	// the consul connect redirect-traffic command.
 	TProxyExcludeUIDs []string
+
+	// MultiPort is true when the pod registers more than one Consul service. In that case
+	// connect-init waits for all of the services and writes a proxy ID file for each of them.
+	MultiPort bool
+
+	// EnvoyBootstraps is the list of Envoy bootstrap configs to generate. Regular pods
+	// have a single entry while multi-port pods have one entry per service.
+	EnvoyBootstraps []envoyBootstrapData
+
+	// EnableProxyLifecycle copies the consul-k8s binary to the shared volume so that
+	// the lifecycle hooks of the Envoy sidecar can run it.
+	EnableProxyLifecycle bool
+
+	// ConnectNative is true when the application speaks Connect natively. In that case
+	// connect-init only waits for the service to be registered and no Envoy bootstrap
+	// config is generated.
+	ConnectNative bool
+
+	// UpstreamsManifest is the JSON upstreams manifest written to the shared volume for
+	// the application containers. It's empty if the pod has no upstreams.
+	UpstreamsManifest string
+}
+
+// envoyBootstrapData is the data needed to render the consul connect envoy command
+// for one Envoy proxy.
+type envoyBootstrapData struct {
+	// ProxyIDFile is the file connect-init writes the proxy service ID to.
+	ProxyIDFile string
+	// BootstrapFile is the file the generated bootstrap config is written to.
+	BootstrapFile string
+	// AdminBind is the address of Envoy's admin API. It is left empty for regular
+	// pods so that the consul connect envoy default is used.
+	AdminBind string
+	// Primary is true for the first service of the pod. Only the primary proxy
+	// uses the merged metrics server as its Prometheus backend.
+	Primary bool
 }
 
 // initCopyContainer returns the init container spec for the copy container which places
@@ -116,11 +160,58 @@ func (h *Handler) containerInit(namespace corev1.Namespace, pod corev1.Pod) (cor
 		EnvoyUID:                   envoyUserAndGroupID,
 	}
 
+	data.EnableProxyLifecycle, err = h.LifecycleConfig.enableProxyLifecycle(pod)
+	if err != nil {
+		return corev1.Container{}, err
+	}
+
+	// Connect native pods don't run Envoy, so there's nothing to bootstrap
+	// and no proxy to redirect traffic to.
+	data.ConnectNative, err = connectNative(pod)
+	if err != nil {
+		return corev1.Container{}, err
+	}
+	if data.ConnectNative {
+		tproxyEnabled = false
+		data.EnableTransparentProxy = false
+		data.EnableProxyLifecycle = false
+	}
+
+	data.UpstreamsManifest, err = h.upstreamsManifest(pod)
+	if err != nil {
+		return corev1.Container{}, err
+	}
+
 	if data.AuthMethod != "" {
 		data.ServiceAccountName = pod.Spec.ServiceAccountName
 		data.ServiceName = pod.Annotations[annotationService]
 	}
 
+	if isMultiPort(pod) {
+		services, err := multiPortServices(pod)
+		if err != nil {
+			return corev1.Container{}, err
+		}
+		data.MultiPort = true
+		data.ServiceName = pod.Annotations[annotationService]
+		for _, svc := range services {
+			data.EnvoyBootstraps = append(data.EnvoyBootstraps, envoyBootstrapData{
+				ProxyIDFile:   fmt.Sprintf("/consul/connect-inject/proxyid-%s", svc.serviceName),
+				BootstrapFile: envoyBootstrapFile(svc),
+				AdminBind:     fmt.Sprintf("127.0.0.1:%d", defaultEnvoyAdminPort+svc.serviceIndex),
+				Primary:       svc.serviceIndex == 0,
+			})
+		}
+	} else if !data.ConnectNative {
+		data.EnvoyBootstraps = []envoyBootstrapData{
+			{
+				ProxyIDFile:   "/consul/connect-inject/proxyid",
+				BootstrapFile: envoyBootstrapFile(multiPortInfo{}),
+				Primary:       true,
+			},
+		}
+	}
+
 	// This determines how to configure the consul connect envoy command: what
 	// metrics backend to use and what path to expose on the
 	// envoy_prometheus_bind_addr listener for scraping.
@@ -234,6 +325,19 @@ func transparentProxyEnabled(namespace corev1.Namespace, pod corev1.Pod, globalE
 	return globalEnabled, nil
 }
 
+// consulHTTPEnvVars returns the environment variables that point the Consul CLI and API
+// client of a sidecar at the Consul client agent on the node, like in the init container.
+// They expand the HOST_IP environment variable, which must come before them.
+func (h *Handler) consulHTTPEnvVars() []corev1.EnvVar {
+	if h.ConsulCACert != "" {
+		return []corev1.EnvVar{
+			{Name: "CONSUL_HTTP_ADDR", Value: "https://$(HOST_IP):8501"},
+			{Name: "CONSUL_CACERT", Value: "/consul/connect-inject/consul-ca.pem"},
+		}
+	}
+	return []corev1.EnvVar{{Name: "CONSUL_HTTP_ADDR", Value: "$(HOST_IP):8500"}}
+}
+
 // pointerToInt64 takes an int64 and returns a pointer to it.
 func pointerToInt64(i int64) *int64 {
 	return &i
@@ -271,6 +375,11 @@ EOF
 export CONSUL_HTTP_ADDR="${HOST_IP}:8500"
 export CONSUL_GRPC_ADDR="${HOST_IP}:8502"
 {{- end}}
+{{- if .UpstreamsManifest }}
+cat <<'EOF' >/consul/connect-inject/upstreams.json
+{{ .UpstreamsManifest }}
+EOF
+{{- end}}
 consul-k8s connect-init -pod-name=${POD_NAME} -pod-namespace=${POD_NAMESPACE} \
   {{- if .AuthMethod }}
   -acl-auth-method="{{ .AuthMethod }}" \
@@ -289,28 +398,54 @@ consul-k8s connect-init -pod-name=${POD_NAME} -pod-namespace=${POD_NAMESPACE} \
   {{- if .ConsulNamespace }}
   -consul-service-namespace="{{ .ConsulNamespace }}" \
   {{- end }}
+  {{- if .MultiPort }}
+  -multiport=true \
+  -service-name="{{ .ServiceName }}" \
+  {{- end }}
+  {{- if .ConnectNative }}
+  -connect-native=true \
+  {{- end }}
 
 # Generate the envoy bootstrap code
+{{- range .EnvoyBootstraps }}
 /consul/connect-inject/consul connect envoy \
-  -proxy-id="$(cat /consul/connect-inject/proxyid)" \
-  {{- if .PrometheusScrapePath }}
-  -prometheus-scrape-path="{{ .PrometheusScrapePath }}" \
+  -proxy-id="$(cat {{ .ProxyIDFile }})" \
+  {{- if .AdminBind }}
+  -admin-bind="{{ .AdminBind }}" \
   {{- end }}
-  {{- if .PrometheusBackendPort }}
-  -prometheus-backend-port="{{ .PrometheusBackendPort }}" \
+  {{- if .Primary }}
+  {{- if $.PrometheusScrapePath }}
+  -prometheus-scrape-path="{{ $.PrometheusScrapePath }}" \
   {{- end }}
-  {{- if .AuthMethod }}
+  {{- if $.PrometheusBackendPort }}
+  -prometheus-backend-port="{{ $.PrometheusBackendPort }}" \
+  {{- end }}
+  {{- end }}
+  {{- if $.AuthMethod }}
   -token-file="/consul/connect-inject/acl-token" \
   {{- end }}
-  {{- if .ConsulNamespace }}
-  -namespace="{{ .ConsulNamespace }}" \
+  {{- if $.ConsulNamespace }}
+  -namespace="{{ $.ConsulNamespace }}" \
   {{- end }}
-  -bootstrap > /consul/connect-inject/envoy-bootstrap.yaml
+  -bootstrap > {{ .BootstrapFile }}
+{{- end }}
+
+{{- if .EnableProxyLifecycle }}
+
+# Copy consul-k8s for the Envoy sidecar lifecycle hooks.
+cp /bin/consul-k8s /consul/connect-inject/consul-k8s
+{{- end }}
 
 {{- if .EnableTransparentProxy }}
 {{- /* The newline below is intentional to allow extra space
        in the rendered template between this and the previous commands. */}}
 
+# Traffic redirection only applies IPv4 rules, so the IPv6 traffic of a pod with a global
+# IPv6 address bypasses Envoy.
+if awk '$4 == "00" && $6 != "lo" { found = 1 } END { exit !found }' /proc/net/if_inet6 2>/dev/null; then
+  echo "warning: transparent proxy only redirects IPv4 traffic, the IPv6 traffic of this pod bypasses Envoy" >&2
+fi
+
 # Apply traffic redirection rules.
 /consul/connect-inject/consul connect redirect-traffic \
   {{- if .ConsulNamespace }}
@@ -122,6 +122,31 @@ consul-k8s connect-init -pod-name=${POD_NAME} -pod-namespace=${POD_NAMESPACE} \
   -bootstrap > /consul/connect-inject/envoy-bootstrap.yaml`,
 			"",
 		},
+		{
+			"Sidecar proxy lifecycle enabled",
+			func(pod *corev1.Pod) *corev1.Pod {
+				pod.Annotations[annotationService] = "web"
+				pod.Annotations[annotationEnableSidecarProxyLifecycle] = "true"
+				return pod
+			},
+			Handler{},
+			`  -bootstrap > /consul/connect-inject/envoy-bootstrap.yaml
+
+# Copy consul-k8s for the Envoy sidecar lifecycle hooks.
+cp /bin/consul-k8s /consul/connect-inject/consul-k8s`,
+			"",
+		},
+
+		{
+			"Sidecar proxy lifecycle disabled",
+			func(pod *corev1.Pod) *corev1.Pod {
+				pod.Annotations[annotationService] = "web"
+				return pod
+			},
+			Handler{},
+			"",
+			"cp /bin/consul-k8s",
+		},
 	}
 
 	for _, tt := range cases {
@@ -141,6 +166,53 @@ consul-k8s connect-init -pod-name=${POD_NAME} -pod-namespace=${POD_NAMESPACE} \
 	}
 }
 
+func TestHandlerContainerInit_MultiPort(t *testing.T) {
+	require := require.New(t)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod",
+			Namespace: "test-namespace",
+			Annotations: map[string]string{
+				annotationService:              "web,web-admin",
+				annotationPort:                 "8080,9090",
+				annotationEnableMetrics:        "true",
+				annotationEnableMetricsMerging: "true",
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "web",
+				},
+			},
+		},
+	}
+	h := Handler{
+		MetricsConfig: MetricsConfig{
+			DefaultMergedMetricsPort:    "20100",
+			DefaultPrometheusScrapePath: "/metrics",
+		},
+	}
+	container, err := h.containerInit(testNS, *pod)
+	require.NoError(err)
+	actual := strings.Join(container.Command, " ")
+	require.Contains(actual, `consul-k8s connect-init -pod-name=${POD_NAME} -pod-namespace=${POD_NAMESPACE} \
+  -multiport=true \
+  -service-name="web,web-admin" \
+
+# Generate the envoy bootstrap code
+/consul/connect-inject/consul connect envoy \
+  -proxy-id="$(cat /consul/connect-inject/proxyid-web)" \
+  -admin-bind="127.0.0.1:19000" \
+  -prometheus-scrape-path="/metrics" \
+  -prometheus-backend-port="20100" \
+  -bootstrap > /consul/connect-inject/envoy-bootstrap-web.yaml
+/consul/connect-inject/consul connect envoy \
+  -proxy-id="$(cat /consul/connect-inject/proxyid-web-admin)" \
+  -admin-bind="127.0.0.1:19001" \
+  -bootstrap > /consul/connect-inject/envoy-bootstrap-web-admin.yaml`)
+}
+
 func TestHandlerContainerInit_transparentProxy(t *testing.T) {
 	cases := map[string]struct {
 		globalEnabled          bool
@@ -474,6 +546,12 @@ consul-k8s connect-init -pod-name=${POD_NAME} -pod-namespace=${POD_NAMESPACE} \
   -namespace="default" \
   -bootstrap > /consul/connect-inject/envoy-bootstrap.yaml
 
+# Traffic redirection only applies IPv4 rules, so the IPv6 traffic of a pod with a global
+# IPv6 address bypasses Envoy.
+if awk '$4 == "00" && $6 != "lo" { found = 1 } END { exit !found }' /proc/net/if_inet6 2>/dev/null; then
+  echo "warning: transparent proxy only redirects IPv4 traffic, the IPv6 traffic of this pod bypasses Envoy" >&2
+fi
+
 # Apply traffic redirection rules.
 /consul/connect-inject/consul connect redirect-traffic \
   -namespace="default" \
@@ -504,6 +582,12 @@ consul-k8s connect-init -pod-name=${POD_NAME} -pod-namespace=${POD_NAMESPACE} \
   -namespace="non-default" \
   -bootstrap > /consul/connect-inject/envoy-bootstrap.yaml
 
+# Traffic redirection only applies IPv4 rules, so the IPv6 traffic of a pod with a global
+# IPv6 address bypasses Envoy.
+if awk '$4 == "00" && $6 != "lo" { found = 1 } END { exit !found }' /proc/net/if_inet6 2>/dev/null; then
+  echo "warning: transparent proxy only redirects IPv4 traffic, the IPv6 traffic of this pod bypasses Envoy" >&2
+fi
+
 # Apply traffic redirection rules.
 /consul/connect-inject/consul connect redirect-traffic \
   -namespace="non-default" \
@@ -541,6 +625,12 @@ consul-k8s connect-init -pod-name=${POD_NAME} -pod-namespace=${POD_NAMESPACE} \
   -namespace="k8snamespace" \
   -bootstrap > /consul/connect-inject/envoy-bootstrap.yaml
 
+# Traffic redirection only applies IPv4 rules, so the IPv6 traffic of a pod with a global
+# IPv6 address bypasses Envoy.
+if awk '$4 == "00" && $6 != "lo" { found = 1 } END { exit !found }' /proc/net/if_inet6 2>/dev/null; then
+  echo "warning: transparent proxy only redirects IPv4 traffic, the IPv6 traffic of this pod bypasses Envoy" >&2
+fi
+
 # Apply traffic redirection rules.
 /consul/connect-inject/consul connect redirect-traffic \
   -namespace="k8snamespace" \
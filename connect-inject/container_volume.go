@@ -1,6 +1,8 @@
 package connectinject
 
 import (
+	"fmt"
+
 	corev1 "k8s.io/api/core/v1"
 )
 
@@ -8,6 +10,10 @@ import (
 // Consul Connect injection data.
 const volumeName = "consul-connect-inject-data"
 
+// appExitVolumeName is the name of the downward API volume that exposes the
+// consul.hashicorp.com/app-exited annotation of the pod to the consul-sidecar.
+const appExitVolumeName = "consul-connect-app-exit"
+
 // containerVolume returns the volume data to add to the pod. This volume
 // is used for shared data between containers.
 func (h *Handler) containerVolume() corev1.Volume {
@@ -18,3 +24,24 @@ func (h *Handler) containerVolume() corev1.Volume {
 		},
 	}
 }
+
+// appExitVolume returns the volume that the consul-sidecar reads the
+// consul.hashicorp.com/app-exited annotation of the pod from. The kubelet
+// updates the file when the annotation changes.
+func appExitVolume() corev1.Volume {
+	return corev1.Volume{
+		Name: appExitVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			DownwardAPI: &corev1.DownwardAPIVolumeSource{
+				Items: []corev1.DownwardAPIVolumeFile{
+					{
+						Path: "app-exited",
+						FieldRef: &corev1.ObjectFieldSelector{
+							FieldPath: fmt.Sprintf("metadata.annotations['%s']", annotationAppExited),
+						},
+					},
+				},
+			},
+		},
+	}
+}
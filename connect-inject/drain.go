@@ -0,0 +1,148 @@
+package connectinject
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// drainingInstance is a service instance that's critical in Consul so that traffic shifts away
+// from it, and that's deregistered once its deadline has passed.
+type drainingInstance struct {
+	k8sServiceName string
+	k8sNamespace   string
+	deadline       time.Time
+}
+
+// drainingInstances tracks the service instances being drained, keyed by the Kubernetes namespace
+// and the ID of the instance. It isn't persisted, so instances that were being drained when the
+// controller restarted are drained again for the full delay.
+type drainingInstances struct {
+	mu        sync.Mutex
+	instances map[string]drainingInstance
+}
+
+func drainingInstanceKey(svc *api.AgentService) string {
+	return svc.Meta[MetaKeyKubeNS] + "/" + svc.ID
+}
+
+func (d *drainingInstances) get(key string) (drainingInstance, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	instance, ok := d.instances[key]
+	return instance, ok
+}
+
+func (d *drainingInstances) add(key string, instance drainingInstance) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.instances == nil {
+		d.instances = make(map[string]drainingInstance)
+	}
+	d.instances[key] = instance
+}
+
+func (d *drainingInstances) remove(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.instances, key)
+}
+
+// requeueAfter returns how long until the first instance of the Kubernetes service can be
+// deregistered, or zero if none of its instances are being drained. It's called at the end of a
+// reconcile and forgets the instances whose deadline has passed.
+func (d *drainingInstances) requeueAfter(k8sServiceName, k8sNamespace string) time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var requeueAfter time.Duration
+	for key, instance := range d.instances {
+		if instance.k8sServiceName != k8sServiceName || instance.k8sNamespace != k8sNamespace {
+			continue
+		}
+		// Instances whose deadline has passed weren't deregistered by the reconcile, because they're
+		// no longer registered for the Kubernetes service, e.g. because they've been registered again
+		// for a pod that no Kubernetes service selects. There's nothing left to wait for.
+		until := time.Until(instance.deadline)
+		if until <= 0 {
+			delete(d.instances, key)
+			continue
+		}
+		// Deadlines that are about to pass are handled on the next reconcile, which shouldn't be immediate.
+		if until < time.Second {
+			until = time.Second
+		}
+		if requeueAfter == 0 || until < requeueAfter {
+			requeueAfter = until
+		}
+	}
+	return requeueAfter
+}
+
+// drainInstance drains a service instance that's no longer an endpoint of its Kubernetes service
+// and returns true once it should be deregistered. The first time it's called for an instance, it
+// marks the Kubernetes health check of the instance as critical so that traffic shifts away from
+// it. The instance should be deregistered once the drain delay has passed, or once its pod has
+// been deleted, whichever is first.
+func (r *EndpointsController) drainInstance(ctx context.Context, client *api.Client, svc *api.AgentService) (bool, error) {
+	if r.DeregistrationDrainDelay <= 0 {
+		return true, nil
+	}
+
+	key := drainingInstanceKey(svc)
+	var pod corev1.Pod
+	err := r.Client.Get(ctx, types.NamespacedName{Name: svc.Meta[MetaKeyPodName], Namespace: svc.Meta[MetaKeyKubeNS]}, &pod)
+	if k8serrors.IsNotFound(err) {
+		// The pod has terminated, so there's no traffic left to drain.
+		r.drainingInstances.remove(key)
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	instance, ok := r.drainingInstances.get(key)
+	if ok {
+		if time.Now().Before(instance.deadline) {
+			return false, nil
+		}
+		r.drainingInstances.remove(key)
+		return true, nil
+	}
+
+	// The pod is killed once its termination grace period has passed, at its deletion timestamp.
+	deadline := time.Now().Add(r.DeregistrationDrainDelay)
+	if pod.DeletionTimestamp != nil && pod.DeletionTimestamp.Time.Before(deadline) {
+		deadline = pod.DeletionTimestamp.Time
+	}
+	reason := fmt.Sprintf("Pod \"%s/%s\" is draining before it is deregistered", pod.Namespace, pod.Name)
+	if err := r.markInstanceCritical(client, pod, svc, reason); err != nil {
+		return false, err
+	}
+	r.Log.Info("draining service instance", "svc", svc.ID, "until", deadline)
+	r.drainingInstances.add(key, drainingInstance{
+		k8sServiceName: svc.Meta[MetaKeyKubeServiceName],
+		k8sNamespace:   svc.Meta[MetaKeyKubeNS],
+		deadline:       deadline,
+	})
+	return false, nil
+}
+
+// cancelDrain stops draining a service instance that's an endpoint of its Kubernetes service again.
+// Its health check is updated by the registration.
+func (r *EndpointsController) cancelDrain(svc *api.AgentService) {
+	r.drainingInstances.remove(drainingInstanceKey(svc))
+}
+
+// markInstanceCritical sets the Kubernetes health check of the service instance to critical.
+// Proxies don't have that check and follow their service with an alias check instead.
+func (r *EndpointsController) markInstanceCritical(client *api.Client, pod corev1.Pod, svc *api.AgentService, reason string) error {
+	if svc.Kind == api.ServiceKindConnectProxy {
+		return nil
+	}
+	return r.updateConsulHealthCheckStatus(client, getConsulHealthCheckID(pod, svc.ID), api.HealthCritical, reason)
+}
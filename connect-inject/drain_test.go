@@ -0,0 +1,233 @@
+package connectinject
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	mapset "github.com/deckarep/golang-set"
+	logrtest "github.com/go-logr/logr/testing"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/sdk/testutil"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestDrainingInstances_RequeueAfter(t *testing.T) {
+	t.Parallel()
+	var d drainingInstances
+	require.Zero(t, d.requeueAfter("service-created", "default"))
+
+	d.add("default/pod1-service-created", drainingInstance{
+		k8sServiceName: "service-created",
+		k8sNamespace:   "default",
+		deadline:       time.Now().Add(time.Minute),
+	})
+	d.add("default/pod2-service-created", drainingInstance{
+		k8sServiceName: "service-created",
+		k8sNamespace:   "default",
+		deadline:       time.Now().Add(10 * time.Second),
+	})
+	d.add("other/pod3-service-created", drainingInstance{
+		k8sServiceName: "service-created",
+		k8sNamespace:   "other",
+		deadline:       time.Now().Add(time.Second),
+	})
+	requeueAfter := d.requeueAfter("service-created", "default")
+	require.True(t, requeueAfter > 9*time.Second && requeueAfter <= 10*time.Second, requeueAfter)
+
+	// Deadlines that are about to pass are requeued after a second.
+	d.add("default/pod2-service-created", drainingInstance{
+		k8sServiceName: "service-created",
+		k8sNamespace:   "default",
+		deadline:       time.Now().Add(100 * time.Millisecond),
+	})
+	require.Equal(t, time.Second, d.requeueAfter("service-created", "default"))
+
+	// Instances whose deadline has passed are forgotten.
+	d.add("default/pod2-service-created", drainingInstance{
+		k8sServiceName: "service-created",
+		k8sNamespace:   "default",
+		deadline:       time.Now().Add(-time.Second),
+	})
+	requeueAfter = d.requeueAfter("service-created", "default")
+	require.True(t, requeueAfter > 59*time.Second && requeueAfter <= time.Minute, requeueAfter)
+	_, ok := d.get("default/pod2-service-created")
+	require.False(t, ok)
+
+	d.remove("default/pod1-service-created")
+	require.Zero(t, d.requeueAfter("service-created", "default"))
+}
+
+// Test the drain of instances that don't need a Consul client to be marked critical, i.e.
+// proxies registered with agents.
+func TestDrainInstance(t *testing.T) {
+	t.Parallel()
+	proxy := &api.AgentService{
+		Kind:    api.ServiceKindConnectProxy,
+		ID:      "pod1-service-created-sidecar-proxy",
+		Service: "service-created-sidecar-proxy",
+		Meta: map[string]string{
+			MetaKeyPodName:         "pod1",
+			MetaKeyKubeNS:          "default",
+			MetaKeyKubeServiceName: "service-created",
+			MetaKeyManagedBy:       managedByValue,
+		},
+	}
+	terminating := createPod("pod1", "1.2.3.4", true, true)
+	deletionTimestamp := metav1.NewTime(time.Now().Add(30 * time.Second).Truncate(time.Second))
+	terminating.DeletionTimestamp = &deletionTimestamp
+
+	cases := map[string]struct {
+		drainDelay    time.Duration
+		k8sObjects    []runtime.Object
+		draining      *drainingInstance
+		expDeregister bool
+		expDeadline   time.Time
+	}{
+		"drain disabled": {
+			k8sObjects:    []runtime.Object{createPod("pod1", "1.2.3.4", true, true)},
+			expDeregister: true,
+		},
+		"pod deleted": {
+			drainDelay:    time.Minute,
+			expDeregister: true,
+		},
+		"drain started": {
+			drainDelay: time.Minute,
+			k8sObjects: []runtime.Object{createPod("pod1", "1.2.3.4", true, true)},
+		},
+		"drain ends with the termination grace period": {
+			drainDelay:  time.Minute,
+			k8sObjects:  []runtime.Object{terminating},
+			expDeadline: deletionTimestamp.Time,
+		},
+		"draining": {
+			drainDelay: time.Minute,
+			k8sObjects: []runtime.Object{createPod("pod1", "1.2.3.4", true, true)},
+			draining:   &drainingInstance{deadline: time.Now().Add(time.Second)},
+		},
+		"drained": {
+			drainDelay:    time.Minute,
+			k8sObjects:    []runtime.Object{createPod("pod1", "1.2.3.4", true, true)},
+			draining:      &drainingInstance{deadline: time.Now().Add(-time.Second)},
+			expDeregister: true,
+		},
+	}
+	for name, c := range cases {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			ep := &EndpointsController{
+				Client:                   fake.NewClientBuilder().WithRuntimeObjects(c.k8sObjects...).Build(),
+				DeregistrationDrainDelay: c.drainDelay,
+				Log:                      logrtest.TestLogger{T: t},
+			}
+			key := drainingInstanceKey(proxy)
+			if c.draining != nil {
+				ep.drainingInstances.add(key, *c.draining)
+			}
+
+			deregister, err := ep.drainInstance(context.Background(), nil, proxy)
+			require.NoError(t, err)
+			require.Equal(t, c.expDeregister, deregister)
+
+			instance, ok := ep.drainingInstances.get(key)
+			require.Equal(t, !c.expDeregister && c.drainDelay > 0, ok)
+			if ok && c.draining == nil {
+				require.Equal(t, "service-created", instance.k8sServiceName)
+				require.Equal(t, "default", instance.k8sNamespace)
+				if c.expDeadline.IsZero() {
+					require.WithinDuration(t, time.Now().Add(c.drainDelay), instance.deadline, 5*time.Second)
+				} else {
+					require.True(t, c.expDeadline.Equal(instance.deadline))
+				}
+			}
+		})
+	}
+}
+
+// Test that with a drain delay, the instances of a pod that's removed from the Endpoints are
+// marked critical instead of being deregistered, that the reconcile is requeued, and that they're
+// deregistered once the pod has been deleted.
+func TestReconcile_DeregistrationDrain(t *testing.T) {
+	t.Parallel()
+	ns := corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	pod1 := createPod("pod1", "1.2.3.4", true, true)
+	endpoints := &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "service-created",
+			Namespace: "default",
+		},
+		Subsets: []corev1.EndpointSubset{
+			{
+				Addresses: []corev1.EndpointAddress{
+					{
+						IP:        "1.2.3.4",
+						NodeName:  toStringPtr("node1"),
+						TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: "pod1", Namespace: "default"},
+					},
+				},
+			},
+		},
+	}
+	fakeClientPod := createPod("fake-consul-client", "127.0.0.1", false, true)
+	fakeClientPod.Labels = map[string]string{"component": "client", "app": "consul", "release": "consul"}
+	fakeClient := fake.NewClientBuilder().WithRuntimeObjects(&ns, pod1, endpoints, fakeClientPod).Build()
+
+	consul, err := testutil.NewTestServerConfigT(t, nil)
+	require.NoError(t, err)
+	defer consul.Stop()
+	consul.WaitForServiceIntentions(t)
+	cfg := &api.Config{Address: consul.HTTPAddr}
+	consulClient, err := api.NewClient(cfg)
+	require.NoError(t, err)
+
+	ep := &EndpointsController{
+		Client:                   fakeClient,
+		Log:                      logrtest.TestLogger{T: t},
+		ConsulClient:             consulClient,
+		ConsulPort:               strings.Split(consul.HTTPAddr, ":")[1],
+		ConsulScheme:             "http",
+		AllowK8sNamespacesSet:    mapset.NewSetWith("*"),
+		DenyK8sNamespacesSet:     mapset.NewSetWith(),
+		ReleaseName:              "consul",
+		ReleaseNamespace:         "default",
+		ConsulClientCfg:          cfg,
+		DeregistrationDrainDelay: time.Minute,
+		Context:                  context.Background(),
+	}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "service-created", Namespace: "default"}}
+	result, err := ep.Reconcile(context.Background(), req)
+	require.NoError(t, err)
+	require.Zero(t, result.RequeueAfter)
+
+	// Remove the pod from the Endpoints and check that its service is critical but still registered.
+	endpoints.Subsets = nil
+	require.NoError(t, fakeClient.Update(context.Background(), endpoints))
+	result, err = ep.Reconcile(context.Background(), req)
+	require.NoError(t, err)
+	require.True(t, result.RequeueAfter > 0 && result.RequeueAfter <= time.Minute, result.RequeueAfter)
+
+	services, err := consulClient.Agent().Services()
+	require.NoError(t, err)
+	require.Len(t, services, 2)
+	check, err := getServiceCheck(consulClient, "default/pod1-service-created/kubernetes-health-check")
+	require.NoError(t, err)
+	require.Equal(t, api.HealthCritical, check.Status)
+	require.Equal(t, `Pod "default/pod1" is draining before it is deregistered`, check.Output)
+
+	// Once the pod has been deleted, its services are deregistered.
+	require.NoError(t, fakeClient.Delete(context.Background(), pod1))
+	result, err = ep.Reconcile(context.Background(), req)
+	require.NoError(t, err)
+	require.Zero(t, result.RequeueAfter)
+	services, err = consulClient.Agent().Services()
+	require.NoError(t, err)
+	require.Empty(t, services)
+}
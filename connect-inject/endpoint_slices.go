@@ -0,0 +1,204 @@
+package connectinject
+
+import (
+	"context"
+	"sort"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-multierror"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1beta1 "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// MetaKeyKubeZone is the service metadata key for the zone of the pod's node, as reported
+// by the EndpointSlices of the Kubernetes service.
+const MetaKeyKubeZone = "k8s-zone"
+
+// endpointSliceAddress is an address of a Kubernetes service aggregated from its
+// EndpointSlices, with the health status derived from its conditions.
+type endpointSliceAddress struct {
+	address      corev1.EndpointAddress
+	healthStatus string
+	zone         string
+}
+
+// reconcileEndpointSlices registers the pods selected by a Kubernetes service with Consul
+// based on the service's EndpointSlices. A service can have many EndpointSlices, e.g. one
+// per address family or one per 100 endpoints, which are aggregated so that all of its pods
+// are compared against the service instances in Consul at once.
+func (r *EndpointsController) reconcileEndpointSlices(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var errs error
+	var slices discoveryv1beta1.EndpointSliceList
+	err := r.Client.List(ctx, &slices,
+		client.InNamespace(req.Namespace),
+		client.MatchingLabels{discoveryv1beta1.LabelServiceName: req.Name})
+	if err != nil {
+		r.Log.Error(err, "failed to list EndpointSlices", "name", req.Name, "ns", req.Namespace)
+		return ctrl.Result{}, err
+	}
+
+	// If the service has been deleted, so have its EndpointSlices, and all instances
+	// in Consul for that service are deregistered because the address map is empty.
+	r.Log.Info("retrieved EndpointSlices", "name", req.Name, "ns", req.Namespace, "count", len(slices.Items))
+
+	// The registration code is shared with Endpoints, which only need the name and namespace
+	// of the Kubernetes service.
+	serviceEndpoints := corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      req.Name,
+			Namespace: req.Namespace,
+		},
+	}
+	endpointAddressMap := map[string]bool{}
+	for _, address := range endpointSliceAddresses(slices.Items, r.podPrimaryIP(ctx)) {
+		if err := r.registerServicesAndHealthCheck(ctx, serviceEndpoints, address.address, address.healthStatus, address.zone, endpointAddressMap); err != nil {
+			r.Log.Error(err, "failed to register services or health check", "name", req.Name, "ns", req.Namespace)
+			errs = multierror.Append(errs, err)
+		}
+	}
+
+	if err = r.deregisterServiceOnAllAgents(ctx, req.Name, req.Namespace, endpointAddressMap); err != nil {
+		r.Log.Error(err, "failed to deregister endpoints on all agents", "name", req.Name, "ns", req.Namespace)
+		errs = multierror.Append(errs, err)
+	}
+
+	return ctrl.Result{RequeueAfter: r.drainingInstances.requeueAfter(req.Name, req.Namespace)}, errs
+}
+
+// endpointSliceAddresses returns an address for each pod in the EndpointSlices. A pod can be
+// part of several slices, e.g. on dual-stack clusters where each address family has its own
+// slices, or briefly while an endpoint moves between slices. Such pods are returned once and
+// are passing if any of their endpoints is. Their address is the endpoint with the pod's
+// primary IP, as returned by primaryIP, or else the endpoint with the lowest IP, so that it
+// doesn't depend on the order of the slices. primaryIP may be nil if the IP doesn't matter.
+// FQDN slices and endpoints that aren't pods are skipped. Addresses are sorted by pod name so
+// that pods are registered in a stable order.
+func endpointSliceAddresses(slices []discoveryv1beta1.EndpointSlice, primaryIP func(pod types.NamespacedName) string) []endpointSliceAddress {
+	byPod := make(map[types.NamespacedName][]endpointSliceAddress)
+	for _, slice := range slices {
+		if slice.AddressType == discoveryv1beta1.AddressTypeFQDN {
+			continue
+		}
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.TargetRef == nil || endpoint.TargetRef.Kind != "Pod" || len(endpoint.Addresses) == 0 {
+				continue
+			}
+			key := types.NamespacedName{Name: endpoint.TargetRef.Name, Namespace: endpoint.TargetRef.Namespace}
+			address := endpointSliceAddress{
+				address: corev1.EndpointAddress{
+					IP:        endpoint.Addresses[0],
+					NodeName:  endpoint.NodeName,
+					TargetRef: endpoint.TargetRef,
+				},
+				healthStatus: endpointHealthStatus(endpoint.Conditions),
+				zone:         endpoint.Topology[corev1.LabelTopologyZone],
+			}
+			if endpoint.Hostname != nil {
+				address.address.Hostname = *endpoint.Hostname
+			}
+			byPod[key] = append(byPod[key], address)
+		}
+	}
+
+	var addresses []endpointSliceAddress
+	for key, endpoints := range byPod {
+		var primary string
+		if primaryIP != nil {
+			primary = primaryIP(key)
+		}
+		healthStatus := api.HealthCritical
+		for _, endpoint := range endpoints {
+			if endpoint.healthStatus == api.HealthPassing {
+				healthStatus = api.HealthPassing
+			}
+		}
+		sort.Slice(endpoints, func(i, j int) bool {
+			a, b := endpoints[i].address.IP, endpoints[j].address.IP
+			if (a == primary) != (b == primary) {
+				return a == primary
+			}
+			return a < b
+		})
+		address := endpoints[0]
+		address.healthStatus = healthStatus
+		addresses = append(addresses, address)
+	}
+	sort.Slice(addresses, func(i, j int) bool {
+		a, b := addresses[i].address.TargetRef, addresses[j].address.TargetRef
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+	return addresses
+}
+
+// podPrimaryIP returns a function that returns the primary IP of a pod, or an empty string if
+// the pod can't be read.
+func (r *EndpointsController) podPrimaryIP(ctx context.Context) func(types.NamespacedName) string {
+	return func(name types.NamespacedName) string {
+		var pod corev1.Pod
+		if err := r.Client.Get(ctx, name, &pod); err != nil {
+			return ""
+		}
+		return pod.Status.PodIP
+	}
+}
+
+// endpointHealthStatus returns the Consul health status for the conditions of an endpoint.
+// Endpoints are passing when they are ready, which Kubernetes defines as serving and not
+// terminating, and an unknown ready condition is interpreted as ready. The serving condition is
+// intentionally ignored: terminating endpoints are critical even while they are still serving so
+// that Consul stops routing new traffic to them, and they stay registered, as critical, until they
+// are removed from the EndpointSlice or for the -deregistration-drain-delay after that, which is
+// what lets in-flight requests complete.
+func endpointHealthStatus(conditions discoveryv1beta1.EndpointConditions) string {
+	if conditions.Terminating != nil && *conditions.Terminating {
+		return api.HealthCritical
+	}
+	if conditions.Ready != nil && !*conditions.Ready {
+		return api.HealthCritical
+	}
+	return api.HealthPassing
+}
+
+// requestsForEndpointSlice maps an EndpointSlice to a request for its Kubernetes service.
+func (r *EndpointsController) requestsForEndpointSlice(object client.Object) []ctrl.Request {
+	serviceName, ok := object.GetLabels()[discoveryv1beta1.LabelServiceName]
+	if !ok || serviceName == "" {
+		return []ctrl.Request{}
+	}
+	return []ctrl.Request{{NamespacedName: types.NamespacedName{Name: serviceName, Namespace: object.GetNamespace()}}}
+}
+
+// requestsForEndpointSlicesOnNode returns a request for each Kubernetes service with an
+// endpoint on the node.
+func (r *EndpointsController) requestsForEndpointSlicesOnNode(nodeName string) []ctrl.Request {
+	var slices discoveryv1beta1.EndpointSliceList
+	if err := r.Client.List(r.Context, &slices); err != nil {
+		r.Log.Error(err, "failed to list EndpointSlices")
+		return []ctrl.Request{}
+	}
+
+	var requests []reconcile.Request
+	seen := make(map[types.NamespacedName]bool)
+	for _, slice := range slices.Items {
+		serviceName, ok := slice.Labels[discoveryv1beta1.LabelServiceName]
+		if !ok || serviceName == "" {
+			continue
+		}
+		name := types.NamespacedName{Name: serviceName, Namespace: slice.Namespace}
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.NodeName != nil && *endpoint.NodeName == nodeName && !seen[name] {
+				seen[name] = true
+				requests = append(requests, reconcile.Request{NamespacedName: name})
+			}
+		}
+	}
+	return requests
+}
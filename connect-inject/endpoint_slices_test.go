@@ -0,0 +1,248 @@
+package connectinject
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	mapset "github.com/deckarep/golang-set"
+	logrtest "github.com/go-logr/logr/testing"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/sdk/testutil"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1beta1 "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func endpointSlice(name string, addressType discoveryv1beta1.AddressType, endpoints ...discoveryv1beta1.Endpoint) *discoveryv1beta1.EndpointSlice {
+	return &discoveryv1beta1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels:    map[string]string{discoveryv1beta1.LabelServiceName: "service-created"},
+		},
+		AddressType: addressType,
+		Endpoints:   endpoints,
+	}
+}
+
+func sliceEndpoint(podName, ip string, ready bool) discoveryv1beta1.Endpoint {
+	return discoveryv1beta1.Endpoint{
+		Addresses:  []string{ip},
+		Conditions: discoveryv1beta1.EndpointConditions{Ready: pointerToBool(ready)},
+		NodeName:   toStringPtr("node1"),
+		TargetRef: &corev1.ObjectReference{
+			Kind:      "Pod",
+			Name:      podName,
+			Namespace: "default",
+		},
+	}
+}
+
+func TestEndpointHealthStatus(t *testing.T) {
+	t.Parallel()
+	cases := map[string]struct {
+		conditions discoveryv1beta1.EndpointConditions
+		expStatus  string
+	}{
+		"unknown": {
+			expStatus: api.HealthPassing,
+		},
+		"ready": {
+			conditions: discoveryv1beta1.EndpointConditions{Ready: pointerToBool(true)},
+			expStatus:  api.HealthPassing,
+		},
+		"not ready": {
+			conditions: discoveryv1beta1.EndpointConditions{Ready: pointerToBool(false)},
+			expStatus:  api.HealthCritical,
+		},
+		"terminating but serving": {
+			conditions: discoveryv1beta1.EndpointConditions{
+				Ready:       pointerToBool(false),
+				Serving:     pointerToBool(true),
+				Terminating: pointerToBool(true),
+			},
+			expStatus: api.HealthCritical,
+		},
+		"terminating without ready condition": {
+			conditions: discoveryv1beta1.EndpointConditions{Terminating: pointerToBool(true)},
+			expStatus:  api.HealthCritical,
+		},
+	}
+	for name, c := range cases {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, c.expStatus, endpointHealthStatus(c.conditions))
+		})
+	}
+}
+
+func TestEndpointSliceAddresses(t *testing.T) {
+	t.Parallel()
+	pod1IPv4 := sliceEndpoint("pod1", "1.2.3.4", true)
+	pod1IPv4.Hostname = toStringPtr("pod1-host")
+	pod1IPv4.Topology = map[string]string{corev1.LabelTopologyZone: "zone-a"}
+	// The IPv6 slice hasn't caught up with the pod being ready yet.
+	pod1IPv6 := sliceEndpoint("pod1", "2001:db8::1", false)
+	pod2 := sliceEndpoint("pod2", "2.3.4.5", false)
+	nonPod := sliceEndpoint("external", "3.4.5.6", true)
+	nonPod.TargetRef = nil
+
+	slices := []discoveryv1beta1.EndpointSlice{
+		*endpointSlice("service-created-ipv6", discoveryv1beta1.AddressTypeIPv6, pod1IPv6),
+		*endpointSlice("service-created-ipv4-1", discoveryv1beta1.AddressTypeIPv4, pod2, nonPod),
+		*endpointSlice("service-created-ipv4-2", discoveryv1beta1.AddressTypeIPv4, pod1IPv4),
+		*endpointSlice("service-created-fqdn", discoveryv1beta1.AddressTypeFQDN, sliceEndpoint("pod3", "pod3.example.com", true)),
+	}
+	reversed := make([]discoveryv1beta1.EndpointSlice, len(slices))
+	for i, slice := range slices {
+		reversed[len(slices)-1-i] = slice
+	}
+	addresses := endpointSliceAddresses(slices, nil)
+	require.Equal(t, addresses, endpointSliceAddresses(reversed, nil))
+	require.Equal(t, []endpointSliceAddress{
+		{
+			address: corev1.EndpointAddress{
+				IP:        "1.2.3.4",
+				Hostname:  "pod1-host",
+				NodeName:  toStringPtr("node1"),
+				TargetRef: pod1IPv4.TargetRef,
+			},
+			healthStatus: api.HealthPassing,
+			zone:         "zone-a",
+		},
+		{
+			address: corev1.EndpointAddress{
+				IP:        "2.3.4.5",
+				NodeName:  toStringPtr("node1"),
+				TargetRef: pod2.TargetRef,
+			},
+			healthStatus: api.HealthCritical,
+		},
+	}, addresses)
+
+	// The address of a dual-stack pod is its primary IP, whatever the order of the slices.
+	primaryIP := func(pod types.NamespacedName) string {
+		if pod.Name == "pod1" {
+			return "2001:db8::1"
+		}
+		return ""
+	}
+	addresses = endpointSliceAddresses(slices, primaryIP)
+	require.Equal(t, addresses, endpointSliceAddresses(reversed, primaryIP))
+	require.Equal(t, endpointSliceAddress{
+		address: corev1.EndpointAddress{
+			IP:        "2001:db8::1",
+			NodeName:  toStringPtr("node1"),
+			TargetRef: pod1IPv6.TargetRef,
+		},
+		healthStatus: api.HealthPassing,
+	}, addresses[0])
+}
+
+func TestRequestsForEndpointSlice(t *testing.T) {
+	t.Parallel()
+	ep := EndpointsController{}
+	require.Equal(t, []ctrl.Request{
+		{NamespacedName: types.NamespacedName{Name: "service-created", Namespace: "default"}},
+	}, ep.requestsForEndpointSlice(endpointSlice("service-created-abcde", discoveryv1beta1.AddressTypeIPv4)))
+
+	// Slices that aren't managed for a service are ignored.
+	slice := endpointSlice("custom", discoveryv1beta1.AddressTypeIPv4)
+	slice.Labels = nil
+	require.Empty(t, ep.requestsForEndpointSlice(slice))
+}
+
+func TestRequestsForEndpointSlicesOnNode(t *testing.T) {
+	t.Parallel()
+	other := sliceEndpoint("pod3", "3.4.5.6", true)
+	other.NodeName = toStringPtr("node2")
+	otherService := endpointSlice("other-service-abcde", discoveryv1beta1.AddressTypeIPv4, other)
+	otherService.Labels[discoveryv1beta1.LabelServiceName] = "other-service"
+
+	ep := EndpointsController{
+		Client: fake.NewClientBuilder().WithRuntimeObjects(
+			endpointSlice("service-created-1", discoveryv1beta1.AddressTypeIPv4, sliceEndpoint("pod1", "1.2.3.4", true)),
+			endpointSlice("service-created-2", discoveryv1beta1.AddressTypeIPv4, sliceEndpoint("pod2", "2.3.4.5", true)),
+			otherService,
+		).Build(),
+		Log:     logrtest.TestLogger{T: t},
+		Context: context.Background(),
+	}
+	// The service is requested once even though both of its slices have endpoints on the node.
+	require.Equal(t, []ctrl.Request{
+		{NamespacedName: types.NamespacedName{Name: "service-created", Namespace: "default"}},
+	}, ep.requestsForEndpointSlicesOnNode("node1"))
+}
+
+// Test that the pods of all EndpointSlices of a service are registered and that service
+// instances of pods that are in none of them are deregistered.
+func TestReconcileEndpointSlices(t *testing.T) {
+	t.Parallel()
+	fakeClientPod := createPod("fake-consul-client", "127.0.0.1", false, true)
+	fakeClientPod.Labels = map[string]string{"component": "client", "app": "consul", "release": "consul"}
+	ns := corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	pod1 := createPod("pod1", "1.2.3.4", true, true)
+	pod2 := createPod("pod2", "2.3.4.5", true, true)
+	zonal := sliceEndpoint("pod2", "2.3.4.5", false)
+	zonal.Topology = map[string]string{corev1.LabelTopologyZone: "zone-a"}
+	fakeClient := fake.NewClientBuilder().WithRuntimeObjects(
+		fakeClientPod, &ns, pod1, pod2,
+		endpointSlice("service-created-1", discoveryv1beta1.AddressTypeIPv4, sliceEndpoint("pod1", "1.2.3.4", true)),
+		endpointSlice("service-created-2", discoveryv1beta1.AddressTypeIPv4, zonal),
+	).Build()
+
+	consul, err := testutil.NewTestServerConfigT(t, nil)
+	require.NoError(t, err)
+	defer consul.Stop()
+	consul.WaitForServiceIntentions(t)
+	cfg := &api.Config{Address: consul.HTTPAddr}
+	consulClient, err := api.NewClient(cfg)
+	require.NoError(t, err)
+
+	// An instance of a pod that no longer exists.
+	require.NoError(t, consulClient.Agent().ServiceRegister(&api.AgentServiceRegistration{
+		ID:      "pod3-service-created",
+		Name:    "service-created",
+		Address: "3.4.5.6",
+		Meta: map[string]string{
+			MetaKeyKubeServiceName: "service-created",
+			MetaKeyKubeNS:          "default",
+			MetaKeyManagedBy:       managedByValue,
+		},
+	}))
+
+	ep := &EndpointsController{
+		Client:                fakeClient,
+		Log:                   logrtest.TestLogger{T: t},
+		ConsulClient:          consulClient,
+		ConsulPort:            strings.Split(consul.HTTPAddr, ":")[1],
+		ConsulScheme:          "http",
+		AllowK8sNamespacesSet: mapset.NewSetWith("*"),
+		DenyK8sNamespacesSet:  mapset.NewSetWith(),
+		ReleaseName:           "consul",
+		ReleaseNamespace:      "default",
+		ConsulClientCfg:       cfg,
+		EnableEndpointSlices:  true,
+		Context:               context.Background(),
+	}
+	_, err = ep.Reconcile(context.Background(), ctrl.Request{
+		NamespacedName: types.NamespacedName{Name: "service-created", Namespace: "default"},
+	})
+	require.NoError(t, err)
+
+	instances, _, err := consulClient.Catalog().Service("service-created", "", nil)
+	require.NoError(t, err)
+	require.Len(t, instances, 2)
+	require.Equal(t, "pod1-service-created", instances[0].ServiceID)
+	require.Equal(t, "pod2-service-created", instances[1].ServiceID)
+	require.Equal(t, "zone-a", instances[1].ServiceMeta[MetaKeyKubeZone])
+
+	checks, err := consulClient.Agent().ChecksWithFilter("ServiceID == `pod2-service-created`")
+	require.NoError(t, err)
+	require.Equal(t, api.HealthCritical, checks["default/pod2-service-created/kubernetes-health-check"].Status)
+}
@@ -2,18 +2,20 @@ package connectinject
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/deckarep/golang-set"
 	"github.com/go-logr/logr"
-	"github.com/hashicorp/consul-k8s/consul"
 	"github.com/hashicorp/consul-k8s/namespaces"
 	"github.com/hashicorp/consul/api"
 	"github.com/hashicorp/go-multierror"
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1beta1 "k8s.io/api/discovery/v1beta1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
@@ -24,6 +26,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	"sigs.k8s.io/controller-runtime/pkg/source"
@@ -34,6 +37,7 @@ const (
 	MetaKeyKubeServiceName     = "k8s-service-name"
 	MetaKeyKubeNS              = "k8s-namespace"
 	MetaKeyManagedBy           = "managed-by"
+	MetaKeyKubeHostname        = "k8s-hostname"
 	kubernetesSuccessReasonMsg = "Kubernetes health checks passing"
 	envoyPrometheusBindAddr    = "envoy_prometheus_bind_addr"
 
@@ -49,6 +53,15 @@ const (
 	// defaultExposedPathsListenerPortReadiness is the default port that we will use as the ListenerPort
 	// for the Expose configuration of the proxy registration for a readiness probe.
 	defaultExposedPathsListenerPortReadiness = 20301
+
+	// defaultExposedPathsListenerPortStartup is the first port that we will use as the ListenerPort
+	// for the Expose configuration of the proxy registration for the startup probe and for the probes
+	// of the other application containers. Each of these probes is allocated the next free port.
+	defaultExposedPathsListenerPortStartup = 20302
+
+	// defaultEnvoyPublicListenerPort is the port of the public listener of the Envoy proxy.
+	// Multi-port pods run one Envoy per service and offset this port by the service index.
+	defaultEnvoyPublicListenerPort = 20000
 )
 
 type EndpointsController struct {
@@ -95,12 +108,33 @@ type EndpointsController struct {
 	// TProxyOverwriteProbes controls whether the endpoints controller should expose pod's HTTP probes
 	// via Envoy proxy.
 	TProxyOverwriteProbes bool
+	// EnableProbeChecks controls whether the endpoints controller registers Consul checks for
+	// the HTTP and TCP readiness and liveness probes of pods by default.
+	EnableProbeChecks bool
+	// EnableEndpointSlices makes the controller reconcile Kubernetes services based on their
+	// EndpointSlices instead of their Endpoints.
+	EnableEndpointSlices bool
+	// DeregistrationDrainDelay is how long service instances that are no longer endpoints of their
+	// Kubernetes service are kept registered with a critical health check before they're deregistered,
+	// so that traffic shifts away from them first. Instances are deregistered earlier if their pod is
+	// deleted. If zero, instances are deregistered right away.
+	DeregistrationDrainDelay time.Duration
 
 	MetricsConfig MetricsConfig
-	Log           logr.Logger
+	// ProxyConfig contains the configuration of the public listener of the proxy and its check.
+	// It must be the same as the handler's so that the Envoy sidecar listens on the registered port.
+	ProxyConfig ProxyConfig
+	Log         logr.Logger
 
 	Scheme *runtime.Scheme
 	context.Context
+
+	// drainingInstances are the service instances that are being drained.
+	drainingInstances drainingInstances
+	// agentClients are the Consul API clients of the agents.
+	agentClients agentClientPool
+	// agentInstances are the nodes whose agents hold the instances of each Kubernetes service.
+	agentInstances agentInstanceIndex
 }
 
 func (r *EndpointsController) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
@@ -111,6 +145,12 @@ func (r *EndpointsController) Reconcile(ctx context.Context, req ctrl.Request) (
 		return ctrl.Result{}, nil
 	}
 
+	// Requests are for Kubernetes services in both modes. With EndpointSlices, the request
+	// name is the name of the service rather than of its Endpoints, which is the same.
+	if r.EnableEndpointSlices {
+		return r.reconcileEndpointSlices(ctx, req)
+	}
+
 	err := r.Client.Get(ctx, req.NamespacedName, &serviceEndpoints)
 
 	// If the endpoints object has been deleted (and we get an IsNotFound
@@ -121,7 +161,7 @@ func (r *EndpointsController) Reconcile(ctx context.Context, req ctrl.Request) (
 		if err = r.deregisterServiceOnAllAgents(ctx, req.Name, req.Namespace, nil); err != nil {
 			return ctrl.Result{}, err
 		}
-		return ctrl.Result{}, nil
+		return ctrl.Result{RequeueAfter: r.drainingInstances.requeueAfter(req.Name, req.Namespace)}, nil
 	} else if err != nil {
 		r.Log.Error(err, "failed to get Endpoints", "name", req.Name, "ns", req.Namespace)
 		return ctrl.Result{}, err
@@ -147,7 +187,7 @@ func (r *EndpointsController) Reconcile(ctx context.Context, req ctrl.Request) (
 
 		for address, healthStatus := range allAddresses {
 			if address.TargetRef != nil && address.TargetRef.Kind == "Pod" {
-				if err := r.registerServicesAndHealthCheck(ctx, serviceEndpoints, address, healthStatus, endpointAddressMap); err != nil {
+				if err := r.registerServicesAndHealthCheck(ctx, serviceEndpoints, address, healthStatus, "", endpointAddressMap); err != nil {
 					r.Log.Error(err, "failed to register services or health check", "name", serviceEndpoints.Name, "ns", serviceEndpoints.Namespace)
 					errs = multierror.Append(errs, err)
 				}
@@ -163,7 +203,8 @@ func (r *EndpointsController) Reconcile(ctx context.Context, req ctrl.Request) (
 		errs = multierror.Append(errs, err)
 	}
 
-	return ctrl.Result{}, errs
+	// Reconcile again once the instances being drained can be deregistered.
+	return ctrl.Result{RequeueAfter: r.drainingInstances.requeueAfter(serviceEndpoints.Name, serviceEndpoints.Namespace)}, errs
 }
 
 func (r *EndpointsController) Logger(name types.NamespacedName) logr.Logger {
@@ -171,18 +212,48 @@ func (r *EndpointsController) Logger(name types.NamespacedName) logr.Logger {
 }
 
 func (r *EndpointsController) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&corev1.Endpoints{}).
-		Watches(
-			&source.Kind{Type: &corev1.Pod{}},
-			handler.EnqueueRequestsFromMapFunc(r.requestsForRunningAgentPods),
-			builder.WithPredicates(predicate.NewPredicateFuncs(r.filterAgentPods)),
-		).Complete(r)
+	var b *builder.Builder
+	if r.EnableEndpointSlices {
+		b = ctrl.NewControllerManagedBy(mgr).
+			For(&corev1.Service{}).
+			Watches(
+				&source.Kind{Type: &discoveryv1beta1.EndpointSlice{}},
+				handler.EnqueueRequestsFromMapFunc(r.requestsForEndpointSlice),
+			)
+	} else {
+		b = ctrl.NewControllerManagedBy(mgr).
+			For(&corev1.Endpoints{})
+	}
+	// Pods selected by several Kubernetes services are registered for one of them, which is
+	// chosen again whenever the services that select a pod or its annotation change.
+	b = b.Watches(
+		&source.Kind{Type: &corev1.Service{}},
+		handler.EnqueueRequestsFromMapFunc(r.requestsForServicesSelectingPodsOfService),
+		builder.WithPredicates(primaryServiceServicePredicate),
+	).Watches(
+		&source.Kind{Type: &corev1.Pod{}},
+		handler.EnqueueRequestsFromMapFunc(r.requestsForServicesSelectingPod),
+		builder.WithPredicates(primaryServicePodPredicate),
+	)
+	b = b.Watches(
+		&source.Kind{Type: &corev1.Pod{}},
+		handler.EnqueueRequestsFromMapFunc(r.requestsForRunningAgentPods),
+		builder.WithPredicates(predicate.NewPredicateFuncs(r.filterAgentPods)),
+	)
+	// Like the controller, the lookup only runs on the leader, once the caches are synced.
+	if err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		r.warmAgentInstanceIndex(ctx)
+		return nil
+	})); err != nil {
+		return err
+	}
+	return b.Complete(r)
 }
 
 // registerServicesAndHealthCheck creates Consul registrations for the service and proxy and register them with Consul.
 // It also upserts a Kubernetes health check for the service based on whether the endpoint address is ready.
-func (r *EndpointsController) registerServicesAndHealthCheck(ctx context.Context, serviceEndpoints corev1.Endpoints, address corev1.EndpointAddress, healthStatus string, endpointAddressMap map[string]bool) error {
+// The zone of the endpoint is only known from EndpointSlices and is empty for Endpoints.
+func (r *EndpointsController) registerServicesAndHealthCheck(ctx context.Context, serviceEndpoints corev1.Endpoints, address corev1.EndpointAddress, healthStatus, zone string, endpointAddressMap map[string]bool) error {
 	// Get pod associated with this address.
 	var pod corev1.Pod
 	objectKey := types.NamespacedName{Name: address.TargetRef.Name, Namespace: address.TargetRef.Namespace}
@@ -193,8 +264,37 @@ func (r *EndpointsController) registerServicesAndHealthCheck(ctx context.Context
 	podHostIP := pod.Status.HostIP
 
 	if hasBeenInjected(pod) {
-		// Build the endpointAddressMap up for deregistering service instances later.
+		// Pods that stop their sidecars when the application exits are left out of the
+		// endpointAddressMap once the application has exited so that they're deregistered
+		// instead of being left critical in Consul.
+		if appExited(pod) {
+			r.Log.Info("skipping registration because the application has exited", "name", pod.Name, "ns", pod.Namespace)
+			return nil
+		}
+		// Pods that register a single Consul service are only registered for one of the Kubernetes
+		// services that select them. They're left out of the endpointAddressMap of the others so that
+		// their instances for those services are deregistered.
+		if pod.Labels[keyManagedBy] == managedByValue && !isMultiPort(pod) && !isServicelessEndpoints(serviceEndpoints) {
+			primary, selecting, err := r.primaryKubernetesService(ctx, pod)
+			if err != nil {
+				r.Log.Error(err, "failed to get Kubernetes services of pod", "name", pod.Name, "ns", pod.Namespace)
+				return err
+			}
+			if err := r.updateServiceConflictCondition(ctx, pod, primary, selecting); err != nil {
+				r.Log.Error(err, "failed to update Kubernetes service conflict condition of pod", "name", pod.Name, "ns", pod.Namespace)
+			}
+			if primary != "" && primary != serviceEndpoints.Name {
+				r.Log.Info("skipping pod because it is registered for another Kubernetes service",
+					"name", pod.Name, "ns", pod.Namespace, "endpoints", serviceEndpoints.Name, "k8s-service", primary)
+				return nil
+			}
+		}
+		// Build the endpointAddressMap up for deregistering service instances later. Pods on
+		// dual-stack clusters have an IP of each family, and all of them belong to the pod.
 		endpointAddressMap[pod.Status.PodIP] = true
+		for _, podIP := range pod.Status.PodIPs {
+			endpointAddressMap[podIP.IP] = true
+		}
 		// Create client for Consul agent local to the pod.
 		client, err := r.remoteConsulClient(podHostIP, r.consulNamespace(pod.Namespace))
 		if err != nil {
@@ -202,57 +302,38 @@ func (r *EndpointsController) registerServicesAndHealthCheck(ctx context.Context
 			return err
 		}
 
+		// Multi-port pods register a Consul service for each of the Kubernetes services
+		// listed in their annotation. Skip the pod if it doesn't list this one.
+		if _, ok, err := endpointsMultiPortInfo(pod, serviceEndpoints); err != nil {
+			r.Log.Error(err, "failed to determine services of multi-port pod", "name", pod.Name, "ns", pod.Namespace)
+			return err
+		} else if !ok {
+			r.Log.Info("skipping multi-port pod because it does not register a service for these endpoints",
+				"name", pod.Name, "ns", pod.Namespace, "endpoints", serviceEndpoints.Name)
+			return nil
+		}
+
 		var managedByEndpointsController bool
 		if raw, ok := pod.Labels[keyManagedBy]; ok && raw == managedByValue {
 			managedByEndpointsController = true
 		}
 		// For pods managed by this controller, create and register the service instance.
 		if managedByEndpointsController {
-			// Get information from the pod to create service instance registrations.
-			serviceRegistration, proxyServiceRegistration, err := r.createServiceRegistrations(pod, serviceEndpoints)
-			if err != nil {
-				r.Log.Error(err, "failed to create service registrations for endpoints", "name", serviceEndpoints.Name, "ns", serviceEndpoints.Namespace)
-				return err
+			// The node is recorded first so that its agent is queried when the service's instances are
+			// deregistered, even if the registration fails after the agent got some of them.
+			if !isServicelessEndpoints(serviceEndpoints) {
+				r.agentInstances.add(types.NamespacedName{Name: serviceEndpoints.Name, Namespace: serviceEndpoints.Namespace}, pod.Spec.NodeName)
 			}
-
-			// When Consul namespaces are not enabled, we check that the service with the same name but in a different namespace
-			// is already registered with Consul, and if it is, we skip the registration to avoid service name collisions.
-			if !r.EnableConsulNamespaces {
-				services, _, err := client.Catalog().Service(serviceRegistration.Name, "", nil)
-				if err != nil {
-					r.Log.Error(err, "failed to get service from the Consul catalog", "name", serviceRegistration.Name)
-					return err
-				}
-				for _, service := range services {
-					if service.ServiceMeta[MetaKeyKubeNS] != serviceEndpoints.Namespace {
-						// Log but don't return an error because we don't want to reconcile this endpoints object again.
-						r.Log.Info("Skipping service registration because a service with the same name "+
-							"but a different Kubernetes namespace is already registered with Consul",
-							"name", serviceRegistration.Name,
-							MetaKeyKubeNS, serviceEndpoints.Namespace,
-							"existing-k8s-namespace", service.ServiceMeta[MetaKeyKubeNS])
-						return nil
-					}
-				}
+			err = r.registerServices(client, pod, serviceEndpoints, address, healthStatus, zone)
+			// The result of the registration is reflected in the pod's readiness gate, if it has one.
+			if condErr := r.updateRegisteredCondition(ctx, client, pod, err); condErr != nil {
+				r.Log.Error(condErr, "failed to update registered condition of pod", "name", pod.Name, "ns", pod.Namespace)
 			}
-
-			// Register the service instance with the local agent.
-			// Note: the order of how we register services is important,
-			// and the connect-proxy service should come after the "main" service
-			// because its alias health check depends on the main service existing.
-			r.Log.Info("registering service with Consul", "name", serviceRegistration.Name,
-				"id", serviceRegistration.ID, "agentIP", podHostIP)
-			err = client.Agent().ServiceRegister(serviceRegistration)
-			if err != nil {
-				r.Log.Error(err, "failed to register service", "name", serviceRegistration.Name)
-				return err
-			}
-
-			// Register the proxy service instance with the local agent.
-			r.Log.Info("registering proxy service with Consul", "name", proxyServiceRegistration.Name)
-			err = client.Agent().ServiceRegister(proxyServiceRegistration)
-			if err != nil {
-				r.Log.Error(err, "failed to register proxy service", "name", proxyServiceRegistration.Name)
+			var collisionErr serviceNameCollisionError
+			if errors.As(err, &collisionErr) {
+				// Don't return an error because we don't want to reconcile this endpoints object again.
+				return nil
+			} else if err != nil {
 				return err
 			}
 		}
@@ -272,8 +353,91 @@ func (r *EndpointsController) registerServicesAndHealthCheck(ctx context.Context
 			r.Log.Error(err, "failed to update health check status for service", "name", serviceName)
 			return err
 		}
+
+		// Checks derived from the pod's probes are part of the registration of services
+		// managed by the endpoints controller.
+		if managedByEndpointsController {
+			err = r.upsertProbeChecks(pod, client, serviceID)
+			if err != nil {
+				r.Log.Error(err, "failed to update probe checks for service", "name", serviceName)
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// serviceNameCollisionError is returned when a service isn't registered because a service with the
+// same name from a different Kubernetes namespace is already registered with Consul.
+type serviceNameCollisionError struct {
+	name         string
+	k8sNamespace string
+}
+
+func (e serviceNameCollisionError) Error() string {
+	return fmt.Sprintf("a service named %q from Kubernetes namespace %q is already registered with Consul", e.name, e.k8sNamespace)
+}
+
+// registerServices creates the service and proxy registrations for the pod and registers them with
+// the Consul agent the client points at.
+func (r *EndpointsController) registerServices(client *api.Client, pod corev1.Pod, serviceEndpoints corev1.Endpoints, address corev1.EndpointAddress, healthStatus, zone string) error {
+	// Get information from the pod to create service instance registrations.
+	serviceRegistration, proxyServiceRegistration, err := r.createServiceRegistrations(pod, serviceEndpoints)
+	if err != nil {
+		r.Log.Error(err, "failed to create service registrations for endpoints", "name", serviceEndpoints.Name, "ns", serviceEndpoints.Namespace)
+		return err
+	}
+	// The service and proxy registrations share their metadata.
+	if address.Hostname != "" {
+		serviceRegistration.Meta[MetaKeyKubeHostname] = address.Hostname
+	}
+	if zone != "" {
+		serviceRegistration.Meta[MetaKeyKubeZone] = zone
+	}
+
+	// When Consul namespaces are not enabled, we check that the service with the same name but in a different namespace
+	// is already registered with Consul, and if it is, we skip the registration to avoid service name collisions.
+	if !r.EnableConsulNamespaces {
+		services, _, err := client.Catalog().Service(serviceRegistration.Name, "", nil)
+		if err != nil {
+			r.Log.Error(err, "failed to get service from the Consul catalog", "name", serviceRegistration.Name)
+			return err
+		}
+		for _, service := range services {
+			if service.ServiceMeta[MetaKeyKubeNS] != serviceEndpoints.Namespace {
+				r.Log.Info("Skipping service registration because a service with the same name "+
+					"but a different Kubernetes namespace is already registered with Consul",
+					"name", serviceRegistration.Name,
+					MetaKeyKubeNS, serviceEndpoints.Namespace,
+					"existing-k8s-namespace", service.ServiceMeta[MetaKeyKubeNS])
+				return serviceNameCollisionError{name: serviceRegistration.Name, k8sNamespace: service.ServiceMeta[MetaKeyKubeNS]}
+			}
+		}
+	}
+
+	// Register the service instance with the local agent.
+	// Note: the order of how we register services is important,
+	// and the connect-proxy service should come after the "main" service
+	// because its alias health check depends on the main service existing.
+	r.Log.Info("registering service with Consul", "name", serviceRegistration.Name,
+		"id", serviceRegistration.ID, "agentIP", pod.Status.HostIP)
+	err = client.Agent().ServiceRegister(serviceRegistration)
+	if err != nil {
+		r.Log.Error(err, "failed to register service", "name", serviceRegistration.Name)
+		return err
 	}
 
+	// Register the proxy service instance with the local agent. Connect native
+	// services don't have one.
+	if proxyServiceRegistration != nil {
+		r.Log.Info("registering proxy service with Consul", "name", proxyServiceRegistration.Name)
+		err = client.Agent().ServiceRegister(proxyServiceRegistration)
+		if err != nil {
+			r.Log.Error(err, "failed to register proxy service", "name", proxyServiceRegistration.Name)
+			return err
+		}
+	}
 	return nil
 }
 
@@ -361,6 +525,10 @@ func (r *EndpointsController) upsertHealthCheck(pod corev1.Pod, client *api.Clie
 
 func getServiceName(pod corev1.Pod, serviceEndpoints corev1.Endpoints) string {
 	serviceName := serviceEndpoints.Name
+	// On multi-port pods the Consul service names must match the Kubernetes service names.
+	if isMultiPort(pod) {
+		return serviceName
+	}
 	if serviceNameFromAnnotation, ok := pod.Annotations[annotationService]; ok && serviceNameFromAnnotation != "" {
 		serviceName = serviceNameFromAnnotation
 	}
@@ -384,11 +552,26 @@ func getProxyServiceID(pod corev1.Pod, serviceEndpoints corev1.Endpoints) string
 // createServiceRegistrations creates the service and proxy service instance registrations with the information from the
 // Pod.
 func (r *EndpointsController) createServiceRegistrations(pod corev1.Pod, serviceEndpoints corev1.Endpoints) (*api.AgentServiceRegistration, *api.AgentServiceRegistration, error) {
+	mpi, ok, err := endpointsMultiPortInfo(pod, serviceEndpoints)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		return nil, nil, fmt.Errorf("multi-port pod %q does not register a service for endpoints %q", pod.Name, serviceEndpoints.Name)
+	}
+
 	// If a port is specified, then we determine the value of that port
 	// and register that port for the host service.
 	// The handler will always set the port annotation if one is not provided on the pod.
+	// Multi-port pods use the port listed for the service in the annotation.
 	var consulServicePort int
-	if raw, ok := pod.Annotations[annotationPort]; ok && raw != "" {
+	if mpi.serviceName != "" {
+		port, err := portValue(pod, mpi.servicePort)
+		if err != nil {
+			return nil, nil, err
+		}
+		consulServicePort = int(port)
+	} else if raw, ok := pod.Annotations[annotationPort]; ok && raw != "" {
 		if port, err := portValue(pod, raw); port > 0 {
 			if err != nil {
 				return nil, nil, err
@@ -411,6 +594,12 @@ func (r *EndpointsController) createServiceRegistrations(pod corev1.Pod, service
 		MetaKeyKubeNS:          serviceEndpoints.Namespace,
 		MetaKeyManagedBy:       managedByValue,
 	}
+	// Pods that no Kubernetes service selects are registered without one so that their instances
+	// aren't deregistered by the reconcile of a Kubernetes service with the same name.
+	if isServicelessEndpoints(serviceEndpoints) {
+		delete(meta, MetaKeyKubeServiceName)
+		meta[MetaKeyServiceless] = "true"
+	}
 	for k, v := range pod.Annotations {
 		if strings.HasPrefix(k, annotationMeta) && strings.TrimPrefix(k, annotationMeta) != "" {
 			meta[strings.TrimPrefix(k, annotationMeta)] = v
@@ -433,10 +622,31 @@ func (r *EndpointsController) createServiceRegistrations(pod corev1.Pod, service
 		Address:   pod.Status.PodIP,
 		Meta:      meta,
 		Namespace: r.consulNamespace(pod.Namespace),
+		// Dual-stack pods also register the address of their secondary IP family.
+		TaggedAddresses: podTaggedAddresses(pod, consulServicePort),
 	}
 	if len(tags) > 0 {
 		service.Tags = tags
 	}
+	weights, err := serviceWeights(pod)
+	if err != nil {
+		return nil, nil, err
+	}
+	service.Weights = weights
+	service.TaggedAddresses, err = withAnnotatedTaggedAddresses(pod, service.TaggedAddresses, consulServicePort)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Connect native services handle Connect themselves and have no proxy service.
+	native, err := connectNative(pod)
+	if err != nil {
+		return nil, nil, err
+	}
+	if native {
+		service.Connect = &api.AgentServiceConnect{Native: true}
+		return service, nil, nil
+	}
 
 	proxyServiceName := getProxyServiceName(pod, serviceEndpoints)
 	proxyServiceID := getProxyServiceID(pod, serviceEndpoints)
@@ -446,9 +656,18 @@ func (r *EndpointsController) createServiceRegistrations(pod corev1.Pod, service
 		Config:                 make(map[string]interface{}),
 	}
 
-	// If metrics are enabled, the proxyConfig should set envoy_prometheus_bind_addr to a listener on 0.0.0.0 on
-	// the prometheusScrapePort that points to a metrics backend. The backend for this listener will be determined by
-	// the envoy bootstrapping command (consul connect envoy) configuration in the init container. If there is a merged
+	// Settings can be defaulted for an entire namespace. They're resolved the same way
+	// as in the handler so that the pod is registered with the settings it was injected with.
+	var ns corev1.Namespace
+	err = r.Client.Get(r.Context, types.NamespacedName{Name: pod.Namespace, Namespace: ""}, &ns)
+	if err != nil {
+		return nil, nil, err
+	}
+	pod = withNamespaceDefaults(ns, pod)
+
+	// If metrics are enabled, the proxyConfig should set envoy_prometheus_bind_addr to a listener on 0.0.0.0 (:: on IPv6
+	// pods) on the prometheusScrapePort that points to a metrics backend. The backend for this listener will be determined
+	// by the envoy bootstrapping command (consul connect envoy) configuration in the init container. If there is a merged
 	// metrics server, the backend would be that server. If we are not running the merged metrics server, the backend
 	// should just be the Envoy metrics endpoint.
 	enableMetrics, err := r.MetricsConfig.enableMetrics(pod)
@@ -460,37 +679,50 @@ func (r *EndpointsController) createServiceRegistrations(pod corev1.Pod, service
 		if err != nil {
 			return nil, nil, err
 		}
-		prometheusScrapeListener := fmt.Sprintf("0.0.0.0:%s", prometheusScrapePort)
+		prometheusScrapeListener := net.JoinHostPort(wildcardAddress(pod), prometheusScrapePort)
+		// Every Envoy on a multi-port pod needs its own metrics listener.
+		if mpi.serviceIndex > 0 {
+			port, err := strconv.Atoi(prometheusScrapePort)
+			if err != nil {
+				return nil, nil, err
+			}
+			prometheusScrapeListener = net.JoinHostPort(wildcardAddress(pod), strconv.Itoa(port+mpi.serviceIndex))
+		}
 		proxyConfig.Config[envoyPrometheusBindAddr] = prometheusScrapeListener
 	}
 
 	if consulServicePort > 0 {
-		proxyConfig.LocalServiceAddress = "127.0.0.1"
+		proxyConfig.LocalServiceAddress = loopbackAddress(pod)
 		proxyConfig.LocalServicePort = consulServicePort
 	}
 
-	upstreams, err := r.processUpstreams(pod)
+	upstreams, err := r.processUpstreams(pod, mpi)
 	if err != nil {
 		return nil, nil, err
 	}
 	proxyConfig.Upstreams = upstreams
 
+	publicListenerPort, err := r.ProxyConfig.publicListenerPort(pod)
+	if err != nil {
+		return nil, nil, err
+	}
+	proxyPort := publicListenerPort + mpi.serviceIndex
+	proxyCheck, err := r.ProxyConfig.publicListenerCheck(pod, proxyPort)
+	if err != nil {
+		return nil, nil, err
+	}
 	proxyService := &api.AgentServiceRegistration{
-		Kind:      api.ServiceKindConnectProxy,
-		ID:        proxyServiceID,
-		Name:      proxyServiceName,
-		Port:      20000,
-		Address:   pod.Status.PodIP,
-		Meta:      meta,
-		Namespace: r.consulNamespace(pod.Namespace),
-		Proxy:     proxyConfig,
+		Kind:            api.ServiceKindConnectProxy,
+		ID:              proxyServiceID,
+		Name:            proxyServiceName,
+		Port:            proxyPort,
+		Address:         pod.Status.PodIP,
+		Meta:            meta,
+		Namespace:       r.consulNamespace(pod.Namespace),
+		Proxy:           proxyConfig,
+		TaggedAddresses: podTaggedAddresses(pod, proxyPort),
 		Checks: api.AgentServiceChecks{
-			{
-				Name:                           "Proxy Public Listener",
-				TCP:                            fmt.Sprintf("%s:20000", pod.Status.PodIP),
-				Interval:                       "10s",
-				DeregisterCriticalServiceAfter: "10m",
-			},
+			proxyCheck,
 			{
 				Name:         "Destination Alias",
 				AliasService: serviceID,
@@ -500,10 +732,8 @@ func (r *EndpointsController) createServiceRegistrations(pod corev1.Pod, service
 	if len(tags) > 0 {
 		proxyService.Tags = tags
 	}
-
-	// A user can enable/disable tproxy for an entire namespace.
-	var ns corev1.Namespace
-	err = r.Client.Get(r.Context, types.NamespacedName{Name: pod.Namespace, Namespace: ""}, &ns)
+	proxyService.Weights = weights
+	proxyService.TaggedAddresses, err = withAnnotatedTaggedAddresses(pod, proxyService.TaggedAddresses, proxyPort)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -514,105 +744,119 @@ func (r *EndpointsController) createServiceRegistrations(pod corev1.Pod, service
 	}
 
 	if tproxyEnabled {
-		var k8sService corev1.Service
+		// Pods that no Kubernetes service selects have no cluster IP to sync, but their
+		// proxy still captures the pod's outbound traffic.
+		if isServicelessEndpoints(serviceEndpoints) {
+			proxyService.Proxy.Mode = api.ProxyModeTransparent
+		} else if err := r.syncClusterIP(pod, serviceEndpoints, consulServicePort, service, proxyService); err != nil {
+			return nil, nil, err
+		}
 
-		err := r.Client.Get(r.Context, types.NamespacedName{Name: serviceEndpoints.Name, Namespace: serviceEndpoints.Namespace}, &k8sService)
+		// Expose k8s probes as Envoy listeners if needed.
+		overwriteProbes, err := shouldOverwriteProbes(pod, r.TProxyOverwriteProbes)
 		if err != nil {
 			return nil, nil, err
 		}
-
-		// Check if the service has a valid IP.
-		parsedIP := net.ParseIP(k8sService.Spec.ClusterIP)
-		if parsedIP != nil {
-			taggedAddresses := make(map[string]api.ServiceAddress)
-
-			// When a service has multiple ports, we need to choose the port that is registered with Consul
-			// and only set that port as the tagged address because Consul currently does not support multiple port
-			// on a single service.
-			var k8sServicePort int32
-			for _, sp := range k8sService.Spec.Ports {
-				// If target port is a name, then we need to find the port value from the pod.
-				if sp.TargetPort.Type == intstr.String {
-					targetPortValue, err := portValue(pod, sp.TargetPort.StrVal)
+		if overwriteProbes {
+			// The handler pointed the HTTP probes of the application containers to Envoy
+			// listeners and recorded their original ports.
+			firstAppContainer := appContainerIndex(pod)
+			for i := range pod.Spec.Containers {
+				container := &pod.Spec.Containers[i]
+				if isInjectedContainer(container.Name) {
+					continue
+				}
+				for _, p := range containerProbes(container) {
+					if p.probe == nil || p.probe.HTTPGet == nil {
+						continue
+					}
+					raw, ok := pod.Annotations[originalProbePortAnnotation(p.kind, container.Name, i == firstAppContainer)]
+					if !ok {
+						continue
+					}
+					originalPort, err := strconv.Atoi(raw)
 					if err != nil {
 						return nil, nil, err
 					}
 
-					// If the targetPortValue is the consulServicePort, then this is the service port we'll use as the tagged address.
-					if targetPortValue == int32(consulServicePort) {
-						k8sServicePort = sp.Port
-						break
-					}
-				} else if sp.TargetPort.Type == intstr.Int && sp.TargetPort.IntVal != 0 {
-					// If the target port is a non-zero int, we can compare that port directly with the Consul service port.
-					if sp.TargetPort.IntVal == int32(consulServicePort) {
-						k8sServicePort = sp.Port
-						break
-					}
-				} else {
-					// If targetPort is not specified, then the service port is used as the target port,
-					// and we can compare the service port with the Consul service port.
-					if sp.Port == int32(consulServicePort) {
-						k8sServicePort = sp.Port
-						break
-					}
+					proxyConfig.Expose.Paths = append(proxyConfig.Expose.Paths, api.ExposePath{
+						ListenerPort:  p.probe.HTTPGet.Port.IntValue(),
+						LocalPathPort: originalPort,
+						Path:          p.probe.HTTPGet.Path,
+					})
 				}
 			}
+		}
+	}
 
-			taggedAddresses[clusterIPTaggedAddressName] = api.ServiceAddress{
-				Address: k8sService.Spec.ClusterIP,
-				Port:    int(k8sServicePort),
-			}
+	return service, proxyService, nil
+}
 
-			service.TaggedAddresses = taggedAddresses
-			proxyService.TaggedAddresses = taggedAddresses
+// syncClusterIP adds the cluster IP of the Kubernetes service and the service port of the
+// registered port as the virtual tagged address of the service and the proxy, and puts the proxy
+// in transparent mode. Services without a cluster IP, e.g. headless services, are skipped.
+func (r *EndpointsController) syncClusterIP(pod corev1.Pod, serviceEndpoints corev1.Endpoints, consulServicePort int, service, proxyService *api.AgentServiceRegistration) error {
+	var k8sService corev1.Service
 
-			proxyService.Proxy.Mode = api.ProxyModeTransparent
-		} else {
-			r.Log.Info("skipping syncing service cluster IP to Consul", "name", k8sService.Name, "ns", k8sService.Namespace, "ip", k8sService.Spec.ClusterIP)
-		}
+	err := r.Client.Get(r.Context, types.NamespacedName{Name: serviceEndpoints.Name, Namespace: serviceEndpoints.Namespace}, &k8sService)
+	if err != nil {
+		return err
+	}
 
-		// Expose k8s probes as Envoy listeners if needed.
-		overwriteProbes, err := shouldOverwriteProbes(pod, r.TProxyOverwriteProbes)
-		if err != nil {
-			return nil, nil, err
-		}
-		if overwriteProbes {
-			if cs := pod.Spec.Containers; len(cs) > 0 {
-				appContainer := cs[0]
-				if appContainer.LivenessProbe != nil && appContainer.LivenessProbe.HTTPGet != nil {
-					if raw, ok := pod.Annotations[annotationOriginalLivenessProbePort]; ok {
-						originalLivenessPort, err := strconv.Atoi(raw)
-						if err != nil {
-							return nil, nil, err
-						}
-
-						proxyConfig.Expose.Paths = append(proxyConfig.Expose.Paths, api.ExposePath{
-							ListenerPort:  appContainer.LivenessProbe.HTTPGet.Port.IntValue(),
-							LocalPathPort: originalLivenessPort,
-							Path:          appContainer.LivenessProbe.HTTPGet.Path,
-						})
-					}
+	// Check if the service has a valid IP.
+	parsedIP := net.ParseIP(k8sService.Spec.ClusterIP)
+	if parsedIP != nil {
+		// When a service has multiple ports, we need to choose the port that is registered with Consul
+		// and only set that port as the tagged address because Consul currently does not support multiple port
+		// on a single service.
+		var k8sServicePort int32
+		for _, sp := range k8sService.Spec.Ports {
+			// If target port is a name, then we need to find the port value from the pod.
+			if sp.TargetPort.Type == intstr.String {
+				targetPortValue, err := portValue(pod, sp.TargetPort.StrVal)
+				if err != nil {
+					return err
 				}
-				if appContainer.ReadinessProbe != nil && appContainer.ReadinessProbe.HTTPGet != nil {
-					if raw, ok := pod.Annotations[annotationOriginalReadinessProbePort]; ok {
-						originalReadinessPort, err := strconv.Atoi(raw)
-						if err != nil {
-							return nil, nil, err
-						}
-
-						proxyConfig.Expose.Paths = append(proxyConfig.Expose.Paths, api.ExposePath{
-							ListenerPort:  appContainer.ReadinessProbe.HTTPGet.Port.IntValue(),
-							LocalPathPort: originalReadinessPort,
-							Path:          appContainer.ReadinessProbe.HTTPGet.Path,
-						})
-					}
+
+				// If the targetPortValue is the consulServicePort, then this is the service port we'll use as the tagged address.
+				if targetPortValue == int32(consulServicePort) {
+					k8sServicePort = sp.Port
+					break
+				}
+			} else if sp.TargetPort.Type == intstr.Int && sp.TargetPort.IntVal != 0 {
+				// If the target port is a non-zero int, we can compare that port directly with the Consul service port.
+				if sp.TargetPort.IntVal == int32(consulServicePort) {
+					k8sServicePort = sp.Port
+					break
+				}
+			} else {
+				// If targetPort is not specified, then the service port is used as the target port,
+				// and we can compare the service port with the Consul service port.
+				if sp.Port == int32(consulServicePort) {
+					k8sServicePort = sp.Port
+					break
 				}
 			}
 		}
-	}
 
-	return service, proxyService, nil
+		virtualAddress := api.ServiceAddress{
+			Address: k8sService.Spec.ClusterIP,
+			Port:    int(k8sServicePort),
+		}
+		if service.TaggedAddresses == nil {
+			service.TaggedAddresses = make(map[string]api.ServiceAddress)
+		}
+		if proxyService.TaggedAddresses == nil {
+			proxyService.TaggedAddresses = make(map[string]api.ServiceAddress)
+		}
+		service.TaggedAddresses[clusterIPTaggedAddressName] = virtualAddress
+		proxyService.TaggedAddresses[clusterIPTaggedAddressName] = virtualAddress
+
+		proxyService.Proxy.Mode = api.ProxyModeTransparent
+	} else {
+		r.Log.Info("skipping syncing service cluster IP to Consul", "name", k8sService.Name, "ns", k8sService.Namespace, "ip", k8sService.Spec.ClusterIP)
+	}
+	return nil
 }
 
 // getConsulHealthCheckID deterministically generates a health check ID that will be unique to the Agent
@@ -641,8 +885,148 @@ func getHealthCheckStatusReason(healthCheckStatus, podName, podNamespace string)
 // The argument endpointsAddressesMap decides whether to deregister *all* service instances or selectively deregister
 // them only if they are not in endpointsAddressesMap. If the map is nil, it will deregister all instances. If the map
 // has addresses, it will only deregister instances not in the map.
+// If a drain delay is configured, instances are drained before they're deregistered, see drainInstance.
+// Once all agents have been queried for the service, only the agents on the nodes that the
+// agentInstances index has for it are queried.
 func (r *EndpointsController) deregisterServiceOnAllAgents(ctx context.Context, k8sSvcName, k8sSvcNamespace string, endpointsAddressesMap map[string]bool) error {
-	// Get all agents by getting pods with label component=client, app=consul and release=<ReleaseName>
+	agents, err := r.consulAgentPods(ctx)
+	if err != nil {
+		r.Log.Error(err, "failed to get Consul client agent pods")
+		return err
+	}
+
+	k8sService := types.NamespacedName{Name: k8sSvcName, Namespace: k8sSvcNamespace}
+	indexedNodes, indexed := r.agentInstances.lookup(k8sService)
+	// remainingNodes are the nodes whose agents still hold instances of the service once this is done.
+	// Indexed nodes without an agent pod right now are kept so that they're queried once it's back.
+	remainingNodes := make(map[string]bool)
+	for node := range indexedNodes {
+		remainingNodes[node] = true
+	}
+	for _, agent := range agents.Items {
+		if indexed && !indexedNodes[agent.Spec.NodeName] {
+			continue
+		}
+		delete(remainingNodes, agent.Spec.NodeName)
+		remaining, err := r.deregisterServiceOnAgent(ctx, agent, k8sSvcName, k8sSvcNamespace, endpointsAddressesMap)
+		if err != nil {
+			return err
+		}
+		if remaining {
+			remainingNodes[agent.Spec.NodeName] = true
+		}
+	}
+
+	// The instances of a deleted service are all gone, so its nodes no longer need to be kept.
+	if endpointsAddressesMap == nil && len(remainingNodes) == 0 {
+		r.agentInstances.forget(k8sService)
+	} else {
+		r.agentInstances.set(k8sService, remainingNodes)
+	}
+	return nil
+}
+
+// warmAgentInstanceIndex fills the agentInstances index with the nodes whose agents hold the
+// instances of each Kubernetes service, by looking up the instances managed by the controller on
+// all agents once, so that deregistrations only query the agents on those nodes right after the
+// controller starts. If an agent can't be queried, the index is left empty.
+func (r *EndpointsController) warmAgentInstanceIndex(ctx context.Context) {
+	r.agentInstances.startWarming()
+	nodes, err := r.agentInstanceNodes(ctx)
+	if err != nil {
+		r.Log.Error(err, "failed to look up the nodes of service instances, every agent is queried until they are known")
+	}
+	r.agentInstances.finishWarming(nodes)
+}
+
+// agentInstanceNodes returns the nodes whose agents hold instances managed by the controller, for
+// each Kubernetes service.
+func (r *EndpointsController) agentInstanceNodes(ctx context.Context) (map[types.NamespacedName]map[string]bool, error) {
+	agents, err := r.consulAgentPods(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Consul client agent pods: %s", err)
+	}
+	// Instances are looked up across all Consul namespaces.
+	namespace := ""
+	if r.EnableConsulNamespaces {
+		namespace = "*"
+	}
+	filter := fmt.Sprintf("Meta[%q] == %q", MetaKeyManagedBy, managedByValue)
+	nodes := make(map[types.NamespacedName]map[string]bool)
+	for _, agent := range agents.Items {
+		client, err := r.remoteConsulClient(agent.Status.PodIP, namespace)
+		if err != nil {
+			return nil, err
+		}
+		services, err := client.Agent().ServicesWithFilter(filter)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get service instances on agent %q: %s", agent.Name, err)
+		}
+		for _, svc := range services {
+			if svc.Meta[MetaKeyKubeServiceName] == "" {
+				continue
+			}
+			k8sService := types.NamespacedName{Name: svc.Meta[MetaKeyKubeServiceName], Namespace: svc.Meta[MetaKeyKubeNS]}
+			if nodes[k8sService] == nil {
+				nodes[k8sService] = make(map[string]bool)
+			}
+			nodes[k8sService][agent.Spec.NodeName] = true
+		}
+	}
+	return nodes, nil
+}
+
+// deregisterServiceOnAgent deregisters the instances of the Kubernetes service on the agent, as
+// described in deregisterServiceOnAllAgents. It returns true if instances of the service remain on
+// the agent, because they're endpoints or because they're being drained.
+func (r *EndpointsController) deregisterServiceOnAgent(ctx context.Context, agent corev1.Pod, k8sSvcName, k8sSvcNamespace string, endpointsAddressesMap map[string]bool) (bool, error) {
+	client, err := r.remoteConsulClient(agent.Status.PodIP, r.consulNamespace(k8sSvcNamespace))
+	if err != nil {
+		r.Log.Error(err, "failed to create a new Consul client", "address", agent.Status.PodIP)
+		return false, err
+	}
+
+	// Get services matching "k8s-service-name" and "k8s-namespace" metadata.
+	svcs, err := serviceInstancesForK8SServiceNameAndNamespace(k8sSvcName, k8sSvcNamespace, client)
+	if err != nil {
+		r.Log.Error(err, "failed to get service instances", "name", k8sSvcName)
+		return false, err
+	}
+
+	// Deregister each service instance that matches the metadata.
+	remaining := false
+	for svcID, serviceRegistration := range svcs {
+		// If we selectively deregister, only deregister if the address is not in the map. Otherwise, deregister
+		// every service instance.
+		if endpointsAddressesMap != nil {
+			if _, ok := endpointsAddressesMap[serviceRegistration.Address]; ok {
+				r.cancelDrain(serviceRegistration)
+				remaining = true
+				continue
+			}
+		}
+		// Instances are drained first if a drain delay is configured.
+		deregister, err := r.drainInstance(ctx, client, serviceRegistration)
+		if err != nil {
+			r.Log.Error(err, "failed to drain service instance", "id", svcID)
+			return false, err
+		}
+		if !deregister {
+			remaining = true
+			continue
+		}
+		r.Log.Info("deregistering service from consul", "svc", svcID)
+		if err = client.Agent().ServiceDeregister(svcID); err != nil {
+			r.Log.Error(err, "failed to deregister service instance", "id", svcID)
+			return false, err
+		}
+	}
+	return remaining, nil
+}
+
+// consulAgentPods returns the Consul client agent pods, i.e. the pods with the labels
+// component=client, app=consul and release=<ReleaseName>.
+func (r *EndpointsController) consulAgentPods(ctx context.Context) (corev1.PodList, error) {
 	agents := corev1.PodList{}
 	listOptions := client.ListOptions{
 		Namespace: r.ReleaseNamespace,
@@ -652,49 +1036,48 @@ func (r *EndpointsController) deregisterServiceOnAllAgents(ctx context.Context,
 			"release":   r.ReleaseName,
 		}),
 	}
-	if err := r.Client.List(ctx, &agents, &listOptions); err != nil {
-		r.Log.Error(err, "failed to get Consul client agent pods")
-		return err
-	}
+	err := r.Client.List(ctx, &agents, &listOptions)
+	return agents, err
+}
+
+// registeredInstance is a service instance registered by the controller, with the client of the
+// agent to deregister it with.
+type registeredInstance struct {
+	client  *api.Client
+	service *api.AgentService
+}
 
-	// On each agent, we need to get services matching "k8s-service-name" and "k8s-namespace" metadata.
+// registeredInstances lists the service instances in the Consul namespace that match the filter on
+// all agents. Agents that
+// can't be reached don't stop the listing of the others, and their errors are returned along with
+// the instances of the other agents.
+func (r *EndpointsController) registeredInstances(ctx context.Context, namespace, filter string) ([]registeredInstance, error) {
+	var instances []registeredInstance
+	agents, err := r.consulAgentPods(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Consul client agent pods: %s", err)
+	}
+	var errs error
 	for _, agent := range agents.Items {
-		client, err := r.remoteConsulClient(agent.Status.PodIP, r.consulNamespace(k8sSvcNamespace))
+		client, err := r.remoteConsulClient(agent.Status.PodIP, namespace)
 		if err != nil {
-			r.Log.Error(err, "failed to create a new Consul client", "address", agent.Status.PodIP)
-			return err
+			return nil, err
 		}
-
-		// Get services matching metadata.
-		svcs, err := serviceInstancesForK8SServiceNameAndNamespace(k8sSvcName, k8sSvcNamespace, client)
+		services, err := client.Agent().ServicesWithFilter(filter)
 		if err != nil {
-			r.Log.Error(err, "failed to get service instances", "name", k8sSvcName)
-			return err
+			errs = multierror.Append(errs, fmt.Errorf("failed to get service instances on agent %q: %s", agent.Name, err))
+			continue
 		}
-
-		// Deregister each service instance that matches the metadata.
-		for svcID, serviceRegistration := range svcs {
-			// If we selectively deregister, only deregister if the address is not in the map. Otherwise, deregister
-			// every service instance.
-			if endpointsAddressesMap != nil {
-				if _, ok := endpointsAddressesMap[serviceRegistration.Address]; !ok {
-					// If the service address is not in the Endpoints addresses, deregister it.
-					r.Log.Info("deregistering service from consul", "svc", svcID)
-					if err = client.Agent().ServiceDeregister(svcID); err != nil {
-						r.Log.Error(err, "failed to deregister service instance", "id", svcID)
-						return err
-					}
-				}
-			} else {
-				r.Log.Info("deregistering service from consul", "svc", svcID)
-				if err = client.Agent().ServiceDeregister(svcID); err != nil {
-					r.Log.Error(err, "failed to deregister service instance", "id", svcID)
-					return err
-				}
-			}
+		for _, svc := range services {
+			instances = append(instances, registeredInstance{client: client, service: svc})
 		}
 	}
-	return nil
+	return instances, errs
+}
+
+// deregisterInstance deregisters the service instance from its agent.
+func deregisterInstance(instance registeredInstance) error {
+	return instance.client.Agent().ServiceDeregister(instance.service.ID)
 }
 
 // serviceInstancesForK8SServiceNameAndNamespace calls Consul's ServicesWithFilter to get the list
@@ -706,71 +1089,36 @@ func serviceInstancesForK8SServiceNameAndNamespace(k8sServiceName, k8sServiceNam
 }
 
 // processUpstreams reads the list of upstreams from the Pod annotation and converts them into a list of api.Upstream
-// objects.
-func (r *EndpointsController) processUpstreams(pod corev1.Pod) ([]api.Upstream, error) {
-	var upstreams []api.Upstream
-	if raw, ok := pod.Annotations[annotationUpstreams]; ok && raw != "" {
-		for _, raw := range strings.Split(raw, ",") {
-			parts := strings.SplitN(raw, ":", 3)
-
-			var datacenter, serviceName, preparedQuery, namespace string
-			var port int32
-			if strings.TrimSpace(parts[0]) == "prepared_query" {
-				port, _ = portValue(pod, strings.TrimSpace(parts[2]))
-				preparedQuery = strings.TrimSpace(parts[1])
-			} else {
-				port, _ = portValue(pod, strings.TrimSpace(parts[1]))
-
-				// If Consul Namespaces are enabled, attempt to parse the
-				// upstream for a namespace.
-				if r.EnableConsulNamespaces {
-					pieces := strings.SplitN(parts[0], ".", 2)
-					serviceName = strings.TrimSpace(pieces[0])
-					if len(pieces) > 1 {
-						namespace = strings.TrimSpace(pieces[1])
-					}
-				} else {
-					serviceName = strings.TrimSpace(parts[0])
-				}
-
-				// parse the optional datacenter
-				if len(parts) > 2 {
-					datacenter = strings.TrimSpace(parts[2])
-
-					// Check if there's a proxy defaults config with mesh gateway
-					// mode set to local or remote. This helps users from
-					// accidentally forgetting to set a mesh gateway mode
-					// and then being confused as to why their traffic isn't
-					// routing.
-					entry, _, err := r.ConsulClient.ConfigEntries().Get(api.ProxyDefaults, api.ProxyConfigGlobal, nil)
-					if err != nil && strings.Contains(err.Error(), "Unexpected response code: 404") {
-						return []api.Upstream{}, fmt.Errorf("upstream %q is invalid: there is no ProxyDefaults config to set mesh gateway mode", raw)
-					} else if err == nil {
-						mode := entry.(*api.ProxyConfigEntry).MeshGateway.Mode
-						if mode != api.MeshGatewayModeLocal && mode != api.MeshGatewayModeRemote {
-							return []api.Upstream{}, fmt.Errorf("upstream %q is invalid: ProxyDefaults mesh gateway mode is neither %q nor %q", raw, api.MeshGatewayModeLocal, api.MeshGatewayModeRemote)
-						}
-					}
-					// NOTE: If we can't reach Consul we don't error out because
-					// that would fail the pod scheduling and this is a nice-to-have
-					// check, not something that should block during a Consul hiccup.
+// objects. On multi-port pods, only the upstreams configured for the given service are returned.
+func (r *EndpointsController) processUpstreams(pod corev1.Pod, mpi multiPortInfo) ([]api.Upstream, error) {
+	// The structured annotation and the string annotation can't both be set, which
+	// is enforced by the handler.
+	if raw, ok := serviceAnnotation(pod, annotationUpstreamsV2, mpi); ok {
+		upstreams, err := parseUpstreamsV2(pod, raw, r.EnableConsulNamespaces)
+		if err != nil {
+			return []api.Upstream{}, fmt.Errorf("%q annotation is invalid: %s", annotationUpstreamsV2, err)
+		}
+		for _, upstream := range upstreams {
+			// An explicit mesh gateway mode on the upstream takes precedence over ProxyDefaults.
+			if upstream.Datacenter != "" && upstream.MeshGateway.Mode == api.MeshGatewayModeDefault {
+				if err := r.checkMeshGatewayMode(upstream.DestinationName); err != nil {
+					return []api.Upstream{}, err
 				}
 			}
+		}
+		return upstreams, nil
+	}
 
-			if port > 0 {
-				upstream := api.Upstream{
-					DestinationType:      api.UpstreamDestTypeService,
-					DestinationNamespace: namespace,
-					DestinationName:      serviceName,
-					Datacenter:           datacenter,
-					LocalBindPort:        int(port),
-				}
-
-				if preparedQuery != "" {
-					upstream.DestinationType = api.UpstreamDestTypePreparedQuery
-					upstream.DestinationName = preparedQuery
+	var upstreams []api.Upstream
+	if raw, ok := serviceAnnotation(pod, annotationUpstreams, mpi); ok && raw != "" {
+		for _, raw := range strings.Split(raw, ",") {
+			upstream := parseUpstream(pod, raw, r.EnableConsulNamespaces)
+			if upstream.Datacenter != "" {
+				if err := r.checkMeshGatewayMode(raw); err != nil {
+					return []api.Upstream{}, err
 				}
-
+			}
+			if upstream.LocalBindPort > 0 {
 				upstreams = append(upstreams, upstream)
 			}
 		}
@@ -779,13 +1127,35 @@ func (r *EndpointsController) processUpstreams(pod corev1.Pod) ([]api.Upstream,
 	return upstreams, nil
 }
 
+// checkMeshGatewayMode returns an error if there's no proxy defaults config with mesh
+// gateway mode set to local or remote. It's used for upstreams in other datacenters
+// and helps users from accidentally forgetting to set a mesh gateway mode and then
+// being confused as to why their traffic isn't routing.
+func (r *EndpointsController) checkMeshGatewayMode(upstream string) error {
+	entry, _, err := r.ConsulClient.ConfigEntries().Get(api.ProxyDefaults, api.ProxyConfigGlobal, nil)
+	if err != nil && strings.Contains(err.Error(), "Unexpected response code: 404") {
+		return fmt.Errorf("upstream %q is invalid: there is no ProxyDefaults config to set mesh gateway mode", upstream)
+	} else if err == nil {
+		mode := entry.(*api.ProxyConfigEntry).MeshGateway.Mode
+		if mode != api.MeshGatewayModeLocal && mode != api.MeshGatewayModeRemote {
+			return fmt.Errorf("upstream %q is invalid: ProxyDefaults mesh gateway mode is neither %q nor %q", upstream, api.MeshGatewayModeLocal, api.MeshGatewayModeRemote)
+		}
+	}
+	// NOTE: If we can't reach Consul we don't error out because
+	// that would fail the pod scheduling and this is a nice-to-have
+	// check, not something that should block during a Consul hiccup.
+	return nil
+}
+
 // remoteConsulClient returns an *api.Client that points at the consul agent local to the pod for a provided namespace.
+// Clients are reused from the controller's pool.
 func (r *EndpointsController) remoteConsulClient(ip string, namespace string) (*api.Client, error) {
-	newAddr := fmt.Sprintf("%s://%s:%s", r.ConsulScheme, ip, r.ConsulPort)
-	localConfig := r.ConsulClientCfg
-	localConfig.Address = newAddr
+	// Copy the config so that clients created concurrently, e.g. by the orphan sweeper,
+	// don't change each other's address.
+	localConfig := *r.ConsulClientCfg
+	localConfig.Address = fmt.Sprintf("%s://%s:%s", r.ConsulScheme, ip, r.ConsulPort)
 	localConfig.Namespace = namespace
-	return consul.NewClient(localConfig)
+	return r.agentClients.client(localConfig)
 }
 
 // shouldIgnore ignores namespaces where we don't connect-inject.
@@ -843,36 +1213,18 @@ func (r *EndpointsController) filterAgentPods(object client.Object) bool {
 // Consul Agent that has been filtered by filterAgentPods and only enqueues endpoints
 // for client agent pods where the Ready condition is true.
 func (r *EndpointsController) requestsForRunningAgentPods(object client.Object) []ctrl.Request {
-	var consulClientPod corev1.Pod
-	r.Log.Info("received update for Consul client pod", "name", object.GetName())
-	err := r.Client.Get(r.Context, types.NamespacedName{Name: object.GetName(), Namespace: object.GetNamespace()}, &consulClientPod)
-	if k8serrors.IsNotFound(err) {
-		// Ignore if consulClientPod is not found.
-		return []ctrl.Request{}
-	}
-	if err != nil {
-		r.Log.Error(err, "failed to get Consul client pod", "name", consulClientPod.Name)
-		return []ctrl.Request{}
-	}
-	// We can ignore the agent pod if it's not running, since
-	// we can't reconcile and register/deregister services against that agent.
-	if consulClientPod.Status.Phase != corev1.PodRunning {
-		r.Log.Info("ignoring Consul client pod because it's not running", "name", consulClientPod.Name)
+	nodeName, ok := r.readyAgentPodNode(object)
+	if !ok {
 		return []ctrl.Request{}
 	}
-	// We can ignore the agent pod if it's not yet ready, since
-	// we can't reconcile and register/deregister services against that agent.
-	for _, cond := range consulClientPod.Status.Conditions {
-		if cond.Type == corev1.PodReady && cond.Status != corev1.ConditionTrue {
-			// Ignore if consulClientPod is not ready.
-			r.Log.Info("ignoring Consul client pod because it's not ready", "name", consulClientPod.Name)
-			return []ctrl.Request{}
-		}
+
+	if r.EnableEndpointSlices {
+		return r.requestsForEndpointSlicesOnNode(nodeName)
 	}
 
 	// Get the list of all endpoints.
 	var endpointsList corev1.EndpointsList
-	err = r.Client.List(r.Context, &endpointsList)
+	err := r.Client.List(r.Context, &endpointsList)
 	if err != nil {
 		r.Log.Error(err, "failed to list endpoints")
 		return []ctrl.Request{}
@@ -887,7 +1239,7 @@ func (r *EndpointsController) requestsForRunningAgentPods(object client.Object)
 			allAddresses = append(allAddresses, subset.NotReadyAddresses...)
 			for _, address := range allAddresses {
 				// Only add requests for the address that is on the same node as the consul client pod.
-				if address.NodeName != nil && *address.NodeName == consulClientPod.Spec.NodeName {
+				if address.NodeName != nil && *address.NodeName == nodeName {
 					requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: ep.Name, Namespace: ep.Namespace}})
 				}
 			}
@@ -896,12 +1248,60 @@ func (r *EndpointsController) requestsForRunningAgentPods(object client.Object)
 	return requests
 }
 
+// readyAgentPodNode returns the node of the Consul client agent pod, and whether the pod is
+// running and ready so that services can be registered with it.
+func (r *EndpointsController) readyAgentPodNode(object client.Object) (string, bool) {
+	var consulClientPod corev1.Pod
+	r.Log.Info("received update for Consul client pod", "name", object.GetName())
+	err := r.Client.Get(r.Context, types.NamespacedName{Name: object.GetName(), Namespace: object.GetNamespace()}, &consulClientPod)
+	if k8serrors.IsNotFound(err) {
+		// Ignore if consulClientPod is not found, but drop the clients of the agent.
+		if deleted, ok := object.(*corev1.Pod); ok {
+			r.agentClients.remove(deleted.Status.PodIP)
+			r.agentClients.remove(deleted.Status.HostIP)
+		}
+		return "", false
+	}
+	if err != nil {
+		r.Log.Error(err, "failed to get Consul client pod", "name", consulClientPod.Name)
+		return "", false
+	}
+	// We can ignore the agent pod if it's not running, since
+	// we can't reconcile and register/deregister services against that agent.
+	if consulClientPod.Status.Phase != corev1.PodRunning {
+		r.Log.Info("ignoring Consul client pod because it's not running", "name", consulClientPod.Name)
+		return "", false
+	}
+	// We can ignore the agent pod if it's not yet ready, since
+	// we can't reconcile and register/deregister services against that agent.
+	for _, cond := range consulClientPod.Status.Conditions {
+		if cond.Type == corev1.PodReady && cond.Status != corev1.ConditionTrue {
+			// Ignore if consulClientPod is not ready.
+			r.Log.Info("ignoring Consul client pod because it's not ready", "name", consulClientPod.Name)
+			return "", false
+		}
+	}
+
+	return consulClientPod.Spec.NodeName, true
+}
+
 // consulNamespace returns the Consul destination namespace for a provided Kubernetes namespace
 // depending on Consul Namespaces being enabled and the value of namespace mirroring.
 func (r *EndpointsController) consulNamespace(namespace string) string {
 	return namespaces.ConsulNamespace(namespace, r.EnableConsulNamespaces, r.ConsulDestinationNamespace, r.EnableNSMirroring, r.NSMirroringPrefix)
 }
 
+// endpointsMultiPortInfo returns the multiPortInfo of the service that the pod registers for
+// the Endpoints object. It returns the zero value for pods that aren't multi-port. On multi-port
+// pods, the Consul service must have the same name as the Kubernetes service, and the boolean
+// is false if the pod doesn't register a service for these Endpoints.
+func endpointsMultiPortInfo(pod corev1.Pod, serviceEndpoints corev1.Endpoints) (multiPortInfo, bool, error) {
+	if !isMultiPort(pod) {
+		return multiPortInfo{}, true, nil
+	}
+	return multiPortInfoForService(pod, serviceEndpoints.Name)
+}
+
 // hasBeenInjected checks the value of the status annotation and returns true if the Pod has been injected.
 func hasBeenInjected(pod corev1.Pod) bool {
 	if anno, ok := pod.Annotations[keyInjectStatus]; ok {
@@ -168,7 +168,7 @@ func TestProcessUpstreamsTLSandACLs(t *testing.T) {
 	pod := createPod("pod1", "1.2.3.4", true, true)
 	pod.Annotations[annotationUpstreams] = "upstream1:1234:dc1"
 
-	upstreams, err := ep.processUpstreams(*pod)
+	upstreams, err := ep.processUpstreams(*pod, multiPortInfo{})
 	require.NoError(t, err)
 
 	expected := []api.Upstream{
@@ -421,6 +421,58 @@ func TestProcessUpstreams(t *testing.T) {
 			},
 			consulNamespacesEnabled: false,
 		},
+		{
+			name: "structured upstreams",
+			pod: func() *corev1.Pod {
+				pod1 := createPod("pod1", "1.2.3.4", true, true)
+				pod1.Annotations[annotationUpstreamsV2] = `[{"destinationName": "upstream1", "localBindPort": 1234, "config": {"protocol": "grpc"}},
+					{"destinationName": "upstream2", "localBindSocketPath": "/tmp/upstream2.sock", "localBindSocketMode": "0600"}]`
+				return pod1
+			},
+			expected: []api.Upstream{
+				{
+					DestinationType: api.UpstreamDestTypeService,
+					DestinationName: "upstream1",
+					LocalBindPort:   1234,
+					Config:          map[string]interface{}{"protocol": "grpc"},
+				},
+				{
+					DestinationType:     api.UpstreamDestTypeService,
+					DestinationName:     "upstream2",
+					LocalBindSocketPath: "/tmp/upstream2.sock",
+					LocalBindSocketMode: "0600",
+				},
+			},
+			consulNamespacesEnabled: false,
+		},
+		{
+			name: "structured upstream with datacenter without ProxyDefaults",
+			pod: func() *corev1.Pod {
+				pod1 := createPod("pod1", "1.2.3.4", true, true)
+				pod1.Annotations[annotationUpstreamsV2] = `[{"destinationName": "upstream1", "localBindPort": 1234, "datacenter": "dc1"}]`
+				return pod1
+			},
+			expErr:                  "upstream \"upstream1\" is invalid: there is no ProxyDefaults config to set mesh gateway mode",
+			consulNamespacesEnabled: false,
+		},
+		{
+			name: "structured upstream with datacenter and mesh gateway mode",
+			pod: func() *corev1.Pod {
+				pod1 := createPod("pod1", "1.2.3.4", true, true)
+				pod1.Annotations[annotationUpstreamsV2] = `[{"destinationName": "upstream1", "localBindPort": 1234, "datacenter": "dc1", "meshGateway": {"mode": "local"}}]`
+				return pod1
+			},
+			expected: []api.Upstream{
+				{
+					DestinationType: api.UpstreamDestTypeService,
+					DestinationName: "upstream1",
+					Datacenter:      "dc1",
+					LocalBindPort:   1234,
+					MeshGateway:     api.MeshGatewayConfig{Mode: api.MeshGatewayModeLocal},
+				},
+			},
+			consulNamespacesEnabled: false,
+		},
 	}
 	for _, tt := range cases {
 		t.Run(tt.name, func(t *testing.T) {
@@ -457,7 +509,7 @@ func TestProcessUpstreams(t *testing.T) {
 				EnableConsulNamespaces: tt.consulNamespacesEnabled,
 			}
 
-			upstreams, err := ep.processUpstreams(*tt.pod())
+			upstreams, err := ep.processUpstreams(*tt.pod(), multiPortInfo{})
 			if tt.expErr != "" {
 				require.EqualError(t, err, tt.expErr)
 			} else {
@@ -3989,7 +4041,7 @@ func TestRegisterServicesAndHealthCheck_skipsWhenDuplicateServiceFound(t *testin
 				Client:                fakeClient,
 			}
 
-			err = ep.registerServicesAndHealthCheck(context.Background(), *endpoints, endpointsAddress, api.HealthPassing, make(map[string]bool))
+			err = ep.registerServicesAndHealthCheck(context.Background(), *endpoints, endpointsAddress, api.HealthPassing, "", make(map[string]bool))
 
 			// Check that the service is not registered with Consul.
 			_, _, err = consulClient.Agent().Service("test-pod-test-service", nil)
@@ -8,21 +8,30 @@ import (
 	"github.com/google/shlex"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
-func (h *Handler) envoySidecar(namespace corev1.Namespace, pod corev1.Pod) (corev1.Container, error) {
+// envoySidecarContainer is the name of the injected Envoy container. On multi-port
+// pods every service gets its own container, named after the service.
+const envoySidecarContainer = "envoy-sidecar"
+
+// envoyShutdownMarginSeconds is the time that Envoy is given to exit once it's sent SIGTERM at
+// the end of the shutdown grace period of its pre-stop hook.
+const envoyShutdownMarginSeconds = 5
+
+func (h *Handler) envoySidecar(namespace corev1.Namespace, pod corev1.Pod, mpi multiPortInfo) (corev1.Container, error) {
 	resources, err := h.envoySidecarResources(pod)
 	if err != nil {
 		return corev1.Container{}, err
 	}
 
-	cmd, err := h.getContainerSidecarCommand(pod)
+	cmd, err := h.getContainerSidecarCommand(pod, mpi)
 	if err != nil {
 		return corev1.Container{}, err
 	}
 
 	container := corev1.Container{
-		Name:  "envoy-sidecar",
+		Name:  envoySidecarContainerName(mpi),
 		Image: h.ImageEnvoy,
 		Env: []corev1.EnvVar{
 			{
@@ -41,6 +50,68 @@ func (h *Handler) envoySidecar(namespace corev1.Namespace, pod corev1.Pod) (core
 		},
 		Command: cmd,
 	}
+	// Envoy logs out of Consul when the pod is deleted so that the ACL token the pod
+	// logged in for is deleted.
+	if h.AuthMethod != "" {
+		container.Env = append(container.Env, h.consulHTTPEnvVars()...)
+	}
+
+	enableProxyLifecycle, err := h.LifecycleConfig.enableProxyLifecycle(pod)
+	if err != nil {
+		return corev1.Container{}, err
+	}
+	if enableProxyLifecycle {
+		shutdownGracePeriodSeconds, err := h.LifecycleConfig.shutdownGracePeriodSeconds(pod)
+		if err != nil {
+			return corev1.Container{}, err
+		}
+		lifecycleCmd := []string{
+			"/consul/connect-inject/consul-k8s",
+			"envoy-lifecycle",
+			fmt.Sprintf("-admin-addr=127.0.0.1:%d", defaultEnvoyAdminPort+mpi.serviceIndex),
+		}
+		preStopCmd := append(lifecycleCmd, "-hook=pre-stop",
+			fmt.Sprintf("-shutdown-grace-period=%ds", shutdownGracePeriodSeconds))
+		if h.AuthMethod != "" {
+			preStopCmd = append(preStopCmd, "-token-file="+aclTokenFile)
+		}
+		container.Lifecycle = &corev1.Lifecycle{
+			// Blocks the start of the containers after Envoy until it's ready.
+			PostStart: &corev1.Handler{
+				Exec: &corev1.ExecAction{
+					Command: append(lifecycleCmd, "-hook=post-start"),
+				},
+			},
+			// Drains Envoy's listeners, logs out of Consul if ACLs are enabled, and
+			// keeps Envoy running for the grace period so that in-flight requests can
+			// complete before it's sent SIGTERM.
+			PreStop: &corev1.Handler{
+				Exec: &corev1.ExecAction{
+					Command: preStopCmd,
+				},
+			},
+		}
+		publicListenerPort, err := h.ProxyConfig.publicListenerPort(pod)
+		if err != nil {
+			return corev1.Container{}, err
+		}
+		container.ReadinessProbe = &corev1.Probe{
+			Handler: corev1.Handler{
+				TCPSocket: &corev1.TCPSocketAction{
+					Port: intstr.FromInt(publicListenerPort + mpi.serviceIndex),
+				},
+			},
+			InitialDelaySeconds: 1,
+		}
+	} else if h.AuthMethod != "" {
+		container.Lifecycle = &corev1.Lifecycle{
+			PreStop: &corev1.Handler{
+				Exec: &corev1.ExecAction{
+					Command: []string{"/consul/connect-inject/consul", "logout", "-token-file=" + aclTokenFile},
+				},
+			},
+		}
+	}
 
 	tproxyEnabled, err := transparentProxyEnabled(namespace, pod, h.EnableTransparentProxy)
 	if err != nil {
@@ -76,10 +147,55 @@ func (h *Handler) envoySidecar(namespace corev1.Namespace, pod corev1.Pod) (core
 
 	return container, nil
 }
-func (h *Handler) getContainerSidecarCommand(pod corev1.Pod) ([]string, error) {
+
+// fitTerminationGracePeriod raises the termination grace period of a pod whose Envoy sidecars run
+// the pre-stop hook of the sidecar proxy lifecycle so that the hook can wait for the shutdown grace
+// period and Envoy can then exit. The kubelet kills the containers once the termination grace period
+// is over, even if their pre-stop hook hasn't returned, and both default to 30 seconds.
+func (h *Handler) fitTerminationGracePeriod(pod *corev1.Pod) error {
+	shutdownGracePeriodSeconds, err := h.LifecycleConfig.shutdownGracePeriodSeconds(*pod)
+	if err != nil {
+		return err
+	}
+	required := int64(shutdownGracePeriodSeconds + envoyShutdownMarginSeconds)
+	terminationGracePeriodSeconds := int64(corev1.DefaultTerminationGracePeriodSeconds)
+	if pod.Spec.TerminationGracePeriodSeconds != nil {
+		terminationGracePeriodSeconds = *pod.Spec.TerminationGracePeriodSeconds
+	}
+	if terminationGracePeriodSeconds < required {
+		pod.Spec.TerminationGracePeriodSeconds = pointerToInt64(required)
+	}
+	return nil
+}
+
+// appContainerIndex returns the index of the first application container of the pod,
+// i.e. the first container that isn't injected, or -1 if there is none.
+// Envoy sidecars come before the application containers when the sidecar proxy
+// lifecycle is enabled.
+func appContainerIndex(pod corev1.Pod) int {
+	for i, c := range pod.Spec.Containers {
+		if !isInjectedContainer(c.Name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// isInjectedContainer returns true if the container with the given name is one of
+// the sidecars added by the handler.
+func isInjectedContainer(name string) bool {
+	return name == envoySidecarContainer || strings.HasPrefix(name, envoySidecarContainer+"-") || name == consulSidecarContainer
+}
+
+func (h *Handler) getContainerSidecarCommand(pod corev1.Pod, mpi multiPortInfo) ([]string, error) {
 	cmd := []string{
 		"envoy",
-		"--config-path", "/consul/connect-inject/envoy-bootstrap.yaml",
+		"--config-path", envoyBootstrapFile(mpi),
+	}
+	if mpi.serviceName != "" {
+		// All containers of a pod share the IPC namespace, so every Envoy
+		// on a multi-port pod needs its own base ID for its shared memory regions.
+		cmd = append(cmd, "--base-id", strconv.Itoa(mpi.serviceIndex))
 	}
 
 	extraArgs, annotationSet := pod.Annotations[annotationEnvoyExtraArgs]
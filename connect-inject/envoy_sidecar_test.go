@@ -1,13 +1,25 @@
 package connectinject
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"testing"
 
+	mapset "github.com/deckarep/golang-set"
+	jsonpatchapply "github.com/evanphx/json-patch"
+	logrtest "github.com/go-logr/logr/testing"
+	"github.com/hashicorp/consul-k8s/namespaces"
 	"github.com/stretchr/testify/require"
+	"gomodules.xyz/jsonpatch/v2"
+	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 )
 
 func TestHandlerEnvoySidecar(t *testing.T) {
@@ -28,7 +40,7 @@ func TestHandlerEnvoySidecar(t *testing.T) {
 			},
 		},
 	}
-	container, err := h.envoySidecar(testNS, pod)
+	container, err := h.envoySidecar(testNS, pod, multiPortInfo{})
 	require.NoError(err)
 	require.Equal(container.Command, []string{
 		"envoy",
@@ -43,6 +55,35 @@ func TestHandlerEnvoySidecar(t *testing.T) {
 	})
 }
 
+func TestHandlerEnvoySidecar_MultiPort(t *testing.T) {
+	require := require.New(t)
+	h := Handler{}
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				annotationService: "web,web-admin",
+				annotationPort:    "8080,9090",
+			},
+		},
+
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "web",
+				},
+			},
+		},
+	}
+	container, err := h.envoySidecar(testNS, pod, multiPortInfo{serviceIndex: 1, serviceName: "web-admin", servicePort: "9090"})
+	require.NoError(err)
+	require.Equal("envoy-sidecar-web-admin", container.Name)
+	require.Equal([]string{
+		"envoy",
+		"--config-path", "/consul/connect-inject/envoy-bootstrap-web-admin.yaml",
+		"--base-id", "1",
+	}, container.Command)
+}
+
 func TestHandlerEnvoySidecar_withSecurityContext(t *testing.T) {
 	cases := map[string]struct {
 		tproxyEnabled      bool
@@ -106,7 +147,7 @@ func TestHandlerEnvoySidecar_withSecurityContext(t *testing.T) {
 					},
 				},
 			}
-			ec, err := h.envoySidecar(testNS, pod)
+			ec, err := h.envoySidecar(testNS, pod, multiPortInfo{})
 			require.NoError(t, err)
 			require.Equal(t, c.expSecurityContext, ec.SecurityContext)
 		})
@@ -130,7 +171,7 @@ func TestHandlerEnvoySidecar_FailsWithDuplicatePodSecurityContextUID(t *testing.
 			},
 		},
 	}
-	_, err := h.envoySidecar(testNS, pod)
+	_, err := h.envoySidecar(testNS, pod, multiPortInfo{})
 	require.Error(err, fmt.Sprintf("pod security context cannot have the same uid as envoy: %v", envoyUserAndGroupID))
 }
 
@@ -159,7 +200,7 @@ func TestHandlerEnvoySidecar_FailsWithDuplicateContainerSecurityContextUID(t *te
 			},
 		},
 	}
-	_, err := h.envoySidecar(testNS, pod)
+	_, err := h.envoySidecar(testNS, pod, multiPortInfo{})
 	require.Error(err, fmt.Sprintf("container %q has runAsUser set to the same uid %q as envoy which is not allowed", pod.Spec.Containers[1].Name, envoyUserAndGroupID))
 }
 
@@ -247,7 +288,7 @@ func TestHandlerEnvoySidecar_EnvoyExtraArgs(t *testing.T) {
 				EnvoyExtraArgs: tc.envoyExtraArgs,
 			}
 
-			c, err := h.envoySidecar(testNS, *tc.pod)
+			c, err := h.envoySidecar(testNS, *tc.pod, multiPortInfo{})
 			require.NoError(t, err)
 			require.Equal(t, tc.expectedContainerCommand, c.Command)
 		})
@@ -421,7 +462,7 @@ func TestHandlerEnvoySidecar_Resources(t *testing.T) {
 					},
 				},
 			}
-			container, err := c.handler.envoySidecar(testNS, pod)
+			container, err := c.handler.envoySidecar(testNS, pod, multiPortInfo{})
 			if c.expErr != "" {
 				require.NotNil(err)
 				require.Contains(err.Error(), c.expErr)
@@ -432,3 +473,404 @@ func TestHandlerEnvoySidecar_Resources(t *testing.T) {
 		})
 	}
 }
+
+func TestHandlerEnvoySidecar_Lifecycle(t *testing.T) {
+	cases := map[string]struct {
+		config       LifecycleConfig
+		annotations  map[string]string
+		mpi          multiPortInfo
+		expLifecycle *corev1.Lifecycle
+		expProbe     *corev1.Probe
+		expErr       string
+	}{
+		"disabled by default": {
+			config: LifecycleConfig{DefaultShutdownGracePeriodSeconds: 30},
+		},
+		"enabled by default": {
+			config: LifecycleConfig{DefaultEnableProxyLifecycle: true, DefaultShutdownGracePeriodSeconds: 30},
+			expLifecycle: &corev1.Lifecycle{
+				PostStart: &corev1.Handler{
+					Exec: &corev1.ExecAction{
+						Command: []string{"/consul/connect-inject/consul-k8s", "envoy-lifecycle",
+							"-admin-addr=127.0.0.1:19000", "-hook=post-start"},
+					},
+				},
+				PreStop: &corev1.Handler{
+					Exec: &corev1.ExecAction{
+						Command: []string{"/consul/connect-inject/consul-k8s", "envoy-lifecycle",
+							"-admin-addr=127.0.0.1:19000", "-hook=pre-stop", "-shutdown-grace-period=30s"},
+					},
+				},
+			},
+			expProbe: &corev1.Probe{
+				Handler: corev1.Handler{
+					TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(20000)},
+				},
+				InitialDelaySeconds: 1,
+			},
+		},
+		"enabled via annotation with grace period": {
+			config: LifecycleConfig{DefaultShutdownGracePeriodSeconds: 30},
+			annotations: map[string]string{
+				annotationEnableSidecarProxyLifecycle:                     "true",
+				annotationSidecarProxyLifecycleShutdownGracePeriodSeconds: "5",
+			},
+			expLifecycle: &corev1.Lifecycle{
+				PostStart: &corev1.Handler{
+					Exec: &corev1.ExecAction{
+						Command: []string{"/consul/connect-inject/consul-k8s", "envoy-lifecycle",
+							"-admin-addr=127.0.0.1:19000", "-hook=post-start"},
+					},
+				},
+				PreStop: &corev1.Handler{
+					Exec: &corev1.ExecAction{
+						Command: []string{"/consul/connect-inject/consul-k8s", "envoy-lifecycle",
+							"-admin-addr=127.0.0.1:19000", "-hook=pre-stop", "-shutdown-grace-period=5s"},
+					},
+				},
+			},
+			expProbe: &corev1.Probe{
+				Handler: corev1.Handler{
+					TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(20000)},
+				},
+				InitialDelaySeconds: 1,
+			},
+		},
+		"disabled via annotation": {
+			config: LifecycleConfig{DefaultEnableProxyLifecycle: true, DefaultShutdownGracePeriodSeconds: 30},
+			annotations: map[string]string{
+				annotationEnableSidecarProxyLifecycle: "false",
+			},
+		},
+		"multi-port": {
+			config: LifecycleConfig{DefaultEnableProxyLifecycle: true},
+			annotations: map[string]string{
+				annotationService: "web,web-admin",
+				annotationPort:    "8080,9090",
+			},
+			mpi: multiPortInfo{serviceIndex: 1, serviceName: "web-admin", servicePort: "9090"},
+			expLifecycle: &corev1.Lifecycle{
+				PostStart: &corev1.Handler{
+					Exec: &corev1.ExecAction{
+						Command: []string{"/consul/connect-inject/consul-k8s", "envoy-lifecycle",
+							"-admin-addr=127.0.0.1:19001", "-hook=post-start"},
+					},
+				},
+				PreStop: &corev1.Handler{
+					Exec: &corev1.ExecAction{
+						Command: []string{"/consul/connect-inject/consul-k8s", "envoy-lifecycle",
+							"-admin-addr=127.0.0.1:19001", "-hook=pre-stop", "-shutdown-grace-period=0s"},
+					},
+				},
+			},
+			expProbe: &corev1.Probe{
+				Handler: corev1.Handler{
+					TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(20001)},
+				},
+				InitialDelaySeconds: 1,
+			},
+		},
+		"custom public listener port": {
+			config: LifecycleConfig{DefaultEnableProxyLifecycle: true},
+			annotations: map[string]string{
+				annotationService:                        "web,web-admin",
+				annotationPort:                           "8080,9090",
+				annotationSidecarProxyPublicListenerPort: "21000",
+			},
+			mpi: multiPortInfo{serviceIndex: 1, serviceName: "web-admin", servicePort: "9090"},
+			expLifecycle: &corev1.Lifecycle{
+				PostStart: &corev1.Handler{
+					Exec: &corev1.ExecAction{
+						Command: []string{"/consul/connect-inject/consul-k8s", "envoy-lifecycle",
+							"-admin-addr=127.0.0.1:19001", "-hook=post-start"},
+					},
+				},
+				PreStop: &corev1.Handler{
+					Exec: &corev1.ExecAction{
+						Command: []string{"/consul/connect-inject/consul-k8s", "envoy-lifecycle",
+							"-admin-addr=127.0.0.1:19001", "-hook=pre-stop", "-shutdown-grace-period=0s"},
+					},
+				},
+			},
+			expProbe: &corev1.Probe{
+				Handler: corev1.Handler{
+					TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(21001)},
+				},
+				InitialDelaySeconds: 1,
+			},
+		},
+		"invalid enable annotation": {
+			annotations: map[string]string{
+				annotationEnableSidecarProxyLifecycle: "yes please",
+			},
+			expErr: "consul.hashicorp.com/enable-sidecar-proxy-lifecycle annotation value of yes please was invalid: strconv.ParseBool: parsing \"yes please\": invalid syntax",
+		},
+		"invalid grace period annotation": {
+			config: LifecycleConfig{DefaultEnableProxyLifecycle: true},
+			annotations: map[string]string{
+				annotationSidecarProxyLifecycleShutdownGracePeriodSeconds: "-1",
+			},
+			expErr: "consul.hashicorp.com/sidecar-proxy-lifecycle-shutdown-grace-period-seconds annotation value of -1 must be a non-negative integer",
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			h := Handler{LifecycleConfig: c.config}
+			pod := corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: c.annotations,
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}
+			container, err := h.envoySidecar(testNS, pod, c.mpi)
+			if c.expErr != "" {
+				require.EqualError(t, err, c.expErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.expLifecycle, container.Lifecycle)
+			require.Equal(t, c.expProbe, container.ReadinessProbe)
+		})
+	}
+}
+
+// Test that the termination grace period of the pod fits the shutdown grace period of Envoy's
+// pre-stop hook, so that Envoy isn't killed before it exits.
+func TestHandlerFitTerminationGracePeriod(t *testing.T) {
+	cases := map[string]struct {
+		config                           LifecycleConfig
+		annotations                      map[string]string
+		terminationGracePeriodSeconds    *int64
+		expTerminationGracePeriodSeconds *int64
+		expErr                           string
+	}{
+		"default termination grace period fits": {
+			config: LifecycleConfig{DefaultShutdownGracePeriodSeconds: 10},
+		},
+		"default termination grace period is raised": {
+			config:                           LifecycleConfig{DefaultShutdownGracePeriodSeconds: 30},
+			expTerminationGracePeriodSeconds: pointerToInt64(35),
+		},
+		"termination grace period is raised": {
+			config:                           LifecycleConfig{DefaultShutdownGracePeriodSeconds: 10},
+			terminationGracePeriodSeconds:    pointerToInt64(12),
+			expTerminationGracePeriodSeconds: pointerToInt64(15),
+		},
+		"longer termination grace period is kept": {
+			config:                           LifecycleConfig{DefaultShutdownGracePeriodSeconds: 30},
+			terminationGracePeriodSeconds:    pointerToInt64(60),
+			expTerminationGracePeriodSeconds: pointerToInt64(60),
+		},
+		"grace period from annotation": {
+			config: LifecycleConfig{DefaultShutdownGracePeriodSeconds: 10},
+			annotations: map[string]string{
+				annotationSidecarProxyLifecycleShutdownGracePeriodSeconds: "45",
+			},
+			expTerminationGracePeriodSeconds: pointerToInt64(50),
+		},
+		"invalid grace period annotation": {
+			annotations: map[string]string{
+				annotationSidecarProxyLifecycleShutdownGracePeriodSeconds: "-1",
+			},
+			expErr: "consul.hashicorp.com/sidecar-proxy-lifecycle-shutdown-grace-period-seconds annotation value of -1 must be a non-negative integer",
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			h := Handler{LifecycleConfig: c.config}
+			pod := corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Annotations: c.annotations},
+				Spec:       corev1.PodSpec{TerminationGracePeriodSeconds: c.terminationGracePeriodSeconds},
+			}
+			err := h.fitTerminationGracePeriod(&pod)
+			if c.expErr != "" {
+				require.EqualError(t, err, c.expErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.expTerminationGracePeriodSeconds, pod.Spec.TerminationGracePeriodSeconds)
+		})
+	}
+}
+
+// Test that Envoy logs out of Consul before it's stopped when ACLs are enabled.
+func TestHandlerEnvoySidecar_Logout(t *testing.T) {
+	hostIP := corev1.EnvVar{
+		Name: "HOST_IP",
+		ValueFrom: &corev1.EnvVarSource{
+			FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.hostIP"},
+		},
+	}
+	cases := map[string]struct {
+		handler    Handler
+		expEnv     []corev1.EnvVar
+		expPreStop []string
+	}{
+		"ACLs disabled": {
+			handler: Handler{},
+			expEnv:  []corev1.EnvVar{hostIP},
+		},
+		"ACLs enabled": {
+			handler: Handler{AuthMethod: "consul-k8s-auth-method"},
+			expEnv:  []corev1.EnvVar{hostIP, {Name: "CONSUL_HTTP_ADDR", Value: "$(HOST_IP):8500"}},
+			expPreStop: []string{"/consul/connect-inject/consul", "logout",
+				"-token-file=/consul/connect-inject/acl-token"},
+		},
+		"ACLs and TLS enabled": {
+			handler: Handler{AuthMethod: "consul-k8s-auth-method", ConsulCACert: "consul-ca-cert"},
+			expEnv: []corev1.EnvVar{
+				hostIP,
+				{Name: "CONSUL_HTTP_ADDR", Value: "https://$(HOST_IP):8501"},
+				{Name: "CONSUL_CACERT", Value: "/consul/connect-inject/consul-ca.pem"},
+			},
+			expPreStop: []string{"/consul/connect-inject/consul", "logout",
+				"-token-file=/consul/connect-inject/acl-token"},
+		},
+		"ACLs and lifecycle enabled": {
+			handler: Handler{
+				AuthMethod:      "consul-k8s-auth-method",
+				LifecycleConfig: LifecycleConfig{DefaultEnableProxyLifecycle: true, DefaultShutdownGracePeriodSeconds: 30},
+			},
+			expEnv: []corev1.EnvVar{hostIP, {Name: "CONSUL_HTTP_ADDR", Value: "$(HOST_IP):8500"}},
+			expPreStop: []string{"/consul/connect-inject/consul-k8s", "envoy-lifecycle",
+				"-admin-addr=127.0.0.1:19000", "-hook=pre-stop", "-shutdown-grace-period=30s",
+				"-token-file=/consul/connect-inject/acl-token"},
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			pod := corev1.Pod{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}
+			container, err := c.handler.envoySidecar(testNS, pod, multiPortInfo{})
+			require.NoError(t, err)
+			require.Equal(t, c.expEnv, container.Env)
+			if c.expPreStop == nil {
+				require.Nil(t, container.Lifecycle)
+				return
+			}
+			require.Equal(t, c.expPreStop, container.Lifecycle.PreStop.Exec.Command)
+		})
+	}
+}
+
+// Test that Envoy sidecars are placed before the application containers when the
+// sidecar proxy lifecycle is enabled so that they're started first.
+func TestHandlerHandle_ProxyLifecycleContainerOrder(t *testing.T) {
+	s := runtime.NewScheme()
+	s.AddKnownTypes(schema.GroupVersion{Group: "", Version: "v1"}, &corev1.Pod{})
+	decoder, err := admission.NewDecoder(s)
+	require.NoError(t, err)
+
+	for _, enabled := range []bool{true, false} {
+		t.Run(fmt.Sprintf("enabled=%t", enabled), func(t *testing.T) {
+			h := Handler{
+				Log:                   logrtest.TestLogger{T: t},
+				AllowK8sNamespacesSet: mapset.NewSetWith("*"),
+				DenyK8sNamespacesSet:  mapset.NewSet(),
+				LifecycleConfig:       LifecycleConfig{DefaultEnableProxyLifecycle: enabled},
+				decoder:               decoder,
+				Clientset:             defaultTestClientWithNamespace(),
+			}
+			pod := &corev1.Pod{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}
+			resp := h.Handle(context.Background(), admission.Request{
+				AdmissionRequest: admissionv1.AdmissionRequest{
+					Namespace: namespaces.DefaultNamespace,
+					Object:    encodeRaw(t, pod),
+				},
+			})
+			require.True(t, resp.Allowed, resp.Result)
+
+			patched := applyPatches(t, pod, resp.Patches)
+			require.Len(t, patched.Spec.Containers, 2)
+			envoyIdx, appIdx := 1, 0
+			if enabled {
+				envoyIdx, appIdx = 0, 1
+			}
+			require.Equal(t, envoySidecarContainer, patched.Spec.Containers[envoyIdx].Name)
+			require.Equal(t, "web", patched.Spec.Containers[appIdx].Name)
+			require.Equal(t, appIdx, appContainerIndex(*patched))
+			require.Equal(t, enabled, patched.Spec.Containers[envoyIdx].Lifecycle != nil)
+			if enabled {
+				require.Equal(t, "web", patched.Annotations[annotationDefaultContainer])
+			} else {
+				require.NotContains(t, patched.Annotations, annotationDefaultContainer)
+			}
+		})
+	}
+}
+
+// Test that the default container chosen by the user is kept when the Envoy sidecars come first.
+func TestHandlerHandle_ProxyLifecycleDefaultContainer(t *testing.T) {
+	s := runtime.NewScheme()
+	s.AddKnownTypes(schema.GroupVersion{Group: "", Version: "v1"}, &corev1.Pod{})
+	decoder, err := admission.NewDecoder(s)
+	require.NoError(t, err)
+
+	h := Handler{
+		Log:                   logrtest.TestLogger{T: t},
+		AllowK8sNamespacesSet: mapset.NewSetWith("*"),
+		DenyK8sNamespacesSet:  mapset.NewSet(),
+		LifecycleConfig:       LifecycleConfig{DefaultEnableProxyLifecycle: true},
+		decoder:               decoder,
+		Clientset:             defaultTestClientWithNamespace(),
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{annotationDefaultContainer: "worker"},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "web"}, {Name: "worker"}},
+		},
+	}
+	resp := h.Handle(context.Background(), admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Namespace: namespaces.DefaultNamespace,
+			Object:    encodeRaw(t, pod),
+		},
+	})
+	require.True(t, resp.Allowed, resp.Result)
+
+	patched := applyPatches(t, pod, resp.Patches)
+	require.Equal(t, envoySidecarContainer, patched.Spec.Containers[0].Name)
+	require.Equal(t, "worker", patched.Annotations[annotationDefaultContainer])
+}
+
+// applyPatches applies the JSON patches returned by the handler to the pod.
+func applyPatches(t *testing.T, pod *corev1.Pod, patches []jsonpatch.Operation) *corev1.Pod {
+	t.Helper()
+	podJSON, err := json.Marshal(pod)
+	require.NoError(t, err)
+	patchJSON, err := json.Marshal(patches)
+	require.NoError(t, err)
+	patch, err := jsonpatchapply.DecodePatch(patchJSON)
+	require.NoError(t, err)
+	patchedJSON, err := patch.Apply(podJSON)
+	require.NoError(t, err)
+	var patched corev1.Pod
+	require.NoError(t, json.Unmarshal(patchedJSON, &patched))
+	return &patched
+}
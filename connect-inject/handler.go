@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/deckarep/golang-set"
 	"github.com/go-logr/logr"
@@ -21,6 +22,7 @@ import (
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 )
 
@@ -38,6 +40,11 @@ type Handler struct {
 	ConsulClient *api.Client
 	Clientset    kubernetes.Interface
 
+	// ProxyInjectionPolicyClient is used to look up the ProxyInjectionPolicy
+	// resources that supply defaults for the injection settings of pods.
+	// If it's nil, policies aren't applied.
+	ProxyInjectionPolicyClient client.Reader
+
 	// ImageConsul is the container image for Consul to use.
 	// ImageEnvoy is the container image for Envoy to use.
 	//
@@ -117,6 +124,15 @@ type Handler struct {
 	// annotations and the merged metrics server.
 	MetricsConfig MetricsConfig
 
+	// LifecycleConfig contains the Envoy sidecar lifecycle configuration from the inject-connect command and has
+	// methods to determine whether configuration should come from the default flags or annotations. The handler uses
+	// this to configure the startup ordering and the lifecycle hooks of the Envoy sidecar.
+	LifecycleConfig LifecycleConfig
+
+	// ProxyConfig contains the configuration of the public listener of the Envoy sidecar and its
+	// Consul check from the inject-connect command. It's shared with the endpoints controller.
+	ProxyConfig ProxyConfig
+
 	// Resource settings for init container. All of these fields
 	// will be populated by the defaults provided in the initial flags.
 	InitContainerResources corev1.ResourceRequirements
@@ -134,6 +150,10 @@ type Handler struct {
 	// to point them to the Envoy proxy.
 	TProxyOverwriteProbes bool
 
+	// EnableRegistrationReadinessGate adds a readiness gate to injected pods for the condition that
+	// the endpoints controller sets once the pod's services are registered with Consul.
+	EnableRegistrationReadinessGate bool
+
 	// EnableOpenShift indicates that when tproxy is enabled, the security context for the Envoy and init
 	// containers should not be added because OpenShift sets a random user for those and will not allow
 	// those containers to be created otherwise.
@@ -164,15 +184,14 @@ func (h *Handler) Handle(ctx context.Context, req admission.Request) admission.R
 		return admission.Errored(http.StatusBadRequest, err)
 	}
 
-	if err := h.validatePod(pod); err != nil {
-		h.Log.Error(err, "error validating pod", "request name", req.Name)
-		return admission.Errored(http.StatusBadRequest, err)
-	}
+	// All invalid annotations are reported at once, but only pods that are injected
+	// are denied for them. Warnings are returned whether or not the pod is injected.
+	warnings, validationErr := h.validatePod(pod)
 
 	// Setup the default annotation values that are used for the container.
 	// This MUST be done before shouldInject is called since that function
 	// uses these annotations.
-	if err := h.defaultAnnotations(&pod); err != nil {
+	if err := h.defaultAnnotations(ctx, &pod, req.Namespace); err != nil {
 		h.Log.Error(err, "error creating default annotations", "request name", req.Name)
 		return admission.Errored(http.StatusInternalServerError, fmt.Errorf("error creating default annotations: %s", err))
 	}
@@ -183,7 +202,11 @@ func (h *Handler) Handle(ctx context.Context, req admission.Request) admission.R
 		h.Log.Error(err, "error checking if should inject", "request name", req.Name)
 		return admission.Errored(http.StatusInternalServerError, fmt.Errorf("error checking if should inject: %s", err))
 	} else if !shouldInject {
-		return admission.Allowed(fmt.Sprintf("%s %s does not require injection", pod.Kind, pod.Name))
+		return admission.Allowed(fmt.Sprintf("%s %s does not require injection", pod.Kind, pod.Name)).WithWarnings(warnings...)
+	}
+	if validationErr != nil {
+		h.Log.Error(validationErr, "error validating pod", "request name", req.Name)
+		return admission.Errored(http.StatusBadRequest, validationErr).WithWarnings(warnings...)
 	}
 
 	h.Log.Info("received pod", "name", pod.Name, "ns", pod.Namespace)
@@ -193,14 +216,11 @@ func (h *Handler) Handle(ctx context.Context, req admission.Request) admission.R
 	pod.Spec.Volumes = append(pod.Spec.Volumes, h.containerVolume())
 
 	// Add the upstream services as environment variables for easy
-	// service discovery.
+	// service discovery. Init containers run before Envoy is started,
+	// so only the application containers can reach the upstreams.
 	containerEnvVars := h.containerEnvVars(pod)
-	for _, container := range pod.Spec.InitContainers {
-		container.Env = append(container.Env, containerEnvVars...)
-	}
-
-	for _, container := range pod.Spec.Containers {
-		container.Env = append(container.Env, containerEnvVars...)
+	for i := range pod.Spec.Containers {
+		pod.Spec.Containers[i].Env = append(pod.Spec.Containers[i].Env, containerEnvVars...)
 	}
 
 	// Add the init container which copies the Consul binary to /consul/connect-inject/.
@@ -214,6 +234,104 @@ func (h *Handler) Handle(ctx context.Context, req admission.Request) admission.R
 		return admission.Errored(http.StatusInternalServerError, fmt.Errorf("error getting namespace metadata for container: %s", err))
 	}
 
+	// Namespace owners can default the settings of all pods in the namespace with annotations
+	// on the Namespace. The effective settings are recorded on the pod so that the endpoints
+	// controller registers it with the settings it was injected with.
+	pod = withNamespaceDefaults(*ns, pod)
+	if _, err := validateAnnotations(pod, h.EnableNamespaces); err != nil {
+		h.Log.Error(err, "error validating namespace defaults", "request name", req.Name)
+		return admission.Errored(http.StatusBadRequest, fmt.Errorf("error validating namespace defaults: %s", err))
+	}
+
+	// Connect native applications speak Connect themselves, so no Envoy sidecar is injected
+	// for them. The init container still runs to log in with ACLs and wait for registration.
+	native, err := connectNative(pod)
+	if err != nil {
+		h.Log.Error(err, "error determining if pod is Connect native", "request name", req.Name)
+		return admission.Errored(http.StatusBadRequest, fmt.Errorf("error determining if pod is Connect native: %s", err))
+	}
+
+	// Multi-port pods run an Envoy sidecar for each of their services. The zero value of
+	// multiPortInfo describes the single service of a regular pod.
+	envoyServices := []multiPortInfo{{}}
+	if native {
+		envoyServices = nil
+		// The application reads the ACL token and CA certificate from the shared volume.
+		for i := range pod.Spec.Containers {
+			pod.Spec.Containers[i].Env = append(pod.Spec.Containers[i].Env, h.connectNativeEnvVars(pod.Spec.Containers[i])...)
+			pod.Spec.Containers[i].VolumeMounts = append(pod.Spec.Containers[i].VolumeMounts, corev1.VolumeMount{
+				Name:      volumeName,
+				MountPath: "/consul/connect-inject",
+				ReadOnly:  true,
+			})
+		}
+	} else if isMultiPort(pod) {
+		envoyServices, err = h.injectableMultiPortServices(*ns, pod)
+		if err != nil {
+			h.Log.Error(err, "error configuring multi-port pod", "request name", req.Name)
+			return admission.Errored(http.StatusBadRequest, fmt.Errorf("error configuring multi-port pod: %s", err))
+		}
+	}
+
+	// Traffic redirection only applies IPv4 rules, so the IPv6 traffic of a transparent proxy pod
+	// bypasses Envoy. Pods that ask for transparent proxy themselves are rejected if a Kubernetes
+	// service reaches them over IPv6, while pods that get it by default only get a warning so that
+	// existing dual-stack workloads keep starting.
+	if !native {
+		tproxyEnabled, err := transparentProxyEnabled(*ns, pod, h.EnableTransparentProxy)
+		if err != nil {
+			h.Log.Error(err, "error determining if transparent proxy is enabled", "request name", req.Name)
+			return admission.Errored(http.StatusBadRequest, fmt.Errorf("error determining if transparent proxy is enabled: %s", err))
+		}
+		if tproxyEnabled {
+			ipv6Services, err := h.ipv6Services(ctx, pod)
+			if err != nil {
+				h.Log.Error(err, "error listing services of pod", "request name", req.Name)
+				return admission.Errored(http.StatusInternalServerError, fmt.Errorf("error listing services of pod: %s", err))
+			}
+			if len(ipv6Services) > 0 {
+				message := fmt.Sprintf("transparent proxy only redirects IPv4 traffic, but Kubernetes services %s reach the pod over IPv6",
+					quotedList(ipv6Services))
+				if _, ok := pod.Annotations[keyTransparentProxy]; ok {
+					err := fmt.Errorf("%s; set the %q annotation to \"false\"", message, keyTransparentProxy)
+					h.Log.Error(err, "error configuring transparent proxy", "request name", req.Name)
+					return admission.Errored(http.StatusBadRequest, err).WithWarnings(warnings...)
+				}
+				warnings = append(warnings, message+", and that traffic bypasses Envoy")
+			}
+		}
+	}
+
+	// The endpoints controller registers the proxy with the public listener port and check settings
+	// that the Envoy sidecar is configured with here, even if the defaults change later.
+	if !native {
+		if err := h.ProxyConfig.proxyAnnotations(&pod); err != nil {
+			h.Log.Error(err, "error configuring proxy public listener", "request name", req.Name)
+			return admission.Errored(http.StatusBadRequest, fmt.Errorf("error configuring proxy public listener: %s", err))
+		}
+		if err := h.validatePublicListenerPorts(*ns, pod); err != nil {
+			h.Log.Error(err, "error configuring proxy public listener", "request name", req.Name)
+			return admission.Errored(http.StatusBadRequest, fmt.Errorf("error configuring proxy public listener: %s", err))
+		}
+	}
+
+	// The init container writes the upstreams manifest to the shared volume, which is mounted
+	// into the application containers of pods that aren't Connect native.
+	if !native && len(injectedUpstreams(pod, h.EnableNamespaces)) > 0 {
+		for i := range pod.Spec.Containers {
+			pod.Spec.Containers[i].VolumeMounts = append(pod.Spec.Containers[i].VolumeMounts, upstreamsManifestVolumeMount())
+		}
+	}
+
+	// Overwrite the probes of the application containers if needed. This is done before the
+	// init container is configured because the ports of TCP probes are excluded from traffic
+	// redirection.
+	err = h.overwriteProbes(*ns, &pod)
+	if err != nil {
+		h.Log.Error(err, "error overwriting probes", "request name", req.Name)
+		return admission.Errored(http.StatusInternalServerError, fmt.Errorf("error overwriting probes: %s", err))
+	}
+
 	// Add the init container that registers the service and sets up the Envoy configuration.
 	initContainer, err := h.containerInit(*ns, pod)
 	if err != nil {
@@ -222,27 +340,71 @@ func (h *Handler) Handle(ctx context.Context, req admission.Request) admission.R
 	}
 	pod.Spec.InitContainers = append(pod.Spec.InitContainers, initContainer)
 
-	// Add the Envoy sidecar.
-	envoySidecar, err := h.envoySidecar(*ns, pod)
+	// Add the Envoy sidecar(s).
+	var envoySidecars []corev1.Container
+	for _, svc := range envoyServices {
+		envoySidecar, err := h.envoySidecar(*ns, pod, svc)
+		if err != nil {
+			h.Log.Error(err, "error configuring injection sidecar container", "request name", req.Name)
+			return admission.Errored(http.StatusInternalServerError, fmt.Errorf("error configuring injection sidecar container: %s", err))
+		}
+		envoySidecars = append(envoySidecars, envoySidecar)
+	}
+	enableProxyLifecycle, err := h.LifecycleConfig.enableProxyLifecycle(pod)
 	if err != nil {
-		h.Log.Error(err, "error configuring injection sidecar container", "request name", req.Name)
-		return admission.Errored(http.StatusInternalServerError, fmt.Errorf("error configuring injection sidecar container: %s", err))
+		h.Log.Error(err, "error determining if sidecar proxy lifecycle is enabled", "request name", req.Name)
+		return admission.Errored(http.StatusInternalServerError, fmt.Errorf("error determining if sidecar proxy lifecycle is enabled: %s", err))
+	}
+	if enableProxyLifecycle && !native {
+		// Kubernetes starts containers in order and waits for the postStart hook of a
+		// container to complete before starting the next one, so Envoy is started first
+		// to hold the application containers until it's ready. kubectl and other tools
+		// default to the first container, so the first application container is kept as
+		// the default container.
+		if _, ok := pod.Annotations[annotationDefaultContainer]; !ok && len(pod.Spec.Containers) > 0 {
+			pod.Annotations[annotationDefaultContainer] = pod.Spec.Containers[0].Name
+		}
+		pod.Spec.Containers = append(envoySidecars, pod.Spec.Containers...)
+		if err := h.fitTerminationGracePeriod(&pod); err != nil {
+			h.Log.Error(err, "error configuring termination grace period", "request name", req.Name)
+			return admission.Errored(http.StatusBadRequest, fmt.Errorf("error configuring termination grace period: %s", err))
+		}
+	} else {
+		pod.Spec.Containers = append(pod.Spec.Containers, envoySidecars...)
 	}
-	pod.Spec.Containers = append(pod.Spec.Containers, envoySidecar)
 
 	// Now that the consul-sidecar no longer needs to re-register services periodically
 	// (that functionality lives in the endpoints-controller),
 	// we only need the consul sidecar to run the metrics merging server.
 	// First, determine if we need to run the metrics merging server.
+	// Connect native pods have no Envoy metrics to merge.
 	shouldRunMetricsMerging, err := h.MetricsConfig.shouldRunMergedMetricsServer(pod)
 	if err != nil {
 		h.Log.Error(err, "error determining if metrics merging server should be run", "request name", req.Name)
 		return admission.Errored(http.StatusInternalServerError, fmt.Errorf("error determining if metrics merging server should be run: %s", err))
 	}
+	shouldRunMetricsMerging = shouldRunMetricsMerging && !native
 
-	// Add the consul-sidecar only if we need to run the metrics merging server.
-	if shouldRunMetricsMerging {
-		consulSidecar, err := h.consulSidecar(pod)
+	// Jobs and CronJobs can only complete once all containers of their pods have exited, so
+	// the sidecars can be stopped when the application exits. The consul-sidecar waits for the
+	// controller to mark the pod once its application containers won't run again, which it
+	// reads from a downward API volume.
+	stopOnAppExit, err := stopSidecarsOnAppExit(*ns, pod)
+	if err != nil {
+		h.Log.Error(err, "error determining if sidecars should be stopped on application exit", "request name", req.Name)
+		return admission.Errored(http.StatusBadRequest, fmt.Errorf("error determining if sidecars should be stopped on application exit: %s", err))
+	}
+	if stopOnAppExit {
+		pod.Spec.Volumes = append(pod.Spec.Volumes, appExitVolume())
+		// Record the setting for the controllers which mark and deregister the pod
+		// once its application has exited.
+		pod.Annotations[keyStopSidecarsOnAppExit] = "true"
+	}
+
+	// Add the consul-sidecar only if we need to run the metrics merging server
+	// or to stop the sidecars on application exit.
+	if shouldRunMetricsMerging || stopOnAppExit {
+		consulSidecar, err := h.consulSidecar(pod, shouldRunMetricsMerging, stopOnAppExit, envoyServices)
 		if err != nil {
 			h.Log.Error(err, "error configuring consul sidecar container", "request name", req.Name)
 			return admission.Errored(http.StatusInternalServerError, fmt.Errorf("error configuring consul sidecar container: %s", err))
@@ -254,10 +416,13 @@ func (h *Handler) Handle(ctx context.Context, req admission.Request) admission.R
 	// and does not need to be checked for being a nil value.
 	pod.Annotations[keyInjectStatus] = injected
 
-	// Add annotations for metrics.
-	if err = h.prometheusAnnotations(&pod); err != nil {
-		h.Log.Error(err, "error configuring prometheus annotations", "request name", req.Name)
-		return admission.Errored(http.StatusInternalServerError, fmt.Errorf("error configuring prometheus annotations: %s", err))
+	// Add annotations for metrics. Prometheus scrapes Envoy, so there's nothing to
+	// scrape on Connect native pods.
+	if !native {
+		if err = h.prometheusAnnotations(&pod); err != nil {
+			h.Log.Error(err, "error configuring prometheus annotations", "request name", req.Name)
+			return admission.Errored(http.StatusInternalServerError, fmt.Errorf("error configuring prometheus annotations: %s", err))
+		}
 	}
 
 	if pod.Labels == nil {
@@ -269,18 +434,16 @@ func (h *Handler) Handle(ctx context.Context, req admission.Request) admission.R
 	// from consul-k8s without Endpoints controller to consul-k8s with Endpoints controller.
 	pod.Labels[keyManagedBy] = managedByValue
 
+	// Keep the pod from becoming ready before the endpoints controller has registered it.
+	if h.EnableRegistrationReadinessGate {
+		addRegisteredReadinessGate(&pod)
+	}
+
 	// Consul-ENT only: Add the Consul destination namespace as an annotation to the pod.
 	if h.EnableNamespaces {
 		pod.Annotations[annotationConsulNamespace] = h.consulNamespace(req.Namespace)
 	}
 
-	// Overwrite readiness/liveness probes if needed.
-	err = h.overwriteProbes(*ns, &pod)
-	if err != nil {
-		h.Log.Error(err, "error overwriting readiness or liveness probes", "request name", req.Name)
-		return admission.Errored(http.StatusInternalServerError, fmt.Errorf("error overwriting readiness or liveness probes: %s", err))
-	}
-
 	// Marshall the pod into JSON after it has the desired envs, annotations, labels,
 	// sidecars and initContainers appended to it.
 	updatedPodJson, err := json.Marshal(pod)
@@ -297,8 +460,9 @@ func (h *Handler) Handle(ctx context.Context, req admission.Request) admission.R
 
 	// Check and potentially create Consul resources. This is done after
 	// all patches are created to guarantee no errors were encountered in
-	// that process before modifying the Consul cluster.
-	if h.EnableNamespaces {
+	// that process before modifying the Consul cluster. There is no Consul client
+	// when the handler runs offline, e.g. for the inject-preview command.
+	if h.EnableNamespaces && h.ConsulClient != nil {
 		if _, err := namespaces.EnsureExists(h.ConsulClient, h.consulNamespace(req.Namespace), h.CrossNamespaceACLPolicy); err != nil {
 			h.Log.Error(err, "error checking or creating namespace",
 				"ns", h.consulNamespace(req.Namespace), "request name", req.Name)
@@ -308,7 +472,7 @@ func (h *Handler) Handle(ctx context.Context, req admission.Request) admission.R
 
 	// Return a Patched response along with the patches we intend on applying to the
 	// Pod received by the handler.
-	return admission.Patched(fmt.Sprintf("valid %s request", pod.Kind), patches...)
+	return admission.Patched(fmt.Sprintf("valid %s request", pod.Kind), patches...).WithWarnings(warnings...)
 }
 
 // shouldOverwriteProbes returns true if we need to overwrite readiness/liveness probes for this pod.
@@ -321,8 +485,14 @@ func shouldOverwriteProbes(pod corev1.Pod, globalOverwrite bool) (bool, error) {
 	return globalOverwrite, nil
 }
 
-// overwriteProbes overwrites readiness/liveness probes of this pod when
+// overwriteProbes overwrites the probes of the application containers of this pod when
 // both transparent proxy is enabled and overwrite probes is true for the pod.
+// HTTP probes are pointed to a distinct Envoy listener each, which the endpoints controller
+// exposes to the original port recorded in the pod's annotations. Envoy can't expose TCP
+// probes, so their ports are excluded from inbound traffic redirection instead, unless the
+// port is the service port or an upstream port. Those ports stay redirected so that their
+// traffic keeps going through the mesh, and TCP probes of them reach Envoy's inbound
+// listener rather than the application.
 func (h *Handler) overwriteProbes(ns corev1.Namespace, pod *corev1.Pod) error {
 	tproxyEnabled, err := transparentProxyEnabled(ns, *pod, h.EnableTransparentProxy)
 	if err != nil {
@@ -334,41 +504,101 @@ func (h *Handler) overwriteProbes(ns corev1.Namespace, pod *corev1.Pod) error {
 		return err
 	}
 
-	if tproxyEnabled && overwriteProbes {
-		if cs := pod.Spec.Containers; len(cs) > 0 {
-			// The first container will be the original application container that we need to
-			// modify probes for.
-			appContainer := cs[0]
-			if appContainer.LivenessProbe != nil && appContainer.LivenessProbe.HTTPGet != nil {
-				// We need to save original port first so that endpoints controller can use it for exposing paths.
-				pod.Annotations[annotationOriginalLivenessProbePort] = appContainer.LivenessProbe.HTTPGet.Port.String()
-				listenerPort := defaultExposedPathsListenerPortLiveness
-				if raw, ok := pod.Annotations[annotationTransparentProxyLivenessListenerPort]; ok {
-					listenerPort, err = strconv.Atoi(raw)
-					if err != nil {
-						return err
-					}
-				}
-				appContainer.LivenessProbe.HTTPGet.Port = intstr.FromInt(listenerPort)
+	// Connect native pods don't have an Envoy to expose their probes.
+	native, err := connectNative(*pod)
+	if err != nil {
+		return err
+	}
+
+	if !tproxyEnabled || !overwriteProbes || native {
+		return nil
+	}
+
+	publicListenerPorts, err := h.ProxyConfig.publicListenerPorts(*pod)
+	if err != nil {
+		return err
+	}
+	listenerPorts, err := newProbeListenerPorts(*pod, publicListenerPorts)
+	if err != nil {
+		return err
+	}
+	meshPorts, err := h.meshPorts(*pod)
+	if err != nil {
+		return err
+	}
 
+	firstAppContainer := appContainerIndex(*pod)
+	var excludeInboundPorts []string
+	for i := range pod.Spec.Containers {
+		container := &pod.Spec.Containers[i]
+		if isInjectedContainer(container.Name) {
+			continue
+		}
+		for _, p := range containerProbes(container) {
+			if p.probe == nil {
+				continue
 			}
-			if appContainer.ReadinessProbe != nil && appContainer.ReadinessProbe.HTTPGet != nil {
+			switch {
+			case p.probe.HTTPGet != nil:
+				originalPort, err := probePortValue(*pod, *container, p.probe.HTTPGet.Port)
+				if err != nil {
+					return err
+				}
 				// We need to save original port first so that endpoints controller can use it for exposing paths.
-				pod.Annotations[annotationOriginalReadinessProbePort] = appContainer.ReadinessProbe.HTTPGet.Port.String()
-				listenerPort := defaultExposedPathsListenerPortReadiness
-				if raw, ok := pod.Annotations[annotationTransparentProxyReadinessListenerPort]; ok {
-					listenerPort, err = strconv.Atoi(raw)
-					if err != nil {
-						return err
-					}
+				pod.Annotations[originalProbePortAnnotation(p.kind, container.Name, i == firstAppContainer)] = strconv.Itoa(originalPort)
+				listenerPort, err := listenerPorts.allocate(p.kind, i == firstAppContainer)
+				if err != nil {
+					return err
+				}
+				p.probe.HTTPGet.Port = intstr.FromInt(listenerPort)
+			case p.probe.TCPSocket != nil:
+				port, err := probePortValue(*pod, *container, p.probe.TCPSocket.Port)
+				if err != nil {
+					return err
 				}
-				appContainer.ReadinessProbe.HTTPGet.Port = intstr.FromInt(listenerPort)
+				if !meshPorts[port] {
+					excludeInboundPorts = append(excludeInboundPorts, strconv.Itoa(port))
+				}
+			}
+		}
+	}
+
+	if len(excludeInboundPorts) > 0 {
+		ports := splitCommaSeparatedItemsFromAnnotation(annotationTProxyExcludeInboundPorts, *pod)
+		excluded := make(map[string]bool)
+		for _, port := range ports {
+			excluded[strings.TrimSpace(port)] = true
+		}
+		for _, port := range excludeInboundPorts {
+			if !excluded[port] {
+				excluded[port] = true
+				ports = append(ports, port)
 			}
 		}
+		pod.Annotations[annotationTProxyExcludeInboundPorts] = strings.Join(ports, ",")
 	}
 	return nil
 }
 
+// meshPorts returns the service port and the upstream ports of the pod, whose traffic
+// must not be excluded from redirection to Envoy.
+func (h *Handler) meshPorts(pod corev1.Pod) (map[int]bool, error) {
+	ports := make(map[int]bool)
+	if raw, ok := pod.Annotations[annotationPort]; ok && raw != "" {
+		port, err := portValue(pod, raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s annotation value of %q is not a valid port or named port: %s", annotationPort, raw, err)
+		}
+		ports[int(port)] = true
+	}
+	for _, upstream := range injectedUpstreams(pod, h.EnableNamespaces) {
+		if upstream.LocalBindPort > 0 {
+			ports[upstream.LocalBindPort] = true
+		}
+	}
+	return ports, nil
+}
+
 func (h *Handler) shouldInject(pod corev1.Pod, namespace string) (bool, error) {
 	// Don't inject in the Kubernetes system namespaces
 	if kubeSystemNamespaces.Contains(namespace) {
@@ -401,11 +631,17 @@ func (h *Handler) shouldInject(pod corev1.Pod, namespace string) (bool, error) {
 	return !h.RequireAnnotation, nil
 }
 
-func (h *Handler) defaultAnnotations(pod *corev1.Pod) error {
+func (h *Handler) defaultAnnotations(ctx context.Context, pod *corev1.Pod, namespace string) error {
 	if pod.Annotations == nil {
 		pod.Annotations = make(map[string]string)
 	}
 
+	// Settings that the pod doesn't set with its own annotations are
+	// defaulted from the ProxyInjectionPolicy that selects it.
+	if err := h.applyProxyInjectionPolicy(ctx, pod, namespace); err != nil {
+		return err
+	}
+
 	// Default service port is the first port exported in the container
 	if _, ok := pod.ObjectMeta.Annotations[annotationPort]; !ok {
 		if cs := pod.Spec.Containers; len(cs) > 0 {
@@ -450,16 +686,10 @@ func (h *Handler) consulNamespace(ns string) string {
 	return namespaces.ConsulNamespace(ns, h.EnableNamespaces, h.ConsulDestinationNamespace, h.EnableK8SNSMirroring, h.K8SNSMirroringPrefix)
 }
 
-func (h *Handler) validatePod(pod corev1.Pod) error {
-	if _, ok := pod.Annotations[annotationProtocol]; ok {
-		return fmt.Errorf("the %q annotation is no longer supported. Instead, create a ServiceDefaults resource (see www.consul.io/docs/k8s/crds/upgrade-to-crds)",
-			annotationProtocol)
-	}
-
-	if _, ok := pod.Annotations[annotationSyncPeriod]; ok {
-		return fmt.Errorf("the %q annotation is no longer supported because consul-sidecar is no longer injected to periodically register services", annotationSyncPeriod)
-	}
-	return nil
+// validatePod validates the annotations of the pod. It returns admission warnings for
+// deprecated and unknown annotations and an error that lists every invalid annotation.
+func (h *Handler) validatePod(pod corev1.Pod) ([]string, error) {
+	return validateAnnotations(pod, h.EnableNamespaces)
 }
 
 func portValue(pod corev1.Pod, value string) (int32, error) {
@@ -165,10 +165,34 @@ func TestHandlerHandle(t *testing.T) {
 					Operation: "add",
 					Path:      "/metadata/annotations/" + escapeJSONPointer(keyInjectStatus),
 				},
+				{
+					Operation: "add",
+					Path:      "/metadata/annotations/" + escapeJSONPointer(annotationSidecarProxyPublicListenerPort),
+				},
+				{
+					Operation: "add",
+					Path:      "/metadata/annotations/" + escapeJSONPointer(annotationSidecarProxyCheckInterval),
+				},
+				{
+					Operation: "add",
+					Path:      "/metadata/annotations/" + escapeJSONPointer(annotationSidecarProxyCheckTimeout),
+				},
+				{
+					Operation: "add",
+					Path:      "/metadata/annotations/" + escapeJSONPointer(annotationSidecarProxyDeregisterCriticalServiceAfter),
+				},
 				{
 					Operation: "add",
 					Path:      "/spec/volumes",
 				},
+				{
+					Operation: "add",
+					Path:      "/spec/containers/0/env",
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/containers/0/volumeMounts",
+				},
 				{
 					Operation: "add",
 					Path:      "/spec/initContainers",
@@ -246,6 +270,22 @@ func TestHandlerHandle(t *testing.T) {
 					Operation: "add",
 					Path:      "/metadata/annotations/" + escapeJSONPointer(keyInjectStatus),
 				},
+				{
+					Operation: "add",
+					Path:      "/metadata/annotations/" + escapeJSONPointer(annotationSidecarProxyPublicListenerPort),
+				},
+				{
+					Operation: "add",
+					Path:      "/metadata/annotations/" + escapeJSONPointer(annotationSidecarProxyCheckInterval),
+				},
+				{
+					Operation: "add",
+					Path:      "/metadata/annotations/" + escapeJSONPointer(annotationSidecarProxyCheckTimeout),
+				},
+				{
+					Operation: "add",
+					Path:      "/metadata/annotations/" + escapeJSONPointer(annotationSidecarProxyDeregisterCriticalServiceAfter),
+				},
 				{
 					Operation: "add",
 					Path:      "/metadata/labels",
@@ -293,6 +333,22 @@ func TestHandlerHandle(t *testing.T) {
 					Operation: "add",
 					Path:      "/metadata/annotations/" + escapeJSONPointer(keyInjectStatus),
 				},
+				{
+					Operation: "add",
+					Path:      "/metadata/annotations/" + escapeJSONPointer(annotationSidecarProxyPublicListenerPort),
+				},
+				{
+					Operation: "add",
+					Path:      "/metadata/annotations/" + escapeJSONPointer(annotationSidecarProxyCheckInterval),
+				},
+				{
+					Operation: "add",
+					Path:      "/metadata/annotations/" + escapeJSONPointer(annotationSidecarProxyCheckTimeout),
+				},
+				{
+					Operation: "add",
+					Path:      "/metadata/annotations/" + escapeJSONPointer(annotationSidecarProxyDeregisterCriticalServiceAfter),
+				},
 				{
 					Operation: "add",
 					Path:      "/metadata/labels",
@@ -402,6 +458,22 @@ func TestHandlerHandle(t *testing.T) {
 					Operation: "add",
 					Path:      "/metadata/annotations/" + escapeJSONPointer(keyInjectStatus),
 				},
+				{
+					Operation: "add",
+					Path:      "/metadata/annotations/" + escapeJSONPointer(annotationSidecarProxyPublicListenerPort),
+				},
+				{
+					Operation: "add",
+					Path:      "/metadata/annotations/" + escapeJSONPointer(annotationSidecarProxyCheckInterval),
+				},
+				{
+					Operation: "add",
+					Path:      "/metadata/annotations/" + escapeJSONPointer(annotationSidecarProxyCheckTimeout),
+				},
+				{
+					Operation: "add",
+					Path:      "/metadata/annotations/" + escapeJSONPointer(annotationSidecarProxyDeregisterCriticalServiceAfter),
+				},
 				{
 					Operation: "add",
 					Path:      "/metadata/annotations/" + escapeJSONPointer(annotationPrometheusScrape),
@@ -492,6 +564,22 @@ func TestHandlerHandle(t *testing.T) {
 					Operation: "add",
 					Path:      "/metadata/annotations/" + escapeJSONPointer(keyInjectStatus),
 				},
+				{
+					Operation: "add",
+					Path:      "/metadata/annotations/" + escapeJSONPointer(annotationSidecarProxyPublicListenerPort),
+				},
+				{
+					Operation: "add",
+					Path:      "/metadata/annotations/" + escapeJSONPointer(annotationSidecarProxyCheckInterval),
+				},
+				{
+					Operation: "add",
+					Path:      "/metadata/annotations/" + escapeJSONPointer(annotationSidecarProxyCheckTimeout),
+				},
+				{
+					Operation: "add",
+					Path:      "/metadata/annotations/" + escapeJSONPointer(annotationSidecarProxyDeregisterCriticalServiceAfter),
+				},
 				{
 					Operation: "add",
 					Path:      "/metadata/annotations/" + escapeJSONPointer(annotationOriginalLivenessProbePort),
@@ -536,26 +624,238 @@ func TestHandlerHandle(t *testing.T) {
 	}
 }
 
-// Test that we error out when deprecated annotations are set.
-func TestHandler_ErrorsOnDeprecatedAnnotations(t *testing.T) {
+// Test that pods in namespaces labeled to stop sidecars on application exit share
+// their process namespace and run the consul-sidecar to watch the application.
+func TestHandlerHandle_StopSidecarsOnAppExit(t *testing.T) {
+	s := runtime.NewScheme()
+	s.AddKnownTypes(schema.GroupVersion{Group: "", Version: "v1"}, &corev1.Pod{})
+	decoder, err := admission.NewDecoder(s)
+	require.NoError(t, err)
+
+	ns := corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "jobs",
+			Labels: map[string]string{keyStopSidecarsOnAppExit: "true"},
+		},
+	}
+	h := Handler{
+		Log:                   logrtest.TestLogger{T: t},
+		AllowK8sNamespacesSet: mapset.NewSetWith("*"),
+		DenyK8sNamespacesSet:  mapset.NewSet(),
+		decoder:               decoder,
+		Clientset:             fake.NewSimpleClientset(&ns),
+	}
+	pod := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "web",
+				},
+			},
+		},
+	}
+	resp := h.Handle(context.Background(), admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Namespace: ns.Name,
+			Object:    encodeRaw(t, pod),
+		},
+	})
+	require.True(t, resp.Allowed, resp.Result)
+
+	patched := applyPatches(t, pod, resp.Patches)
+	require.Nil(t, patched.Spec.ShareProcessNamespace)
+	require.Contains(t, patched.Spec.Volumes, appExitVolume())
+	require.Equal(t, "true", patched.Annotations[keyStopSidecarsOnAppExit])
+	require.Len(t, patched.Spec.Containers, 3)
+	require.Equal(t, consulSidecarContainer, patched.Spec.Containers[2].Name)
+	require.Contains(t, patched.Spec.Containers[2].Command, "-stop-on-app-exit=true")
+}
+
+// Test that the upstreams are added as environment variables to the application containers,
+// but not to the init containers of the pod that run before Envoy.
+func TestHandlerHandle_UpstreamEnvVars(t *testing.T) {
+	s := runtime.NewScheme()
+	s.AddKnownTypes(schema.GroupVersion{Group: "", Version: "v1"}, &corev1.Pod{})
+	decoder, err := admission.NewDecoder(s)
+	require.NoError(t, err)
+
+	h := Handler{
+		Log:                   logrtest.TestLogger{T: t},
+		AllowK8sNamespacesSet: mapset.NewSetWith("*"),
+		DenyK8sNamespacesSet:  mapset.NewSet(),
+		decoder:               decoder,
+		Clientset:             defaultTestClientWithNamespace(),
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				annotationUpstreams: "echo:1234",
+			},
+		},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{
+				{
+					Name: "web-init",
+				},
+			},
+			Containers: []corev1.Container{
+				{
+					Name: "web",
+				},
+				{
+					Name: "web-side",
+					Env:  []corev1.EnvVar{{Name: "DEBUG", Value: "true"}},
+				},
+			},
+		},
+	}
+	resp := h.Handle(context.Background(), admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Namespace: namespaces.DefaultNamespace,
+			Object:    encodeRaw(t, pod),
+		},
+	})
+	require.True(t, resp.Allowed, resp.Result)
+
+	patched := applyPatches(t, pod, resp.Patches)
+	upstreamEnvVars := []corev1.EnvVar{
+		{Name: "ECHO_CONNECT_SERVICE_HOST", Value: "127.0.0.1"},
+		{Name: "ECHO_CONNECT_SERVICE_PORT", Value: "1234"},
+	}
+	require.Equal(t, upstreamEnvVars, patched.Spec.Containers[0].Env)
+	require.Equal(t, append([]corev1.EnvVar{{Name: "DEBUG", Value: "true"}}, upstreamEnvVars...), patched.Spec.Containers[1].Env)
+	require.Equal(t, "web-init", patched.Spec.InitContainers[0].Name)
+	require.Empty(t, patched.Spec.InitContainers[0].Env)
+}
+
+// Test that transparent proxy pods reached by an IPv6 service are rejected when they enable
+// transparent proxy themselves, and only warned about when it is enabled by default.
+func TestHandlerHandle_TransparentProxyIPv6Services(t *testing.T) {
+	ns := corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	dualStack := corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec: corev1.ServiceSpec{
+			Selector:   map[string]string{"app": "web"},
+			IPFamilies: []corev1.IPFamily{corev1.IPv4Protocol, corev1.IPv6Protocol},
+		},
+	}
+	ipv4Only := corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-v4", Namespace: "default"},
+		Spec: corev1.ServiceSpec{
+			Selector:   map[string]string{"app": "web"},
+			IPFamilies: []corev1.IPFamily{corev1.IPv4Protocol},
+		},
+	}
+	otherApp := corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default"},
+		Spec: corev1.ServiceSpec{
+			Selector:   map[string]string{"app": "api"},
+			IPFamilies: []corev1.IPFamily{corev1.IPv6Protocol},
+		},
+	}
+
+	cases := map[string]struct {
+		services    []runtime.Object
+		annotations map[string]string
+		expAllowed  bool
+		expWarning  string
+		expErr      string
+	}{
+		"ipv4 services": {
+			services:   []runtime.Object{&ipv4Only, &otherApp},
+			expAllowed: true,
+		},
+		"dual-stack service, transparent proxy enabled by default": {
+			services:   []runtime.Object{&dualStack, &ipv4Only},
+			expAllowed: true,
+			expWarning: `transparent proxy only redirects IPv4 traffic, but Kubernetes services "web" reach the pod over IPv6, and that traffic bypasses Envoy`,
+		},
+		"dual-stack service, transparent proxy enabled by the pod": {
+			services:    []runtime.Object{&dualStack},
+			annotations: map[string]string{keyTransparentProxy: "true"},
+			expErr:      `transparent proxy only redirects IPv4 traffic, but Kubernetes services "web" reach the pod over IPv6; set the "consul.hashicorp.com/transparent-proxy" annotation to "false"`,
+		},
+		"dual-stack service, transparent proxy disabled by the pod": {
+			services:    []runtime.Object{&dualStack},
+			annotations: map[string]string{keyTransparentProxy: "false"},
+			expAllowed:  true,
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			s := runtime.NewScheme()
+			s.AddKnownTypes(schema.GroupVersion{Group: "", Version: "v1"}, &corev1.Pod{})
+			decoder, err := admission.NewDecoder(s)
+			require.NoError(t, err)
+
+			h := Handler{
+				Log:                    logrtest.TestLogger{T: t},
+				AllowK8sNamespacesSet:  mapset.NewSetWith("*"),
+				DenyK8sNamespacesSet:   mapset.NewSet(),
+				EnableTransparentProxy: true,
+				decoder:                decoder,
+				Clientset:              fake.NewSimpleClientset(append(c.services, &ns)...),
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      map[string]string{"app": "web"},
+					Annotations: c.annotations,
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}
+			resp := h.Handle(context.Background(), admission.Request{
+				AdmissionRequest: admissionv1.AdmissionRequest{
+					Namespace: ns.Name,
+					Object:    encodeRaw(t, pod),
+				},
+			})
+			require.Equal(t, c.expAllowed, resp.Allowed, resp.Result)
+			if c.expErr != "" {
+				require.Equal(t, c.expErr, resp.Result.Message)
+				return
+			}
+			if c.expWarning != "" {
+				require.Equal(t, []string{c.expWarning}, resp.Warnings)
+			} else {
+				require.Empty(t, resp.Warnings)
+			}
+		})
+	}
+}
+
+// Test that deprecated annotations are allowed with a warning.
+func TestHandler_WarnsOnDeprecatedAnnotations(t *testing.T) {
 	cases := []struct {
 		name        string
 		annotations map[string]string
-		expErr      string
+		expWarning  string
 	}{
 		{
 			"default protocol annotation",
 			map[string]string{
 				annotationProtocol: "http",
 			},
-			"the \"consul.hashicorp.com/connect-service-protocol\" annotation is no longer supported. Instead, create a ServiceDefaults resource (see www.consul.io/docs/k8s/crds/upgrade-to-crds)",
+			"the \"consul.hashicorp.com/connect-service-protocol\" annotation is no longer supported and is ignored. Instead, create a ServiceDefaults resource (see www.consul.io/docs/k8s/crds/upgrade-to-crds)",
 		},
 		{
 			"sync period annotation",
 			map[string]string{
 				annotationSyncPeriod: "30s",
 			},
-			"the \"consul.hashicorp.com/connect-sync-period\" annotation is no longer supported because consul-sidecar is no longer injected to periodically register services",
+			"the \"consul.hashicorp.com/connect-sync-period\" annotation is no longer supported and is ignored because consul-sidecar is no longer injected to periodically register services",
+		},
+		{
+			"connect tags annotation",
+			map[string]string{
+				annotationConnectTags: "abc",
+			},
+			"the \"consul.hashicorp.com/connect-service-tags\" annotation is deprecated, use \"consul.hashicorp.com/service-tags\" instead",
 		},
 	}
 
@@ -577,6 +877,8 @@ func TestHandler_ErrorsOnDeprecatedAnnotations(t *testing.T) {
 				decoder:               decoder,
 			}
 
+			// The pod opts out of injection so that only validation is exercised.
+			c.annotations[annotationInject] = "false"
 			request := admission.Request{
 				AdmissionRequest: admissionv1.AdmissionRequest{
 					Namespace: "default",
@@ -596,8 +898,121 @@ func TestHandler_ErrorsOnDeprecatedAnnotations(t *testing.T) {
 			}
 
 			response := handler.Handle(context.Background(), request)
-			require.False(response.Allowed)
-			require.Equal(c.expErr, response.Result.Message)
+			require.True(response.Allowed)
+			require.Equal([]string{c.expWarning}, response.Warnings)
+		})
+	}
+}
+
+// Test that all invalid annotations are reported in a single denial.
+func TestHandler_ErrorsOnInvalidAnnotations(t *testing.T) {
+	require := require.New(t)
+	s := runtime.NewScheme()
+	s.AddKnownTypes(schema.GroupVersion{
+		Group:   "",
+		Version: "v1",
+	}, &corev1.Pod{})
+	decoder, err := admission.NewDecoder(s)
+	require.NoError(err)
+
+	handler := Handler{
+		Log:                   logrtest.TestLogger{T: t},
+		AllowK8sNamespacesSet: mapset.NewSetWith("*"),
+		DenyK8sNamespacesSet:  mapset.NewSet(),
+		decoder:               decoder,
+	}
+
+	request := admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Namespace: "default",
+			Object: encodeRaw(t, &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						annotationProtocol:             "http",
+						annotationEnableMetrics:        "yes please",
+						annotationUpstreams:            "db:notaport",
+						annotationSidecarProxyCPULimit: "lots",
+					},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}),
+		},
+	}
+
+	response := handler.Handle(context.Background(), request)
+	require.False(response.Allowed)
+	require.Contains(response.Result.Message, "3 errors occurred")
+	require.Contains(response.Result.Message, `"consul.hashicorp.com/enable-metrics" annotation is invalid`)
+	require.Contains(response.Result.Message, `"consul.hashicorp.com/connect-service-upstreams" annotation is invalid`)
+	require.Contains(response.Result.Message, `"consul.hashicorp.com/sidecar-proxy-cpu-limit" annotation is invalid`)
+	require.Len(response.Warnings, 1)
+}
+
+// Test that pods that aren't injected are allowed even if their annotations are invalid.
+func TestHandler_SkippedPodsWithInvalidAnnotations(t *testing.T) {
+	cases := map[string]struct {
+		namespace   string
+		annotations map[string]string
+	}{
+		"system namespace": {
+			namespace:   "kube-system",
+			annotations: map[string]string{},
+		},
+		"denied namespace": {
+			namespace:   "denied",
+			annotations: map[string]string{},
+		},
+		"injection disabled": {
+			namespace:   "default",
+			annotations: map[string]string{annotationInject: "false"},
+		},
+		"already injected": {
+			namespace:   "default",
+			annotations: map[string]string{keyInjectStatus: injected},
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			s := runtime.NewScheme()
+			s.AddKnownTypes(schema.GroupVersion{Group: "", Version: "v1"}, &corev1.Pod{})
+			decoder, err := admission.NewDecoder(s)
+			require.NoError(t, err)
+
+			handler := Handler{
+				Log:                   logrtest.TestLogger{T: t},
+				AllowK8sNamespacesSet: mapset.NewSetWith("*"),
+				DenyK8sNamespacesSet:  mapset.NewSetWith("denied"),
+				decoder:               decoder,
+			}
+
+			c.annotations[annotationProtocol] = "http"
+			c.annotations[annotationEnableMetrics] = "yes please"
+			response := handler.Handle(context.Background(), admission.Request{
+				AdmissionRequest: admissionv1.AdmissionRequest{
+					Namespace: c.namespace,
+					Object: encodeRaw(t, &corev1.Pod{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: c.annotations,
+						},
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{
+								{
+									Name: "web",
+								},
+							},
+						},
+					}),
+				},
+			})
+			require.True(t, response.Allowed, response.Result)
+			require.Empty(t, response.Patches)
+			require.Len(t, response.Warnings, 1)
 		})
 	}
 }
@@ -721,7 +1136,7 @@ func TestHandlerDefaultAnnotations(t *testing.T) {
 			require := require.New(t)
 
 			var h Handler
-			err := h.defaultAnnotations(tt.Pod)
+			err := h.defaultAnnotations(context.Background(), tt.Pod, "default")
 			if (tt.Err != "") != (err != nil) {
 				t.Fatalf("actual: %v, expected err: %v", err, tt.Err)
 			}
@@ -0,0 +1,101 @@
+package connectinject
+
+import (
+	"context"
+	"net"
+	"sort"
+
+	"github.com/hashicorp/consul/api"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// taggedAddressLANIPv4 and taggedAddressLANIPv6 are the keys of the tagged addresses
+	// that Consul uses for the address of each IP family.
+	taggedAddressLANIPv4 = "lan_ipv4"
+	taggedAddressLANIPv6 = "lan_ipv6"
+)
+
+// isIPv6 returns true if the address is an IPv6 address.
+func isIPv6(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && parsed.To4() == nil
+}
+
+// podIPs returns the IPs of the pod with the primary IP, i.e. pod.Status.PodIP, first.
+// Pods on dual-stack clusters have an IP of each family.
+func podIPs(pod corev1.Pod) []string {
+	var ips []string
+	if pod.Status.PodIP != "" {
+		ips = append(ips, pod.Status.PodIP)
+	}
+	for _, podIP := range pod.Status.PodIPs {
+		if podIP.IP != pod.Status.PodIP {
+			ips = append(ips, podIP.IP)
+		}
+	}
+	return ips
+}
+
+// loopbackAddress returns the loopback address of the pod's primary IP family, which
+// Envoy uses to reach the application.
+func loopbackAddress(pod corev1.Pod) string {
+	if isIPv6(pod.Status.PodIP) {
+		return "::1"
+	}
+	return "127.0.0.1"
+}
+
+// wildcardAddress returns the address that listens on all addresses of the pod's primary
+// IP family.
+func wildcardAddress(pod corev1.Pod) string {
+	if isIPv6(pod.Status.PodIP) {
+		return "::"
+	}
+	return "0.0.0.0"
+}
+
+// ipv6Services returns the names of the Kubernetes services that select the pod and have an
+// IPv6 cluster IP family, i.e. that reach the pod over IPv6, sorted by name.
+func (h *Handler) ipv6Services(ctx context.Context, pod corev1.Pod) ([]string, error) {
+	services, err := h.Clientset.CoreV1().Services(pod.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, svc := range services.Items {
+		if len(svc.Spec.Selector) == 0 || !labels.SelectorFromSet(svc.Spec.Selector).Matches(labels.Set(pod.Labels)) {
+			continue
+		}
+		for _, family := range svc.Spec.IPFamilies {
+			if family == corev1.IPv6Protocol {
+				names = append(names, svc.Name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// podTaggedAddresses returns the tagged addresses for the IPs of each family of a dual-stack
+// pod, so that the secondary family can be discovered in Consul, which only registers one
+// address for the service. Single-stack pods have no tagged addresses.
+func podTaggedAddresses(pod corev1.Pod, port int) map[string]api.ServiceAddress {
+	taggedAddresses := make(map[string]api.ServiceAddress)
+	for _, ip := range podIPs(pod) {
+		key := taggedAddressLANIPv4
+		if isIPv6(ip) {
+			key = taggedAddressLANIPv6
+		}
+		if _, ok := taggedAddresses[key]; !ok {
+			taggedAddresses[key] = api.ServiceAddress{Address: ip, Port: port}
+		}
+	}
+	if len(taggedAddresses) < 2 {
+		return nil
+	}
+	return taggedAddresses
+}
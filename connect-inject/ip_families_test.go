@@ -0,0 +1,159 @@
+package connectinject
+
+import (
+	"context"
+	"testing"
+
+	logrtest "github.com/go-logr/logr/testing"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func podWithIPs(ips ...string) corev1.Pod {
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "pod1",
+			Namespace:   "default",
+			Annotations: map[string]string{annotationPort: "8080"},
+		},
+	}
+	if len(ips) > 0 {
+		pod.Status.PodIP = ips[0]
+	}
+	for _, ip := range ips {
+		pod.Status.PodIPs = append(pod.Status.PodIPs, corev1.PodIP{IP: ip})
+	}
+	return pod
+}
+
+func TestIPFamilies(t *testing.T) {
+	t.Parallel()
+	cases := map[string]struct {
+		pod                corev1.Pod
+		expPodIPs          []string
+		expLoopback        string
+		expWildcard        string
+		expTaggedAddresses map[string]api.ServiceAddress
+	}{
+		"IPv4": {
+			pod:         podWithIPs("1.2.3.4"),
+			expPodIPs:   []string{"1.2.3.4"},
+			expLoopback: "127.0.0.1",
+			expWildcard: "0.0.0.0",
+		},
+		"IPv6": {
+			pod:         podWithIPs("2001:db8::1"),
+			expPodIPs:   []string{"2001:db8::1"},
+			expLoopback: "::1",
+			expWildcard: "::",
+		},
+		"dual-stack with IPv4 primary": {
+			pod:         podWithIPs("1.2.3.4", "2001:db8::1"),
+			expPodIPs:   []string{"1.2.3.4", "2001:db8::1"},
+			expLoopback: "127.0.0.1",
+			expWildcard: "0.0.0.0",
+			expTaggedAddresses: map[string]api.ServiceAddress{
+				taggedAddressLANIPv4: {Address: "1.2.3.4", Port: 8080},
+				taggedAddressLANIPv6: {Address: "2001:db8::1", Port: 8080},
+			},
+		},
+		"dual-stack with IPv6 primary": {
+			pod:         podWithIPs("2001:db8::1", "1.2.3.4"),
+			expPodIPs:   []string{"2001:db8::1", "1.2.3.4"},
+			expLoopback: "::1",
+			expWildcard: "::",
+			expTaggedAddresses: map[string]api.ServiceAddress{
+				taggedAddressLANIPv4: {Address: "1.2.3.4", Port: 8080},
+				taggedAddressLANIPv6: {Address: "2001:db8::1", Port: 8080},
+			},
+		},
+		"only the primary IP is known": {
+			pod: corev1.Pod{
+				Status: corev1.PodStatus{PodIP: "1.2.3.4"},
+			},
+			expPodIPs:   []string{"1.2.3.4"},
+			expLoopback: "127.0.0.1",
+			expWildcard: "0.0.0.0",
+		},
+	}
+	for name, c := range cases {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, c.expPodIPs, podIPs(c.pod))
+			require.Equal(t, c.expLoopback, loopbackAddress(c.pod))
+			require.Equal(t, c.expWildcard, wildcardAddress(c.pod))
+			require.Equal(t, c.expTaggedAddresses, podTaggedAddresses(c.pod, 8080))
+		})
+	}
+}
+
+func TestCreateServiceRegistrations_IPFamilies(t *testing.T) {
+	t.Parallel()
+	cases := map[string]struct {
+		pod                     corev1.Pod
+		expCheckTCP             string
+		expLocalServiceAddress  string
+		expPrometheusBindAddr   string
+		expServiceTaggedAddress map[string]api.ServiceAddress
+		expProxyTaggedAddress   map[string]api.ServiceAddress
+	}{
+		"IPv4": {
+			pod:                    podWithIPs("1.2.3.4"),
+			expCheckTCP:            "1.2.3.4:20000",
+			expLocalServiceAddress: "127.0.0.1",
+			expPrometheusBindAddr:  "0.0.0.0:20200",
+		},
+		"IPv6": {
+			pod:                    podWithIPs("2001:db8::1"),
+			expCheckTCP:            "[2001:db8::1]:20000",
+			expLocalServiceAddress: "::1",
+			expPrometheusBindAddr:  "[::]:20200",
+		},
+		"dual-stack": {
+			pod:                    podWithIPs("2001:db8::1", "1.2.3.4"),
+			expCheckTCP:            "[2001:db8::1]:20000",
+			expLocalServiceAddress: "::1",
+			expPrometheusBindAddr:  "[::]:20200",
+			expServiceTaggedAddress: map[string]api.ServiceAddress{
+				taggedAddressLANIPv4: {Address: "1.2.3.4", Port: 8080},
+				taggedAddressLANIPv6: {Address: "2001:db8::1", Port: 8080},
+			},
+			expProxyTaggedAddress: map[string]api.ServiceAddress{
+				taggedAddressLANIPv4: {Address: "1.2.3.4", Port: 20000},
+				taggedAddressLANIPv6: {Address: "2001:db8::1", Port: 20000},
+			},
+		},
+	}
+	for name, c := range cases {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			endpoints := corev1.Endpoints{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "web",
+					Namespace: "default",
+				},
+			}
+			ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+			ep := EndpointsController{
+				Client: fake.NewClientBuilder().WithRuntimeObjects(ns).Build(),
+				MetricsConfig: MetricsConfig{
+					DefaultEnableMetrics:        true,
+					DefaultPrometheusScrapePort: "20200",
+				},
+				Log:     logrtest.TestLogger{T: t},
+				Context: context.Background(),
+			}
+			service, proxyService, err := ep.createServiceRegistrations(c.pod, endpoints)
+			require.NoError(t, err)
+			require.Equal(t, c.pod.Status.PodIP, service.Address)
+			require.Equal(t, c.expServiceTaggedAddress, service.TaggedAddresses)
+			require.Equal(t, c.expProxyTaggedAddress, proxyService.TaggedAddresses)
+			require.Equal(t, c.expCheckTCP, proxyService.Checks[0].TCP)
+			require.Equal(t, c.expLocalServiceAddress, proxyService.Proxy.LocalServiceAddress)
+			require.Equal(t, c.expPrometheusBindAddr, proxyService.Proxy.Config[envoyPrometheusBindAddr])
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package connectinject
+
+import (
+	"fmt"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// LifecycleConfig represents configuration common to connect-inject components related to
+// the lifecycle of the Envoy sidecar.
+type LifecycleConfig struct {
+	// DefaultEnableProxyLifecycle holds the start of application containers until Envoy
+	// is ready and drains Envoy before it's stopped.
+	DefaultEnableProxyLifecycle bool
+	// DefaultShutdownGracePeriodSeconds is how long Envoy keeps running after its
+	// listeners have been drained when the pod is terminated.
+	DefaultShutdownGracePeriodSeconds int
+}
+
+// enableProxyLifecycle returns whether the Envoy lifecycle hooks are enabled either via the
+// default value in the handler, or if it's been overridden via the annotation.
+func (lc LifecycleConfig) enableProxyLifecycle(pod corev1.Pod) (bool, error) {
+	enabled := lc.DefaultEnableProxyLifecycle
+	if raw, ok := pod.Annotations[annotationEnableSidecarProxyLifecycle]; ok && raw != "" {
+		enableProxyLifecycle, err := strconv.ParseBool(raw)
+		if err != nil {
+			return false, fmt.Errorf("%s annotation value of %s was invalid: %s", annotationEnableSidecarProxyLifecycle, raw, err)
+		}
+		enabled = enableProxyLifecycle
+	}
+	return enabled, nil
+}
+
+// shutdownGracePeriodSeconds returns how long Envoy should keep running after it's been drained,
+// either via the default value in the handler, or if it's been overridden via the annotation.
+func (lc LifecycleConfig) shutdownGracePeriodSeconds(pod corev1.Pod) (int, error) {
+	if raw, ok := pod.Annotations[annotationSidecarProxyLifecycleShutdownGracePeriodSeconds]; ok && raw != "" {
+		seconds, err := strconv.Atoi(raw)
+		if err != nil || seconds < 0 {
+			return 0, fmt.Errorf("%s annotation value of %s must be a non-negative integer", annotationSidecarProxyLifecycleShutdownGracePeriodSeconds, raw)
+		}
+		return seconds, nil
+	}
+	return lc.DefaultShutdownGracePeriodSeconds, nil
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 
 	corev1 "k8s.io/api/core/v1"
 )
@@ -119,6 +120,10 @@ func (mc MetricsConfig) serviceMetricsPort(pod corev1.Pod) (string, error) {
 	// If that has been set, it'll be used as the port for getting service
 	// metrics as well, unless overridden by the service-metrics-port annotation.
 	if raw, ok := pod.Annotations[annotationPort]; ok && raw != "" {
+		// Multi-port pods only merge the metrics of their first service.
+		if isMultiPort(pod) {
+			raw = strings.TrimSpace(strings.Split(raw, ",")[0])
+		}
 		// The service metrics port can be privileged if the service author has
 		// written their service in such a way that it expects to be able to use
 		// privileged ports. So, the port metrics are exposed on the service can
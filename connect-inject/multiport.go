@@ -0,0 +1,141 @@
+package connectinject
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// multiPortInfo identifies one of the Consul services of a multi-port pod.
+// The zero value describes a regular pod that registers a single service.
+type multiPortInfo struct {
+	// serviceIndex is the position of the service in the comma-separated
+	// consul.hashicorp.com/connect-service annotation. It is used to derive
+	// ports that have to be unique per Envoy proxy within the pod.
+	serviceIndex int
+	// serviceName is the name of the Consul service.
+	serviceName string
+	// servicePort is the name or value of the port the service listens on,
+	// taken from the same position in the consul.hashicorp.com/connect-service-port
+	// annotation.
+	servicePort string
+}
+
+// isMultiPort returns true if the pod registers more than one Consul service,
+// i.e. the consul.hashicorp.com/connect-service annotation is a comma-separated list.
+func isMultiPort(pod corev1.Pod) bool {
+	return strings.Contains(pod.Annotations[annotationService], ",")
+}
+
+// multiPortServices returns a multiPortInfo for every service listed on a multi-port pod.
+// It returns an error if the service names are invalid or if the number of ports in the
+// consul.hashicorp.com/connect-service-port annotation doesn't match the number of services.
+func multiPortServices(pod corev1.Pod) ([]multiPortInfo, error) {
+	names := strings.Split(pod.Annotations[annotationService], ",")
+	// The ports are listed in their own annotation rather than next to each service.
+	for _, name := range names {
+		if strings.Contains(name, ":") {
+			return nil, fmt.Errorf("%s annotation %q must only list service names, list their ports in the %s annotation, e.g. %q and %q",
+				annotationService, pod.Annotations[annotationService], annotationPort, "web,web-admin", "8080,9090")
+		}
+	}
+	ports := strings.Split(pod.Annotations[annotationPort], ",")
+	if len(ports) != len(names) {
+		return nil, fmt.Errorf("%s annotation must list a port for each of the %d services in the %s annotation, got %q",
+			annotationPort, len(names), annotationService, pod.Annotations[annotationPort])
+	}
+
+	seen := make(map[string]bool)
+	var services []multiPortInfo
+	for i, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("%s annotation %q contains an empty service name", annotationService, pod.Annotations[annotationService])
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("%s annotation %q contains duplicate service %q", annotationService, pod.Annotations[annotationService], name)
+		}
+		seen[name] = true
+
+		port := strings.TrimSpace(ports[i])
+		if p, err := portValue(pod, port); err != nil || p <= 0 {
+			return nil, fmt.Errorf("port %q for service %q is not a valid port or named port on the pod", port, name)
+		}
+
+		services = append(services, multiPortInfo{
+			serviceIndex: i,
+			serviceName:  name,
+			servicePort:  port,
+		})
+	}
+	return services, nil
+}
+
+// multiPortInfoForService returns the multiPortInfo of the service with the given name
+// on a multi-port pod. The boolean is false if the pod doesn't register that service.
+func multiPortInfoForService(pod corev1.Pod, serviceName string) (multiPortInfo, bool, error) {
+	services, err := multiPortServices(pod)
+	if err != nil {
+		return multiPortInfo{}, false, err
+	}
+	for _, svc := range services {
+		if svc.serviceName == serviceName {
+			return svc, true, nil
+		}
+	}
+	return multiPortInfo{}, false, nil
+}
+
+// serviceAnnotation returns the value of a per-service annotation. On multi-port pods
+// the annotation can be scoped to one of the services by suffixing its key with
+// ".<service-name>", e.g. consul.hashicorp.com/connect-service-upstreams.admin.
+// The unscoped annotation only applies to the first service of a multi-port pod so
+// that two Envoy proxies are never configured to bind the same local ports.
+func serviceAnnotation(pod corev1.Pod, annotation string, mpi multiPortInfo) (string, bool) {
+	if mpi.serviceName != "" {
+		if raw, ok := pod.Annotations[fmt.Sprintf("%s.%s", annotation, mpi.serviceName)]; ok {
+			return raw, true
+		}
+		if mpi.serviceIndex > 0 {
+			return "", false
+		}
+	}
+	raw, ok := pod.Annotations[annotation]
+	return raw, ok
+}
+
+// envoyBootstrapFile returns the path of the Envoy bootstrap config written by the
+// init container for the service.
+func envoyBootstrapFile(mpi multiPortInfo) string {
+	if mpi.serviceName == "" {
+		return "/consul/connect-inject/envoy-bootstrap.yaml"
+	}
+	return fmt.Sprintf("/consul/connect-inject/envoy-bootstrap-%s.yaml", mpi.serviceName)
+}
+
+// envoySidecarContainerName returns the name of the Envoy container for the service.
+func envoySidecarContainerName(mpi multiPortInfo) string {
+	if mpi.serviceName == "" {
+		return envoySidecarContainer
+	}
+	return fmt.Sprintf("%s-%s", envoySidecarContainer, mpi.serviceName)
+}
+
+// injectableMultiPortServices validates that a multi-port pod can be injected and returns its services.
+// Transparent proxy redirects all inbound traffic to a single Envoy and ACL tokens obtained by
+// connect-init are tied to a single service identity, so neither is supported on multi-port pods.
+func (h *Handler) injectableMultiPortServices(ns corev1.Namespace, pod corev1.Pod) ([]multiPortInfo, error) {
+	tproxyEnabled, err := transparentProxyEnabled(ns, pod, h.EnableTransparentProxy)
+	if err != nil {
+		return nil, err
+	}
+	if tproxyEnabled {
+		return nil, fmt.Errorf("multi-port pods are not supported with transparent proxy; set the %q annotation to \"false\"", keyTransparentProxy)
+	}
+	if h.AuthMethod != "" {
+		return nil, errors.New("multi-port pods are not supported when ACLs are enabled")
+	}
+	return multiPortServices(pod)
+}
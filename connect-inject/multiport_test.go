@@ -0,0 +1,290 @@
+package connectinject
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	mapset "github.com/deckarep/golang-set"
+	logrtest "github.com/go-logr/logr/testing"
+	"github.com/hashicorp/consul-k8s/namespaces"
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestMultiPortServices(t *testing.T) {
+	t.Parallel()
+	cases := map[string]struct {
+		annotations map[string]string
+		expServices []multiPortInfo
+		expErr      string
+	}{
+		"named and numbered ports": {
+			annotations: map[string]string{
+				annotationService: "web,web-admin",
+				annotationPort:    "http, 9090",
+			},
+			expServices: []multiPortInfo{
+				{serviceIndex: 0, serviceName: "web", servicePort: "http"},
+				{serviceIndex: 1, serviceName: "web-admin", servicePort: "9090"},
+			},
+		},
+		"fewer ports than services": {
+			annotations: map[string]string{
+				annotationService: "web,web-admin",
+				annotationPort:    "http",
+			},
+			expErr: `consul.hashicorp.com/connect-service-port annotation must list a port for each of the 2 services in the consul.hashicorp.com/connect-service annotation, got "http"`,
+		},
+		"ports next to the services": {
+			annotations: map[string]string{
+				annotationService: "web:8080,web-admin:9090",
+			},
+			expErr: `consul.hashicorp.com/connect-service annotation "web:8080,web-admin:9090" must only list service names, list their ports in the consul.hashicorp.com/connect-service-port annotation, e.g. "web,web-admin" and "8080,9090"`,
+		},
+		"empty service name": {
+			annotations: map[string]string{
+				annotationService: "web,",
+				annotationPort:    "http,9090",
+			},
+			expErr: `consul.hashicorp.com/connect-service annotation "web," contains an empty service name`,
+		},
+		"duplicate service name": {
+			annotations: map[string]string{
+				annotationService: "web,web",
+				annotationPort:    "http,9090",
+			},
+			expErr: `consul.hashicorp.com/connect-service annotation "web,web" contains duplicate service "web"`,
+		},
+		"unknown named port": {
+			annotations: map[string]string{
+				annotationService: "web,web-admin",
+				annotationPort:    "http,metrics",
+			},
+			expErr: `port "metrics" for service "web-admin" is not a valid port or named port on the pod`,
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			pod := multiPortPod()
+			pod.Annotations = c.annotations
+			services, err := multiPortServices(*pod)
+			if c.expErr != "" {
+				require.EqualError(t, err, c.expErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.expServices, services)
+		})
+	}
+}
+
+func TestServiceAnnotation(t *testing.T) {
+	t.Parallel()
+	pod := multiPortPod()
+	pod.Annotations[annotationUpstreams] = "db:1234"
+	pod.Annotations[annotationUpstreams+".web-admin"] = "auth:1235"
+	web := multiPortInfo{serviceIndex: 0, serviceName: "web", servicePort: "http"}
+	admin := multiPortInfo{serviceIndex: 1, serviceName: "web-admin", servicePort: "9090"}
+
+	// Regular pods only use the unscoped annotation.
+	raw, ok := serviceAnnotation(*pod, annotationUpstreams, multiPortInfo{})
+	require.True(t, ok)
+	require.Equal(t, "db:1234", raw)
+
+	// The first service falls back to the unscoped annotation.
+	raw, ok = serviceAnnotation(*pod, annotationUpstreams, web)
+	require.True(t, ok)
+	require.Equal(t, "db:1234", raw)
+
+	// Other services only use the annotation scoped to them.
+	raw, ok = serviceAnnotation(*pod, annotationUpstreams, admin)
+	require.True(t, ok)
+	require.Equal(t, "auth:1235", raw)
+
+	delete(pod.Annotations, annotationUpstreams+".web-admin")
+	_, ok = serviceAnnotation(*pod, annotationUpstreams, admin)
+	require.False(t, ok)
+}
+
+func TestHandlerHandle_MultiPort(t *testing.T) {
+	t.Parallel()
+	s := runtime.NewScheme()
+	s.AddKnownTypes(schema.GroupVersion{Group: "", Version: "v1"}, &corev1.Pod{})
+	decoder, err := admission.NewDecoder(s)
+	require.NoError(t, err)
+
+	cases := map[string]struct {
+		handler       Handler
+		annotations   map[string]string
+		expContainers []string
+		expErr        string
+	}{
+		"one envoy sidecar per service": {
+			handler: Handler{},
+			annotations: map[string]string{
+				annotationService: "web,web-admin",
+				annotationPort:    "http,9090",
+			},
+			expContainers: []string{"web", "envoy-sidecar-web", "envoy-sidecar-web-admin"},
+		},
+		"transparent proxy enabled": {
+			handler: Handler{EnableTransparentProxy: true},
+			annotations: map[string]string{
+				annotationService: "web,web-admin",
+				annotationPort:    "http,9090",
+			},
+			expErr: "error configuring multi-port pod: multi-port pods are not supported with transparent proxy",
+		},
+		"ACLs enabled": {
+			handler: Handler{AuthMethod: "auth-method"},
+			annotations: map[string]string{
+				annotationService: "web,web-admin",
+				annotationPort:    "http,9090",
+			},
+			expErr: "error configuring multi-port pod: multi-port pods are not supported when ACLs are enabled",
+		},
+		"missing ports": {
+			handler: Handler{},
+			annotations: map[string]string{
+				annotationService: "web,web-admin",
+			},
+			expErr: "consul.hashicorp.com/connect-service-port annotation must list a port for each of the 2 services",
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			h := c.handler
+			h.Log = logrtest.TestLogger{T: t}
+			h.AllowK8sNamespacesSet = mapset.NewSetWith("*")
+			h.DenyK8sNamespacesSet = mapset.NewSet()
+			h.Clientset = defaultTestClientWithNamespace()
+			h.decoder = decoder
+
+			pod := multiPortPod()
+			pod.Annotations = c.annotations
+			resp := h.Handle(context.Background(), admission.Request{
+				AdmissionRequest: admissionv1.AdmissionRequest{
+					Namespace: namespaces.DefaultNamespace,
+					Object:    encodeRaw(t, pod),
+				},
+			})
+			if c.expErr != "" {
+				require.False(t, resp.Allowed)
+				require.Contains(t, resp.Result.Message, c.expErr)
+				return
+			}
+			require.True(t, resp.Allowed, resp.Result)
+
+			var containerNames []string
+			for _, patch := range resp.Patches {
+				if patch.Path == "/spec/containers/1" || patch.Path == "/spec/containers/2" {
+					containerNames = append(containerNames, patch.Value.(map[string]interface{})["name"].(string))
+				}
+			}
+			require.Equal(t, c.expContainers[1:], containerNames)
+		})
+	}
+}
+
+func TestCreateServiceRegistrations_MultiPort(t *testing.T) {
+	t.Parallel()
+	pod := multiPortPod()
+	pod.Name = "pod1"
+	pod.Namespace = "default"
+	pod.Status.PodIP = "1.2.3.4"
+	pod.Annotations[annotationService] = "web,web-admin"
+	pod.Annotations[annotationPort] = "http,9090"
+	pod.Annotations[annotationEnableMetrics] = "true"
+	pod.Annotations[annotationUpstreams] = "db:1234"
+	pod.Annotations[annotationUpstreams+".web-admin"] = "auth:1235"
+
+	ns := corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	epCtrl := EndpointsController{
+		Client:        fake.NewClientBuilder().WithRuntimeObjects(pod, &ns).Build(),
+		MetricsConfig: MetricsConfig{DefaultPrometheusScrapePort: "20200"},
+		Log:           logrtest.TestLogger{T: t},
+	}
+
+	cases := []struct {
+		endpoints       string
+		expServicePort  int
+		expProxyPort    int
+		expMetricsBind  string
+		expUpstreamName string
+	}{
+		{
+			endpoints:       "web",
+			expServicePort:  8080,
+			expProxyPort:    20000,
+			expMetricsBind:  "0.0.0.0:20200",
+			expUpstreamName: "db",
+		},
+		{
+			endpoints:       "web-admin",
+			expServicePort:  9090,
+			expProxyPort:    20001,
+			expMetricsBind:  "0.0.0.0:20201",
+			expUpstreamName: "auth",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.endpoints, func(t *testing.T) {
+			endpoints := corev1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: c.endpoints, Namespace: "default"}}
+			service, proxy, err := epCtrl.createServiceRegistrations(*pod, endpoints)
+			require.NoError(t, err)
+
+			require.Equal(t, "pod1-"+c.endpoints, service.ID)
+			require.Equal(t, c.endpoints, service.Name)
+			require.Equal(t, c.expServicePort, service.Port)
+			require.Equal(t, c.endpoints, service.Meta[MetaKeyKubeServiceName])
+
+			require.Equal(t, "pod1-"+c.endpoints+"-sidecar-proxy", proxy.ID)
+			require.Equal(t, c.expProxyPort, proxy.Port)
+			require.Equal(t, c.expServicePort, proxy.Proxy.LocalServicePort)
+			require.Equal(t, c.expMetricsBind, proxy.Proxy.Config[envoyPrometheusBindAddr])
+			require.Len(t, proxy.Proxy.Upstreams, 1)
+			require.Equal(t, c.expUpstreamName, proxy.Proxy.Upstreams[0].DestinationName)
+			require.Equal(t, fmt.Sprintf("1.2.3.4:%d", c.expProxyPort), proxy.Checks[0].TCP)
+			require.Equal(t, service.ID, proxy.Checks[1].AliasService)
+		})
+	}
+
+	// Endpoints of a service that the pod doesn't list are rejected.
+	_, _, err := epCtrl.createServiceRegistrations(*pod, corev1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "default"}})
+	require.EqualError(t, err, `multi-port pod "pod1" does not register a service for endpoints "other"`)
+}
+
+// multiPortPod returns a pod exposing an application port and an admin port.
+func multiPortPod() *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "web",
+					Ports: []corev1.ContainerPort{
+						{
+							Name:          "http",
+							ContainerPort: 8080,
+						},
+						{
+							Name:          "admin",
+							ContainerPort: 9090,
+						},
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,68 @@
+package connectinject
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+// namespaceDefaultAnnotations are the pod annotations that can be defaulted for all pods
+// in a Kubernetes namespace by setting the same annotation on the Namespace object.
+// consul.hashicorp.com/transparent-proxy and consul.hashicorp.com/stop-sidecars-on-app-exit
+// aren't among them since they're defaulted with Namespace labels of the same name.
+var namespaceDefaultAnnotations = []string{
+	annotationSidecarProxyCPULimit,
+	annotationSidecarProxyCPURequest,
+	annotationSidecarProxyMemoryLimit,
+	annotationSidecarProxyMemoryRequest,
+	annotationEnableMetrics,
+	annotationEnableMetricsMerging,
+	annotationMergedMetricsPort,
+	annotationPrometheusScrapePort,
+	annotationPrometheusScrapePath,
+	annotationServiceMetricsPort,
+	annotationServiceMetricsPath,
+	annotationEnableSidecarProxyLifecycle,
+	annotationSidecarProxyLifecycleShutdownGracePeriodSeconds,
+	annotationEnvoyExtraArgs,
+	annotationTProxyExcludeInboundPorts,
+	annotationTProxyExcludeOutboundPorts,
+	annotationTProxyExcludeOutboundCIDRs,
+	annotationTProxyExcludeUIDs,
+	annotationTransparentProxyOverwriteProbes,
+	annotationTransparentProxyReadinessListenerPort,
+	annotationTransparentProxyLivenessListenerPort,
+}
+
+// annotationValue returns the effective value of an annotation for a pod in the namespace.
+// The pod's annotation takes precedence over the namespace's annotation, which only applies
+// to the annotations in namespaceDefaultAnnotations. The boolean is false if neither sets
+// the annotation, in which case the flags of the injector apply.
+func annotationValue(namespace corev1.Namespace, pod corev1.Pod, key string) (string, bool) {
+	if raw, ok := pod.Annotations[key]; ok {
+		return raw, true
+	}
+	for _, defaultKey := range namespaceDefaultAnnotations {
+		if key == defaultKey {
+			raw, ok := namespace.Annotations[key]
+			return raw, ok
+		}
+	}
+	return "", false
+}
+
+// withNamespaceDefaults returns a copy of the pod whose annotations include the namespace's
+// defaults for all annotations in namespaceDefaultAnnotations that the pod doesn't set.
+// Both the handler and the endpoints controller resolve annotations with it so that they
+// agree on the effective settings of the pod.
+func withNamespaceDefaults(namespace corev1.Namespace, pod corev1.Pod) corev1.Pod {
+	annotations := make(map[string]string, len(pod.Annotations))
+	for key, value := range pod.Annotations {
+		annotations[key] = value
+	}
+	for _, key := range namespaceDefaultAnnotations {
+		if raw, ok := annotationValue(namespace, pod, key); ok {
+			annotations[key] = raw
+		}
+	}
+	pod.Annotations = annotations
+	return pod
+}
@@ -0,0 +1,238 @@
+package connectinject
+
+import (
+	"context"
+	"testing"
+
+	mapset "github.com/deckarep/golang-set"
+	logrtest "github.com/go-logr/logr/testing"
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	ctrlfake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestAnnotationValue(t *testing.T) {
+	t.Parallel()
+	cases := map[string]struct {
+		podAnnotations map[string]string
+		nsAnnotations  map[string]string
+		key            string
+		expValue       string
+		expOK          bool
+	}{
+		"unset": {
+			key: annotationSidecarProxyCPULimit,
+		},
+		"pod annotation": {
+			podAnnotations: map[string]string{annotationSidecarProxyCPULimit: "100m"},
+			key:            annotationSidecarProxyCPULimit,
+			expValue:       "100m",
+			expOK:          true,
+		},
+		"namespace annotation": {
+			nsAnnotations: map[string]string{annotationSidecarProxyCPULimit: "200m"},
+			key:           annotationSidecarProxyCPULimit,
+			expValue:      "200m",
+			expOK:         true,
+		},
+		"pod annotation takes precedence over namespace annotation": {
+			podAnnotations: map[string]string{annotationSidecarProxyCPULimit: "100m"},
+			nsAnnotations:  map[string]string{annotationSidecarProxyCPULimit: "200m"},
+			key:            annotationSidecarProxyCPULimit,
+			expValue:       "100m",
+			expOK:          true,
+		},
+		"empty pod annotation takes precedence over namespace annotation": {
+			podAnnotations: map[string]string{annotationEnvoyExtraArgs: ""},
+			nsAnnotations:  map[string]string{annotationEnvoyExtraArgs: "--log-level debug"},
+			key:            annotationEnvoyExtraArgs,
+			expValue:       "",
+			expOK:          true,
+		},
+		"namespace annotation that can't be defaulted": {
+			nsAnnotations: map[string]string{annotationUpstreams: "db:1234"},
+			key:           annotationUpstreams,
+		},
+		"namespace annotation of a setting defaulted by namespace label": {
+			nsAnnotations: map[string]string{keyTransparentProxy: "false"},
+			key:           keyTransparentProxy,
+		},
+	}
+	for name, c := range cases {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			ns := corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Annotations: c.nsAnnotations}}
+			pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: c.podAnnotations}}
+			value, ok := annotationValue(ns, pod, c.key)
+			require.Equal(t, c.expOK, ok)
+			require.Equal(t, c.expValue, value)
+		})
+	}
+}
+
+func TestWithNamespaceDefaults(t *testing.T) {
+	t.Parallel()
+	ns := corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				annotationSidecarProxyCPULimit:       "200m",
+				annotationTProxyExcludeOutboundCIDRs: "10.0.0.0/8",
+				annotationUpstreams:                  "db:1234",
+			},
+		},
+	}
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				annotationSidecarProxyCPULimit: "100m",
+			},
+		},
+	}
+	defaulted := withNamespaceDefaults(ns, pod)
+	require.Equal(t, map[string]string{
+		annotationSidecarProxyCPULimit:       "100m",
+		annotationTProxyExcludeOutboundCIDRs: "10.0.0.0/8",
+	}, defaulted.Annotations)
+	// The annotations of the original pod aren't modified.
+	require.Equal(t, map[string]string{annotationSidecarProxyCPULimit: "100m"}, pod.Annotations)
+}
+
+// Test that the handler and the endpoints controller resolve the same effective value
+// for a setting that can be set by the pod, its namespace or the injector's flags.
+func TestNamespaceDefaults_Precedence(t *testing.T) {
+	t.Parallel()
+	cases := map[string]struct {
+		podAnnotations map[string]string
+		nsAnnotations  map[string]string
+		expPort        string
+	}{
+		"flag": {
+			expPort: "20200",
+		},
+		"namespace": {
+			nsAnnotations: map[string]string{annotationPrometheusScrapePort: "20300"},
+			expPort:       "20300",
+		},
+		"pod": {
+			podAnnotations: map[string]string{annotationPrometheusScrapePort: "20400"},
+			nsAnnotations:  map[string]string{annotationPrometheusScrapePort: "20300"},
+			expPort:        "20400",
+		},
+	}
+	for name, c := range cases {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			metricsConfig := MetricsConfig{
+				DefaultEnableMetrics:        true,
+				DefaultPrometheusScrapePort: "20200",
+				DefaultPrometheusScrapePath: "/metrics",
+			}
+			ns := corev1.Namespace{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "default",
+					Annotations: c.nsAnnotations,
+				},
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "pod1",
+					Namespace:   ns.Name,
+					Annotations: c.podAnnotations,
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}
+
+			// The handler records the effective port in the Prometheus annotations.
+			s := runtime.NewScheme()
+			s.AddKnownTypes(schema.GroupVersion{Group: "", Version: "v1"}, &corev1.Pod{})
+			decoder, err := admission.NewDecoder(s)
+			require.NoError(t, err)
+			h := Handler{
+				Log:                   logrtest.TestLogger{T: t},
+				AllowK8sNamespacesSet: mapset.NewSetWith("*"),
+				DenyK8sNamespacesSet:  mapset.NewSet(),
+				MetricsConfig:         metricsConfig,
+				decoder:               decoder,
+				Clientset:             fake.NewSimpleClientset(&ns),
+			}
+			resp := h.Handle(context.Background(), admission.Request{
+				AdmissionRequest: admissionv1.AdmissionRequest{
+					Namespace: ns.Name,
+					Object:    encodeRaw(t, pod),
+				},
+			})
+			require.True(t, resp.Allowed, resp.Result)
+			patched := applyPatches(t, pod, resp.Patches)
+			require.Equal(t, c.expPort, patched.Annotations[annotationPrometheusPort])
+
+			// The endpoints controller registers the proxy with the same port, including for
+			// pods that were injected before the namespace default was set.
+			endpoints := corev1.Endpoints{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "web",
+					Namespace: ns.Name,
+				},
+			}
+			ep := EndpointsController{
+				Client:        ctrlfake.NewClientBuilder().WithRuntimeObjects(&ns).Build(),
+				MetricsConfig: metricsConfig,
+				Log:           logrtest.TestLogger{T: t},
+				Context:       context.Background(),
+			}
+			_, proxyService, err := ep.createServiceRegistrations(*pod, endpoints)
+			require.NoError(t, err)
+			require.Equal(t, "0.0.0.0:"+c.expPort, proxyService.Proxy.Config[envoyPrometheusBindAddr])
+		})
+	}
+}
+
+// Test that invalid namespace defaults are reported when a pod is created.
+func TestHandlerHandle_InvalidNamespaceDefaults(t *testing.T) {
+	s := runtime.NewScheme()
+	s.AddKnownTypes(schema.GroupVersion{Group: "", Version: "v1"}, &corev1.Pod{})
+	decoder, err := admission.NewDecoder(s)
+	require.NoError(t, err)
+
+	ns := corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "default",
+			Annotations: map[string]string{annotationTProxyExcludeUIDs: "root"},
+		},
+	}
+	h := Handler{
+		Log:                   logrtest.TestLogger{T: t},
+		AllowK8sNamespacesSet: mapset.NewSetWith("*"),
+		DenyK8sNamespacesSet:  mapset.NewSet(),
+		decoder:               decoder,
+		Clientset:             fake.NewSimpleClientset(&ns),
+	}
+	resp := h.Handle(context.Background(), admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Namespace: ns.Name,
+			Object: encodeRaw(t, &corev1.Pod{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}),
+		},
+	})
+	require.False(t, resp.Allowed)
+	require.Contains(t, resp.Result.Message, `error validating namespace defaults`)
+	require.Contains(t, resp.Result.Message, `"consul.hashicorp.com/transparent-proxy-exclude-uids" annotation is invalid: "root" is not a user ID`)
+}
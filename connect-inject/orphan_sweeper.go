@@ -0,0 +1,188 @@
+package connectinject
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-multierror"
+	"golang.org/x/time/rate"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1beta1 "k8s.io/api/discovery/v1beta1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// OrphanSweeper periodically deregisters the service instances managed by the endpoints
+// controller that no longer belong to a live pod of the Kubernetes service they were
+// registered for. The endpoints controller only deregisters instances in response to
+// events, so instances are left behind if it misses the deletion of an Endpoints object
+// while it's down or while the agent the instances are registered with is unreachable.
+// It implements controller-runtime's manager.Runnable and only runs on the leader.
+type OrphanSweeper struct {
+	// Controller is the endpoints controller whose registrations are swept. Its
+	// configuration is used to find the agents to sweep.
+	Controller *EndpointsController
+	// Interval is the time between sweeps.
+	Interval time.Duration
+	// RateLimit is the maximum number of instances deregistered per second.
+	RateLimit rate.Limit
+	// DryRun only logs the instances that would be deregistered.
+	DryRun bool
+	Log    logr.Logger
+}
+
+// Start runs a sweep every interval until the context is cancelled.
+func (s *OrphanSweeper) Start(ctx context.Context) error {
+	limiter := rate.NewLimiter(s.RateLimit, 1)
+	for {
+		select {
+		case <-time.After(s.Interval):
+			if err := s.sweep(ctx, limiter); err != nil {
+				s.Log.Error(err, "failed to sweep orphaned service instances")
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// sweep deregisters the orphaned service instances, waiting on the limiter before each
+// deregistration.
+func (s *OrphanSweeper) sweep(ctx context.Context, limiter *rate.Limiter) error {
+	instances, err := s.managedInstances(ctx)
+	if err != nil {
+		return err
+	}
+	s.Log.Info("sweeping service instances", "count", len(instances), "dry-run", s.DryRun)
+
+	var errs error
+	for _, instance := range instances {
+		// Instances being drained are deregistered by the controller.
+		if _, ok := s.Controller.drainingInstances.get(drainingInstanceKey(instance.service)); ok {
+			continue
+		}
+		reason, err := s.orphanReason(ctx, instance.service)
+		if err != nil {
+			errs = multierror.Append(errs, err)
+			continue
+		}
+		if reason == "" {
+			continue
+		}
+		if s.DryRun {
+			s.Log.Info("would deregister orphaned service instance", "id", instance.service.ID, "reason", reason)
+			continue
+		}
+		if err := limiter.Wait(ctx); err != nil {
+			return err
+		}
+		s.Log.Info("deregistering orphaned service instance", "id", instance.service.ID, "reason", reason)
+		if err := deregisterInstance(instance); err != nil {
+			s.Log.Error(err, "failed to deregister orphaned service instance", "id", instance.service.ID)
+			errs = multierror.Append(errs, err)
+		}
+	}
+	return errs
+}
+
+// managedInstances lists the service instances managed by the endpoints controller on all
+// agents.
+func (s *OrphanSweeper) managedInstances(ctx context.Context) ([]registeredInstance, error) {
+	r := s.Controller
+	filter := fmt.Sprintf("Meta[%q] == %q", MetaKeyManagedBy, managedByValue)
+	// Instances are swept across all Consul namespaces.
+	namespace := ""
+	if r.EnableConsulNamespaces {
+		namespace = "*"
+	}
+	instances, err := r.registeredInstances(ctx, namespace, filter)
+	if err != nil && instances == nil {
+		return nil, err
+	} else if err != nil {
+		// An unreachable agent doesn't stop the sweep of the others.
+		s.Log.Error(err, "failed to get service instances")
+	}
+	return instances, nil
+}
+
+// orphanReason returns why the service instance is orphaned, or an empty string if it still
+// belongs to a live pod that's an endpoint of the Kubernetes service it was registered for, or to a
+// live pod if it was registered for a pod that no Kubernetes service selects.
+// Instances in Kubernetes namespaces that the controller ignores are never orphaned.
+func (s *OrphanSweeper) orphanReason(ctx context.Context, svc *api.AgentService) (string, error) {
+	r := s.Controller
+	k8sNamespace := svc.Meta[MetaKeyKubeNS]
+	k8sServiceName := svc.Meta[MetaKeyKubeServiceName]
+	podName := svc.Meta[MetaKeyPodName]
+	serviceless := svc.Meta[MetaKeyServiceless] == "true"
+	if k8sNamespace == "" || (k8sServiceName == "" && !serviceless) || podName == "" {
+		return "", nil
+	}
+	if shouldIgnore(k8sNamespace, r.DenyK8sNamespacesSet, r.AllowK8sNamespacesSet) {
+		return "", nil
+	}
+
+	// Instances of a pod that was replaced by a pod with the same name, e.g. of a StatefulSet,
+	// are deregistered by the controller when it reconciles the service.
+	var pod corev1.Pod
+	err := r.Client.Get(ctx, types.NamespacedName{Name: podName, Namespace: k8sNamespace}, &pod)
+	if k8serrors.IsNotFound(err) {
+		return "pod not found", nil
+	} else if err != nil {
+		return "", err
+	}
+	// Instances of pods that no Kubernetes service selects belong to their pod as long as it exists.
+	if serviceless {
+		return "", nil
+	}
+	isEndpoint, err := s.isEndpoint(ctx, k8sNamespace, k8sServiceName, podName)
+	if err != nil {
+		return "", err
+	}
+	if !isEndpoint {
+		return "pod is not an endpoint of the service", nil
+	}
+	return "", nil
+}
+
+// isEndpoint returns true if the pod is an endpoint of the Kubernetes service, based on its
+// EndpointSlices or Endpoints depending on which of them the controller reconciles.
+func (s *OrphanSweeper) isEndpoint(ctx context.Context, namespace, serviceName, podName string) (bool, error) {
+	r := s.Controller
+	if r.EnableEndpointSlices {
+		var slices discoveryv1beta1.EndpointSliceList
+		err := r.Client.List(ctx, &slices,
+			client.InNamespace(namespace),
+			client.MatchingLabels{discoveryv1beta1.LabelServiceName: serviceName})
+		if err != nil {
+			return false, err
+		}
+		for _, address := range endpointSliceAddresses(slices.Items, nil) {
+			if address.address.TargetRef.Name == podName {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	var endpoints corev1.Endpoints
+	err := r.Client.Get(ctx, types.NamespacedName{Name: serviceName, Namespace: namespace}, &endpoints)
+	if k8serrors.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	for _, subset := range endpoints.Subsets {
+		addresses := append(subset.Addresses, subset.NotReadyAddresses...)
+		for _, address := range addresses {
+			if address.TargetRef != nil && address.TargetRef.Kind == "Pod" && address.TargetRef.Name == podName {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,205 @@
+package connectinject
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	mapset "github.com/deckarep/golang-set"
+	logrtest "github.com/go-logr/logr/testing"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/sdk/testutil"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1beta1 "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func managedInstance(podName, namespace string) *api.AgentService {
+	return &api.AgentService{
+		ID:      podName + "-service-created",
+		Service: "service-created",
+		Meta: map[string]string{
+			MetaKeyPodName:         podName,
+			MetaKeyKubeNS:          namespace,
+			MetaKeyKubeServiceName: "service-created",
+			MetaKeyManagedBy:       managedByValue,
+		},
+	}
+}
+
+func serviceCreatedEndpoints(podNames ...string) *corev1.Endpoints {
+	endpoints := &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "service-created",
+			Namespace: "default",
+		},
+	}
+	var addresses []corev1.EndpointAddress
+	for _, name := range podNames {
+		addresses = append(addresses, corev1.EndpointAddress{
+			TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: name, Namespace: "default"},
+		})
+	}
+	// Not ready endpoints belong to the service as well.
+	endpoints.Subsets = []corev1.EndpointSubset{{NotReadyAddresses: addresses}}
+	return endpoints
+}
+
+// servicelessInstance returns a service instance of a pod that no Kubernetes service selects.
+func servicelessInstance(podName string) *api.AgentService {
+	return &api.AgentService{
+		ID:      podName + "-client",
+		Service: "client",
+		Meta: map[string]string{
+			MetaKeyPodName:     podName,
+			MetaKeyKubeNS:      "default",
+			MetaKeyServiceless: "true",
+			MetaKeyManagedBy:   managedByValue,
+		},
+	}
+}
+
+func TestOrphanReason(t *testing.T) {
+	t.Parallel()
+	cases := map[string]struct {
+		instance      *api.AgentService
+		k8sObjects    []runtime.Object
+		endpointSlice bool
+		expReason     string
+	}{
+		"live pod": {
+			instance:   managedInstance("pod1", "default"),
+			k8sObjects: []runtime.Object{createPod("pod1", "1.2.3.4", true, true), serviceCreatedEndpoints("pod1")},
+		},
+		"pod not found": {
+			instance:   managedInstance("pod1", "default"),
+			k8sObjects: []runtime.Object{serviceCreatedEndpoints("pod1")},
+			expReason:  "pod not found",
+		},
+		"endpoints not found": {
+			instance:   managedInstance("pod1", "default"),
+			k8sObjects: []runtime.Object{createPod("pod1", "1.2.3.4", true, true)},
+			expReason:  "pod is not an endpoint of the service",
+		},
+		"pod not in endpoints": {
+			instance:   managedInstance("pod1", "default"),
+			k8sObjects: []runtime.Object{createPod("pod1", "1.2.3.4", true, true), serviceCreatedEndpoints("pod2")},
+			expReason:  "pod is not an endpoint of the service",
+		},
+		"ignored namespace": {
+			instance: managedInstance("pod1", "denied"),
+		},
+		"missing metadata": {
+			instance: &api.AgentService{ID: "pod1-service-created", Meta: map[string]string{MetaKeyManagedBy: managedByValue}},
+		},
+		"live serviceless pod": {
+			instance:   servicelessInstance("pod1"),
+			k8sObjects: []runtime.Object{createPod("pod1", "1.2.3.4", true, true)},
+		},
+		"serviceless pod not found": {
+			instance:  servicelessInstance("pod1"),
+			expReason: "pod not found",
+		},
+		"live pod with EndpointSlices": {
+			instance: managedInstance("pod1", "default"),
+			k8sObjects: []runtime.Object{
+				createPod("pod1", "1.2.3.4", true, true),
+				endpointSlice("service-created-abcde", discoveryv1beta1.AddressTypeIPv4, sliceEndpoint("pod1", "1.2.3.4", false)),
+			},
+			endpointSlice: true,
+		},
+		"pod not in EndpointSlices": {
+			instance: managedInstance("pod1", "default"),
+			k8sObjects: []runtime.Object{
+				createPod("pod1", "1.2.3.4", true, true),
+				endpointSlice("service-created-abcde", discoveryv1beta1.AddressTypeIPv4, sliceEndpoint("pod2", "2.3.4.5", true)),
+			},
+			endpointSlice: true,
+			expReason:     "pod is not an endpoint of the service",
+		},
+	}
+	for name, c := range cases {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			sweeper := OrphanSweeper{
+				Controller: &EndpointsController{
+					Client:                fake.NewClientBuilder().WithRuntimeObjects(c.k8sObjects...).Build(),
+					AllowK8sNamespacesSet: mapset.NewSetWith("*"),
+					DenyK8sNamespacesSet:  mapset.NewSetWith("denied"),
+					EnableEndpointSlices:  c.endpointSlice,
+				},
+				Log: logrtest.TestLogger{T: t},
+			}
+			reason, err := sweeper.orphanReason(context.Background(), c.instance)
+			require.NoError(t, err)
+			require.Equal(t, c.expReason, reason)
+		})
+	}
+}
+
+// Test that a sweep deregisters the orphaned instances managed by the controller from the
+// agents and leaves the others alone, and that a dry run doesn't deregister anything.
+func TestOrphanSweeper_Sweep(t *testing.T) {
+	t.Parallel()
+	for _, dryRun := range []bool{false, true} {
+		dryRun := dryRun
+		t.Run(map[bool]string{false: "sweep", true: "dry run"}[dryRun], func(t *testing.T) {
+			fakeClientPod := createPod("fake-consul-client", "127.0.0.1", false, true)
+			fakeClientPod.Labels = map[string]string{"component": "client", "app": "consul", "release": "consul"}
+			fakeClient := fake.NewClientBuilder().WithRuntimeObjects(
+				fakeClientPod, createPod("pod1", "1.2.3.4", true, true), serviceCreatedEndpoints("pod1"),
+			).Build()
+
+			consul, err := testutil.NewTestServerConfigT(t, nil)
+			require.NoError(t, err)
+			defer consul.Stop()
+			consul.WaitForLeader(t)
+			cfg := &api.Config{Address: consul.HTTPAddr}
+			consulClient, err := api.NewClient(cfg)
+			require.NoError(t, err)
+
+			legacy := managedInstance("pod3", "default")
+			delete(legacy.Meta, MetaKeyManagedBy)
+			for _, svc := range []*api.AgentService{managedInstance("pod1", "default"), managedInstance("pod2", "default"), legacy} {
+				require.NoError(t, consulClient.Agent().ServiceRegister(&api.AgentServiceRegistration{
+					ID:   svc.ID,
+					Name: svc.Service,
+					Meta: svc.Meta,
+				}))
+			}
+
+			sweeper := OrphanSweeper{
+				Controller: &EndpointsController{
+					Client:                fakeClient,
+					ConsulClientCfg:       cfg,
+					ConsulPort:            strings.Split(consul.HTTPAddr, ":")[1],
+					ConsulScheme:          "http",
+					AllowK8sNamespacesSet: mapset.NewSetWith("*"),
+					DenyK8sNamespacesSet:  mapset.NewSetWith(),
+					ReleaseName:           "consul",
+					ReleaseNamespace:      "default",
+					Log:                   logrtest.TestLogger{T: t},
+				},
+				DryRun: dryRun,
+				Log:    logrtest.TestLogger{T: t},
+			}
+			require.NoError(t, sweeper.sweep(context.Background(), rate.NewLimiter(rate.Inf, 1)))
+
+			services, err := consulClient.Agent().Services()
+			require.NoError(t, err)
+			var ids []string
+			for id := range services {
+				ids = append(ids, id)
+			}
+			if dryRun {
+				require.ElementsMatch(t, []string{"pod1-service-created", "pod2-service-created", "pod3-service-created"}, ids)
+			} else {
+				require.ElementsMatch(t, []string{"pod1-service-created", "pod3-service-created"}, ids)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package connectinject
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+const (
+	// conditionTypeServiceConflict is the type of the pod condition that the endpoints controller
+	// sets when the Kubernetes service a pod is registered for can't be chosen unambiguously, e.g.
+	// because more than one Kubernetes service selects the pod.
+	conditionTypeServiceConflict corev1.PodConditionType = "consul.hashicorp.com/kubernetes-service-conflict"
+
+	conditionReasonMultipleServices   = "MultipleKubernetesServices"
+	conditionReasonServiceNotSelected = "KubernetesServiceNotSelecting"
+	conditionReasonNoConflict         = "NoConflict"
+)
+
+// primaryKubernetesService returns the name of the Kubernetes service that the pod is registered
+// for, and the names of the Kubernetes services that select the pod in alphabetical order. Pods
+// register a single Consul service and a single proxy, except for multi-port pods, so when more
+// than one Kubernetes service selects them they're only registered for one of them: the one in the
+// consul.hashicorp.com/kubernetes-service annotation, or else the first one in alphabetical order.
+// The name is empty if no Kubernetes service selects the pod, e.g. if its Endpoints are managed
+// without a selector, and the annotation isn't set.
+func (r *EndpointsController) primaryKubernetesService(ctx context.Context, pod corev1.Pod) (string, []string, error) {
+	selecting, err := r.selectingServices(ctx, pod)
+	if err != nil {
+		return "", nil, err
+	}
+	if name := pod.Annotations[annotationKubernetesService]; name != "" {
+		return name, selecting, nil
+	}
+	if len(selecting) == 0 {
+		return "", nil, nil
+	}
+	return selecting[0], selecting, nil
+}
+
+// selectingServices returns the names of the Kubernetes services in the pod's namespace that select
+// the pod, in alphabetical order. Services without a selector don't select pods.
+func (r *EndpointsController) selectingServices(ctx context.Context, pod corev1.Pod) ([]string, error) {
+	var services corev1.ServiceList
+	if err := r.Client.List(ctx, &services, client.InNamespace(pod.Namespace)); err != nil {
+		return nil, err
+	}
+	var selecting []string
+	for _, svc := range services.Items {
+		if len(svc.Spec.Selector) == 0 {
+			continue
+		}
+		if labels.SelectorFromSet(svc.Spec.Selector).Matches(labels.Set(pod.Labels)) {
+			selecting = append(selecting, svc.Name)
+		}
+	}
+	sort.Strings(selecting)
+	return selecting, nil
+}
+
+// updateServiceConflictCondition reports on the pod why it's only registered for the primary
+// Kubernetes service, or why it isn't registered at all if the annotation names a Kubernetes
+// service that doesn't select it. Once the conflict is resolved, the condition is set to false.
+// Pods that never had a conflict don't get the condition.
+func (r *EndpointsController) updateServiceConflictCondition(ctx context.Context, pod corev1.Pod, primary string, selecting []string) error {
+	condition := corev1.PodCondition{
+		Type:               conditionTypeServiceConflict,
+		Status:             corev1.ConditionTrue,
+		LastTransitionTime: metav1.Now(),
+	}
+	_, annotated := pod.Annotations[annotationKubernetesService]
+	switch {
+	case annotated && len(selecting) > 0 && !containsString(selecting, primary):
+		condition.Reason = conditionReasonServiceNotSelected
+		condition.Message = fmt.Sprintf("The %s annotation is %q but that Kubernetes service doesn't select the pod, "+
+			"which is selected by %s, so the pod isn't registered with Consul",
+			annotationKubernetesService, primary, quotedList(selecting))
+	case !annotated && len(selecting) > 1:
+		condition.Reason = conditionReasonMultipleServices
+		condition.Message = fmt.Sprintf("The pod is selected by Kubernetes services %s and is only registered with Consul for %q. "+
+			"Set the %s annotation to choose the Kubernetes service, or list the services in the %s annotation to register each of them",
+			quotedList(selecting), primary, annotationKubernetesService, annotationService)
+	default:
+		if !hasPodCondition(pod, conditionTypeServiceConflict) {
+			return nil
+		}
+		condition.Status = corev1.ConditionFalse
+		condition.Reason = conditionReasonNoConflict
+		condition.Message = "The pod isn't selected by more than one Kubernetes service"
+		if primary != "" {
+			condition.Message = fmt.Sprintf("The pod is registered with Consul for Kubernetes service %q", primary)
+		}
+	}
+	return r.patchPodCondition(ctx, pod, condition)
+}
+
+// The primary Kubernetes service of a pod changes when a Kubernetes service starts or stops selecting
+// it, or when its consul.hashicorp.com/kubernetes-service annotation changes. The Endpoints of the
+// Kubernetes services that the pod joins or leaves change, but those of the other Kubernetes services
+// that select it don't, so the pod would stay registered for the previous primary service. All the
+// Kubernetes services that select the pod are reconciled instead.
+
+// primaryServiceServicePredicate lets through the events of Kubernetes services that may change
+// which Kubernetes services select some pods.
+var primaryServiceServicePredicate = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		oldService, ok := e.ObjectOld.(*corev1.Service)
+		if !ok {
+			return false
+		}
+		newService, ok := e.ObjectNew.(*corev1.Service)
+		if !ok {
+			return false
+		}
+		return !reflect.DeepEqual(oldService.Spec.Selector, newService.Spec.Selector)
+	},
+	GenericFunc: func(event.GenericEvent) bool { return false },
+}
+
+// primaryServicePodPredicate lets through the updates of pods that may change their primary
+// Kubernetes service. The Endpoints of pods that are created or deleted change anyway.
+var primaryServicePodPredicate = predicate.Funcs{
+	CreateFunc: func(event.CreateEvent) bool { return false },
+	DeleteFunc: func(event.DeleteEvent) bool { return false },
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		if !hasBeenInjected(podOf(e.ObjectNew)) {
+			return false
+		}
+		return e.ObjectOld.GetAnnotations()[annotationKubernetesService] != e.ObjectNew.GetAnnotations()[annotationKubernetesService] ||
+			!reflect.DeepEqual(e.ObjectOld.GetLabels(), e.ObjectNew.GetLabels())
+	},
+	GenericFunc: func(event.GenericEvent) bool { return false },
+}
+
+// requestsForServicesSelectingPodsOfService enqueues the Kubernetes service and every Kubernetes
+// service that selects any of the injected pods it selects.
+func (r *EndpointsController) requestsForServicesSelectingPodsOfService(object client.Object) []ctrl.Request {
+	svc, ok := object.(*corev1.Service)
+	if !ok || len(svc.Spec.Selector) == 0 {
+		return []ctrl.Request{}
+	}
+	var pods corev1.PodList
+	if err := r.Client.List(r.Context, &pods, client.InNamespace(svc.Namespace), client.MatchingLabels(svc.Spec.Selector)); err != nil {
+		r.Log.Error(err, "failed to list pods", "ns", svc.Namespace)
+		return []ctrl.Request{}
+	}
+	requests := r.requestsForServicesSelectingPods(svc.Namespace, pods.Items)
+	for _, request := range requests {
+		if request.Name == svc.Name {
+			return requests
+		}
+	}
+	return append(requests, ctrl.Request{NamespacedName: types.NamespacedName{Name: svc.Name, Namespace: svc.Namespace}})
+}
+
+// requestsForServicesSelectingPod enqueues every Kubernetes service that selects the injected pod.
+func (r *EndpointsController) requestsForServicesSelectingPod(object client.Object) []ctrl.Request {
+	return r.requestsForServicesSelectingPods(object.GetNamespace(), []corev1.Pod{podOf(object)})
+}
+
+// requestsForServicesSelectingPods returns a request for each Kubernetes service in the namespace
+// that selects any of the pods that are registered for a single Kubernetes service.
+func (r *EndpointsController) requestsForServicesSelectingPods(namespace string, pods []corev1.Pod) []ctrl.Request {
+	var registered []corev1.Pod
+	for _, pod := range pods {
+		if hasBeenInjected(pod) && pod.Labels[keyManagedBy] == managedByValue && !isMultiPort(pod) {
+			registered = append(registered, pod)
+		}
+	}
+	if len(registered) == 0 {
+		return []ctrl.Request{}
+	}
+	var services corev1.ServiceList
+	if err := r.Client.List(r.Context, &services, client.InNamespace(namespace)); err != nil {
+		r.Log.Error(err, "failed to list services", "ns", namespace)
+		return []ctrl.Request{}
+	}
+	var requests []ctrl.Request
+	for _, svc := range services.Items {
+		if len(svc.Spec.Selector) == 0 {
+			continue
+		}
+		selector := labels.SelectorFromSet(svc.Spec.Selector)
+		for _, pod := range registered {
+			if selector.Matches(labels.Set(pod.Labels)) {
+				requests = append(requests, ctrl.Request{NamespacedName: types.NamespacedName{Name: svc.Name, Namespace: svc.Namespace}})
+				break
+			}
+		}
+	}
+	return requests
+}
+
+// podOf returns the pod of a watch event, or an empty pod if the object isn't a pod.
+func podOf(object client.Object) corev1.Pod {
+	if pod, ok := object.(*corev1.Pod); ok {
+		return *pod
+	}
+	return corev1.Pod{}
+}
+
+// hasPodCondition returns true if the pod has a condition of the type.
+func hasPodCondition(pod corev1.Pod, conditionType corev1.PodConditionType) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == conditionType {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// quotedList returns the items quoted and separated by commas, e.g. "a", "b".
+func quotedList(items []string) string {
+	quoted := make([]string, len(items))
+	for i, item := range items {
+		quoted[i] = fmt.Sprintf("%q", item)
+	}
+	return strings.Join(quoted, ", ")
+}
@@ -0,0 +1,356 @@
+package connectinject
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	mapset "github.com/deckarep/golang-set"
+	logrtest "github.com/go-logr/logr/testing"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/sdk/testutil"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// selectingService returns a Kubernetes service in the namespace that selects pods with the app label.
+func selectingService(name, namespace, app string) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": app}},
+	}
+}
+
+func TestPrimaryKubernetesService(t *testing.T) {
+	t.Parallel()
+	cases := map[string]struct {
+		annotation   string
+		k8sObjects   []runtime.Object
+		expPrimary   string
+		expSelecting []string
+	}{
+		"no services": {},
+		"single service": {
+			k8sObjects:   []runtime.Object{selectingService("web", "default", "web")},
+			expPrimary:   "web",
+			expSelecting: []string{"web"},
+		},
+		"first service in alphabetical order": {
+			k8sObjects: []runtime.Object{
+				selectingService("web-canary", "default", "web"),
+				selectingService("web", "default", "web"),
+			},
+			expPrimary:   "web",
+			expSelecting: []string{"web", "web-canary"},
+		},
+		"annotation": {
+			annotation: "web-canary",
+			k8sObjects: []runtime.Object{
+				selectingService("web-canary", "default", "web"),
+				selectingService("web", "default", "web"),
+			},
+			expPrimary:   "web-canary",
+			expSelecting: []string{"web", "web-canary"},
+		},
+		"services that don't select the pod": {
+			k8sObjects: []runtime.Object{
+				selectingService("api", "default", "api"),
+				selectingService("web", "other", "web"),
+				&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "external", Namespace: "default"}},
+			},
+		},
+	}
+	for name, c := range cases {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			pod := *createPod("pod1", "1.2.3.4", true, true)
+			pod.Labels["app"] = "web"
+			if c.annotation != "" {
+				pod.Annotations[annotationKubernetesService] = c.annotation
+			}
+			ep := &EndpointsController{
+				Client: fake.NewClientBuilder().WithRuntimeObjects(c.k8sObjects...).Build(),
+				Log:    logrtest.TestLogger{T: t},
+			}
+			primary, selecting, err := ep.primaryKubernetesService(context.Background(), pod)
+			require.NoError(t, err)
+			require.Equal(t, c.expPrimary, primary)
+			require.Equal(t, c.expSelecting, selecting)
+		})
+	}
+}
+
+func TestUpdateServiceConflictCondition(t *testing.T) {
+	t.Parallel()
+	conflict := corev1.PodCondition{
+		Type:    conditionTypeServiceConflict,
+		Status:  corev1.ConditionTrue,
+		Reason:  conditionReasonMultipleServices,
+		Message: "conflict",
+	}
+	cases := map[string]struct {
+		annotation    string
+		primary       string
+		selecting     []string
+		conditions    []corev1.PodCondition
+		expConditions []corev1.PodCondition
+	}{
+		"single service": {
+			primary:   "web",
+			selecting: []string{"web"},
+		},
+		"multiple services": {
+			primary:   "web",
+			selecting: []string{"web", "web-canary"},
+			expConditions: []corev1.PodCondition{{
+				Type:   conditionTypeServiceConflict,
+				Status: corev1.ConditionTrue,
+				Reason: conditionReasonMultipleServices,
+				Message: `The pod is selected by Kubernetes services "web", "web-canary" and is only registered with Consul for "web". ` +
+					`Set the consul.hashicorp.com/kubernetes-service annotation to choose the Kubernetes service, ` +
+					`or list the services in the consul.hashicorp.com/connect-service annotation to register each of them`,
+			}},
+		},
+		"annotated service doesn't select the pod": {
+			annotation: "api",
+			primary:    "api",
+			selecting:  []string{"web"},
+			expConditions: []corev1.PodCondition{{
+				Type:   conditionTypeServiceConflict,
+				Status: corev1.ConditionTrue,
+				Reason: conditionReasonServiceNotSelected,
+				Message: `The consul.hashicorp.com/kubernetes-service annotation is "api" but that Kubernetes service ` +
+					`doesn't select the pod, which is selected by "web", so the pod isn't registered with Consul`,
+			}},
+		},
+		"conflict resolved by the annotation": {
+			annotation: "web-canary",
+			primary:    "web-canary",
+			selecting:  []string{"web", "web-canary"},
+			conditions: []corev1.PodCondition{conflict},
+			expConditions: []corev1.PodCondition{{
+				Type:    conditionTypeServiceConflict,
+				Status:  corev1.ConditionFalse,
+				Reason:  conditionReasonNoConflict,
+				Message: `The pod is registered with Consul for Kubernetes service "web-canary"`,
+			}},
+		},
+	}
+	for name, c := range cases {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			pod := createPod("pod1", "1.2.3.4", true, true)
+			if c.annotation != "" {
+				pod.Annotations[annotationKubernetesService] = c.annotation
+			}
+			pod.Status.Conditions = c.conditions
+			fakeClient := fake.NewClientBuilder().WithRuntimeObjects(pod).Build()
+			ep := &EndpointsController{
+				Client: fakeClient,
+				Log:    logrtest.TestLogger{T: t},
+			}
+
+			err := ep.updateServiceConflictCondition(context.Background(), *pod, c.primary, c.selecting)
+			require.NoError(t, err)
+
+			var updated corev1.Pod
+			err = fakeClient.Get(context.Background(), types.NamespacedName{Name: "pod1", Namespace: "default"}, &updated)
+			require.NoError(t, err)
+			var actual []corev1.PodCondition
+			for _, condition := range updated.Status.Conditions {
+				condition.LastTransitionTime = metav1.Time{}
+				actual = append(actual, condition)
+			}
+			require.Equal(t, c.expConditions, actual)
+		})
+	}
+}
+
+// Test that a pod selected by two Kubernetes services is only registered for the first of them in
+// alphabetical order, and that its instances for the other one are deregistered.
+func TestReconcile_MultipleKubernetesServices(t *testing.T) {
+	t.Parallel()
+	ns := corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	pod1 := createPod("pod1", "1.2.3.4", true, true)
+	pod1.Labels["app"] = "web"
+	endpoints := func(name string) *corev1.Endpoints {
+		return &corev1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Subsets: []corev1.EndpointSubset{{
+				Addresses: []corev1.EndpointAddress{{
+					IP:        "1.2.3.4",
+					NodeName:  toStringPtr("node1"),
+					TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: "pod1", Namespace: "default"},
+				}},
+			}},
+		}
+	}
+	fakeClientPod := createPod("fake-consul-client", "127.0.0.1", false, true)
+	fakeClientPod.Labels = map[string]string{"component": "client", "app": "consul", "release": "consul"}
+	fakeClient := fake.NewClientBuilder().WithRuntimeObjects(&ns, pod1, fakeClientPod,
+		selectingService("web", "default", "web"), endpoints("web"),
+		selectingService("web-canary", "default", "web"), endpoints("web-canary"),
+	).Build()
+
+	consul, err := testutil.NewTestServerConfigT(t, nil)
+	require.NoError(t, err)
+	defer consul.Stop()
+	consul.WaitForServiceIntentions(t)
+	cfg := &api.Config{Address: consul.HTTPAddr}
+	consulClient, err := api.NewClient(cfg)
+	require.NoError(t, err)
+
+	ep := &EndpointsController{
+		Client:                fakeClient,
+		Log:                   logrtest.TestLogger{T: t},
+		ConsulClient:          consulClient,
+		ConsulPort:            strings.Split(consul.HTTPAddr, ":")[1],
+		ConsulScheme:          "http",
+		AllowK8sNamespacesSet: mapset.NewSetWith("*"),
+		DenyK8sNamespacesSet:  mapset.NewSetWith(),
+		ReleaseName:           "consul",
+		ReleaseNamespace:      "default",
+		ConsulClientCfg:       cfg,
+		Context:               context.Background(),
+	}
+
+	// The instances registered for "web-canary" before the pod is reconciled for it are deregistered.
+	err = consulClient.Agent().ServiceRegister(&api.AgentServiceRegistration{
+		ID:   "pod1-web-canary",
+		Name: "web-canary",
+		Meta: map[string]string{
+			MetaKeyPodName:         "pod1",
+			MetaKeyKubeServiceName: "web-canary",
+			MetaKeyKubeNS:          "default",
+			MetaKeyManagedBy:       managedByValue,
+		},
+	})
+	require.NoError(t, err)
+
+	for _, name := range []string{"web", "web-canary"} {
+		_, err = ep.Reconcile(context.Background(), ctrl.Request{NamespacedName: types.NamespacedName{Name: name, Namespace: "default"}})
+		require.NoError(t, err)
+	}
+
+	services, err := consulClient.Agent().Services()
+	require.NoError(t, err)
+	require.Len(t, services, 2)
+	require.Contains(t, services, "pod1-web")
+	require.Contains(t, services, "pod1-web-sidecar-proxy")
+
+	var updated corev1.Pod
+	err = fakeClient.Get(context.Background(), types.NamespacedName{Name: "pod1", Namespace: "default"}, &updated)
+	require.NoError(t, err)
+	require.True(t, hasPodCondition(updated, conditionTypeServiceConflict))
+}
+
+// Test that every Kubernetes service that selects a pod is enqueued when the Kubernetes services
+// that select it or its annotation change, so that the pod's primary Kubernetes service is chosen again.
+func TestRequestsForServicesSelectingPods(t *testing.T) {
+	t.Parallel()
+	pod1 := createPod("pod1", "1.2.3.4", true, true)
+	pod1.Labels["app"] = "web"
+	legacyPod := createPod("pod2", "2.3.4.5", true, false)
+	legacyPod.Labels["app"] = "legacy"
+	fakeClient := fake.NewClientBuilder().WithRuntimeObjects(pod1, legacyPod,
+		selectingService("web", "default", "web"),
+		selectingService("a-web", "default", "web"),
+		selectingService("api", "default", "api"),
+		selectingService("legacy", "default", "legacy"),
+		selectingService("web-other-ns", "other", "web"),
+	).Build()
+	ep := &EndpointsController{
+		Client:  fakeClient,
+		Log:     logrtest.TestLogger{T: t},
+		Context: context.Background(),
+	}
+	request := func(name string) ctrl.Request {
+		return ctrl.Request{NamespacedName: types.NamespacedName{Name: name, Namespace: "default"}}
+	}
+
+	// A new Kubernetes service that selects the pod enqueues the service the pod was registered for.
+	require.ElementsMatch(t, []ctrl.Request{request("a-web"), request("web")},
+		ep.requestsForServicesSelectingPodsOfService(selectingService("a-web", "default", "web")))
+	// Kubernetes services that don't select registered pods only enqueue themselves.
+	require.Equal(t, []ctrl.Request{request("api")},
+		ep.requestsForServicesSelectingPodsOfService(selectingService("api", "default", "api")))
+	require.Equal(t, []ctrl.Request{request("legacy")},
+		ep.requestsForServicesSelectingPodsOfService(selectingService("legacy", "default", "legacy")))
+	// A pod whose annotation changed enqueues the Kubernetes services that select it.
+	require.ElementsMatch(t, []ctrl.Request{request("a-web"), request("web")}, ep.requestsForServicesSelectingPod(pod1))
+	require.Empty(t, ep.requestsForServicesSelectingPod(legacyPod))
+}
+
+// Test that a pod registered for a Kubernetes service is deregistered from it once a Kubernetes
+// service that comes first in alphabetical order starts selecting it.
+func TestReconcile_NewPrimaryKubernetesService(t *testing.T) {
+	t.Parallel()
+	ns := corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	pod1 := createPod("pod1", "1.2.3.4", true, true)
+	pod1.Labels["app"] = "web"
+	endpoints := func(name string) *corev1.Endpoints {
+		return &corev1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Subsets: []corev1.EndpointSubset{{
+				Addresses: []corev1.EndpointAddress{{
+					IP:        "1.2.3.4",
+					NodeName:  toStringPtr("node1"),
+					TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: "pod1", Namespace: "default"},
+				}},
+			}},
+		}
+	}
+	fakeClientPod := createPod("fake-consul-client", "127.0.0.1", false, true)
+	fakeClientPod.Labels = map[string]string{"component": "client", "app": "consul", "release": "consul"}
+	fakeClient := fake.NewClientBuilder().WithRuntimeObjects(&ns, pod1, fakeClientPod,
+		selectingService("web", "default", "web"), endpoints("web"),
+	).Build()
+
+	consul, err := testutil.NewTestServerConfigT(t, nil)
+	require.NoError(t, err)
+	defer consul.Stop()
+	consul.WaitForServiceIntentions(t)
+	cfg := &api.Config{Address: consul.HTTPAddr}
+	consulClient, err := api.NewClient(cfg)
+	require.NoError(t, err)
+
+	ep := &EndpointsController{
+		Client:                fakeClient,
+		Log:                   logrtest.TestLogger{T: t},
+		ConsulClient:          consulClient,
+		ConsulPort:            strings.Split(consul.HTTPAddr, ":")[1],
+		ConsulScheme:          "http",
+		AllowK8sNamespacesSet: mapset.NewSetWith("*"),
+		DenyK8sNamespacesSet:  mapset.NewSetWith(),
+		ReleaseName:           "consul",
+		ReleaseNamespace:      "default",
+		ConsulClientCfg:       cfg,
+		Context:               context.Background(),
+	}
+
+	_, err = ep.Reconcile(context.Background(), ctrl.Request{NamespacedName: types.NamespacedName{Name: "web", Namespace: "default"}})
+	require.NoError(t, err)
+	services, err := consulClient.Agent().Services()
+	require.NoError(t, err)
+	require.Contains(t, services, "pod1-web")
+
+	// The new Kubernetes service enqueues itself and "web", whose Endpoints don't change.
+	aWeb := selectingService("a-web", "default", "web")
+	require.NoError(t, fakeClient.Create(context.Background(), aWeb))
+	require.NoError(t, fakeClient.Create(context.Background(), endpoints("a-web")))
+	for _, request := range ep.requestsForServicesSelectingPodsOfService(aWeb) {
+		_, err = ep.Reconcile(context.Background(), request)
+		require.NoError(t, err)
+	}
+
+	services, err = consulClient.Agent().Services()
+	require.NoError(t, err)
+	require.Len(t, services, 2)
+	require.Contains(t, services, "pod1-a-web")
+	require.Contains(t, services, "pod1-a-web-sidecar-proxy")
+}
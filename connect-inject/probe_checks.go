@@ -0,0 +1,194 @@
+package connectinject
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// probeCheckIDSuffix is the suffix of the IDs of the Consul checks derived from probes.
+// It distinguishes them from the TTL check that mirrors the pod's readiness.
+const probeCheckIDSuffix = "-probe"
+
+// probeChecksEnabled returns true if the endpoints controller should register Consul checks
+// for the probes of the pod. The annotation on the pod takes precedence over the global setting.
+func probeChecksEnabled(pod corev1.Pod, globalEnabled bool) (bool, error) {
+	if raw, ok := pod.Annotations[annotationEnableProbeChecks]; ok {
+		return strconv.ParseBool(raw)
+	}
+	return globalEnabled, nil
+}
+
+// getProbeCheckID returns the ID of the Consul check for a probe of a container. Like
+// getConsulHealthCheckID, it's unique to the agent the service is registered with.
+func getProbeCheckID(pod corev1.Pod, serviceID, containerName, kind string) string {
+	return fmt.Sprintf("%s/%s/%s/%s%s", pod.Namespace, serviceID, containerName, kind, probeCheckIDSuffix)
+}
+
+// isProbeCheckID returns true if the check ID is the ID of a Consul check derived from a
+// probe of the pod.
+func isProbeCheckID(pod corev1.Pod, serviceID, checkID string) bool {
+	return strings.HasPrefix(checkID, fmt.Sprintf("%s/%s/", pod.Namespace, serviceID)) &&
+		strings.HasSuffix(checkID, probeCheckIDSuffix)
+}
+
+// probeChecks returns the Consul checks for the HTTP and TCP readiness and liveness probes
+// of the pod's application containers. Consul agents run the checks against the pod IP with
+// the interval, timeout and thresholds of the probe. Exec probes can't be run by Consul and
+// are skipped. The checks' notes describe the probe they are derived from, and a change in the
+// notes means that the check needs to be registered again.
+func probeChecks(pod corev1.Pod, serviceID string) ([]*api.AgentCheckRegistration, error) {
+	var checks []*api.AgentCheckRegistration
+	for _, container := range pod.Spec.Containers {
+		if isInjectedContainer(container.Name) {
+			continue
+		}
+		for _, p := range containerProbes(&container) {
+			// Startup probes only matter until the container has started.
+			if p.probe == nil || p.kind == probeStartup {
+				continue
+			}
+			check, err := probeCheck(pod, container, p)
+			if err != nil {
+				return nil, err
+			}
+			if check == nil {
+				continue
+			}
+			check.ID = getProbeCheckID(pod, serviceID, container.Name, p.kind)
+			check.Name = fmt.Sprintf("Kubernetes %s probe (%s)", strings.Title(p.kind), container.Name)
+			check.ServiceID = serviceID
+			checks = append(checks, check)
+		}
+	}
+	return checks, nil
+}
+
+// probeCheck translates a probe into a Consul check. It returns nil if the probe can't be
+// run by Consul.
+func probeCheck(pod corev1.Pod, container corev1.Container, p containerProbe) (*api.AgentCheckRegistration, error) {
+	// These are the defaults of the Kubernetes API.
+	interval, timeout := 10, 1
+	successThreshold, failureThreshold := 1, 3
+	if p.probe.PeriodSeconds > 0 {
+		interval = int(p.probe.PeriodSeconds)
+	}
+	if p.probe.TimeoutSeconds > 0 {
+		timeout = int(p.probe.TimeoutSeconds)
+	}
+	if p.probe.SuccessThreshold > 0 {
+		successThreshold = int(p.probe.SuccessThreshold)
+	}
+	if p.probe.FailureThreshold > 0 {
+		failureThreshold = int(p.probe.FailureThreshold)
+	}
+	check := &api.AgentCheckRegistration{
+		AgentServiceCheck: api.AgentServiceCheck{
+			Interval:               fmt.Sprintf("%ds", interval),
+			Timeout:                fmt.Sprintf("%ds", timeout),
+			SuccessBeforePassing:   successThreshold,
+			FailuresBeforeCritical: failureThreshold,
+		},
+	}
+
+	var target string
+	switch {
+	case p.probe.HTTPGet != nil:
+		action := p.probe.HTTPGet
+		port, err := probePortValue(pod, container, action.Port)
+		if err != nil {
+			return nil, err
+		}
+		host := action.Host
+		if host == "" {
+			host = pod.Status.PodIP
+		}
+		scheme := strings.ToLower(string(action.Scheme))
+		if scheme == "" {
+			scheme = "http"
+		}
+		path := action.Path
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		check.HTTP = fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(host, strconv.Itoa(port)), path)
+		// Like the kubelet, Consul doesn't verify the certificate of HTTPS probes.
+		check.TLSSkipVerify = scheme == "https"
+		if len(action.HTTPHeaders) > 0 {
+			check.Header = make(map[string][]string)
+			for _, header := range action.HTTPHeaders {
+				check.Header[header.Name] = append(check.Header[header.Name], header.Value)
+			}
+		}
+		target = "GET " + check.HTTP
+	case p.probe.TCPSocket != nil:
+		action := p.probe.TCPSocket
+		port, err := probePortValue(pod, container, action.Port)
+		if err != nil {
+			return nil, err
+		}
+		host := action.Host
+		if host == "" {
+			host = pod.Status.PodIP
+		}
+		check.TCP = net.JoinHostPort(host, strconv.Itoa(port))
+		target = "TCP " + check.TCP
+	default:
+		return nil, nil
+	}
+
+	check.Notes = fmt.Sprintf("%s probe of container %q of pod \"%s/%s\": %s every %s with a timeout of %s, "+
+		"passing after %d and critical after %d consecutive results",
+		strings.Title(p.kind), container.Name, pod.Namespace, pod.Name, target, check.Interval, check.Timeout,
+		successThreshold, failureThreshold)
+	return check, nil
+}
+
+// upsertProbeChecks reconciles the Consul checks derived from the probes of the pod with the
+// checks registered for the service. Checks are registered when they are missing or their
+// probe has changed, and checks of probes that no longer exist are deregistered. When probe
+// checks aren't enabled for the pod, all of them are deregistered.
+func (r *EndpointsController) upsertProbeChecks(pod corev1.Pod, client *api.Client, serviceID string) error {
+	enabled, err := probeChecksEnabled(pod, r.EnableProbeChecks)
+	if err != nil {
+		return err
+	}
+	var desired []*api.AgentCheckRegistration
+	if enabled {
+		desired, err = probeChecks(pod, serviceID)
+		if err != nil {
+			return err
+		}
+	}
+
+	existing, err := client.Agent().ChecksWithFilter(fmt.Sprintf("ServiceID == `%s`", serviceID))
+	if err != nil {
+		return fmt.Errorf("unable to get agent health checks: serviceID=%s, %s", serviceID, err)
+	}
+
+	desiredIDs := make(map[string]bool)
+	for _, check := range desired {
+		desiredIDs[check.ID] = true
+		if current, ok := existing[check.ID]; ok && current.Notes == check.Notes {
+			continue
+		}
+		r.Log.Info("registering probe check", "id", check.ID)
+		if err := client.Agent().CheckRegister(check); err != nil {
+			return fmt.Errorf("registering probe check %q for service %q: %w", check.ID, serviceID, err)
+		}
+	}
+	for id := range existing {
+		if !isProbeCheckID(pod, serviceID, id) || desiredIDs[id] {
+			continue
+		}
+		r.Log.Info("deregistering probe check", "id", id)
+		if err := client.Agent().CheckDeregister(id); err != nil {
+			return fmt.Errorf("deregistering probe check %q for service %q: %w", id, serviceID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package connectinject
+
+import (
+	"testing"
+
+	logrtest "github.com/go-logr/logr/testing"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/sdk/testutil"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func probeChecksTestPod() corev1.Pod {
+	return corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "pod1",
+			Namespace: "default",
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "web",
+					Ports: []corev1.ContainerPort{
+						{
+							Name:          "http",
+							ContainerPort: 8080,
+						},
+					},
+					ReadinessProbe: &corev1.Probe{
+						Handler: corev1.Handler{
+							HTTPGet: &corev1.HTTPGetAction{
+								Port:        intstr.FromString("http"),
+								Path:        "ready",
+								HTTPHeaders: []corev1.HTTPHeader{{Name: "X-Probe", Value: "consul"}},
+							},
+						},
+						PeriodSeconds:    5,
+						TimeoutSeconds:   2,
+						SuccessThreshold: 2,
+						FailureThreshold: 4,
+					},
+					LivenessProbe: tcpProbe(intstr.FromInt(8080)),
+					StartupProbe:  httpProbe(intstr.FromInt(8080), "/started"),
+				},
+				{
+					Name: "worker",
+					LivenessProbe: &corev1.Probe{
+						Handler: corev1.Handler{
+							HTTPGet: &corev1.HTTPGetAction{
+								Port:   intstr.FromInt(9443),
+								Path:   "/live",
+								Scheme: corev1.URISchemeHTTPS,
+							},
+						},
+					},
+					ReadinessProbe: &corev1.Probe{
+						Handler: corev1.Handler{
+							Exec: &corev1.ExecAction{Command: []string{"true"}},
+						},
+					},
+				},
+				{
+					Name:           envoySidecarContainer,
+					ReadinessProbe: tcpProbe(intstr.FromInt(20000)),
+				},
+			},
+		},
+		Status: corev1.PodStatus{
+			PodIP: "1.2.3.4",
+		},
+	}
+}
+
+func TestProbeChecks(t *testing.T) {
+	t.Parallel()
+	checks, err := probeChecks(probeChecksTestPod(), "pod1-web")
+	require.NoError(t, err)
+	require.Equal(t, []*api.AgentCheckRegistration{
+		{
+			ID:        "default/pod1-web/web/liveness-probe",
+			Name:      "Kubernetes Liveness probe (web)",
+			ServiceID: "pod1-web",
+			Notes: `Liveness probe of container "web" of pod "default/pod1": TCP 1.2.3.4:8080 every 10s with a timeout of 1s, ` +
+				`passing after 1 and critical after 3 consecutive results`,
+			AgentServiceCheck: api.AgentServiceCheck{
+				TCP:                    "1.2.3.4:8080",
+				Interval:               "10s",
+				Timeout:                "1s",
+				SuccessBeforePassing:   1,
+				FailuresBeforeCritical: 3,
+			},
+		},
+		{
+			ID:        "default/pod1-web/web/readiness-probe",
+			Name:      "Kubernetes Readiness probe (web)",
+			ServiceID: "pod1-web",
+			Notes: `Readiness probe of container "web" of pod "default/pod1": GET http://1.2.3.4:8080/ready every 5s with a timeout of 2s, ` +
+				`passing after 2 and critical after 4 consecutive results`,
+			AgentServiceCheck: api.AgentServiceCheck{
+				HTTP:                   "http://1.2.3.4:8080/ready",
+				Header:                 map[string][]string{"X-Probe": {"consul"}},
+				Interval:               "5s",
+				Timeout:                "2s",
+				SuccessBeforePassing:   2,
+				FailuresBeforeCritical: 4,
+			},
+		},
+		{
+			ID:        "default/pod1-web/worker/liveness-probe",
+			Name:      "Kubernetes Liveness probe (worker)",
+			ServiceID: "pod1-web",
+			Notes: `Liveness probe of container "worker" of pod "default/pod1": GET https://1.2.3.4:9443/live every 10s with a timeout of 1s, ` +
+				`passing after 1 and critical after 3 consecutive results`,
+			AgentServiceCheck: api.AgentServiceCheck{
+				HTTP:                   "https://1.2.3.4:9443/live",
+				TLSSkipVerify:          true,
+				Interval:               "10s",
+				Timeout:                "1s",
+				SuccessBeforePassing:   1,
+				FailuresBeforeCritical: 3,
+			},
+		},
+	}, checks)
+}
+
+func TestProbeChecks_InvalidNamedPort(t *testing.T) {
+	t.Parallel()
+	pod := probeChecksTestPod()
+	pod.Spec.Containers[0].ReadinessProbe.HTTPGet.Port = intstr.FromString("metrics")
+	_, err := probeChecks(pod, "pod1-web")
+	require.EqualError(t, err, `probe port "metrics" of container "web" is not a named port or a port number`)
+}
+
+func TestIsProbeCheckID(t *testing.T) {
+	t.Parallel()
+	pod := probeChecksTestPod()
+	require.True(t, isProbeCheckID(pod, "pod1-web", getProbeCheckID(pod, "pod1-web", "web", probeReadiness)))
+	require.False(t, isProbeCheckID(pod, "pod1-web", getConsulHealthCheckID(pod, "pod1-web")))
+	require.False(t, isProbeCheckID(pod, "pod1-web-admin", getProbeCheckID(pod, "pod1-web", "web", probeReadiness)))
+}
+
+// Test that the probe checks registered with Consul follow the pod's probes and annotation.
+func TestUpsertProbeChecks(t *testing.T) {
+	t.Parallel()
+	consul, err := testutil.NewTestServerConfigT(t, nil)
+	require.NoError(t, err)
+	defer consul.Stop()
+	consul.WaitForLeader(t)
+
+	client, err := api.NewClient(&api.Config{Address: consul.HTTPAddr})
+	require.NoError(t, err)
+	require.NoError(t, client.Agent().ServiceRegister(&api.AgentServiceRegistration{
+		ID:      "pod1-web",
+		Name:    "web",
+		Address: "1.2.3.4",
+	}))
+	require.NoError(t, registerConsulHealthCheck(client, "default/pod1-web/kubernetes-health-check", "pod1-web", api.HealthPassing))
+
+	ep := EndpointsController{
+		EnableProbeChecks: true,
+		Log:               logrtest.TestLogger{T: t},
+	}
+	checkIDs := func() []string {
+		checks, err := client.Agent().ChecksWithFilter("ServiceID == `pod1-web`")
+		require.NoError(t, err)
+		var ids []string
+		for id := range checks {
+			ids = append(ids, id)
+		}
+		return ids
+	}
+
+	pod := probeChecksTestPod()
+	require.NoError(t, ep.upsertProbeChecks(pod, client, "pod1-web"))
+	require.ElementsMatch(t, []string{
+		"default/pod1-web/kubernetes-health-check",
+		"default/pod1-web/web/liveness-probe",
+		"default/pod1-web/web/readiness-probe",
+		"default/pod1-web/worker/liveness-probe",
+	}, checkIDs())
+
+	// A changed probe is registered again and a removed probe is deregistered.
+	pod.Spec.Containers[0].ReadinessProbe.HTTPGet.Path = "/healthz"
+	pod.Spec.Containers[1].LivenessProbe = nil
+	require.NoError(t, ep.upsertProbeChecks(pod, client, "pod1-web"))
+	require.ElementsMatch(t, []string{
+		"default/pod1-web/kubernetes-health-check",
+		"default/pod1-web/web/liveness-probe",
+		"default/pod1-web/web/readiness-probe",
+	}, checkIDs())
+	checks, err := client.Agent().ChecksWithFilter("ServiceID == `pod1-web`")
+	require.NoError(t, err)
+	require.Contains(t, checks["default/pod1-web/web/readiness-probe"].Notes, "GET http://1.2.3.4:8080/healthz")
+
+	// Opting the pod out removes all probe checks, but not the Kubernetes health check.
+	pod.Annotations = map[string]string{annotationEnableProbeChecks: "false"}
+	require.NoError(t, ep.upsertProbeChecks(pod, client, "pod1-web"))
+	require.ElementsMatch(t, []string{"default/pod1-web/kubernetes-health-check"}, checkIDs())
+}
@@ -0,0 +1,138 @@
+package connectinject
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	probeLiveness  = "liveness"
+	probeReadiness = "readiness"
+	probeStartup   = "startup"
+)
+
+// containerProbe is one of the probes of a container.
+type containerProbe struct {
+	kind  string
+	probe *corev1.Probe
+}
+
+// containerProbes returns the liveness, readiness and startup probes of the container,
+// in the order in which their listener ports are allocated. Probes that aren't set are nil.
+func containerProbes(container *corev1.Container) []containerProbe {
+	return []containerProbe{
+		{kind: probeLiveness, probe: container.LivenessProbe},
+		{kind: probeReadiness, probe: container.ReadinessProbe},
+		{kind: probeStartup, probe: container.StartupProbe},
+	}
+}
+
+// originalProbePortAnnotation returns the key of the annotation that records the original
+// port of a probe before it was overwritten. The probes of other containers than the first
+// application container are scoped to the container with a ".<hash>" suffix, where the hash
+// is the FNV-1a hash of the container's name in hex. The name itself can't be used since the
+// name part of an annotation key is limited to 63 characters. The first application
+// container's keys are unscoped so that pods injected by earlier versions still have their
+// probes exposed.
+func originalProbePortAnnotation(kind, containerName string, firstAppContainer bool) string {
+	var key string
+	switch kind {
+	case probeLiveness:
+		key = annotationOriginalLivenessProbePort
+	case probeReadiness:
+		key = annotationOriginalReadinessProbePort
+	default:
+		key = annotationOriginalStartupProbePort
+	}
+	if firstAppContainer {
+		return key
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(containerName))
+	return fmt.Sprintf("%s.%08x", key, hash.Sum32())
+}
+
+// probePortValue returns the port number of a probe's port, which can be the name of
+// one of the container's ports.
+func probePortValue(pod corev1.Pod, container corev1.Container, port intstr.IntOrString) (int, error) {
+	if port.Type == intstr.Int {
+		return port.IntValue(), nil
+	}
+	for _, p := range container.Ports {
+		if p.Name == port.StrVal {
+			return int(p.ContainerPort), nil
+		}
+	}
+	value, err := portValue(pod, port.StrVal)
+	if err != nil {
+		return 0, fmt.Errorf("probe port %q of container %q is not a named port or a port number", port.StrVal, container.Name)
+	}
+	return int(value), nil
+}
+
+// probeListenerPorts allocates the Envoy listener ports for the HTTP probes of the pod.
+// The liveness and readiness probes of the first application container keep their
+// configurable ports, and every other probe is allocated the next free port starting at
+// defaultExposedPathsListenerPortStartup, skipping the public listener ports of the pod.
+type probeListenerPorts struct {
+	liveness        int
+	readiness       int
+	next            int
+	used            map[int]bool
+	publicListeners map[int]bool
+}
+
+// newProbeListenerPorts returns the listener ports for the probes of the pod, taking the
+// ports of the first application container's probes from the pod's annotations.
+func newProbeListenerPorts(pod corev1.Pod, publicListenerPorts []int) (*probeListenerPorts, error) {
+	ports := &probeListenerPorts{
+		liveness:        defaultExposedPathsListenerPortLiveness,
+		readiness:       defaultExposedPathsListenerPortReadiness,
+		next:            defaultExposedPathsListenerPortStartup,
+		publicListeners: make(map[int]bool),
+	}
+	var err error
+	if raw, ok := pod.Annotations[annotationTransparentProxyLivenessListenerPort]; ok {
+		ports.liveness, err = strconv.Atoi(raw)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if raw, ok := pod.Annotations[annotationTransparentProxyReadinessListenerPort]; ok {
+		ports.readiness, err = strconv.Atoi(raw)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ports.used = map[int]bool{ports.liveness: true, ports.readiness: true}
+	for _, port := range publicListenerPorts {
+		ports.used[port] = true
+		ports.publicListeners[port] = true
+	}
+	return ports, nil
+}
+
+// allocate returns the listener port for a probe. It returns an error if the configured
+// port of a probe of the first application container is a public listener port.
+func (p *probeListenerPorts) allocate(kind string, firstAppContainer bool) (int, error) {
+	if firstAppContainer && (kind == probeLiveness || kind == probeReadiness) {
+		port, key := p.liveness, annotationTransparentProxyLivenessListenerPort
+		if kind == probeReadiness {
+			port, key = p.readiness, annotationTransparentProxyReadinessListenerPort
+		}
+		if p.publicListeners[port] {
+			return 0, fmt.Errorf("the %s probe listener port %d is also an Envoy public listener port, set the %q annotation to another port",
+				kind, port, key)
+		}
+		return port, nil
+	}
+	for p.used[p.next] {
+		p.next++
+	}
+	p.used[p.next] = true
+	return p.next, nil
+}
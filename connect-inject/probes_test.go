@@ -0,0 +1,247 @@
+package connectinject
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	logrtest "github.com/go-logr/logr/testing"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func httpProbe(port intstr.IntOrString, path string) *corev1.Probe {
+	return &corev1.Probe{
+		Handler: corev1.Handler{
+			HTTPGet: &corev1.HTTPGetAction{
+				Port: port,
+				Path: path,
+			},
+		},
+	}
+}
+
+func tcpProbe(port intstr.IntOrString) *corev1.Probe {
+	return &corev1.Probe{
+		Handler: corev1.Handler{
+			TCPSocket: &corev1.TCPSocketAction{
+				Port: port,
+			},
+		},
+	}
+}
+
+// probesTestPod returns a pod whose Envoy sidecar comes first, as with the sidecar
+// lifecycle enabled, followed by two application containers with all kinds of probes.
+func probesTestPod() *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "pod1",
+			Namespace: "default",
+			Annotations: map[string]string{
+				keyTransparentProxy:                 "true",
+				annotationTProxyExcludeInboundPorts: "9999",
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: envoySidecarContainer,
+				},
+				{
+					Name:           "web",
+					LivenessProbe:  httpProbe(intstr.FromInt(8080), "/live"),
+					ReadinessProbe: httpProbe(intstr.FromInt(8080), "/ready"),
+					StartupProbe:   httpProbe(intstr.FromInt(8080), "/started"),
+				},
+				{
+					Name: "worker",
+					Ports: []corev1.ContainerPort{
+						{
+							Name:          "health",
+							ContainerPort: 9090,
+						},
+					},
+					LivenessProbe:  httpProbe(intstr.FromString("health"), "/live"),
+					ReadinessProbe: tcpProbe(intstr.FromInt(7070)),
+					StartupProbe: &corev1.Probe{
+						Handler: corev1.Handler{
+							Exec: &corev1.ExecAction{Command: []string{"true"}},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestOverwriteProbes_AllContainersAndProbeKinds(t *testing.T) {
+	t.Parallel()
+	pod := probesTestPod()
+	// The readiness listener port of the first application container is the port that
+	// would otherwise be allocated first.
+	pod.Annotations[annotationTransparentProxyReadinessListenerPort] = "20302"
+
+	h := Handler{TProxyOverwriteProbes: true}
+	require.NoError(t, h.overwriteProbes(corev1.Namespace{}, pod))
+
+	web := pod.Spec.Containers[1]
+	require.Equal(t, defaultExposedPathsListenerPortLiveness, web.LivenessProbe.HTTPGet.Port.IntValue())
+	require.Equal(t, 20302, web.ReadinessProbe.HTTPGet.Port.IntValue())
+	require.Equal(t, 20303, web.StartupProbe.HTTPGet.Port.IntValue())
+
+	worker := pod.Spec.Containers[2]
+	require.Equal(t, 20304, worker.LivenessProbe.HTTPGet.Port.IntValue())
+	// TCP and exec probes aren't overwritten.
+	require.Equal(t, 7070, worker.ReadinessProbe.TCPSocket.Port.IntValue())
+	require.NotNil(t, worker.StartupProbe.Exec)
+
+	require.Equal(t, "8080", pod.Annotations[annotationOriginalLivenessProbePort])
+	require.Equal(t, "8080", pod.Annotations[annotationOriginalReadinessProbePort])
+	require.Equal(t, "8080", pod.Annotations[annotationOriginalStartupProbePort])
+	require.Equal(t, "9090", pod.Annotations[originalProbePortAnnotation(probeLiveness, "worker", false)])
+	require.NotContains(t, pod.Annotations, originalProbePortAnnotation(probeReadiness, "worker", false))
+	require.Equal(t, "9999,7070", pod.Annotations[annotationTProxyExcludeInboundPorts])
+}
+
+// Test that the annotations of the probes of containers with the longest possible name
+// are valid annotation keys.
+func TestOverwriteProbes_LongContainerName(t *testing.T) {
+	t.Parallel()
+	pod := probesTestPod()
+	name := strings.Repeat("w", 63)
+	pod.Spec.Containers[2].Name = name
+
+	h := Handler{TProxyOverwriteProbes: true}
+	require.NoError(t, h.overwriteProbes(corev1.Namespace{}, pod))
+
+	key := originalProbePortAnnotation(probeLiveness, name, false)
+	require.Equal(t, "9090", pod.Annotations[key])
+	for key := range pod.Annotations {
+		require.Empty(t, validation.IsQualifiedName(key), "annotation key %q is invalid", key)
+	}
+}
+
+// Test that the ports of TCP probes aren't excluded from inbound traffic redirection
+// when they're the service port or an upstream port.
+func TestOverwriteProbes_TCPProbeOfMeshPort(t *testing.T) {
+	t.Parallel()
+	cases := map[string]struct {
+		annotations map[string]string
+	}{
+		"service port": {
+			annotations: map[string]string{annotationPort: "7070"},
+		},
+		"named service port": {
+			annotations: map[string]string{annotationPort: "tcp"},
+		},
+		"upstream port": {
+			annotations: map[string]string{annotationUpstreams: "db:7070"},
+		},
+	}
+	for name, c := range cases {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			pod := probesTestPod()
+			pod.Spec.Containers[2].Ports = append(pod.Spec.Containers[2].Ports, corev1.ContainerPort{
+				Name:          "tcp",
+				ContainerPort: 7070,
+			})
+			for k, v := range c.annotations {
+				pod.Annotations[k] = v
+			}
+
+			h := Handler{TProxyOverwriteProbes: true}
+			require.NoError(t, h.overwriteProbes(corev1.Namespace{}, pod))
+			require.Equal(t, 7070, pod.Spec.Containers[2].ReadinessProbe.TCPSocket.Port.IntValue())
+			require.Equal(t, "9999", pod.Annotations[annotationTProxyExcludeInboundPorts])
+		})
+	}
+}
+
+// Test that probe listener ports aren't allocated on the public listener ports of the pod,
+// and that the configured probe listener ports can't be public listener ports.
+func TestOverwriteProbes_PublicListenerPorts(t *testing.T) {
+	t.Parallel()
+	pod := probesTestPod()
+	pod.Annotations[annotationSidecarProxyPublicListenerPort] = "20303"
+
+	h := Handler{TProxyOverwriteProbes: true}
+	require.NoError(t, h.overwriteProbes(corev1.Namespace{}, pod))
+	require.Equal(t, 20302, pod.Spec.Containers[1].StartupProbe.HTTPGet.Port.IntValue())
+	require.Equal(t, 20304, pod.Spec.Containers[2].LivenessProbe.HTTPGet.Port.IntValue())
+
+	pod = probesTestPod()
+	pod.Annotations[annotationSidecarProxyPublicListenerPort] = "20301"
+	err := h.overwriteProbes(corev1.Namespace{}, pod)
+	require.EqualError(t, err, `the readiness probe listener port 20301 is also an Envoy public listener port, set the "consul.hashicorp.com/transparent-proxy-readiness-listener-port" annotation to another port`)
+}
+
+func TestOverwriteProbes_InvalidNamedPort(t *testing.T) {
+	t.Parallel()
+	pod := probesTestPod()
+	pod.Spec.Containers[2].LivenessProbe = httpProbe(intstr.FromString("metrics"), "/live")
+
+	h := Handler{TProxyOverwriteProbes: true}
+	err := h.overwriteProbes(corev1.Namespace{}, pod)
+	require.EqualError(t, err, `probe port "metrics" of container "worker" is not a named port or a port number`)
+}
+
+func TestCreateServiceRegistrations_ExposesAllProbes(t *testing.T) {
+	t.Parallel()
+	pod := probesTestPod()
+	h := Handler{TProxyOverwriteProbes: true}
+	require.NoError(t, h.overwriteProbes(corev1.Namespace{}, pod))
+
+	endpoints := &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web",
+			Namespace: "default",
+		},
+	}
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web",
+			Namespace: "default",
+		},
+		Spec: corev1.ServiceSpec{
+			ClusterIP: "10.0.0.1",
+		},
+	}
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	ep := EndpointsController{
+		Client:                fake.NewClientBuilder().WithRuntimeObjects(pod, endpoints, service, ns).Build(),
+		TProxyOverwriteProbes: true,
+		Log:                   logrtest.TestLogger{T: t},
+		Context:               context.Background(),
+	}
+	_, proxyService, err := ep.createServiceRegistrations(*pod, *endpoints)
+	require.NoError(t, err)
+	require.Equal(t, []api.ExposePath{
+		{
+			ListenerPort:  defaultExposedPathsListenerPortLiveness,
+			LocalPathPort: 8080,
+			Path:          "/live",
+		},
+		{
+			ListenerPort:  defaultExposedPathsListenerPortReadiness,
+			LocalPathPort: 8080,
+			Path:          "/ready",
+		},
+		{
+			ListenerPort:  20302,
+			LocalPathPort: 8080,
+			Path:          "/started",
+		},
+		{
+			ListenerPort:  20303,
+			LocalPathPort: 9090,
+			Path:          "/live",
+		},
+	}, proxyService.Proxy.Expose.Paths)
+}
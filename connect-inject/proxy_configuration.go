@@ -0,0 +1,232 @@
+package connectinject
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-multierror"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// defaultProxyCheckInterval is the interval of the check of the proxy's public listener.
+	defaultProxyCheckInterval = 10 * time.Second
+
+	// defaultProxyDeregisterCriticalServiceAfter is how long the check of the proxy's public
+	// listener can be critical before Consul deregisters the proxy.
+	defaultProxyDeregisterCriticalServiceAfter = 10 * time.Minute
+
+	// defaultTProxyOutboundListenerPort is the port of the outbound listener that traffic
+	// redirection sends the outbound traffic of transparent proxy pods to.
+	defaultTProxyOutboundListenerPort = 15001
+)
+
+// ProxyConfig represents configuration common to connect-inject components related to the
+// public listener of the Envoy sidecar and the Consul check of the proxy service. The
+// handler and the endpoints controller must share it so that the readiness probe of the
+// Envoy sidecar and the proxy registration agree on the port.
+type ProxyConfig struct {
+	// DefaultPublicListenerPort is the port of the public listener of Envoy. Multi-port pods
+	// offset it by the index of each service. If zero, 20000 is used.
+	DefaultPublicListenerPort int
+	// DefaultCheckInterval is the interval of the TCP check of the public listener. If zero,
+	// 10s is used.
+	DefaultCheckInterval time.Duration
+	// DefaultCheckTimeout is the timeout of the TCP check of the public listener. If zero,
+	// Consul's default is used.
+	DefaultCheckTimeout time.Duration
+	// DefaultDeregisterCriticalServiceAfter is how long the check can be critical before
+	// Consul deregisters the proxy. If zero, 10m is used.
+	DefaultDeregisterCriticalServiceAfter time.Duration
+}
+
+// publicListenerPort returns the port of Envoy's public listener for the first service of the
+// pod, either via the default value in the handler, or if it's been overridden via the annotation.
+func (pc ProxyConfig) publicListenerPort(pod corev1.Pod) (int, error) {
+	if raw, ok := pod.Annotations[annotationSidecarProxyPublicListenerPort]; ok && raw != "" {
+		port, err := strconv.Atoi(raw)
+		if err != nil || port < 1 || port > 65535 {
+			return 0, fmt.Errorf("%s annotation value of %s is not a valid port", annotationSidecarProxyPublicListenerPort, raw)
+		}
+		return port, nil
+	}
+	if pc.DefaultPublicListenerPort == 0 {
+		return defaultEnvoyPublicListenerPort, nil
+	}
+	return pc.DefaultPublicListenerPort, nil
+}
+
+// publicListenerPorts returns the ports of the public listeners of the pod's Envoy sidecars,
+// i.e. the public listener port offset by the index of each service of multi-port pods.
+func (pc ProxyConfig) publicListenerPorts(pod corev1.Pod) ([]int, error) {
+	port, err := pc.publicListenerPort(pod)
+	if err != nil {
+		return nil, err
+	}
+	services := []multiPortInfo{{}}
+	if isMultiPort(pod) {
+		if services, err = multiPortServices(pod); err != nil {
+			return nil, err
+		}
+	}
+	var ports []int
+	for _, svc := range services {
+		ports = append(ports, port+svc.serviceIndex)
+	}
+	return ports, nil
+}
+
+// validatePublicListenerPorts checks that the public listener ports of the pod's Envoy sidecars
+// don't collide with the other ports that the pod listens on: the ports of its containers, the
+// admin ports of the Envoy sidecars, the local bind ports of its upstreams and the outbound
+// listener of transparent proxy. The probe listener ports are checked when they're allocated.
+func (h *Handler) validatePublicListenerPorts(ns corev1.Namespace, pod corev1.Pod) error {
+	publicPorts, err := h.ProxyConfig.publicListenerPorts(pod)
+	if err != nil {
+		return err
+	}
+
+	ports := make(map[int]string)
+	for _, c := range pod.Spec.Containers {
+		for _, p := range c.Ports {
+			ports[int(p.ContainerPort)] = fmt.Sprintf("port %d of container %q", p.ContainerPort, c.Name)
+		}
+	}
+	for i := range publicPorts {
+		ports[defaultEnvoyAdminPort+i] = fmt.Sprintf("the Envoy admin port %d", defaultEnvoyAdminPort+i)
+	}
+	for _, upstream := range injectedUpstreams(pod, h.EnableNamespaces) {
+		if upstream.LocalBindPort > 0 {
+			ports[upstream.LocalBindPort] = fmt.Sprintf("the local bind port %d of upstream %s", upstream.LocalBindPort, upstream.description())
+		}
+	}
+	tproxyEnabled, err := transparentProxyEnabled(ns, pod, h.EnableTransparentProxy)
+	if err != nil {
+		return err
+	}
+	if tproxyEnabled {
+		ports[defaultTProxyOutboundListenerPort] = fmt.Sprintf("the transparent proxy outbound listener port %d", defaultTProxyOutboundListenerPort)
+	}
+
+	var errs error
+	for _, port := range publicPorts {
+		if used, ok := ports[port]; ok {
+			errs = multierror.Append(errs, fmt.Errorf("the Envoy public listener port %d collides with %s, set the %q annotation to another port",
+				port, used, annotationSidecarProxyPublicListenerPort))
+		}
+	}
+	return errs
+}
+
+// checkInterval returns the interval of the check of the public listener, either via the
+// default value in the handler, or if it's been overridden via the annotation.
+func (pc ProxyConfig) checkInterval(pod corev1.Pod) (time.Duration, error) {
+	return durationAnnotation(pod, annotationSidecarProxyCheckInterval, pc.DefaultCheckInterval, defaultProxyCheckInterval)
+}
+
+// checkTimeout returns the timeout of the check of the public listener, either via the default
+// value in the handler, or if it's been overridden via the annotation. Zero means Consul's default.
+func (pc ProxyConfig) checkTimeout(pod corev1.Pod) (time.Duration, error) {
+	if raw, ok := pod.Annotations[annotationSidecarProxyCheckTimeout]; ok && raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d < 0 {
+			return 0, fmt.Errorf("%s annotation value of %s must be a non-negative duration", annotationSidecarProxyCheckTimeout, raw)
+		}
+		return d, nil
+	}
+	return pc.DefaultCheckTimeout, nil
+}
+
+// deregisterCriticalServiceAfter returns how long the check of the public listener can be
+// critical before the proxy is deregistered, either via the default value in the handler, or if
+// it's been overridden via the annotation.
+func (pc ProxyConfig) deregisterCriticalServiceAfter(pod corev1.Pod) (time.Duration, error) {
+	return durationAnnotation(pod, annotationSidecarProxyDeregisterCriticalServiceAfter,
+		pc.DefaultDeregisterCriticalServiceAfter, defaultProxyDeregisterCriticalServiceAfter)
+}
+
+// proxyAnnotations records the port of the public listener and the settings of its check in the
+// annotations of the pod, as resolved when it's injected. The readiness probe of the Envoy sidecar
+// uses the same port, so the endpoints controller must register the proxy with these values rather
+// than with the defaults of the connect injector, which can change once the pod is running.
+func (pc ProxyConfig) proxyAnnotations(pod *corev1.Pod) error {
+	port, err := pc.publicListenerPort(*pod)
+	if err != nil {
+		return err
+	}
+	interval, err := pc.checkInterval(*pod)
+	if err != nil {
+		return err
+	}
+	timeout, err := pc.checkTimeout(*pod)
+	if err != nil {
+		return err
+	}
+	deregisterAfter, err := pc.deregisterCriticalServiceAfter(*pod)
+	if err != nil {
+		return err
+	}
+	pod.Annotations[annotationSidecarProxyPublicListenerPort] = strconv.Itoa(port)
+	pod.Annotations[annotationSidecarProxyCheckInterval] = formatDuration(interval)
+	pod.Annotations[annotationSidecarProxyCheckTimeout] = formatDuration(timeout)
+	pod.Annotations[annotationSidecarProxyDeregisterCriticalServiceAfter] = formatDuration(deregisterAfter)
+	return nil
+}
+
+// publicListenerCheck returns the TCP check of Envoy's public listener on the given port.
+func (pc ProxyConfig) publicListenerCheck(pod corev1.Pod, port int) (*api.AgentServiceCheck, error) {
+	interval, err := pc.checkInterval(pod)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := pc.checkTimeout(pod)
+	if err != nil {
+		return nil, err
+	}
+	deregisterAfter, err := pc.deregisterCriticalServiceAfter(pod)
+	if err != nil {
+		return nil, err
+	}
+	check := &api.AgentServiceCheck{
+		Name:                           "Proxy Public Listener",
+		TCP:                            net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(port)),
+		Interval:                       formatDuration(interval),
+		DeregisterCriticalServiceAfter: formatDuration(deregisterAfter),
+	}
+	if timeout > 0 {
+		check.Timeout = formatDuration(timeout)
+	}
+	return check, nil
+}
+
+// durationAnnotation returns the positive duration of the annotation if it's set, or else
+// defaultValue, falling back to fallback if defaultValue is zero.
+func durationAnnotation(pod corev1.Pod, key string, defaultValue, fallback time.Duration) (time.Duration, error) {
+	if raw, ok := pod.Annotations[key]; ok && raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			return 0, fmt.Errorf("%s annotation value of %s must be a positive duration", key, raw)
+		}
+		return d, nil
+	}
+	if defaultValue == 0 {
+		return fallback, nil
+	}
+	return defaultValue, nil
+}
+
+// formatDuration formats the duration without trailing zero units, e.g. 10m rather than 10m0s.
+func formatDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
@@ -0,0 +1,255 @@
+package connectinject
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	logrtest "github.com/go-logr/logr/testing"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestProxyConfig_PublicListenerCheck(t *testing.T) {
+	t.Parallel()
+	cases := map[string]struct {
+		config      ProxyConfig
+		annotations map[string]string
+		expPort     int
+		expCheck    *api.AgentServiceCheck
+		expErr      string
+	}{
+		"zero config uses the defaults": {
+			expPort: 20000,
+			expCheck: &api.AgentServiceCheck{
+				Name:                           "Proxy Public Listener",
+				TCP:                            "1.2.3.4:20000",
+				Interval:                       "10s",
+				DeregisterCriticalServiceAfter: "10m",
+			},
+		},
+		"defaults from flags": {
+			config: ProxyConfig{
+				DefaultPublicListenerPort:             21000,
+				DefaultCheckInterval:                  5 * time.Second,
+				DefaultCheckTimeout:                   2 * time.Second,
+				DefaultDeregisterCriticalServiceAfter: time.Hour,
+			},
+			expPort: 21000,
+			expCheck: &api.AgentServiceCheck{
+				Name:                           "Proxy Public Listener",
+				TCP:                            "1.2.3.4:21000",
+				Interval:                       "5s",
+				Timeout:                        "2s",
+				DeregisterCriticalServiceAfter: "1h",
+			},
+		},
+		"annotations override the defaults": {
+			config: ProxyConfig{
+				DefaultPublicListenerPort: 21000,
+				DefaultCheckInterval:      5 * time.Second,
+			},
+			annotations: map[string]string{
+				annotationSidecarProxyPublicListenerPort:             "22000",
+				annotationSidecarProxyCheckInterval:                  "1s",
+				annotationSidecarProxyCheckTimeout:                   "500ms",
+				annotationSidecarProxyDeregisterCriticalServiceAfter: "90s",
+			},
+			expPort: 22000,
+			expCheck: &api.AgentServiceCheck{
+				Name:                           "Proxy Public Listener",
+				TCP:                            "1.2.3.4:22000",
+				Interval:                       "1s",
+				Timeout:                        "500ms",
+				DeregisterCriticalServiceAfter: "1m30s",
+			},
+		},
+		"invalid port annotation": {
+			annotations: map[string]string{annotationSidecarProxyPublicListenerPort: "0"},
+			expErr:      "consul.hashicorp.com/sidecar-proxy-public-listener-port annotation value of 0 is not a valid port",
+		},
+		"invalid interval annotation": {
+			annotations: map[string]string{annotationSidecarProxyCheckInterval: "10"},
+			expPort:     20000,
+			expErr:      "consul.hashicorp.com/sidecar-proxy-check-interval annotation value of 10 must be a positive duration",
+		},
+	}
+	for name, c := range cases {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			pod := *createPod("pod1", "1.2.3.4", true, true)
+			for k, v := range c.annotations {
+				pod.Annotations[k] = v
+			}
+			port, err := c.config.publicListenerPort(pod)
+			if err == nil {
+				require.Equal(t, c.expPort, port)
+				var check *api.AgentServiceCheck
+				check, err = c.config.publicListenerCheck(pod, port)
+				if err == nil {
+					require.Equal(t, c.expCheck, check)
+				}
+			}
+			if c.expErr != "" {
+				require.EqualError(t, err, c.expErr)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+// Test that the proxy is registered on the configured public listener port, offset by the
+// service index on multi-port pods, and that its check uses the configured durations.
+func TestCreateServiceRegistrations_ProxyConfig(t *testing.T) {
+	t.Parallel()
+	pod := *createPod("pod1", "1.2.3.4", true, true)
+	pod.Annotations[annotationService] = "web,web-admin"
+	pod.Annotations[annotationPort] = "8080,9090"
+	pod.Annotations[annotationSidecarProxyCheckInterval] = "3s"
+	endpoints := corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web-admin",
+			Namespace: "default",
+		},
+	}
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	ep := EndpointsController{
+		Client:      fake.NewClientBuilder().WithRuntimeObjects(ns).Build(),
+		ProxyConfig: ProxyConfig{DefaultPublicListenerPort: 21000},
+		Log:         logrtest.TestLogger{T: t},
+		Context:     context.Background(),
+	}
+	_, proxyService, err := ep.createServiceRegistrations(pod, endpoints)
+	require.NoError(t, err)
+	require.Equal(t, 21001, proxyService.Port)
+	require.Equal(t, &api.AgentServiceCheck{
+		Name:                           "Proxy Public Listener",
+		TCP:                            "1.2.3.4:21001",
+		Interval:                       "3s",
+		DeregisterCriticalServiceAfter: "10m",
+	}, proxyService.Checks[0])
+}
+
+// Test that the proxy settings resolved when the pod is injected are recorded on the pod,
+// so that the proxy is still registered with them once the defaults have changed.
+func TestProxyConfig_ProxyAnnotations(t *testing.T) {
+	t.Parallel()
+	pod := *createPod("pod1", "1.2.3.4", true, true)
+	pod.Annotations[annotationSidecarProxyCheckInterval] = "3s"
+	injected := ProxyConfig{
+		DefaultPublicListenerPort:             21000,
+		DefaultDeregisterCriticalServiceAfter: time.Hour,
+	}
+	require.NoError(t, injected.proxyAnnotations(&pod))
+	require.Equal(t, "21000", pod.Annotations[annotationSidecarProxyPublicListenerPort])
+	require.Equal(t, "3s", pod.Annotations[annotationSidecarProxyCheckInterval])
+	require.Equal(t, "0s", pod.Annotations[annotationSidecarProxyCheckTimeout])
+	require.Equal(t, "1h", pod.Annotations[annotationSidecarProxyDeregisterCriticalServiceAfter])
+	_, err := validateAnnotations(pod, false)
+	require.NoError(t, err)
+
+	changed := ProxyConfig{
+		DefaultPublicListenerPort:             22000,
+		DefaultCheckTimeout:                   time.Second,
+		DefaultDeregisterCriticalServiceAfter: time.Minute,
+	}
+	port, err := changed.publicListenerPort(pod)
+	require.NoError(t, err)
+	require.Equal(t, 21000, port)
+	check, err := changed.publicListenerCheck(pod, port)
+	require.NoError(t, err)
+	require.Equal(t, &api.AgentServiceCheck{
+		Name:                           "Proxy Public Listener",
+		TCP:                            "1.2.3.4:21000",
+		Interval:                       "3s",
+		DeregisterCriticalServiceAfter: "1h",
+	}, check)
+}
+
+func TestHandler_ValidatePublicListenerPorts(t *testing.T) {
+	t.Parallel()
+	cases := map[string]struct {
+		annotations map[string]string
+		ports       []int32
+		tproxy      bool
+		expErr      string
+	}{
+		"no collision": {
+			annotations: map[string]string{annotationSidecarProxyPublicListenerPort: "20000"},
+			ports:       []int32{8080},
+			tproxy:      true,
+		},
+		"container port": {
+			annotations: map[string]string{annotationSidecarProxyPublicListenerPort: "8080"},
+			ports:       []int32{8080},
+			expErr:      `the Envoy public listener port 8080 collides with port 8080 of container "web"`,
+		},
+		"container port of the second service of a multi-port pod": {
+			annotations: map[string]string{
+				annotationService:                        "web,web-admin",
+				annotationPort:                           "8080,8081",
+				annotationSidecarProxyPublicListenerPort: "8080",
+			},
+			ports:  []int32{8080, 8081},
+			expErr: `the Envoy public listener port 8081 collides with port 8081 of container "web"`,
+		},
+		"Envoy admin port": {
+			annotations: map[string]string{annotationSidecarProxyPublicListenerPort: "19000"},
+			expErr:      `the Envoy public listener port 19000 collides with the Envoy admin port 19000`,
+		},
+		"Envoy admin port of the second service of a multi-port pod": {
+			annotations: map[string]string{
+				annotationService:                        "web,web-admin",
+				annotationPort:                           "8080,9090",
+				annotationSidecarProxyPublicListenerPort: "19001",
+			},
+			ports:  []int32{8080, 9090},
+			expErr: `the Envoy public listener port 19001 collides with the Envoy admin port 19001`,
+		},
+		"upstream port": {
+			annotations: map[string]string{
+				annotationSidecarProxyPublicListenerPort: "1234",
+				annotationUpstreams:                      "db:1234",
+			},
+			expErr: `the Envoy public listener port 1234 collides with the local bind port 1234 of upstream "db"`,
+		},
+		"transparent proxy outbound listener": {
+			annotations: map[string]string{annotationSidecarProxyPublicListenerPort: "15001"},
+			tproxy:      true,
+			expErr:      `the Envoy public listener port 15001 collides with the transparent proxy outbound listener port 15001`,
+		},
+		"transparent proxy outbound listener without transparent proxy": {
+			annotations: map[string]string{annotationSidecarProxyPublicListenerPort: "15001"},
+		},
+	}
+	for name, c := range cases {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			pod := corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Annotations: c.annotations},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}
+			for _, port := range c.ports {
+				pod.Spec.Containers[0].Ports = append(pod.Spec.Containers[0].Ports, corev1.ContainerPort{ContainerPort: port})
+			}
+			h := Handler{EnableTransparentProxy: c.tproxy}
+			err := h.validatePublicListenerPorts(corev1.Namespace{}, pod)
+			if c.expErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Contains(t, err.Error(), c.expErr)
+		})
+	}
+}
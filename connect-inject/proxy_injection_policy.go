@@ -0,0 +1,111 @@
+package connectinject
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/consul-k8s/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// applyProxyInjectionPolicy sets the annotations for the settings of the ProxyInjectionPolicy
+// that selects the pod, unless the pod already sets them with its own annotations. Because
+// namespace labels and the flags of the injector only apply when a pod doesn't set the
+// annotation, settings resolve in the order pod annotation > policy > namespace > global flags.
+// When several policies select the pod, the first one by name is applied. The name of the
+// applied policy is recorded in the annotationProxyInjectionPolicy annotation.
+func (h *Handler) applyProxyInjectionPolicy(ctx context.Context, pod *corev1.Pod, namespace string) error {
+	if h.ProxyInjectionPolicyClient == nil {
+		return nil
+	}
+
+	var policies v1alpha1.ProxyInjectionPolicyList
+	if err := h.ProxyInjectionPolicyClient.List(ctx, &policies, client.InNamespace(namespace)); err != nil {
+		return fmt.Errorf("error listing ProxyInjectionPolicies: %s", err)
+	}
+	sort.Slice(policies.Items, func(i, j int) bool {
+		return policies.Items[i].Name < policies.Items[j].Name
+	})
+
+	for _, policy := range policies.Items {
+		matches, err := policy.Matches(pod.Labels)
+		if err != nil {
+			return fmt.Errorf("ProxyInjectionPolicy %q has an invalid selector: %s", policy.Name, err)
+		}
+		if !matches {
+			continue
+		}
+		for key, value := range proxyInjectionPolicyAnnotations(policy.Spec) {
+			if _, ok := pod.Annotations[key]; !ok {
+				pod.Annotations[key] = value
+			}
+		}
+		pod.Annotations[annotationProxyInjectionPolicy] = policy.Name
+		return nil
+	}
+	return nil
+}
+
+// proxyInjectionPolicyAnnotations returns the pod annotations that configure the settings
+// of the policy. Settings that aren't set in the policy are left out.
+func proxyInjectionPolicyAnnotations(spec v1alpha1.ProxyInjectionPolicySpec) map[string]string {
+	annotations := make(map[string]string)
+	setString := func(key, value string) {
+		if value != "" {
+			annotations[key] = value
+		}
+	}
+	setBool := func(key string, value *bool) {
+		if value != nil {
+			annotations[key] = strconv.FormatBool(*value)
+		}
+	}
+	setPort := func(key string, value int32) {
+		if value != 0 {
+			annotations[key] = strconv.Itoa(int(value))
+		}
+	}
+	setList := func(key string, value []string) {
+		if len(value) > 0 {
+			annotations[key] = strings.Join(value, ",")
+		}
+	}
+
+	proxy := spec.SidecarProxy
+	if proxy.CPURequest != nil {
+		annotations[annotationSidecarProxyCPURequest] = proxy.CPURequest.String()
+	}
+	if proxy.CPULimit != nil {
+		annotations[annotationSidecarProxyCPULimit] = proxy.CPULimit.String()
+	}
+	if proxy.MemoryRequest != nil {
+		annotations[annotationSidecarProxyMemoryRequest] = proxy.MemoryRequest.String()
+	}
+	if proxy.MemoryLimit != nil {
+		annotations[annotationSidecarProxyMemoryLimit] = proxy.MemoryLimit.String()
+	}
+	setString(annotationEnvoyExtraArgs, proxy.EnvoyExtraArgs)
+
+	metrics := spec.Metrics
+	setBool(annotationEnableMetrics, metrics.EnableMetrics)
+	setBool(annotationEnableMetricsMerging, metrics.EnableMetricsMerging)
+	setPort(annotationMergedMetricsPort, metrics.MergedMetricsPort)
+	setPort(annotationPrometheusScrapePort, metrics.PrometheusScrapePort)
+	setString(annotationPrometheusScrapePath, metrics.PrometheusScrapePath)
+	setString(annotationServiceMetricsPort, metrics.ServiceMetricsPort)
+	setString(annotationServiceMetricsPath, metrics.ServiceMetricsPath)
+
+	tproxy := spec.TransparentProxy
+	setBool(keyTransparentProxy, tproxy.Enabled)
+	setList(annotationTProxyExcludeInboundPorts, tproxy.ExcludeInboundPorts)
+	setList(annotationTProxyExcludeOutboundPorts, tproxy.ExcludeOutboundPorts)
+	setList(annotationTProxyExcludeOutboundCIDRs, tproxy.ExcludeOutboundCIDRs)
+	setList(annotationTProxyExcludeUIDs, tproxy.ExcludeUIDs)
+	setBool(annotationTransparentProxyOverwriteProbes, tproxy.OverwriteProbes)
+
+	return annotations
+}
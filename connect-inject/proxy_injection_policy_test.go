@@ -0,0 +1,162 @@
+package connectinject
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/consul-k8s/api/v1alpha1"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestHandlerDefaultAnnotations_ProxyInjectionPolicy(t *testing.T) {
+	cpu := resource.MustParse("100m")
+	backendPolicy := &v1alpha1.ProxyInjectionPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "backend", Namespace: "default"},
+		Spec: v1alpha1.ProxyInjectionPolicySpec{
+			Selector: metav1.LabelSelector{MatchLabels: map[string]string{"tier": "backend"}},
+			SidecarProxy: v1alpha1.SidecarProxyPolicy{
+				CPURequest:     &cpu,
+				EnvoyExtraArgs: "--log-level warn",
+			},
+			Metrics: v1alpha1.MetricsPolicy{
+				EnableMetrics:        pointerToBool(true),
+				PrometheusScrapePort: 20300,
+			},
+			TransparentProxy: v1alpha1.TransparentProxyPolicy{
+				Enabled:              pointerToBool(false),
+				ExcludeOutboundCIDRs: []string{"10.0.0.0/8", "192.168.0.0/16"},
+			},
+		},
+	}
+	// allPolicy selects every pod but comes after backendPolicy by name.
+	allPolicy := &v1alpha1.ProxyInjectionPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "default"},
+		Spec: v1alpha1.ProxyInjectionPolicySpec{
+			SidecarProxy: v1alpha1.SidecarProxyPolicy{EnvoyExtraArgs: "--log-level info"},
+		},
+	}
+	otherNamespacePolicy := &v1alpha1.ProxyInjectionPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "another", Namespace: "other"},
+		Spec: v1alpha1.ProxyInjectionPolicySpec{
+			SidecarProxy: v1alpha1.SidecarProxyPolicy{EnvoyExtraArgs: "--log-level trace"},
+		},
+	}
+	invalidPolicy := &v1alpha1.ProxyInjectionPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "invalid", Namespace: "default"},
+		Spec: v1alpha1.ProxyInjectionPolicySpec{
+			Selector: metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+				{Key: "tier", Operator: "Near"},
+			}},
+		},
+	}
+
+	cases := map[string]struct {
+		policies       []runtime.Object
+		labels         map[string]string
+		annotations    map[string]string
+		expAnnotations map[string]string
+		expErr         string
+	}{
+		"no policies": {
+			labels:         map[string]string{"tier": "backend"},
+			expAnnotations: map[string]string{},
+		},
+		"no matching policy": {
+			policies:       []runtime.Object{backendPolicy, otherNamespacePolicy},
+			labels:         map[string]string{"tier": "frontend"},
+			expAnnotations: map[string]string{},
+		},
+		"matching policy": {
+			policies: []runtime.Object{backendPolicy, otherNamespacePolicy},
+			labels:   map[string]string{"tier": "backend"},
+			expAnnotations: map[string]string{
+				annotationSidecarProxyCPURequest:     "100m",
+				annotationEnvoyExtraArgs:             "--log-level warn",
+				annotationEnableMetrics:              "true",
+				annotationPrometheusScrapePort:       "20300",
+				keyTransparentProxy:                  "false",
+				annotationTProxyExcludeOutboundCIDRs: "10.0.0.0/8,192.168.0.0/16",
+				annotationProxyInjectionPolicy:       "backend",
+			},
+		},
+		"pod annotations take precedence": {
+			policies: []runtime.Object{backendPolicy},
+			labels:   map[string]string{"tier": "backend"},
+			annotations: map[string]string{
+				annotationEnvoyExtraArgs: "--log-level debug",
+				keyTransparentProxy:      "true",
+			},
+			expAnnotations: map[string]string{
+				annotationSidecarProxyCPURequest:     "100m",
+				annotationEnvoyExtraArgs:             "--log-level debug",
+				annotationEnableMetrics:              "true",
+				annotationPrometheusScrapePort:       "20300",
+				keyTransparentProxy:                  "true",
+				annotationTProxyExcludeOutboundCIDRs: "10.0.0.0/8,192.168.0.0/16",
+				annotationProxyInjectionPolicy:       "backend",
+			},
+		},
+		"first policy by name is applied": {
+			policies: []runtime.Object{allPolicy, backendPolicy},
+			labels:   map[string]string{"tier": "backend"},
+			expAnnotations: map[string]string{
+				annotationSidecarProxyCPURequest:     "100m",
+				annotationEnvoyExtraArgs:             "--log-level warn",
+				annotationEnableMetrics:              "true",
+				annotationPrometheusScrapePort:       "20300",
+				keyTransparentProxy:                  "false",
+				annotationTProxyExcludeOutboundCIDRs: "10.0.0.0/8,192.168.0.0/16",
+				annotationProxyInjectionPolicy:       "backend",
+			},
+		},
+		"empty selector": {
+			policies: []runtime.Object{allPolicy, backendPolicy},
+			labels:   map[string]string{"tier": "frontend"},
+			expAnnotations: map[string]string{
+				annotationEnvoyExtraArgs:       "--log-level info",
+				annotationProxyInjectionPolicy: "default",
+			},
+		},
+		"invalid selector": {
+			policies: []runtime.Object{invalidPolicy},
+			expErr:   `ProxyInjectionPolicy "invalid" has an invalid selector: "Near" is not a valid pod selector operator`,
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			s := runtime.NewScheme()
+			require.NoError(t, clientgoscheme.AddToScheme(s))
+			require.NoError(t, v1alpha1.AddToScheme(s))
+			h := Handler{
+				ProxyInjectionPolicyClient: fake.NewClientBuilder().WithScheme(s).WithRuntimeObjects(c.policies...).Build(),
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      c.labels,
+					Annotations: c.annotations,
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+						},
+					},
+				},
+			}
+			err := h.defaultAnnotations(context.Background(), pod, "default")
+			if c.expErr != "" {
+				require.EqualError(t, err, c.expErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.expAnnotations, pod.Annotations)
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package connectinject
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/consul/api"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// conditionTypeRegistered is the type of the pod condition that the endpoints controller sets
+	// once it has registered the services of the pod with Consul. The injector adds a readiness
+	// gate for it so that pods aren't ready before they're part of the mesh.
+	conditionTypeRegistered corev1.PodConditionType = "consul.hashicorp.com/registered"
+
+	conditionReasonRegistered          = "Registered"
+	conditionReasonRegistrationFailed  = "RegistrationFailed"
+	conditionReasonRegistrationPending = "RegistrationPending"
+	conditionMessageRegistered         = "Services registered with Consul"
+)
+
+// addRegisteredReadinessGate adds the readiness gate for the registered condition to the pod
+// if it doesn't have it yet.
+func addRegisteredReadinessGate(pod *corev1.Pod) {
+	if hasRegisteredReadinessGate(*pod) {
+		return
+	}
+	pod.Spec.ReadinessGates = append(pod.Spec.ReadinessGates, corev1.PodReadinessGate{ConditionType: conditionTypeRegistered})
+}
+
+// hasRegisteredReadinessGate returns true if the pod has the readiness gate for the registered
+// condition.
+func hasRegisteredReadinessGate(pod corev1.Pod) bool {
+	for _, gate := range pod.Spec.ReadinessGates {
+		if gate.ConditionType == conditionTypeRegistered {
+			return true
+		}
+	}
+	return false
+}
+
+// updateRegisteredCondition sets the registered condition of the pod to true if its services were
+// registered, or to false with the registration error as its message. Pods without the readiness
+// gate aren't changed, and neither are pods whose condition is already up to date. Multi-port pods
+// register a service each time the endpoints of one of their Kubernetes services are reconciled,
+// so their condition stays false until the local agent has all of their services.
+func (r *EndpointsController) updateRegisteredCondition(ctx context.Context, client *api.Client, pod corev1.Pod, registrationErr error) error {
+	if !hasRegisteredReadinessGate(pod) {
+		return nil
+	}
+
+	var unregistered []string
+	if registrationErr == nil && isMultiPort(pod) {
+		var err error
+		unregistered, err = unregisteredServices(client, pod)
+		if err != nil {
+			return err
+		}
+	}
+
+	condition := corev1.PodCondition{
+		Type:               conditionTypeRegistered,
+		Status:             corev1.ConditionTrue,
+		Reason:             conditionReasonRegistered,
+		Message:            conditionMessageRegistered,
+		LastTransitionTime: metav1.Now(),
+	}
+	if registrationErr != nil {
+		condition.Status = corev1.ConditionFalse
+		condition.Reason = conditionReasonRegistrationFailed
+		condition.Message = registrationErr.Error()
+	} else if len(unregistered) > 0 {
+		condition.Status = corev1.ConditionFalse
+		condition.Reason = conditionReasonRegistrationPending
+		condition.Message = fmt.Sprintf("Services not registered with Consul yet: %s", quotedList(unregistered))
+	}
+	return r.patchPodCondition(ctx, pod, condition)
+}
+
+// unregisteredServices returns the names of the services of the multi-port pod that its local
+// agent doesn't have, sorted by name.
+func unregisteredServices(client *api.Client, pod corev1.Pod) ([]string, error) {
+	services, err := multiPortServices(pod)
+	if err != nil {
+		return nil, err
+	}
+	filter := fmt.Sprintf("Meta[%q] == %q and Meta[%q] == %q", MetaKeyPodName, pod.Name, MetaKeyKubeNS, pod.Namespace)
+	registered, err := client.Agent().ServicesWithFilter(filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get services of pod: %s", err)
+	}
+	names := make(map[string]bool)
+	for _, svc := range registered {
+		if svc.Kind != api.ServiceKindConnectProxy {
+			names[svc.Service] = true
+		}
+	}
+	var unregistered []string
+	for _, svc := range services {
+		if !names[svc.serviceName] {
+			unregistered = append(unregistered, svc.serviceName)
+		}
+	}
+	sort.Strings(unregistered)
+	return unregistered, nil
+}
+
+// patchPodCondition sets the condition on the pod unless the pod already has a condition of the
+// same type with the same status and message. The last transition time of the condition is kept
+// if its status doesn't change.
+func (r *EndpointsController) patchPodCondition(ctx context.Context, pod corev1.Pod, condition corev1.PodCondition) error {
+	for _, existing := range pod.Status.Conditions {
+		if existing.Type != condition.Type {
+			continue
+		}
+		if existing.Status == condition.Status && existing.Message == condition.Message {
+			return nil
+		}
+		if existing.Status == condition.Status {
+			condition.LastTransitionTime = existing.LastTransitionTime
+		}
+	}
+
+	// A strategic merge patch merges the condition into the list by its type, leaving the
+	// conditions set by the kubelet alone.
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{
+			"conditions": []corev1.PodCondition{condition},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	r.Log.Info("updating condition of pod", "name", pod.Name, "ns", pod.Namespace, "type", condition.Type, "status", condition.Status)
+	return r.Client.Status().Patch(ctx, &pod, client.RawPatch(types.StrategicMergePatchType, patch))
+}
@@ -0,0 +1,257 @@
+package connectinject
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	mapset "github.com/deckarep/golang-set"
+	logrtest "github.com/go-logr/logr/testing"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	clientgofake "k8s.io/client-go/kubernetes/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestAddRegisteredReadinessGate(t *testing.T) {
+	t.Parallel()
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			ReadinessGates: []corev1.PodReadinessGate{{ConditionType: "example.com/other"}},
+		},
+	}
+	require.False(t, hasRegisteredReadinessGate(pod))
+
+	addRegisteredReadinessGate(&pod)
+	require.True(t, hasRegisteredReadinessGate(pod))
+
+	// Adding the gate again doesn't duplicate it.
+	addRegisteredReadinessGate(&pod)
+	require.Equal(t, []corev1.PodReadinessGate{
+		{ConditionType: "example.com/other"},
+		{ConditionType: conditionTypeRegistered},
+	}, pod.Spec.ReadinessGates)
+}
+
+func TestUpdateRegisteredCondition(t *testing.T) {
+	t.Parallel()
+	transitionTime := metav1.NewTime(time.Now().Add(-time.Hour).Truncate(time.Second))
+	readyCondition := corev1.PodCondition{Type: corev1.PodReady, Status: corev1.ConditionFalse}
+	registered := corev1.PodCondition{
+		Type:               conditionTypeRegistered,
+		Status:             corev1.ConditionTrue,
+		Reason:             conditionReasonRegistered,
+		Message:            conditionMessageRegistered,
+		LastTransitionTime: transitionTime,
+	}
+
+	cases := map[string]struct {
+		gate            bool
+		conditions      []corev1.PodCondition
+		registrationErr error
+		expConditions   []corev1.PodCondition
+		// expTransitionTime is checked when it's set, since the condition is otherwise given
+		// the current time.
+		expTransitionTime *metav1.Time
+	}{
+		"no readiness gate": {
+			conditions:    []corev1.PodCondition{readyCondition},
+			expConditions: []corev1.PodCondition{readyCondition},
+		},
+		"registered": {
+			gate:       true,
+			conditions: []corev1.PodCondition{readyCondition},
+			expConditions: []corev1.PodCondition{
+				readyCondition,
+				{
+					Type:    conditionTypeRegistered,
+					Status:  corev1.ConditionTrue,
+					Reason:  conditionReasonRegistered,
+					Message: conditionMessageRegistered,
+				},
+			},
+		},
+		"registration failed": {
+			gate:            true,
+			conditions:      []corev1.PodCondition{readyCondition, registered},
+			registrationErr: errors.New("agent unreachable"),
+			expConditions: []corev1.PodCondition{
+				readyCondition,
+				{
+					Type:    conditionTypeRegistered,
+					Status:  corev1.ConditionFalse,
+					Reason:  conditionReasonRegistrationFailed,
+					Message: "agent unreachable",
+				},
+			},
+		},
+		"already registered": {
+			gate:              true,
+			conditions:        []corev1.PodCondition{readyCondition, registered},
+			expConditions:     []corev1.PodCondition{readyCondition, registered},
+			expTransitionTime: &transitionTime,
+		},
+		"registration failed with another error": {
+			gate: true,
+			conditions: []corev1.PodCondition{{
+				Type:               conditionTypeRegistered,
+				Status:             corev1.ConditionFalse,
+				Reason:             conditionReasonRegistrationFailed,
+				Message:            "agent unreachable",
+				LastTransitionTime: transitionTime,
+			}},
+			registrationErr: errors.New("ACL not found"),
+			expConditions: []corev1.PodCondition{{
+				Type:    conditionTypeRegistered,
+				Status:  corev1.ConditionFalse,
+				Reason:  conditionReasonRegistrationFailed,
+				Message: "ACL not found",
+			}},
+			expTransitionTime: &transitionTime,
+		},
+	}
+	for name, c := range cases {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			pod := createPod("pod1", "1.2.3.4", true, true)
+			if c.gate {
+				addRegisteredReadinessGate(pod)
+			}
+			pod.Status.Conditions = c.conditions
+			fakeClient := fake.NewClientBuilder().WithRuntimeObjects(pod).Build()
+			ep := &EndpointsController{
+				Client: fakeClient,
+				Log:    logrtest.TestLogger{T: t},
+			}
+
+			err := ep.updateRegisteredCondition(context.Background(), nil, *pod, c.registrationErr)
+			require.NoError(t, err)
+
+			var updated corev1.Pod
+			err = fakeClient.Get(context.Background(), types.NamespacedName{Name: "pod1", Namespace: "default"}, &updated)
+			require.NoError(t, err)
+			// The transition times are compared separately, and the patch may reorder the conditions.
+			var actual, expected []corev1.PodCondition
+			for _, condition := range updated.Status.Conditions {
+				if c.expTransitionTime != nil && condition.Type == conditionTypeRegistered {
+					require.True(t, c.expTransitionTime.Equal(&condition.LastTransitionTime))
+				}
+				condition.LastTransitionTime = metav1.Time{}
+				actual = append(actual, condition)
+			}
+			for _, condition := range c.expConditions {
+				condition.LastTransitionTime = metav1.Time{}
+				expected = append(expected, condition)
+			}
+			require.ElementsMatch(t, expected, actual)
+		})
+	}
+}
+
+// Test that the registered condition of multi-port pods stays false until the agent has all of
+// their services.
+func TestUpdateRegisteredCondition_MultiPort(t *testing.T) {
+	t.Parallel()
+	agents := startFakeAgents(t, 1)
+	consulClient, err := api.NewClient(&api.Config{Address: net.JoinHostPort(agents.ips[0], agents.port)})
+	require.NoError(t, err)
+	registerService := func(id, name string, kind api.ServiceKind) {
+		agents.mu.Lock()
+		defer agents.mu.Unlock()
+		agents.services[agents.ips[0]][id] = &api.AgentService{
+			ID:      id,
+			Service: name,
+			Kind:    kind,
+			Meta:    map[string]string{MetaKeyPodName: "pod1", MetaKeyKubeNS: "default"},
+		}
+	}
+
+	pod := createPod("pod1", "1.2.3.4", true, true)
+	pod.Annotations[annotationService] = "web,web-admin,web-metrics"
+	pod.Annotations[annotationPort] = "8080,9090,9091"
+	addRegisteredReadinessGate(pod)
+	fakeClient := fake.NewClientBuilder().WithRuntimeObjects(pod).Build()
+	ep := &EndpointsController{
+		Client: fakeClient,
+		Log:    logrtest.TestLogger{T: t},
+	}
+	registeredCondition := func() corev1.PodCondition {
+		var updated corev1.Pod
+		err := fakeClient.Get(context.Background(), types.NamespacedName{Name: "pod1", Namespace: "default"}, &updated)
+		require.NoError(t, err)
+		for _, condition := range updated.Status.Conditions {
+			if condition.Type == conditionTypeRegistered {
+				*pod = updated
+				return condition
+			}
+		}
+		t.Fatal("pod has no registered condition")
+		return corev1.PodCondition{}
+	}
+
+	// The service web is registered, but the other services aren't yet, even though the
+	// proxy of web-admin is.
+	registerService("pod1-web", "web", "")
+	registerService("pod1-web-admin-sidecar-proxy", "web-admin-sidecar-proxy", api.ServiceKindConnectProxy)
+	require.NoError(t, ep.updateRegisteredCondition(context.Background(), consulClient, *pod, nil))
+	condition := registeredCondition()
+	require.Equal(t, corev1.ConditionFalse, condition.Status)
+	require.Equal(t, conditionReasonRegistrationPending, condition.Reason)
+	require.Equal(t, `Services not registered with Consul yet: "web-admin", "web-metrics"`, condition.Message)
+
+	// The registration of web-admin fails.
+	require.NoError(t, ep.updateRegisteredCondition(context.Background(), consulClient, *pod, errors.New("agent unreachable")))
+	condition = registeredCondition()
+	require.Equal(t, conditionReasonRegistrationFailed, condition.Reason)
+
+	// The service web-metrics is registered, but web-admin still isn't.
+	registerService("pod1-web-metrics", "web-metrics", "")
+	require.NoError(t, ep.updateRegisteredCondition(context.Background(), consulClient, *pod, nil))
+	condition = registeredCondition()
+	require.Equal(t, corev1.ConditionFalse, condition.Status)
+	require.Equal(t, `Services not registered with Consul yet: "web-admin"`, condition.Message)
+
+	registerService("pod1-web-admin", "web-admin", "")
+	require.NoError(t, ep.updateRegisteredCondition(context.Background(), consulClient, *pod, nil))
+	condition = registeredCondition()
+	require.Equal(t, corev1.ConditionTrue, condition.Status)
+	require.Equal(t, conditionReasonRegistered, condition.Reason)
+}
+
+func TestHandlerHandle_RegistrationReadinessGate(t *testing.T) {
+	t.Parallel()
+	s := runtime.NewScheme()
+	s.AddKnownTypes(schema.GroupVersion{Group: "", Version: "v1"}, &corev1.Pod{})
+	decoder, err := admission.NewDecoder(s)
+	require.NoError(t, err)
+
+	for _, enabled := range []bool{true, false} {
+		ns := corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+		h := Handler{
+			Log:                             logrtest.TestLogger{T: t},
+			AllowK8sNamespacesSet:           mapset.NewSetWith("*"),
+			DenyK8sNamespacesSet:            mapset.NewSet(),
+			decoder:                         decoder,
+			Clientset:                       clientgofake.NewSimpleClientset(&ns),
+			EnableRegistrationReadinessGate: enabled,
+		}
+		pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "web"}}}}
+		resp := h.Handle(context.Background(), admission.Request{
+			AdmissionRequest: admissionv1.AdmissionRequest{
+				Namespace: ns.Name,
+				Object:    encodeRaw(t, pod),
+			},
+		})
+		require.True(t, resp.Allowed, resp.Result)
+		require.Equal(t, enabled, hasRegisteredReadinessGate(*applyPatches(t, pod, resp.Patches)))
+	}
+}
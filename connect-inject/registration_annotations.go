@@ -0,0 +1,106 @@
+package connectinject
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// serviceWeights returns the weights of the service and proxy registrations of the pod from
+// its annotations, or nil if neither weight is set so that Consul's defaults are used. A weight
+// that isn't set defaults to 1, like in Consul.
+func serviceWeights(pod corev1.Pod) (*api.AgentWeights, error) {
+	rawPassing, passingOK := pod.Annotations[annotationServiceWeightsPassing]
+	rawWarning, warningOK := pod.Annotations[annotationServiceWeightsWarning]
+	if !passingOK && !warningOK {
+		return nil, nil
+	}
+
+	weights := &api.AgentWeights{Passing: 1, Warning: 1}
+	if passingOK {
+		passing, err := strconv.Atoi(rawPassing)
+		if err != nil || passing < 1 {
+			return nil, fmt.Errorf("%s annotation value of %s must be a positive integer", annotationServiceWeightsPassing, rawPassing)
+		}
+		weights.Passing = passing
+	}
+	if warningOK {
+		warning, err := strconv.Atoi(rawWarning)
+		if err != nil || warning < 0 {
+			return nil, fmt.Errorf("%s annotation value of %s must be a non-negative integer", annotationServiceWeightsWarning, rawWarning)
+		}
+		weights.Warning = warning
+	}
+	return weights, nil
+}
+
+// withAnnotatedTaggedAddresses returns the tagged addresses with the ones from the pod's
+// consul.hashicorp.com/service-tagged-address-<name> annotations added. Annotated addresses
+// without a port use the given port, i.e. the port of the service or of the proxy they're
+// registered with. They take precedence over the tagged addresses of the pod's IPs.
+func withAnnotatedTaggedAddresses(pod corev1.Pod, taggedAddresses map[string]api.ServiceAddress, port int) (map[string]api.ServiceAddress, error) {
+	// Sort the keys so that an invalid annotation is always reported the same way.
+	var keys []string
+	for key := range pod.Annotations {
+		if strings.HasPrefix(key, annotationTaggedAddress) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, annotationTaggedAddress)
+		if err := validateTaggedAddressName(name); err != nil {
+			return nil, fmt.Errorf("%s annotation is invalid: %s", key, err)
+		}
+		address, addressPort, err := parseTaggedAddress(pod.Annotations[key])
+		if err != nil {
+			return nil, fmt.Errorf("%s annotation is invalid: %s", key, err)
+		}
+		if addressPort == 0 {
+			addressPort = port
+		}
+		if taggedAddresses == nil {
+			taggedAddresses = make(map[string]api.ServiceAddress)
+		}
+		taggedAddresses[name] = api.ServiceAddress{Address: address, Port: addressPort}
+	}
+	return taggedAddresses, nil
+}
+
+// validateTaggedAddressName validates the name of an annotated tagged address. The "virtual"
+// tagged address is reserved for the cluster IP of the Kubernetes service with transparent proxy.
+func validateTaggedAddressName(name string) error {
+	if name == "" {
+		return fmt.Errorf("the tagged address name must not be empty")
+	}
+	if name == clusterIPTaggedAddressName {
+		return fmt.Errorf("the %q tagged address is reserved", clusterIPTaggedAddressName)
+	}
+	return nil
+}
+
+// parseTaggedAddress parses a tagged address in the form <address>[:<port>], where the address
+// is an IP address or a DNS name and IPv6 addresses with a port are enclosed in brackets. The
+// returned port is zero if it isn't set.
+func parseTaggedAddress(raw string) (string, int, error) {
+	address := raw
+	port := 0
+	if host, rawPort, err := net.SplitHostPort(raw); err == nil {
+		address = host
+		port, err = strconv.Atoi(rawPort)
+		if err != nil || port < 1 || port > 65535 {
+			return "", 0, fmt.Errorf("%q is not a valid port", rawPort)
+		}
+	}
+	if net.ParseIP(address) == nil && len(validation.IsDNS1123Subdomain(address)) > 0 {
+		return "", 0, fmt.Errorf("%q is not an IP address or a DNS name", address)
+	}
+	return address, port, nil
+}
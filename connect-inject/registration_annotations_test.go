@@ -0,0 +1,156 @@
+package connectinject
+
+import (
+	"context"
+	"testing"
+
+	logrtest "github.com/go-logr/logr/testing"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestServiceWeights(t *testing.T) {
+	t.Parallel()
+	cases := map[string]struct {
+		annotations map[string]string
+		expWeights  *api.AgentWeights
+		expErr      string
+	}{
+		"no annotations": {},
+		"passing only": {
+			annotations: map[string]string{annotationServiceWeightsPassing: "10"},
+			expWeights:  &api.AgentWeights{Passing: 10, Warning: 1},
+		},
+		"warning only": {
+			annotations: map[string]string{annotationServiceWeightsWarning: "0"},
+			expWeights:  &api.AgentWeights{Passing: 1, Warning: 0},
+		},
+		"both": {
+			annotations: map[string]string{
+				annotationServiceWeightsPassing: "3",
+				annotationServiceWeightsWarning: "2",
+			},
+			expWeights: &api.AgentWeights{Passing: 3, Warning: 2},
+		},
+		"invalid passing": {
+			annotations: map[string]string{annotationServiceWeightsPassing: "0"},
+			expErr:      "consul.hashicorp.com/service-weights-passing annotation value of 0 must be a positive integer",
+		},
+		"invalid warning": {
+			annotations: map[string]string{annotationServiceWeightsWarning: "low"},
+			expErr:      "consul.hashicorp.com/service-weights-warning annotation value of low must be a non-negative integer",
+		},
+	}
+	for name, c := range cases {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			weights, err := serviceWeights(corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: c.annotations}})
+			if c.expErr != "" {
+				require.EqualError(t, err, c.expErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.expWeights, weights)
+		})
+	}
+}
+
+func TestWithAnnotatedTaggedAddresses(t *testing.T) {
+	t.Parallel()
+	cases := map[string]struct {
+		annotations        map[string]string
+		taggedAddresses    map[string]api.ServiceAddress
+		expTaggedAddresses map[string]api.ServiceAddress
+		expErr             string
+	}{
+		"no annotations": {},
+		"addresses with and without ports": {
+			annotations: map[string]string{
+				annotationTaggedAddress + "wan":      "203.0.113.10:9000",
+				annotationTaggedAddress + "wan_ipv6": "2001:db8::10",
+				annotationTaggedAddress + "public":   "web.example.com",
+			},
+			expTaggedAddresses: map[string]api.ServiceAddress{
+				"wan":      {Address: "203.0.113.10", Port: 9000},
+				"wan_ipv6": {Address: "2001:db8::10", Port: 8080},
+				"public":   {Address: "web.example.com", Port: 8080},
+			},
+		},
+		"merged with the addresses of the pod's IPs": {
+			annotations: map[string]string{
+				annotationTaggedAddress + "wan":      "[2001:db8::10]:9000",
+				annotationTaggedAddress + "lan_ipv4": "10.0.0.1",
+			},
+			taggedAddresses: map[string]api.ServiceAddress{
+				taggedAddressLANIPv4: {Address: "1.2.3.4", Port: 8080},
+				taggedAddressLANIPv6: {Address: "2001:db8::1", Port: 8080},
+			},
+			expTaggedAddresses: map[string]api.ServiceAddress{
+				"wan":                {Address: "2001:db8::10", Port: 9000},
+				taggedAddressLANIPv4: {Address: "10.0.0.1", Port: 8080},
+				taggedAddressLANIPv6: {Address: "2001:db8::1", Port: 8080},
+			},
+		},
+		"reserved name": {
+			annotations: map[string]string{annotationTaggedAddress + "virtual": "10.0.0.1"},
+			expErr:      `consul.hashicorp.com/service-tagged-address-virtual annotation is invalid: the "virtual" tagged address is reserved`,
+		},
+		"invalid address": {
+			annotations: map[string]string{annotationTaggedAddress + "wan": "not an address"},
+			expErr:      `consul.hashicorp.com/service-tagged-address-wan annotation is invalid: "not an address" is not an IP address or a DNS name`,
+		},
+		"invalid port": {
+			annotations: map[string]string{annotationTaggedAddress + "wan": "203.0.113.10:0"},
+			expErr:      `consul.hashicorp.com/service-tagged-address-wan annotation is invalid: "0" is not a valid port`,
+		},
+	}
+	for name, c := range cases {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: c.annotations}}
+			taggedAddresses, err := withAnnotatedTaggedAddresses(pod, c.taggedAddresses, 8080)
+			if c.expErr != "" {
+				require.EqualError(t, err, c.expErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.expTaggedAddresses, taggedAddresses)
+		})
+	}
+}
+
+// Test that the weights and the annotated tagged addresses are registered with both the service
+// and the proxy, with the port of each registration when the annotation doesn't set one.
+func TestCreateServiceRegistrations_WeightsAndTaggedAddresses(t *testing.T) {
+	t.Parallel()
+	pod := *createPod("pod1", "1.2.3.4", true, true)
+	pod.Annotations[annotationPort] = "8080"
+	pod.Annotations[annotationServiceWeightsPassing] = "5"
+	pod.Annotations[annotationTaggedAddress+"wan"] = "203.0.113.10"
+	endpoints := corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web",
+			Namespace: "default",
+		},
+	}
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	ep := EndpointsController{
+		Client:  fake.NewClientBuilder().WithRuntimeObjects(ns).Build(),
+		Log:     logrtest.TestLogger{T: t},
+		Context: context.Background(),
+	}
+	service, proxyService, err := ep.createServiceRegistrations(pod, endpoints)
+	require.NoError(t, err)
+
+	require.Equal(t, &api.AgentWeights{Passing: 5, Warning: 1}, service.Weights)
+	require.Equal(t, &api.AgentWeights{Passing: 5, Warning: 1}, proxyService.Weights)
+	require.Equal(t, map[string]api.ServiceAddress{
+		"wan": {Address: "203.0.113.10", Port: 8080},
+	}, service.TaggedAddresses)
+	require.Equal(t, map[string]api.ServiceAddress{
+		"wan": {Address: "203.0.113.10", Port: 20000},
+	}, proxyService.TaggedAddresses)
+}
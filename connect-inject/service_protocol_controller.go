@@ -0,0 +1,398 @@
+package connectinject
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/hashicorp/consul-k8s/api/v1alpha1"
+	"github.com/hashicorp/go-multierror"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+const (
+	// labelProtocolFromService marks the ServiceDefaults that the service protocol controller
+	// manages, with the name of the Kubernetes service their protocol is derived from. ServiceDefaults
+	// without it are authored by users and are never changed by the controller.
+	labelProtocolFromService = "consul.hashicorp.com/protocol-from-service"
+
+	// conditionTypeProtocolConflict is the type of the Kubernetes service condition that the service
+	// protocol controller sets when it can't manage the ServiceDefaults of the service's Consul service.
+	conditionTypeProtocolConflict = "consul.hashicorp.com/service-defaults-protocol-conflict"
+
+	conditionReasonPortProtocols    = "ConflictingPortProtocols"
+	conditionReasonUserAuthored     = "UserAuthoredServiceDefaults"
+	conditionReasonOtherKubeService = "ServiceDefaultsManagedForOtherService"
+	conditionReasonOtherNamespace   = "ServiceDefaultsInOtherNamespace"
+)
+
+// ServiceProtocolController manages a ServiceDefaults resource for each Kubernetes service that
+// selects injected pods, with the protocol that the service's ports declare through their
+// appProtocol, or else through the http-, http2-, grpc- or tcp- prefix of their name, so that L7
+// features like service routers and L7 intentions apply without writing the ServiceDefaults by hand.
+// The ServiceDefaults is named after the Consul service that the pods are registered as, and is
+// synced to Consul by the config entry controller. ServiceDefaults written by users always win:
+// the controller only changes those it created, which carry the
+// consul.hashicorp.com/protocol-from-service label, and a user can take one over by removing the
+// label. ServiceDefaults in other Kubernetes namespaces that are synced to the same Consul namespace,
+// e.g. any namespace when Consul namespaces are disabled, are the config entry of the same Consul
+// service, so the controller doesn't create one next to them. Conflicts, e.g. with the protocol of a
+// user-authored ServiceDefaults, are reported with a condition on the Kubernetes service.
+type ServiceProtocolController struct {
+	// Controller is the endpoints controller whose configuration and client are used.
+	Controller *EndpointsController
+	Log        logr.Logger
+}
+
+func (r *ServiceProtocolController) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	ep := r.Controller
+	if shouldIgnore(req.Namespace, ep.DenyK8sNamespacesSet, ep.AllowK8sNamespacesSet) {
+		return ctrl.Result{}, nil
+	}
+
+	var svc corev1.Service
+	err := ep.Client.Get(ctx, req.NamespacedName, &svc)
+	if k8serrors.IsNotFound(err) {
+		// The ServiceDefaults that the service owns are garbage collected.
+		return ctrl.Result{}, nil
+	} else if err != nil {
+		r.Log.Error(err, "failed to get service", "name", req.Name, "ns", req.Namespace)
+		return ctrl.Result{}, err
+	}
+
+	consulName, err := r.consulServiceName(ctx, svc)
+	if err != nil {
+		r.Log.Error(err, "failed to list pods", "name", svc.Name, "ns", svc.Namespace)
+		return ctrl.Result{}, err
+	}
+	protocol, protocolErr := serviceProtocol(svc)
+	if consulName == "" {
+		protocolErr = nil
+	}
+
+	if err := r.deleteStaleServiceDefaults(ctx, svc, consulName, protocol); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	var reason, message string
+	if protocolErr != nil {
+		reason = conditionReasonPortProtocols
+		message = fmt.Sprintf("The protocol of Consul service %q isn't set because %s", consulName, protocolErr)
+	}
+	if consulName != "" {
+		var existing v1alpha1.ServiceDefaults
+		err := ep.Client.Get(ctx, types.NamespacedName{Name: consulName, Namespace: svc.Namespace}, &existing)
+		switch {
+		case k8serrors.IsNotFound(err):
+			if protocol == "" {
+				break
+			}
+			otherNamespace, err := r.serviceDefaultsNamespace(ctx, svc.Namespace, consulName)
+			if err != nil {
+				r.Log.Error(err, "failed to list service defaults", "name", consulName)
+				return ctrl.Result{}, err
+			}
+			if otherNamespace != "" {
+				reason = conditionReasonOtherNamespace
+				message = fmt.Sprintf("The ServiceDefaults %q in Kubernetes namespace %q is synced to the same Consul namespace, "+
+					"so a ServiceDefaults with protocol %q isn't created next to it", consulName, otherNamespace, protocol)
+			} else if err := r.createServiceDefaults(ctx, svc, consulName, protocol); err != nil {
+				return ctrl.Result{}, err
+			}
+		case err != nil:
+			r.Log.Error(err, "failed to get service defaults", "name", consulName, "ns", svc.Namespace)
+			return ctrl.Result{}, err
+		case existing.Labels[labelProtocolFromService] == svc.Name:
+			if protocol != "" && existing.Spec.Protocol != protocol {
+				r.Log.Info("updating protocol of service defaults", "name", consulName, "ns", svc.Namespace, "protocol", protocol)
+				existing.Spec.Protocol = protocol
+				if err := ep.Client.Update(ctx, &existing); err != nil {
+					r.Log.Error(err, "failed to update service defaults", "name", consulName, "ns", svc.Namespace)
+					return ctrl.Result{}, err
+				}
+			}
+		case existing.Labels[labelProtocolFromService] != "":
+			if protocol != "" {
+				reason = conditionReasonOtherKubeService
+				message = fmt.Sprintf("The ServiceDefaults %q is managed for Kubernetes service %q, so its protocol isn't set to %q. "+
+					"Register the pods of the Kubernetes services as different Consul services, or write the ServiceDefaults without the %s label",
+					consulName, existing.Labels[labelProtocolFromService], protocol, labelProtocolFromService)
+			}
+		default:
+			// The ServiceDefaults is authored by a user, so it wins even if the ports are inconsistent.
+			reason, message = "", ""
+			if protocol != "" && existing.Spec.Protocol != protocol {
+				reason = conditionReasonUserAuthored
+				message = fmt.Sprintf("The ports of the Kubernetes service declare protocol %q but the ServiceDefaults %q, "+
+					"which isn't managed from the Kubernetes service, sets protocol %q",
+					protocol, consulName, existing.Spec.Protocol)
+			}
+		}
+	}
+
+	if err := r.updateProtocolConflictCondition(ctx, svc, reason, message); err != nil {
+		r.Log.Error(err, "failed to update condition of service", "name", svc.Name, "ns", svc.Namespace)
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+func (r *ServiceProtocolController) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("service-protocol").
+		For(&corev1.Service{}).
+		Watches(
+			&source.Kind{Type: &corev1.Pod{}},
+			handler.EnqueueRequestsFromMapFunc(r.requestsForPod),
+			builder.WithPredicates(predicate.NewPredicateFuncs(func(object client.Object) bool {
+				pod, ok := object.(*corev1.Pod)
+				return ok && hasBeenInjected(*pod)
+			})),
+		).
+		Watches(
+			&source.Kind{Type: &v1alpha1.ServiceDefaults{}},
+			handler.EnqueueRequestsFromMapFunc(r.requestsForServiceDefaults),
+		).
+		Complete(r)
+}
+
+// consulServiceName returns the name of the Consul service that the injected pods selected by the
+// Kubernetes service are registered as, or an empty string if it doesn't select any injected pod.
+// It's taken from the first pod by name, since all the pods of a service are expected to register
+// the same Consul service.
+func (r *ServiceProtocolController) consulServiceName(ctx context.Context, svc corev1.Service) (string, error) {
+	if len(svc.Spec.Selector) == 0 {
+		return "", nil
+	}
+	var pods corev1.PodList
+	if err := r.Controller.Client.List(ctx, &pods, client.InNamespace(svc.Namespace), client.MatchingLabels(svc.Spec.Selector)); err != nil {
+		return "", err
+	}
+	var injected []corev1.Pod
+	for _, pod := range pods.Items {
+		if hasBeenInjected(pod) {
+			injected = append(injected, pod)
+		}
+	}
+	if len(injected) == 0 {
+		return "", nil
+	}
+	sort.Slice(injected, func(i, j int) bool { return injected[i].Name < injected[j].Name })
+	return getServiceName(injected[0], corev1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: svc.Name, Namespace: svc.Namespace}}), nil
+}
+
+// serviceDefaultsNamespace returns the Kubernetes namespace, other than the given one, of a
+// ServiceDefaults with the given name that is synced to the same Consul namespace as the ServiceDefaults
+// of the given namespace, or an empty string if there isn't one.
+func (r *ServiceProtocolController) serviceDefaultsNamespace(ctx context.Context, namespace, name string) (string, error) {
+	var all v1alpha1.ServiceDefaultsList
+	if err := r.Controller.Client.List(ctx, &all); err != nil {
+		return "", err
+	}
+	var namespaces []string
+	for _, serviceDefaults := range all.Items {
+		if serviceDefaults.Name != name || serviceDefaults.Namespace == namespace {
+			continue
+		}
+		if r.Controller.consulNamespace(serviceDefaults.Namespace) == r.Controller.consulNamespace(namespace) {
+			namespaces = append(namespaces, serviceDefaults.Namespace)
+		}
+	}
+	if len(namespaces) == 0 {
+		return "", nil
+	}
+	sort.Strings(namespaces)
+	return namespaces[0], nil
+}
+
+// deleteStaleServiceDefaults deletes the ServiceDefaults managed for the Kubernetes service other than
+// the one of its Consul service, e.g. once its pods are registered as another Consul service, or all
+// of them if the protocol of the service can no longer be derived.
+func (r *ServiceProtocolController) deleteStaleServiceDefaults(ctx context.Context, svc corev1.Service, consulName, protocol string) error {
+	var managed v1alpha1.ServiceDefaultsList
+	err := r.Controller.Client.List(ctx, &managed, client.InNamespace(svc.Namespace), client.MatchingLabels{labelProtocolFromService: svc.Name})
+	if err != nil {
+		r.Log.Error(err, "failed to list service defaults", "ns", svc.Namespace)
+		return err
+	}
+	var errs error
+	for i := range managed.Items {
+		serviceDefaults := &managed.Items[i]
+		if serviceDefaults.Name == consulName && protocol != "" {
+			continue
+		}
+		r.Log.Info("deleting service defaults", "name", serviceDefaults.Name, "ns", serviceDefaults.Namespace, "service", svc.Name)
+		if err := r.Controller.Client.Delete(ctx, serviceDefaults); err != nil && !k8serrors.IsNotFound(err) {
+			r.Log.Error(err, "failed to delete service defaults", "name", serviceDefaults.Name, "ns", serviceDefaults.Namespace)
+			errs = multierror.Append(errs, err)
+		}
+	}
+	return errs
+}
+
+// createServiceDefaults creates the ServiceDefaults of the Consul service, owned by the Kubernetes
+// service so that it's deleted with it.
+func (r *ServiceProtocolController) createServiceDefaults(ctx context.Context, svc corev1.Service, consulName, protocol string) error {
+	serviceDefaults := &v1alpha1.ServiceDefaults{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      consulName,
+			Namespace: svc.Namespace,
+			Labels:    map[string]string{labelProtocolFromService: svc.Name},
+		},
+		Spec: v1alpha1.ServiceDefaultsSpec{Protocol: protocol},
+	}
+	if err := controllerutil.SetControllerReference(&svc, serviceDefaults, r.Controller.Client.Scheme()); err != nil {
+		return err
+	}
+	r.Log.Info("creating service defaults", "name", consulName, "ns", svc.Namespace, "protocol", protocol)
+	if err := r.Controller.Client.Create(ctx, serviceDefaults); err != nil {
+		r.Log.Error(err, "failed to create service defaults", "name", consulName, "ns", svc.Namespace)
+		return err
+	}
+	return nil
+}
+
+// updateProtocolConflictCondition reports on the Kubernetes service why the protocol of its Consul
+// service isn't managed from it. Once the conflict is resolved, the condition is set to false.
+// Services that never had a conflict don't get the condition.
+func (r *ServiceProtocolController) updateProtocolConflictCondition(ctx context.Context, svc corev1.Service, reason, message string) error {
+	condition := metav1.Condition{
+		Type:               conditionTypeProtocolConflict,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: svc.Generation,
+		LastTransitionTime: metav1.Now(),
+		Reason:             reason,
+		Message:            message,
+	}
+	existing := meta.FindStatusCondition(svc.Status.Conditions, conditionTypeProtocolConflict)
+	if reason == "" {
+		if existing == nil {
+			return nil
+		}
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = conditionReasonNoConflict
+		condition.Message = "The protocol of the Consul service is managed from the Kubernetes service, or by a user"
+	}
+	if existing != nil {
+		if existing.Status == condition.Status && existing.Message == condition.Message {
+			return nil
+		}
+		if existing.Status == condition.Status {
+			condition.LastTransitionTime = existing.LastTransitionTime
+		}
+	}
+
+	// A strategic merge patch merges the condition into the list by its type, leaving the
+	// conditions set by others alone.
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{
+			"conditions": []metav1.Condition{condition},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	r.Log.Info("updating condition of service", "name", svc.Name, "ns", svc.Namespace, "type", condition.Type, "status", condition.Status)
+	return r.Controller.Client.Status().Patch(ctx, &svc, client.RawPatch(types.StrategicMergePatchType, patch))
+}
+
+// requestsForPod enqueues the Kubernetes services that select the injected pod.
+func (r *ServiceProtocolController) requestsForPod(object client.Object) []ctrl.Request {
+	pod, ok := object.(*corev1.Pod)
+	if !ok {
+		return []ctrl.Request{}
+	}
+	selecting, err := r.Controller.selectingServices(r.Controller.Context, *pod)
+	if err != nil {
+		r.Log.Error(err, "failed to list services", "ns", pod.Namespace)
+		return []ctrl.Request{}
+	}
+	var requests []ctrl.Request
+	for _, name := range selecting {
+		requests = append(requests, ctrl.Request{NamespacedName: types.NamespacedName{Name: name, Namespace: pod.Namespace}})
+	}
+	return requests
+}
+
+// requestsForServiceDefaults enqueues the Kubernetes services with a selector in the Kubernetes
+// namespaces that are synced to the same Consul namespace as the ServiceDefaults, since it may be the
+// ServiceDefaults of any of their Consul services.
+func (r *ServiceProtocolController) requestsForServiceDefaults(object client.Object) []ctrl.Request {
+	var services corev1.ServiceList
+	if err := r.Controller.Client.List(r.Controller.Context, &services); err != nil {
+		r.Log.Error(err, "failed to list services")
+		return []ctrl.Request{}
+	}
+	consulNS := r.Controller.consulNamespace(object.GetNamespace())
+	var requests []ctrl.Request
+	for _, svc := range services.Items {
+		if len(svc.Spec.Selector) == 0 || r.Controller.consulNamespace(svc.Namespace) != consulNS {
+			continue
+		}
+		requests = append(requests, ctrl.Request{NamespacedName: types.NamespacedName{Name: svc.Name, Namespace: svc.Namespace}})
+	}
+	return requests
+}
+
+// serviceProtocol returns the protocol that the TCP ports of the Kubernetes service declare, or an
+// empty string if none of them declares one. A port's appProtocol takes precedence over the prefix
+// of its name. Ports that declare different protocols are an error.
+func serviceProtocol(svc corev1.Service) (string, error) {
+	protocols := make(map[string]bool)
+	for _, port := range svc.Spec.Ports {
+		if port.Protocol != "" && port.Protocol != corev1.ProtocolTCP {
+			continue
+		}
+		if protocol := portProtocol(port); protocol != "" {
+			protocols[protocol] = true
+		}
+	}
+	var declared []string
+	for protocol := range protocols {
+		declared = append(declared, protocol)
+	}
+	sort.Strings(declared)
+	switch len(declared) {
+	case 0:
+		return "", nil
+	case 1:
+		return declared[0], nil
+	default:
+		return "", fmt.Errorf("the ports of the Kubernetes service declare protocols %s", quotedList(declared))
+	}
+}
+
+// portProtocol returns the Consul protocol that the port declares, or an empty string if it doesn't
+// declare one that Consul supports.
+func portProtocol(port corev1.ServicePort) string {
+	if port.AppProtocol != nil {
+		switch appProtocol := strings.ToLower(*port.AppProtocol); appProtocol {
+		case "http", "http2", "grpc", "tcp":
+			return appProtocol
+		case "h2c", "kubernetes.io/h2c":
+			return "http2"
+		}
+	}
+	// Istio's port naming convention, <protocol>[-<suffix>], is commonly used.
+	name := strings.ToLower(port.Name)
+	for _, protocol := range []string{"http2", "http", "grpc", "tcp"} {
+		if name == protocol || strings.HasPrefix(name, protocol+"-") {
+			return protocol
+		}
+	}
+	return ""
+}
@@ -0,0 +1,314 @@
+package connectinject
+
+import (
+	"context"
+	"testing"
+
+	mapset "github.com/deckarep/golang-set"
+	logrtest "github.com/go-logr/logr/testing"
+	"github.com/hashicorp/consul-k8s/api/v1alpha1"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestServiceProtocol(t *testing.T) {
+	t.Parallel()
+	appProtocol := func(protocol string) *string { return &protocol }
+	cases := map[string]struct {
+		ports       []corev1.ServicePort
+		expProtocol string
+		expErr      string
+	}{
+		"no ports": {},
+		"port without hints": {
+			ports: []corev1.ServicePort{{Name: "web", Port: 80}},
+		},
+		"appProtocol": {
+			ports:       []corev1.ServicePort{{Name: "web", Port: 80, AppProtocol: appProtocol("HTTP")}},
+			expProtocol: "http",
+		},
+		"h2c appProtocol": {
+			ports:       []corev1.ServicePort{{Port: 80, AppProtocol: appProtocol("kubernetes.io/h2c")}},
+			expProtocol: "http2",
+		},
+		"appProtocol takes precedence over the port name": {
+			ports:       []corev1.ServicePort{{Name: "http-web", Port: 80, AppProtocol: appProtocol("grpc")}},
+			expProtocol: "grpc",
+		},
+		"unsupported appProtocol falls back to the port name": {
+			ports:       []corev1.ServicePort{{Name: "http2-web", Port: 80, AppProtocol: appProtocol("https")}},
+			expProtocol: "http2",
+		},
+		"port name prefix": {
+			ports:       []corev1.ServicePort{{Name: "grpc-api", Port: 8080}, {Name: "admin", Port: 9090}},
+			expProtocol: "grpc",
+		},
+		"port name without suffix": {
+			ports:       []corev1.ServicePort{{Name: "http", Port: 80}},
+			expProtocol: "http",
+		},
+		"port name that only starts with a protocol": {
+			ports: []corev1.ServicePort{{Name: "httpbin", Port: 80}},
+		},
+		"UDP ports are ignored": {
+			ports:       []corev1.ServicePort{{Name: "http", Port: 80}, {Name: "tcp-dns", Port: 53, Protocol: corev1.ProtocolUDP}},
+			expProtocol: "http",
+		},
+		"ports that agree": {
+			ports:       []corev1.ServicePort{{Name: "http", Port: 80}, {Name: "admin", Port: 9090, AppProtocol: appProtocol("http")}},
+			expProtocol: "http",
+		},
+		"ports that disagree": {
+			ports:  []corev1.ServicePort{{Name: "http", Port: 80}, {Name: "grpc", Port: 9090}},
+			expErr: `the ports of the Kubernetes service declare protocols "grpc", "http"`,
+		},
+	}
+	for name, c := range cases {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			protocol, err := serviceProtocol(corev1.Service{Spec: corev1.ServiceSpec{Ports: c.ports}})
+			if c.expErr != "" {
+				require.EqualError(t, err, c.expErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.expProtocol, protocol)
+		})
+	}
+}
+
+func TestServiceProtocolController_Reconcile(t *testing.T) {
+	t.Parallel()
+	service := func(name string, ports ...corev1.ServicePort) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: corev1.ServiceSpec{
+				Selector: map[string]string{"app": "web"},
+				Ports:    ports,
+			},
+		}
+	}
+	serviceDefaults := func(name, protocol, managedFor string) *v1alpha1.ServiceDefaults {
+		sd := &v1alpha1.ServiceDefaults{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec:       v1alpha1.ServiceDefaultsSpec{Protocol: protocol},
+		}
+		if managedFor != "" {
+			controller := true
+			sd.Labels = map[string]string{labelProtocolFromService: managedFor}
+			sd.OwnerReferences = []metav1.OwnerReference{{APIVersion: "v1", Kind: "Service", Name: managedFor, Controller: &controller}}
+		}
+		return sd
+	}
+	inNamespace := func(sd *v1alpha1.ServiceDefaults, namespace string) *v1alpha1.ServiceDefaults {
+		sd.Namespace = namespace
+		return sd
+	}
+	webPod := func(name string, inject bool, annotations map[string]string) *corev1.Pod {
+		pod := createPod(name, "1.2.3.4", inject, true)
+		pod.Labels["app"] = "web"
+		for k, v := range annotations {
+			pod.Annotations[k] = v
+		}
+		return pod
+	}
+	httpPort := corev1.ServicePort{Name: "http", Port: 80}
+	grpcPort := corev1.ServicePort{Name: "grpc", Port: 9090}
+
+	cases := map[string]struct {
+		service            *corev1.Service
+		objects            []runtime.Object
+		enableNSMirroring  bool
+		expServiceDefaults map[string]string
+		expReason          string
+	}{
+		"creates the service defaults": {
+			service:            service("web", httpPort),
+			objects:            []runtime.Object{webPod("pod1", true, nil)},
+			expServiceDefaults: map[string]string{"web": "http"},
+		},
+		"named after the Consul service of the pods": {
+			service:            service("web", httpPort),
+			objects:            []runtime.Object{webPod("pod1", true, map[string]string{annotationService: "frontend"})},
+			expServiceDefaults: map[string]string{"frontend": "http"},
+		},
+		"no injected pods": {
+			service: service("web", httpPort),
+			objects: []runtime.Object{webPod("pod1", false, nil)},
+		},
+		"no protocol": {
+			service: service("web", corev1.ServicePort{Name: "web", Port: 80}),
+			objects: []runtime.Object{webPod("pod1", true, nil)},
+		},
+		"updates the managed service defaults": {
+			service:            service("web", grpcPort),
+			objects:            []runtime.Object{webPod("pod1", true, nil), serviceDefaults("web", "http", "web")},
+			expServiceDefaults: map[string]string{"web": "grpc"},
+		},
+		"deletes the managed service defaults once pods are no longer injected": {
+			service: service("web", httpPort),
+			objects: []runtime.Object{webPod("pod1", false, nil), serviceDefaults("web", "http", "web")},
+		},
+		"deletes the managed service defaults of another Consul service": {
+			service: service("web", httpPort),
+			objects: []runtime.Object{
+				webPod("pod1", true, map[string]string{annotationService: "frontend"}),
+				serviceDefaults("web", "http", "web"),
+			},
+			expServiceDefaults: map[string]string{"frontend": "http"},
+		},
+		"ports that disagree": {
+			service:   service("web", httpPort, grpcPort),
+			objects:   []runtime.Object{webPod("pod1", true, nil), serviceDefaults("web", "http", "web")},
+			expReason: conditionReasonPortProtocols,
+		},
+		"user-authored service defaults with the same protocol": {
+			service:            service("web", httpPort),
+			objects:            []runtime.Object{webPod("pod1", true, nil), serviceDefaults("web", "http", "")},
+			expServiceDefaults: map[string]string{"web": "http"},
+		},
+		"user-authored service defaults with another protocol": {
+			service:            service("web", httpPort),
+			objects:            []runtime.Object{webPod("pod1", true, nil), serviceDefaults("web", "tcp", "")},
+			expServiceDefaults: map[string]string{"web": "tcp"},
+			expReason:          conditionReasonUserAuthored,
+		},
+		"user-authored service defaults win over ports that disagree": {
+			service:            service("web", httpPort, grpcPort),
+			objects:            []runtime.Object{webPod("pod1", true, nil), serviceDefaults("web", "tcp", "")},
+			expServiceDefaults: map[string]string{"web": "tcp"},
+		},
+		"service defaults managed for another Kubernetes service": {
+			service:            service("web", grpcPort),
+			objects:            []runtime.Object{webPod("pod1", true, nil), serviceDefaults("web", "http", "web-canary")},
+			expServiceDefaults: map[string]string{"web": "http"},
+			expReason:          conditionReasonOtherKubeService,
+		},
+		"service defaults in another namespace synced to the same Consul namespace": {
+			service:            service("web", httpPort),
+			objects:            []runtime.Object{webPod("pod1", true, nil), inNamespace(serviceDefaults("web", "tcp", ""), "other")},
+			expServiceDefaults: map[string]string{"other/web": "tcp"},
+			expReason:          conditionReasonOtherNamespace,
+		},
+		"service defaults in another namespace mirrored to another Consul namespace": {
+			service:            service("web", httpPort),
+			objects:            []runtime.Object{webPod("pod1", true, nil), inNamespace(serviceDefaults("web", "tcp", ""), "other")},
+			enableNSMirroring:  true,
+			expServiceDefaults: map[string]string{"web": "http", "other/web": "tcp"},
+		},
+	}
+	for name, c := range cases {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			s := runtime.NewScheme()
+			require.NoError(t, clientgoscheme.AddToScheme(s))
+			require.NoError(t, v1alpha1.AddToScheme(s))
+			fakeClient := fake.NewClientBuilder().WithScheme(s).WithRuntimeObjects(append(c.objects, c.service)...).Build()
+			r := &ServiceProtocolController{
+				Controller: &EndpointsController{
+					Client:                 fakeClient,
+					Log:                    logrtest.TestLogger{T: t},
+					AllowK8sNamespacesSet:  mapset.NewSetWith("*"),
+					DenyK8sNamespacesSet:   mapset.NewSetWith(),
+					EnableConsulNamespaces: c.enableNSMirroring,
+					EnableNSMirroring:      c.enableNSMirroring,
+					Context:                context.Background(),
+				},
+				Log: logrtest.TestLogger{T: t},
+			}
+			key := types.NamespacedName{Name: c.service.Name, Namespace: c.service.Namespace}
+			_, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: key})
+			require.NoError(t, err)
+
+			var list v1alpha1.ServiceDefaultsList
+			require.NoError(t, fakeClient.List(context.Background(), &list))
+			actual := make(map[string]string)
+			for _, sd := range list.Items {
+				name := sd.Name
+				if sd.Namespace != c.service.Namespace {
+					name = sd.Namespace + "/" + sd.Name
+				}
+				actual[name] = sd.Spec.Protocol
+				if managedFor := sd.Labels[labelProtocolFromService]; managedFor == c.service.Name {
+					require.Len(t, sd.OwnerReferences, 1)
+					require.Equal(t, c.service.Name, sd.OwnerReferences[0].Name)
+				}
+			}
+			if c.expServiceDefaults == nil {
+				c.expServiceDefaults = map[string]string{}
+			}
+			require.Equal(t, c.expServiceDefaults, actual)
+
+			var svc corev1.Service
+			require.NoError(t, fakeClient.Get(context.Background(), key, &svc))
+			condition := meta.FindStatusCondition(svc.Status.Conditions, conditionTypeProtocolConflict)
+			if c.expReason == "" {
+				require.Nil(t, condition)
+				return
+			}
+			require.NotNil(t, condition)
+			require.Equal(t, metav1.ConditionTrue, condition.Status)
+			require.Equal(t, c.expReason, condition.Reason)
+		})
+	}
+}
+
+// Test that the conflict condition is set to false once the conflict is resolved.
+func TestServiceProtocolController_ConflictResolved(t *testing.T) {
+	t.Parallel()
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec: corev1.ServiceSpec{
+			Selector: map[string]string{"app": "web"},
+			Ports:    []corev1.ServicePort{{Name: "http", Port: 80}},
+		},
+	}
+	pod := createPod("pod1", "1.2.3.4", true, true)
+	pod.Labels["app"] = "web"
+	userAuthored := &v1alpha1.ServiceDefaults{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec:       v1alpha1.ServiceDefaultsSpec{Protocol: "tcp"},
+	}
+	s := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(s))
+	require.NoError(t, v1alpha1.AddToScheme(s))
+	fakeClient := fake.NewClientBuilder().WithScheme(s).WithRuntimeObjects(svc, pod, userAuthored).Build()
+	r := &ServiceProtocolController{
+		Controller: &EndpointsController{
+			Client:                fakeClient,
+			Log:                   logrtest.TestLogger{T: t},
+			AllowK8sNamespacesSet: mapset.NewSetWith("*"),
+			DenyK8sNamespacesSet:  mapset.NewSetWith(),
+			Context:               context.Background(),
+		},
+		Log: logrtest.TestLogger{T: t},
+	}
+	key := types.NamespacedName{Name: "web", Namespace: "default"}
+	conflictCondition := func() *metav1.Condition {
+		_, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: key})
+		require.NoError(t, err)
+		var updated corev1.Service
+		require.NoError(t, fakeClient.Get(context.Background(), key, &updated))
+		return meta.FindStatusCondition(updated.Status.Conditions, conditionTypeProtocolConflict)
+	}
+
+	condition := conflictCondition()
+	require.NotNil(t, condition)
+	require.Equal(t, metav1.ConditionTrue, condition.Status)
+
+	// The user takes the protocol of the ports.
+	require.NoError(t, fakeClient.Get(context.Background(), key, userAuthored))
+	userAuthored.Spec.Protocol = "http"
+	require.NoError(t, fakeClient.Update(context.Background(), userAuthored))
+	condition = conflictCondition()
+	require.NotNil(t, condition)
+	require.Equal(t, metav1.ConditionFalse, condition.Status)
+	require.Equal(t, conditionReasonNoConflict, condition.Reason)
+}
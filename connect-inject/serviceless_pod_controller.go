@@ -0,0 +1,225 @@
+package connectinject
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-multierror"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+const (
+	// MetaKeyServiceless is set on the service instances of pods that no Kubernetes service
+	// selects. They don't have the k8s-service-name meta.
+	MetaKeyServiceless = "k8s-serviceless"
+
+	// keyServicelessEndpoints labels the Endpoints that stand in for the Kubernetes service of a
+	// pod that no Kubernetes service selects. They're never created in Kubernetes.
+	keyServicelessEndpoints = "consul.hashicorp.com/serviceless-endpoints"
+)
+
+// ServicelessPodController registers the injected pods that no Kubernetes service selects, e.g.
+// standalone pods or the pods of Jobs that only call other services of the mesh, which the
+// endpoints controller never registers. They're registered the same way as by the endpoints
+// controller, as the services in their consul.hashicorp.com/connect-service annotation, with a
+// health check that reflects the readiness of the pod. Their services are deregistered once the
+// pod is deleted. Once a Kubernetes service selects the pod, the endpoints controller registers its
+// services with the same IDs, which replaces the registrations of this controller.
+type ServicelessPodController struct {
+	// Controller is the endpoints controller whose configuration is used to register pods.
+	Controller *EndpointsController
+	Log        logr.Logger
+}
+
+func (r *ServicelessPodController) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	ep := r.Controller
+	if shouldIgnore(req.Namespace, ep.DenyK8sNamespacesSet, ep.AllowK8sNamespacesSet) {
+		return ctrl.Result{}, nil
+	}
+
+	var pod corev1.Pod
+	err := ep.Client.Get(ctx, req.NamespacedName, &pod)
+	if k8serrors.IsNotFound(err) {
+		return ctrl.Result{}, r.deregisterPod(ctx, req.Name, req.Namespace)
+	} else if err != nil {
+		r.Log.Error(err, "failed to get pod", "name", req.Name, "ns", req.Namespace)
+		return ctrl.Result{}, err
+	}
+
+	// Legacy pods register their services themselves, and pods are registered once they have an IP.
+	if !hasBeenInjected(pod) || pod.Labels[keyManagedBy] != managedByValue || pod.Status.PodIP == "" {
+		return ctrl.Result{}, nil
+	}
+	// The sidecars of pods that have completed, or whose application has exited, are no longer running.
+	if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed || appExited(pod) {
+		return ctrl.Result{}, r.deregisterPod(ctx, pod.Name, pod.Namespace)
+	}
+
+	selecting, err := ep.selectingServices(ctx, pod)
+	if err != nil {
+		r.Log.Error(err, "failed to list services", "ns", pod.Namespace)
+		return ctrl.Result{}, err
+	}
+	if len(selecting) > 0 {
+		return ctrl.Result{}, nil
+	}
+
+	serviceNames, err := servicelessServiceNames(pod)
+	if err != nil {
+		r.Log.Error(err, "failed to determine services of pod", "name", pod.Name, "ns", pod.Namespace)
+		return ctrl.Result{}, err
+	}
+	if len(serviceNames) == 0 {
+		r.Log.Info("skipping pod that no Kubernetes service selects because it has no service name",
+			"name", pod.Name, "ns", pod.Namespace, "annotation", annotationService)
+		return ctrl.Result{}, nil
+	}
+
+	healthStatus := api.HealthCritical
+	if podReady(pod) && pod.DeletionTimestamp == nil {
+		healthStatus = api.HealthPassing
+	}
+	address := corev1.EndpointAddress{
+		IP:        pod.Status.PodIP,
+		NodeName:  &pod.Spec.NodeName,
+		TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: pod.Name, Namespace: pod.Namespace},
+	}
+	var errs error
+	for _, serviceName := range serviceNames {
+		endpoints := servicelessEndpoints(pod, serviceName)
+		if err := ep.registerServicesAndHealthCheck(ctx, endpoints, address, healthStatus, "", map[string]bool{}); err != nil {
+			r.Log.Error(err, "failed to register services or health check", "name", serviceName, "ns", pod.Namespace)
+			errs = multierror.Append(errs, err)
+		}
+	}
+	return ctrl.Result{}, errs
+}
+
+func (r *ServicelessPodController) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("serviceless-pod").
+		For(&corev1.Pod{}).
+		Watches(
+			&source.Kind{Type: &corev1.Service{}},
+			handler.EnqueueRequestsFromMapFunc(r.requestsForService),
+		).
+		Watches(
+			&source.Kind{Type: &corev1.Pod{}},
+			handler.EnqueueRequestsFromMapFunc(r.requestsForRunningAgentPods),
+			builder.WithPredicates(predicate.NewPredicateFuncs(r.Controller.filterAgentPods)),
+		).
+		Complete(r)
+}
+
+// deregisterPod deregisters the service instances registered by this controller for the pod.
+func (r *ServicelessPodController) deregisterPod(ctx context.Context, podName, k8sNamespace string) error {
+	ep := r.Controller
+	filter := fmt.Sprintf(`Meta[%q] == %q and Meta[%q] == %q and Meta[%q] == "true" and Meta[%q] == %q`,
+		MetaKeyPodName, podName, MetaKeyKubeNS, k8sNamespace, MetaKeyServiceless, MetaKeyManagedBy, managedByValue)
+	instances, errs := ep.registeredInstances(ctx, ep.consulNamespace(k8sNamespace), filter)
+	for _, instance := range instances {
+		r.Log.Info("deregistering service instance of pod", "id", instance.service.ID, "pod", podName, "ns", k8sNamespace)
+		if err := deregisterInstance(instance); err != nil {
+			r.Log.Error(err, "failed to deregister service instance", "id", instance.service.ID)
+			errs = multierror.Append(errs, err)
+		}
+	}
+	return errs
+}
+
+// requestsForService enqueues the injected pods in the namespace of the Kubernetes service, since
+// the service may have started or stopped selecting any of them.
+func (r *ServicelessPodController) requestsForService(object client.Object) []ctrl.Request {
+	var pods corev1.PodList
+	if err := r.Controller.Client.List(r.Controller.Context, &pods, client.InNamespace(object.GetNamespace())); err != nil {
+		r.Log.Error(err, "failed to list pods", "ns", object.GetNamespace())
+		return []ctrl.Request{}
+	}
+	return injectedPodRequests(pods.Items, "")
+}
+
+// requestsForRunningAgentPods enqueues the injected pods on the node of the Consul client agent pod
+// once it's ready, so that their services are registered again if the agent lost them.
+func (r *ServicelessPodController) requestsForRunningAgentPods(object client.Object) []ctrl.Request {
+	nodeName, ok := r.Controller.readyAgentPodNode(object)
+	if !ok {
+		return []ctrl.Request{}
+	}
+	var pods corev1.PodList
+	if err := r.Controller.Client.List(r.Controller.Context, &pods); err != nil {
+		r.Log.Error(err, "failed to list pods")
+		return []ctrl.Request{}
+	}
+	return injectedPodRequests(pods.Items, nodeName)
+}
+
+// injectedPodRequests returns a request for each injected pod, only for those on the node if it's set.
+func injectedPodRequests(pods []corev1.Pod, nodeName string) []ctrl.Request {
+	var requests []ctrl.Request
+	for _, pod := range pods {
+		if !hasBeenInjected(pod) || (nodeName != "" && pod.Spec.NodeName != nodeName) {
+			continue
+		}
+		requests = append(requests, ctrl.Request{NamespacedName: types.NamespacedName{Name: pod.Name, Namespace: pod.Namespace}})
+	}
+	return requests
+}
+
+// servicelessServiceNames returns the names of the services the pod registers when no Kubernetes
+// service selects it, from its consul.hashicorp.com/connect-service annotation.
+func servicelessServiceNames(pod corev1.Pod) ([]string, error) {
+	if isMultiPort(pod) {
+		services, err := multiPortServices(pod)
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, svc := range services {
+			names = append(names, svc.serviceName)
+		}
+		return names, nil
+	}
+	if name := pod.Annotations[annotationService]; name != "" {
+		return []string{name}, nil
+	}
+	return nil, nil
+}
+
+// servicelessEndpoints returns the Endpoints that stand in for the Kubernetes service of the pod's
+// Consul service, so that the pod is registered the same way as the endpoints of a Kubernetes service.
+func servicelessEndpoints(pod corev1.Pod, serviceName string) corev1.Endpoints {
+	return corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      serviceName,
+			Namespace: pod.Namespace,
+			Labels:    map[string]string{keyServicelessEndpoints: "true"},
+		},
+	}
+}
+
+// isServicelessEndpoints returns true if the Endpoints stand in for the Kubernetes service of a pod
+// that no Kubernetes service selects.
+func isServicelessEndpoints(serviceEndpoints corev1.Endpoints) bool {
+	return serviceEndpoints.Labels[keyServicelessEndpoints] == "true"
+}
+
+// podReady returns true if the pod's Ready condition is true.
+func podReady(pod corev1.Pod) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,178 @@
+package connectinject
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	mapset "github.com/deckarep/golang-set"
+	logrtest "github.com/go-logr/logr/testing"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/sdk/testutil"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestServicelessServiceNames(t *testing.T) {
+	t.Parallel()
+	cases := map[string]struct {
+		annotations map[string]string
+		expNames    []string
+		expErr      string
+	}{
+		"no annotation": {},
+		"single service": {
+			annotations: map[string]string{annotationService: "web"},
+			expNames:    []string{"web"},
+		},
+		"multi-port": {
+			annotations: map[string]string{annotationService: "web,web-admin", annotationPort: "8080,9090"},
+			expNames:    []string{"web", "web-admin"},
+		},
+		"invalid multi-port": {
+			annotations: map[string]string{annotationService: "web,web-admin", annotationPort: "8080"},
+			expErr:      `consul.hashicorp.com/connect-service-port annotation must list a port for each of the 2 services in the consul.hashicorp.com/connect-service annotation, got "8080"`,
+		},
+	}
+	for name, c := range cases {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			names, err := servicelessServiceNames(corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: c.annotations}})
+			if c.expErr != "" {
+				require.EqualError(t, err, c.expErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.expNames, names)
+		})
+	}
+}
+
+// Test that pods without a Kubernetes service are registered without the Kubernetes service meta,
+// and that their proxy is transparent without a Kubernetes service to get the cluster IP of.
+func TestCreateServiceRegistrations_Serviceless(t *testing.T) {
+	t.Parallel()
+	pod := *createPod("pod1", "1.2.3.4", true, true)
+	pod.Annotations[annotationService] = "client"
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	ep := EndpointsController{
+		Client:                 fake.NewClientBuilder().WithRuntimeObjects(ns).Build(),
+		EnableTransparentProxy: true,
+		Log:                    logrtest.TestLogger{T: t},
+		Context:                context.Background(),
+	}
+	service, proxyService, err := ep.createServiceRegistrations(pod, servicelessEndpoints(pod, "client"))
+	require.NoError(t, err)
+
+	expMeta := map[string]string{
+		MetaKeyPodName:     "pod1",
+		MetaKeyKubeNS:      "default",
+		MetaKeyManagedBy:   managedByValue,
+		MetaKeyServiceless: "true",
+	}
+	require.Equal(t, "pod1-client", service.ID)
+	require.Equal(t, expMeta, service.Meta)
+	require.Equal(t, "pod1-client-sidecar-proxy", proxyService.ID)
+	require.Equal(t, expMeta, proxyService.Meta)
+	require.Equal(t, api.ProxyModeTransparent, proxyService.Proxy.Mode)
+	require.NotContains(t, proxyService.TaggedAddresses, clusterIPTaggedAddressName)
+}
+
+// Test that a pod that no Kubernetes service selects is registered, that it's left to the endpoints
+// controller once a Kubernetes service selects it, and that it's deregistered once it's deleted.
+func TestServicelessPodController_Reconcile(t *testing.T) {
+	t.Parallel()
+	ns := corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	pod1 := createPod("pod1", "1.2.3.4", true, true)
+	pod1.Annotations[annotationService] = "client"
+	pod1.Labels["app"] = "client"
+	pod1.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+	fakeClientPod := createPod("fake-consul-client", "127.0.0.1", false, true)
+	fakeClientPod.Labels = map[string]string{"component": "client", "app": "consul", "release": "consul"}
+	fakeClient := fake.NewClientBuilder().WithRuntimeObjects(&ns, pod1, fakeClientPod).Build()
+
+	consul, err := testutil.NewTestServerConfigT(t, nil)
+	require.NoError(t, err)
+	defer consul.Stop()
+	consul.WaitForServiceIntentions(t)
+	cfg := &api.Config{Address: consul.HTTPAddr}
+	consulClient, err := api.NewClient(cfg)
+	require.NoError(t, err)
+
+	r := &ServicelessPodController{
+		Controller: &EndpointsController{
+			Client:                fakeClient,
+			Log:                   logrtest.TestLogger{T: t},
+			ConsulClient:          consulClient,
+			ConsulPort:            strings.Split(consul.HTTPAddr, ":")[1],
+			ConsulScheme:          "http",
+			AllowK8sNamespacesSet: mapset.NewSetWith("*"),
+			DenyK8sNamespacesSet:  mapset.NewSetWith(),
+			ReleaseName:           "consul",
+			ReleaseNamespace:      "default",
+			ConsulClientCfg:       cfg,
+			Context:               context.Background(),
+		},
+		Log: logrtest.TestLogger{T: t},
+	}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "pod1", Namespace: "default"}}
+	_, err = r.Reconcile(context.Background(), req)
+	require.NoError(t, err)
+
+	services, err := consulClient.Agent().Services()
+	require.NoError(t, err)
+	require.Len(t, services, 2)
+	require.Contains(t, services, "pod1-client")
+	require.Contains(t, services, "pod1-client-sidecar-proxy")
+	require.Equal(t, "true", services["pod1-client"].Meta[MetaKeyServiceless])
+	check, err := getServiceCheck(consulClient, "default/pod1-client/kubernetes-health-check")
+	require.NoError(t, err)
+	require.Equal(t, api.HealthPassing, check.Status)
+
+	// Pods selected by a Kubernetes service are registered by the endpoints controller.
+	pod2 := createPod("pod2", "2.3.4.5", true, true)
+	pod2.Annotations[annotationService] = "client"
+	pod2.Labels["app"] = "client"
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "client", Namespace: "default"},
+		Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "client"}},
+	}
+	require.NoError(t, fakeClient.Create(context.Background(), pod2))
+	require.NoError(t, fakeClient.Create(context.Background(), service))
+	_, err = r.Reconcile(context.Background(), ctrl.Request{NamespacedName: types.NamespacedName{Name: "pod2", Namespace: "default"}})
+	require.NoError(t, err)
+	services, err = consulClient.Agent().Services()
+	require.NoError(t, err)
+	require.Len(t, services, 2)
+
+	// Once the pod has been deleted, its services are deregistered.
+	require.NoError(t, fakeClient.Delete(context.Background(), pod1))
+	_, err = r.Reconcile(context.Background(), req)
+	require.NoError(t, err)
+	services, err = consulClient.Agent().Services()
+	require.NoError(t, err)
+	require.Empty(t, services)
+}
+
+func TestInjectedPodRequests(t *testing.T) {
+	t.Parallel()
+	pod1 := createPod("pod1", "1.2.3.4", true, true)
+	pod1.Spec.NodeName = "node1"
+	pod2 := createPod("pod2", "2.3.4.5", true, true)
+	pod2.Spec.NodeName = "node2"
+	notInjected := createPod("pod3", "3.4.5.6", false, false)
+	notInjected.Spec.NodeName = "node1"
+	pods := []corev1.Pod{*pod1, *pod2, *notInjected}
+
+	require.Equal(t, []ctrl.Request{
+		{NamespacedName: types.NamespacedName{Name: "pod1", Namespace: "default"}},
+		{NamespacedName: types.NamespacedName{Name: "pod2", Namespace: "default"}},
+	}, injectedPodRequests(pods, ""))
+	require.Equal(t, []ctrl.Request{
+		{NamespacedName: types.NamespacedName{Name: "pod1", Namespace: "default"}},
+	}, injectedPodRequests(pods, "node1"))
+}
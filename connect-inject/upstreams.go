@@ -0,0 +1,189 @@
+package connectinject
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/yaml"
+)
+
+// upstreamV2 is an entry of the consul.hashicorp.com/connect-service-upstreams-v2
+// annotation. It mirrors api.Upstream except that the local bind port may also be
+// the name of a port on the pod.
+type upstreamV2 struct {
+	DestinationType      string                 `json:"destinationType,omitempty"`
+	DestinationNamespace string                 `json:"destinationNamespace,omitempty"`
+	DestinationName      string                 `json:"destinationName,omitempty"`
+	Datacenter           string                 `json:"datacenter,omitempty"`
+	LocalBindAddress     string                 `json:"localBindAddress,omitempty"`
+	LocalBindPort        intstr.IntOrString     `json:"localBindPort,omitempty"`
+	LocalBindSocketPath  string                 `json:"localBindSocketPath,omitempty"`
+	LocalBindSocketMode  string                 `json:"localBindSocketMode,omitempty"`
+	Config               map[string]interface{} `json:"config,omitempty"`
+	MeshGateway          meshGatewayV2          `json:"meshGateway,omitempty"`
+}
+
+type meshGatewayV2 struct {
+	Mode string `json:"mode,omitempty"`
+}
+
+// parseUpstreamsV2 parses the value of the consul.hashicorp.com/connect-service-upstreams-v2
+// annotation, a JSON or YAML list of upstreams, into Consul upstreams. Errors name the
+// index and field of the offending upstream, e.g. "upstreams[1].localBindPort: ...".
+// Destination namespaces may only be set when Consul namespaces are enabled.
+func parseUpstreamsV2(pod corev1.Pod, raw string, enableNamespaces bool) ([]api.Upstream, error) {
+	// YAML is a superset of JSON, so both are converted to JSON before decoding.
+	jsonRaw, err := yaml.YAMLToJSON([]byte(raw))
+	if err != nil {
+		return nil, fmt.Errorf("must be a JSON or YAML list of upstreams: %s", err)
+	}
+	var entries []json.RawMessage
+	if err := json.Unmarshal(jsonRaw, &entries); err != nil {
+		return nil, errors.New("must be a JSON or YAML list of upstreams")
+	}
+
+	var upstreams []api.Upstream
+	for i, entry := range entries {
+		var u upstreamV2
+		decoder := json.NewDecoder(bytes.NewReader(entry))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&u); err != nil {
+			return nil, fmt.Errorf("upstreams[%d]: %s", i, err)
+		}
+		upstream, err := u.toUpstream(pod, enableNamespaces)
+		if err != nil {
+			return nil, fmt.Errorf("upstreams[%d]%s", i, err)
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	return upstreams, nil
+}
+
+// toUpstream validates the upstream and converts it to an api.Upstream. Errors are
+// relative to the upstream, i.e. they start with ".<field>: " or ": " if they don't
+// refer to a single field, so that the caller can prefix them with the upstream's index.
+func (u upstreamV2) toUpstream(pod corev1.Pod, enableNamespaces bool) (api.Upstream, error) {
+	upstream := api.Upstream{
+		DestinationType:      api.UpstreamDestType(u.DestinationType),
+		DestinationNamespace: u.DestinationNamespace,
+		DestinationName:      u.DestinationName,
+		Datacenter:           u.Datacenter,
+		LocalBindAddress:     u.LocalBindAddress,
+		LocalBindSocketPath:  u.LocalBindSocketPath,
+		LocalBindSocketMode:  u.LocalBindSocketMode,
+		Config:               u.Config,
+		MeshGateway:          api.MeshGatewayConfig{Mode: api.MeshGatewayMode(u.MeshGateway.Mode)},
+	}
+
+	switch upstream.DestinationType {
+	case "":
+		upstream.DestinationType = api.UpstreamDestTypeService
+	case api.UpstreamDestTypeService, api.UpstreamDestTypePreparedQuery:
+	default:
+		return api.Upstream{}, fmt.Errorf(".destinationType: %q must be one of %q or %q",
+			u.DestinationType, api.UpstreamDestTypeService, api.UpstreamDestTypePreparedQuery)
+	}
+	if upstream.DestinationName == "" {
+		return api.Upstream{}, errors.New(".destinationName: must be set")
+	}
+	if upstream.DestinationNamespace != "" && !enableNamespaces {
+		return api.Upstream{}, errors.New(".destinationNamespace: can only be set when Consul namespaces are enabled")
+	}
+
+	portSet := u.LocalBindPort != intstr.IntOrString{}
+	switch {
+	case portSet && u.LocalBindSocketPath != "":
+		return api.Upstream{}, errors.New(": only one of localBindPort and localBindSocketPath can be set")
+	case !portSet && u.LocalBindSocketPath == "":
+		return api.Upstream{}, errors.New(": one of localBindPort or localBindSocketPath must be set")
+	case portSet:
+		port, err := portValue(pod, u.LocalBindPort.String())
+		if err != nil || port <= 0 || port > 65535 {
+			return api.Upstream{}, fmt.Errorf(".localBindPort: %q is not a valid port or named port on the pod", u.LocalBindPort.String())
+		}
+		upstream.LocalBindPort = int(port)
+	}
+	if u.LocalBindAddress != "" {
+		if u.LocalBindSocketPath != "" {
+			return api.Upstream{}, errors.New(".localBindAddress: cannot be set with localBindSocketPath")
+		}
+		if net.ParseIP(u.LocalBindAddress) == nil {
+			return api.Upstream{}, fmt.Errorf(".localBindAddress: %q is not a valid IP address", u.LocalBindAddress)
+		}
+	}
+	if u.LocalBindSocketMode != "" {
+		if u.LocalBindSocketPath == "" {
+			return api.Upstream{}, errors.New(".localBindSocketMode: can only be set with localBindSocketPath")
+		}
+		if _, err := strconv.ParseUint(u.LocalBindSocketMode, 8, 32); err != nil {
+			return api.Upstream{}, fmt.Errorf(".localBindSocketMode: %q is not an octal file mode", u.LocalBindSocketMode)
+		}
+	}
+
+	switch upstream.MeshGateway.Mode {
+	case api.MeshGatewayModeDefault, api.MeshGatewayModeNone, api.MeshGatewayModeLocal, api.MeshGatewayModeRemote:
+	default:
+		return api.Upstream{}, fmt.Errorf(".meshGateway.mode: %q must be one of %q, %q or %q",
+			u.MeshGateway.Mode, api.MeshGatewayModeNone, api.MeshGatewayModeLocal, api.MeshGatewayModeRemote)
+	}
+
+	// The config is passed to Envoy as is, but the settings that are commonly set
+	// per upstream are checked so that typos don't go unnoticed until Envoy rejects them.
+	if raw, ok := u.Config["connect_timeout_ms"]; ok {
+		if timeout, ok := raw.(float64); !ok || timeout < 0 || timeout != float64(int64(timeout)) {
+			return api.Upstream{}, fmt.Errorf(".config.connect_timeout_ms: %v must be a non-negative integer", raw)
+		}
+	}
+	if raw, ok := u.Config["protocol"]; ok {
+		if _, ok := raw.(string); !ok {
+			return api.Upstream{}, fmt.Errorf(".config.protocol: %v must be a string", raw)
+		}
+	}
+	return upstream, nil
+}
+
+// parseUpstream parses an entry of the consul.hashicorp.com/connect-service-upstreams
+// annotation, which is either `<service>[.<namespace>]:<port>[:<datacenter>]` or
+// `prepared_query:<query>:<port>`. The namespace is only parsed when Consul namespaces are
+// enabled. The local bind port is zero if the entry's port isn't a valid port or named port.
+func parseUpstream(pod corev1.Pod, raw string, enableNamespaces bool) api.Upstream {
+	parts := strings.SplitN(raw, ":", 3)
+	upstream := api.Upstream{DestinationType: api.UpstreamDestTypeService}
+
+	if strings.TrimSpace(parts[0]) == "prepared_query" {
+		if len(parts) < 3 {
+			return upstream
+		}
+		upstream.DestinationType = api.UpstreamDestTypePreparedQuery
+		upstream.DestinationName = strings.TrimSpace(parts[1])
+		port, _ := portValue(pod, strings.TrimSpace(parts[2]))
+		upstream.LocalBindPort = int(port)
+		return upstream
+	}
+
+	if enableNamespaces {
+		pieces := strings.SplitN(parts[0], ".", 2)
+		upstream.DestinationName = strings.TrimSpace(pieces[0])
+		if len(pieces) > 1 {
+			upstream.DestinationNamespace = strings.TrimSpace(pieces[1])
+		}
+	} else {
+		upstream.DestinationName = strings.TrimSpace(parts[0])
+	}
+	if len(parts) > 1 {
+		port, _ := portValue(pod, strings.TrimSpace(parts[1]))
+		upstream.LocalBindPort = int(port)
+	}
+	if len(parts) > 2 {
+		upstream.Datacenter = strings.TrimSpace(parts[2])
+	}
+	return upstream
+}
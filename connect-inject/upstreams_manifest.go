@@ -0,0 +1,43 @@
+package connectinject
+
+import (
+	"encoding/json"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// upstreamsManifestFile is the file in the shared volume that the init container writes
+// the upstreams manifest to. Application containers can read it to discover their upstreams
+// at runtime.
+const upstreamsManifestFile = "/consul/connect-inject/upstreams.json"
+
+// upstreamsManifest is the JSON document written to upstreamsManifestFile.
+type upstreamsManifest struct {
+	Upstreams []injectedUpstream `json:"upstreams"`
+}
+
+// upstreamsManifest returns the JSON upstreams manifest of the pod, or an empty string
+// if the pod has no upstreams, in which case no manifest is written.
+func (h *Handler) upstreamsManifest(pod corev1.Pod) (string, error) {
+	upstreams := injectedUpstreams(pod, h.EnableNamespaces)
+	if len(upstreams) == 0 {
+		return "", nil
+	}
+	manifest, err := json.Marshal(upstreamsManifest{Upstreams: upstreams})
+	if err != nil {
+		return "", err
+	}
+	return string(manifest), nil
+}
+
+// upstreamsManifestVolumeMount returns the volume mount that makes the upstreams manifest
+// available to application containers. Only the manifest is mounted so that the ACL token
+// and other files in the shared volume aren't exposed to the application.
+func upstreamsManifestVolumeMount() corev1.VolumeMount {
+	return corev1.VolumeMount{
+		Name:      volumeName,
+		MountPath: upstreamsManifestFile,
+		SubPath:   "upstreams.json",
+		ReadOnly:  true,
+	}
+}
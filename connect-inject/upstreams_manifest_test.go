@@ -0,0 +1,96 @@
+package connectinject
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestHandlerUpstreamsManifest(t *testing.T) {
+	cases := map[string]struct {
+		annotations      map[string]string
+		enableNamespaces bool
+		expManifest      string
+	}{
+		"no upstreams": {
+			annotations: map[string]string{annotationService: "web"},
+			expManifest: "",
+		},
+		"upstreams annotation": {
+			annotations: map[string]string{
+				annotationService:   "web",
+				annotationUpstreams: "db.ns1:1234:dc1,prepared_query:cache:2345",
+			},
+			enableNamespaces: true,
+			expManifest: `{"upstreams":[` +
+				`{"destinationType":"service","destinationName":"db","destinationNamespace":"ns1","datacenter":"dc1","localBindAddress":"127.0.0.1","localBindPort":1234},` +
+				`{"destinationType":"prepared_query","destinationName":"cache","localBindAddress":"127.0.0.1","localBindPort":2345}]}`,
+		},
+		"upstreams-v2 annotation": {
+			annotations: map[string]string{
+				annotationService: "web",
+				annotationUpstreamsV2: `[{"destinationName": "db", "localBindPort": 1234, "localBindAddress": "127.0.0.2"},
+					{"destinationName": "cache", "localBindSocketPath": "/consul/cache.sock"}]`,
+			},
+			expManifest: `{"upstreams":[` +
+				`{"destinationType":"service","destinationName":"db","localBindAddress":"127.0.0.2","localBindPort":1234},` +
+				`{"destinationType":"service","destinationName":"cache","localBindSocketPath":"/consul/cache.sock"}]}`,
+		},
+		"multi-port pod": {
+			annotations: map[string]string{
+				annotationService:                  "web,web-admin",
+				annotationPort:                     "8080,9090",
+				annotationUpstreams + ".web":       "db:1234",
+				annotationUpstreams + ".web-admin": "auth:2345",
+			},
+			expManifest: `{"upstreams":[` +
+				`{"service":"web","destinationType":"service","destinationName":"db","localBindAddress":"127.0.0.1","localBindPort":1234},` +
+				`{"service":"web-admin","destinationType":"service","destinationName":"auth","localBindAddress":"127.0.0.1","localBindPort":2345}]}`,
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			h := Handler{EnableNamespaces: c.enableNamespaces}
+			manifest, err := h.upstreamsManifest(corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Annotations: c.annotations},
+			})
+			require.NoError(t, err)
+			require.Equal(t, c.expManifest, manifest)
+		})
+	}
+}
+
+// Test that the init container writes the manifest before running connect-init.
+func TestHandlerContainerInit_UpstreamsManifest(t *testing.T) {
+	h := Handler{}
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				annotationService:   "web",
+				annotationUpstreams: "db:1234",
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "web",
+				},
+			},
+		},
+	}
+	container, err := h.containerInit(corev1.Namespace{}, pod)
+	require.NoError(t, err)
+	cmd := strings.Join(container.Command, " ")
+	require.Contains(t, cmd, `cat <<'EOF' >/consul/connect-inject/upstreams.json
+{"upstreams":[{"destinationType":"service","destinationName":"db","localBindAddress":"127.0.0.1","localBindPort":1234}]}
+EOF
+consul-k8s connect-init`)
+
+	delete(pod.Annotations, annotationUpstreams)
+	container, err = h.containerInit(corev1.Namespace{}, pod)
+	require.NoError(t, err)
+	require.NotContains(t, strings.Join(container.Command, " "), "upstreams.json")
+}
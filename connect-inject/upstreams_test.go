@@ -0,0 +1,205 @@
+package connectinject
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseUpstreamsV2(t *testing.T) {
+	t.Parallel()
+	cases := map[string]struct {
+		raw              string
+		enableNamespaces bool
+		expUpstreams     []api.Upstream
+		expErr           string
+	}{
+		"JSON": {
+			raw: `[{"destinationName": "db", "localBindPort": 1234, "localBindAddress": "127.0.0.2", "datacenter": "dc2",
+				"meshGateway": {"mode": "remote"}, "config": {"connect_timeout_ms": 5000, "protocol": "grpc"}}]`,
+			expUpstreams: []api.Upstream{
+				{
+					DestinationType:  api.UpstreamDestTypeService,
+					DestinationName:  "db",
+					Datacenter:       "dc2",
+					LocalBindAddress: "127.0.0.2",
+					LocalBindPort:    1234,
+					Config:           map[string]interface{}{"connect_timeout_ms": float64(5000), "protocol": "grpc"},
+					MeshGateway:      api.MeshGatewayConfig{Mode: api.MeshGatewayModeRemote},
+				},
+			},
+		},
+		"YAML": {
+			raw: `
+- destinationName: db
+  localBindPort: http
+- destinationType: prepared_query
+  destinationName: query
+  localBindSocketPath: /consul/query.sock
+  localBindSocketMode: "0600"
+`,
+			expUpstreams: []api.Upstream{
+				{
+					DestinationType: api.UpstreamDestTypeService,
+					DestinationName: "db",
+					LocalBindPort:   8080,
+				},
+				{
+					DestinationType:     api.UpstreamDestTypePreparedQuery,
+					DestinationName:     "query",
+					LocalBindSocketPath: "/consul/query.sock",
+					LocalBindSocketMode: "0600",
+				},
+			},
+		},
+		"namespace": {
+			raw:              `[{"destinationName": "db", "destinationNamespace": "ns", "localBindPort": 1234}]`,
+			enableNamespaces: true,
+			expUpstreams: []api.Upstream{
+				{
+					DestinationType:      api.UpstreamDestTypeService,
+					DestinationNamespace: "ns",
+					DestinationName:      "db",
+					LocalBindPort:        1234,
+				},
+			},
+		},
+		"empty list": {
+			raw: `[]`,
+		},
+		"not a list": {
+			raw:    `{"destinationName": "db"}`,
+			expErr: "must be a JSON or YAML list of upstreams",
+		},
+		"unknown field": {
+			raw:    `[{"destinationName": "db", "localBindPort": 1234}, {"destinationNme": "db"}]`,
+			expErr: `upstreams[1]: json: unknown field "destinationNme"`,
+		},
+		"wrong type": {
+			raw:    `[{"destinationName": ["db"], "localBindPort": 1234}]`,
+			expErr: "upstreams[0]: json: cannot unmarshal array into Go struct field upstreamV2.destinationName of type string",
+		},
+		"missing destination name": {
+			raw:    `[{"localBindPort": 1234}]`,
+			expErr: "upstreams[0].destinationName: must be set",
+		},
+		"invalid destination type": {
+			raw:    `[{"destinationName": "db", "destinationType": "node", "localBindPort": 1234}]`,
+			expErr: `upstreams[0].destinationType: "node" must be one of "service" or "prepared_query"`,
+		},
+		"namespace without namespaces enabled": {
+			raw:    `[{"destinationName": "db", "destinationNamespace": "ns", "localBindPort": 1234}]`,
+			expErr: "upstreams[0].destinationNamespace: can only be set when Consul namespaces are enabled",
+		},
+		"unknown named port": {
+			raw:    `[{"destinationName": "db", "localBindPort": "metrics"}]`,
+			expErr: `upstreams[0].localBindPort: "metrics" is not a valid port or named port on the pod`,
+		},
+		"port out of range": {
+			raw:    `[{"destinationName": "db", "localBindPort": 70000}]`,
+			expErr: `upstreams[0].localBindPort: "70000" is not a valid port or named port on the pod`,
+		},
+		"port and socket": {
+			raw:    `[{"destinationName": "db", "localBindPort": 1234, "localBindSocketPath": "/db.sock"}]`,
+			expErr: "upstreams[0]: only one of localBindPort and localBindSocketPath can be set",
+		},
+		"no port or socket": {
+			raw:    `[{"destinationName": "db"}]`,
+			expErr: "upstreams[0]: one of localBindPort or localBindSocketPath must be set",
+		},
+		"invalid bind address": {
+			raw:    `[{"destinationName": "db", "localBindPort": 1234, "localBindAddress": "localhost"}]`,
+			expErr: `upstreams[0].localBindAddress: "localhost" is not a valid IP address`,
+		},
+		"socket mode without socket": {
+			raw:    `[{"destinationName": "db", "localBindPort": 1234, "localBindSocketMode": "0600"}]`,
+			expErr: "upstreams[0].localBindSocketMode: can only be set with localBindSocketPath",
+		},
+		"invalid socket mode": {
+			raw:    `[{"destinationName": "db", "localBindSocketPath": "/db.sock", "localBindSocketMode": "rw"}]`,
+			expErr: `upstreams[0].localBindSocketMode: "rw" is not an octal file mode`,
+		},
+		"invalid mesh gateway mode": {
+			raw:    `[{"destinationName": "db", "localBindPort": 1234, "meshGateway": {"mode": "bad"}}]`,
+			expErr: `upstreams[0].meshGateway.mode: "bad" must be one of "none", "local" or "remote"`,
+		},
+		"invalid connect timeout": {
+			raw:    `[{"destinationName": "db", "localBindPort": 1234, "config": {"connect_timeout_ms": "5s"}}]`,
+			expErr: "upstreams[0].config.connect_timeout_ms: 5s must be a non-negative integer",
+		},
+		"invalid protocol": {
+			raw:    `[{"destinationName": "db", "localBindPort": 1234, "config": {"protocol": 2}}]`,
+			expErr: "upstreams[0].config.protocol: 2 must be a string",
+		},
+	}
+
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:  "web",
+					Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}},
+				},
+			},
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			upstreams, err := parseUpstreamsV2(pod, c.raw, c.enableNamespaces)
+			if c.expErr != "" {
+				require.EqualError(t, err, c.expErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.expUpstreams, upstreams)
+		})
+	}
+}
+
+func TestHandlerValidatePod_UpstreamsV2(t *testing.T) {
+	t.Parallel()
+	cases := map[string]struct {
+		annotations map[string]string
+		expErr      string
+	}{
+		"valid": {
+			annotations: map[string]string{
+				annotationUpstreamsV2: `[{"destinationName": "db", "localBindPort": 1234}]`,
+			},
+		},
+		"invalid": {
+			annotations: map[string]string{
+				annotationUpstreamsV2: `[{"destinationName": "db"}]`,
+			},
+			expErr: `"consul.hashicorp.com/connect-service-upstreams-v2" annotation is invalid: upstreams[0]: one of localBindPort or localBindSocketPath must be set`,
+		},
+		"invalid scoped to a service": {
+			annotations: map[string]string{
+				annotationUpstreamsV2 + ".web-admin": `[{"localBindPort": 1234}]`,
+			},
+			expErr: `"consul.hashicorp.com/connect-service-upstreams-v2.web-admin" annotation is invalid: upstreams[0].destinationName: must be set`,
+		},
+		"set with the string annotation": {
+			annotations: map[string]string{
+				annotationUpstreams:   "db:1234",
+				annotationUpstreamsV2: `[{"destinationName": "db", "localBindPort": 1234}]`,
+			},
+			expErr: `"consul.hashicorp.com/connect-service-upstreams-v2" annotation is invalid: cannot be set together with "consul.hashicorp.com/connect-service-upstreams"`,
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			var h Handler
+			_, err := h.validatePod(corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: c.annotations}})
+			if c.expErr != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), c.expErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -38,6 +39,8 @@ type Command struct {
 	flagConsulServiceNamespace string // Consul destination namespace for the service.
 	flagServiceAccountName     string // Service account name.
 	flagServiceName            string // Service name.
+	flagMultiPort              bool   // True if the pod registers multiple services.
+	flagConnectNative          bool   // True if the service is Connect native and has no proxy.
 	flagLogLevel               string
 
 	bearerTokenFile                    string // Location of the bearer token. Default is /var/run/secrets/kubernetes.io/serviceaccount/token.
@@ -62,6 +65,12 @@ func (c *Command) init() {
 	c.flagSet.StringVar(&c.flagConsulServiceNamespace, "consul-service-namespace", "", "Consul destination namespace of the service.")
 	c.flagSet.StringVar(&c.flagServiceAccountName, "service-account-name", "", "Service account name on the pod.")
 	c.flagSet.StringVar(&c.flagServiceName, "service-name", "", "Service name as specified via the pod annotation.")
+	c.flagSet.BoolVar(&c.flagMultiPort, "multiport", false,
+		"Set when the pod registers multiple services. -service-name must be a comma-separated list of the services. "+
+			"The proxy ID of each service is written to a separate file suffixed with the service name.")
+	c.flagSet.BoolVar(&c.flagConnectNative, "connect-native", false,
+		"Set when the service is Connect native. Only the service is waited for since it has no proxy, "+
+			"and no proxy ID is written.")
 	c.flagSet.StringVar(&c.flagLogLevel, "log-level", "info",
 		"Log verbosity level. Supported values (in order of detail) are \"trace\", "+
 			"\"debug\", \"info\", \"warn\", and \"error\".")
@@ -105,6 +114,18 @@ func (c *Command) Run(args []string) int {
 		c.UI.Error("-service-account-name must be set when ACLs are enabled")
 		return 1
 	}
+	if c.flagMultiPort && c.flagServiceName == "" {
+		c.UI.Error("-service-name must be set when -multiport is set")
+		return 1
+	}
+	if c.flagMultiPort && c.flagACLAuthMethod != "" {
+		c.UI.Error("-multiport is not supported when ACLs are enabled")
+		return 1
+	}
+	if c.flagMultiPort && c.flagConnectNative {
+		c.UI.Error("-multiport and -connect-native cannot both be set")
+		return 1
+	}
 
 	// Set up logging.
 	if c.logger == nil {
@@ -149,6 +170,15 @@ func (c *Command) Run(args []string) int {
 		c.logger.Info("Consul login complete")
 	}
 
+	if c.flagMultiPort {
+		if err := c.waitForMultiPortServices(consulClient); err != nil {
+			c.logger.Error("Timed out waiting for service registration", "error", err)
+			return 1
+		}
+		c.logger.Info("Connect initialization completed")
+		return 0
+	}
+
 	// Now wait for the service to be registered. Do this by querying the Agent for a service
 	// which maps to this pod+namespace.
 	var proxyID string
@@ -156,14 +186,18 @@ func (c *Command) Run(args []string) int {
 	var errServiceNameMismatch error
 	err = backoff.Retry(func() error {
 		registrationRetryCount++
-		filter := fmt.Sprintf("Meta[%q] == %q and Meta[%q] == %q", connectinject.MetaKeyPodName, c.flagPodName, connectinject.MetaKeyKubeNS, c.flagPodNamespace)
-		serviceList, err := consulClient.Agent().ServicesWithFilter(filter)
+		serviceList, err := c.podServices(consulClient)
 		if err != nil {
-			c.logger.Error("Unable to get Agent services", "error", err)
+			c.logger.Error("Unable to get services", "error", err)
 			return err
 		}
 		// Wait for the service and the connect-proxy service to be registered.
-		if len(serviceList) != 2 {
+		// Connect native services don't have a connect-proxy service.
+		expectedServices := 2
+		if c.flagConnectNative {
+			expectedServices = 1
+		}
+		if len(serviceList) != expectedServices {
 			c.logger.Info("Unable to find registered services; retrying")
 			// Once every 10 times we're going to print this informational message to the pod logs so that
 			// it is not "lost" to the user at the end of the retries when the pod enters a CrashLoop.
@@ -193,7 +227,7 @@ func (c *Command) Run(args []string) int {
 			}
 		}
 
-		if proxyID == "" {
+		if proxyID == "" && !c.flagConnectNative {
 			// In theory we can't reach this point unless we have 2 services registered against
 			// this pod and neither are the connect-proxy. We don't support this case anyway, but it
 			// is necessary to return from the function.
@@ -209,6 +243,10 @@ func (c *Command) Run(args []string) int {
 		c.logger.Error(errServiceNameMismatch.Error())
 		return 1
 	}
+	if c.flagConnectNative {
+		c.logger.Info("Connect initialization completed")
+		return 0
+	}
 	// Write the proxy ID to the shared volume so `consul connect envoy` can use it for bootstrapping.
 	err = common.WriteFileWithPerms(c.proxyIDFile, proxyID, os.FileMode(0444))
 	if err != nil {
@@ -219,6 +257,76 @@ func (c *Command) Run(args []string) int {
 	return 0
 }
 
+// waitForMultiPortServices waits for every service of a multi-port pod and its proxy to be
+// registered, and writes the ID of each proxy to the proxy ID file suffixed with the name of
+// the service it fronts, e.g. /consul/connect-inject/proxyid-web.
+func (c *Command) waitForMultiPortServices(consulClient *api.Client) error {
+	serviceNames := strings.Split(c.flagServiceName, ",")
+	for i := range serviceNames {
+		serviceNames[i] = strings.TrimSpace(serviceNames[i])
+	}
+
+	proxyIDs := make(map[string]string)
+	registrationRetryCount := 0
+	err := backoff.Retry(func() error {
+		registrationRetryCount++
+		serviceList, err := c.podServices(consulClient)
+		if err != nil {
+			c.logger.Error("Unable to get services", "error", err)
+			return err
+		}
+
+		registered := make(map[string]bool)
+		for _, svc := range serviceList {
+			if svc.Kind == api.ServiceKindConnectProxy && svc.Proxy != nil {
+				proxyIDs[svc.Proxy.DestinationServiceName] = svc.ID
+			} else {
+				registered[svc.Service] = true
+			}
+		}
+
+		for _, name := range serviceNames {
+			if !registered[name] || proxyIDs[name] == "" {
+				c.logger.Info("Unable to find registered services; retrying", "service", name)
+				// Once every 10 times we're going to print this informational message to the pod logs so that
+				// it is not "lost" to the user at the end of the retries when the pod enters a CrashLoop.
+				if registrationRetryCount%10 == 0 {
+					c.logger.Info("Check to ensure a Kubernetes service has been created for each service of this application.")
+				}
+				return fmt.Errorf("service %q or its proxy is not registered", name)
+			}
+		}
+		return nil
+	}, backoff.WithMaxRetries(backoff.NewConstantBackOff(1*time.Second), c.serviceRegistrationPollingAttempts))
+	if err != nil {
+		return err
+	}
+
+	for _, name := range serviceNames {
+		c.logger.Info("Registered service has been detected", "service", name)
+		// Write each proxy ID to the shared volume so `consul connect envoy` can use it for bootstrapping.
+		proxyIDFile := fmt.Sprintf("%s-%s", c.proxyIDFile, name)
+		if err := common.WriteFileWithPerms(proxyIDFile, proxyIDs[name], os.FileMode(0444)); err != nil {
+			return fmt.Errorf("unable to write proxy ID to file: %s", err)
+		}
+	}
+	return nil
+}
+
+// podServices returns the services registered for this pod with the local agent.
+func (c *Command) podServices(consulClient *api.Client) ([]*api.AgentService, error) {
+	filter := fmt.Sprintf("Meta[%q] == %q and Meta[%q] == %q", connectinject.MetaKeyPodName, c.flagPodName, connectinject.MetaKeyKubeNS, c.flagPodNamespace)
+	services, err := consulClient.Agent().ServicesWithFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	var serviceList []*api.AgentService
+	for _, svc := range services {
+		serviceList = append(serviceList, svc)
+	}
+	return serviceList, nil
+}
+
 func (c *Command) Synopsis() string { return synopsis }
 func (c *Command) Help() string {
 	c.once.Do(c.init)
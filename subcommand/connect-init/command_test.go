@@ -40,6 +40,20 @@ func TestRun_FlagValidation(t *testing.T) {
 			flags:  []string{"-pod-name", testPodName, "-pod-namespace", testPodNamespace, "-acl-auth-method", testAuthMethod, "-service-account-name", "foo", "-log-level", "invalid"},
 			expErr: "unknown log level: invalid",
 		},
+		{
+			flags:  []string{"-pod-name", testPodName, "-pod-namespace", testPodNamespace, "-multiport"},
+			expErr: "-service-name must be set when -multiport is set",
+		},
+		{
+			flags: []string{"-pod-name", testPodName, "-pod-namespace", testPodNamespace, "-multiport", "-service-name", "counting,counting-admin",
+				"-acl-auth-method", testAuthMethod, "-service-account-name", "foo"},
+			expErr: "-multiport is not supported when ACLs are enabled",
+		},
+		{
+			flags: []string{"-pod-name", testPodName, "-pod-namespace", testPodNamespace, "-multiport", "-service-name", "counting,counting-admin",
+				"-connect-native"},
+			expErr: "-multiport and -connect-native cannot both be set",
+		},
 	}
 	for _, c := range cases {
 		t.Run(c.expErr, func(t *testing.T) {
@@ -554,6 +568,124 @@ func TestRun_RetryServicePolling(t *testing.T) {
 	require.Contains(t, string(data), "counting-counting-sidecar-proxy")
 }
 
+// TestRun_MultiPort validates that for multi-port pods the command waits for every service
+// and writes the proxy ID of each service to its own file.
+func TestRun_MultiPort(t *testing.T) {
+	t.Parallel()
+	proxyFile := fmt.Sprintf("/tmp/%d", rand.Int())
+	t.Cleanup(func() {
+		os.Remove(proxyFile + "-counting")
+		os.Remove(proxyFile + "-counting-admin")
+	})
+
+	server, err := testutil.NewTestServerConfigT(t, nil)
+	require.NoError(t, err)
+	defer server.Stop()
+	server.WaitForLeader(t)
+	consulClient, err := api.NewClient(&api.Config{Address: server.HTTPAddr})
+	require.NoError(t, err)
+
+	testConsulServices := []api.AgentServiceRegistration{consulCountingSvc, consulCountingSvcSidecar, consulCountingAdminSvc, consulCountingAdminSvcSidecar}
+	for _, svc := range testConsulServices {
+		require.NoError(t, consulClient.Agent().ServiceRegister(&svc))
+	}
+
+	ui := cli.NewMockUi()
+	cmd := Command{
+		UI:                                 ui,
+		proxyIDFile:                        proxyFile,
+		serviceRegistrationPollingAttempts: 3,
+	}
+	flags := []string{
+		"-pod-name", testPodName,
+		"-pod-namespace", testPodNamespace,
+		"-multiport",
+		"-service-name", "counting,counting-admin",
+		"-http-addr", server.HTTPAddr,
+	}
+	code := cmd.Run(flags)
+	require.Equal(t, 0, code, ui.ErrorWriter.String())
+
+	data, err := ioutil.ReadFile(proxyFile + "-counting")
+	require.NoError(t, err)
+	require.Equal(t, "counting-counting-sidecar-proxy", string(data))
+	data, err = ioutil.ReadFile(proxyFile + "-counting-admin")
+	require.NoError(t, err)
+	require.Equal(t, "counting-counting-admin-sidecar-proxy", string(data))
+}
+
+// TestRun_ConnectNative validates that the command only waits for the service of a
+// Connect native pod, which has no proxy, and doesn't write a proxy ID file.
+func TestRun_ConnectNative(t *testing.T) {
+	t.Parallel()
+	proxyFile := fmt.Sprintf("/tmp/%d", rand.Int())
+
+	server, err := testutil.NewTestServerConfigT(t, nil)
+	require.NoError(t, err)
+	defer server.Stop()
+	server.WaitForLeader(t)
+	consulClient, err := api.NewClient(&api.Config{Address: server.HTTPAddr})
+	require.NoError(t, err)
+
+	nativeSvc := consulCountingSvc
+	nativeSvc.Connect = &api.AgentServiceConnect{Native: true}
+	require.NoError(t, consulClient.Agent().ServiceRegister(&nativeSvc))
+
+	ui := cli.NewMockUi()
+	cmd := Command{
+		UI:                                 ui,
+		proxyIDFile:                        proxyFile,
+		serviceRegistrationPollingAttempts: 3,
+	}
+	flags := []string{
+		"-pod-name", testPodName,
+		"-pod-namespace", testPodNamespace,
+		"-connect-native",
+		"-http-addr", server.HTTPAddr,
+	}
+	code := cmd.Run(flags)
+	require.Equal(t, 0, code, ui.ErrorWriter.String())
+	_, err = os.Stat(proxyFile)
+	require.True(t, os.IsNotExist(err))
+}
+
+// TestRun_MultiPort_MissingService validates that the command fails if one of the
+// services of a multi-port pod is never registered.
+func TestRun_MultiPort_MissingService(t *testing.T) {
+	t.Parallel()
+	proxyFile := fmt.Sprintf("/tmp/%d", rand.Int())
+
+	server, err := testutil.NewTestServerConfigT(t, nil)
+	require.NoError(t, err)
+	defer server.Stop()
+	server.WaitForLeader(t)
+	consulClient, err := api.NewClient(&api.Config{Address: server.HTTPAddr})
+	require.NoError(t, err)
+
+	testConsulServices := []api.AgentServiceRegistration{consulCountingSvc, consulCountingSvcSidecar}
+	for _, svc := range testConsulServices {
+		require.NoError(t, consulClient.Agent().ServiceRegister(&svc))
+	}
+
+	ui := cli.NewMockUi()
+	cmd := Command{
+		UI:                                 ui,
+		proxyIDFile:                        proxyFile,
+		serviceRegistrationPollingAttempts: 2,
+	}
+	flags := []string{
+		"-pod-name", testPodName,
+		"-pod-namespace", testPodNamespace,
+		"-multiport",
+		"-service-name", "counting,counting-admin",
+		"-http-addr", server.HTTPAddr,
+	}
+	code := cmd.Run(flags)
+	require.Equal(t, 1, code)
+	_, err = os.Stat(proxyFile + "-counting")
+	require.True(t, os.IsNotExist(err))
+}
+
 // TestRun_InvalidProxyFile validates that we correctly fail in case the proxyid file
 // is not writable. This functions as coverage for both ACL and non-ACL codepaths.
 func TestRun_InvalidProxyFile(t *testing.T) {
@@ -910,6 +1042,32 @@ var (
 			metaKeyKubeServiceName: "counting",
 		},
 	}
+	consulCountingAdminSvc = api.AgentServiceRegistration{
+		ID:      "counting-counting-admin",
+		Name:    "counting-admin",
+		Address: "127.0.0.1",
+		Meta: map[string]string{
+			metaKeyPodName:         "counting-pod",
+			metaKeyKubeNS:          "default-ns",
+			metaKeyKubeServiceName: "counting-admin",
+		},
+	}
+	consulCountingAdminSvcSidecar = api.AgentServiceRegistration{
+		ID:   "counting-counting-admin-sidecar-proxy",
+		Name: "counting-admin-sidecar-proxy",
+		Kind: "connect-proxy",
+		Proxy: &api.AgentServiceConnectProxyConfig{
+			DestinationServiceName: "counting-admin",
+			DestinationServiceID:   "counting-counting-admin",
+		},
+		Port:    10000,
+		Address: "127.0.0.1",
+		Meta: map[string]string{
+			metaKeyPodName:         "counting-pod",
+			metaKeyKubeNS:          "default-ns",
+			metaKeyKubeServiceName: "counting-admin",
+		},
+	}
 	consulCountingSvcSidecar = api.AgentServiceRegistration{
 		ID:   "counting-counting-sidecar-proxy",
 		Name: "counting-sidecar-proxy",
@@ -0,0 +1,77 @@
+package consulsidecar
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// waitForAppExit blocks until -app-exited-file contains "true", in which case it
+// returns true. It returns false if the context is cancelled first. The file is a
+// downward API volume of the pod's consul.hashicorp.com/app-exited annotation, which
+// the connect injector's controller sets once the application containers have
+// terminated and won't be restarted given the pod's restart policy.
+func (c *Command) waitForAppExit(ctx context.Context) bool {
+	for {
+		exited, err := appExited(c.flagAppExitedFile)
+		if err != nil {
+			c.logger.Error("failed to read application exit file", "file", c.flagAppExitedFile, "err", err)
+		} else if exited {
+			return true
+		}
+
+		select {
+		case <-time.After(c.appExitPollInterval):
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// appExited returns true if the file contains "true". The kubelet writes an
+// empty file while the annotation isn't set.
+func appExited(file string) (bool, error) {
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(contents)) == "true", nil
+}
+
+// quitEnvoy asks each Envoy sidecar to exit through its admin API. Errors are
+// logged because the remaining Envoy sidecars should still be stopped.
+func (c *Command) quitEnvoy() {
+	client := &http.Client{Timeout: 5 * time.Second}
+	for _, addr := range c.flagEnvoyAdminAddrs {
+		resp, err := client.Post(fmt.Sprintf("http://%s/quitquitquit", addr), "", nil)
+		if err != nil {
+			c.logger.Error("failed to stop Envoy", "admin-addr", addr, "err", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			c.logger.Error("failed to stop Envoy", "admin-addr", addr, "status", resp.StatusCode)
+			continue
+		}
+		c.logger.Info("stopped Envoy", "admin-addr", addr)
+	}
+}
+
+// logout destroys the ACL token in -token-file, which connect-init created by logging in
+// with an auth method. Envoy's pre-stop hook logs out when the pod is deleted, but lifecycle
+// hooks don't run when the containers of a pod exit on their own. Errors are logged because
+// the token is deleted once the pod is gone either way.
+func (c *Command) logout() {
+	consulClient, err := c.http.APIClient()
+	if err == nil {
+		_, err = consulClient.ACL().Logout(nil)
+	}
+	if err != nil {
+		c.logger.Error("failed to log out of Consul", "err", err)
+		return
+	}
+	c.logger.Info("logged out of Consul")
+}
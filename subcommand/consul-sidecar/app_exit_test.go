@@ -0,0 +1,121 @@
+package consulsidecar
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/cli"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppExited(t *testing.T) {
+	t.Parallel()
+	file := filepath.Join(t.TempDir(), "app-exited")
+	for contents, exp := range map[string]bool{
+		"":       false,
+		"false":  false,
+		"true":   true,
+		"true\n": true,
+	} {
+		require.NoError(t, ioutil.WriteFile(file, []byte(contents), 0600))
+		exited, err := appExited(file)
+		require.NoError(t, err)
+		require.Equal(t, exp, exited, "contents %q", contents)
+	}
+
+	_, err := appExited(filepath.Join(t.TempDir(), "does-not-exist"))
+	require.Error(t, err)
+}
+
+// Test that the command stops Envoy and exits once the application exit
+// file says that the application has exited.
+func TestRun_StopOnAppExit(t *testing.T) {
+	t.Parallel()
+	var quitRequests int32
+	envoy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == "/quitquitquit" {
+			atomic.AddInt32(&quitRequests, 1)
+		}
+	}))
+	defer envoy.Close()
+
+	appExitedFile := filepath.Join(t.TempDir(), "app-exited")
+	require.NoError(t, ioutil.WriteFile(appExitedFile, nil, 0600))
+
+	ui := cli.NewMockUi()
+	cmd := Command{
+		UI:                  ui,
+		appExitPollInterval: 10 * time.Millisecond,
+	}
+	adminAddr := strings.TrimPrefix(envoy.URL, "http://")
+	exitChan := runCommandAsynchronously(&cmd, []string{
+		"-enable-service-registration=false",
+		"-stop-on-app-exit=true",
+		"-app-exited-file", appExitedFile,
+		"-envoy-admin-addr", adminAddr,
+		"-envoy-admin-addr", adminAddr,
+	})
+
+	// Envoy isn't stopped before the application has exited.
+	time.Sleep(100 * time.Millisecond)
+	require.Len(t, exitChan, 0)
+	require.Equal(t, int32(0), atomic.LoadInt32(&quitRequests))
+
+	require.NoError(t, ioutil.WriteFile(appExitedFile, []byte("true"), 0600))
+	select {
+	case exitCode := <-exitChan:
+		require.Equal(t, 0, exitCode, ui.ErrorWriter.String())
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "timeout waiting for command to exit")
+	}
+	require.Equal(t, int32(2), atomic.LoadInt32(&quitRequests))
+}
+
+// Test that the ACL token in the token file is logged out once Envoy is stopped
+// because the application exited.
+func TestRun_LogoutOnAppExit(t *testing.T) {
+	t.Parallel()
+	var loggedOut atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == "/v1/acl/logout" {
+			loggedOut.Store(r.Header.Get("X-Consul-Token"))
+		}
+	}))
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "acl-token")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("b78d37c7-0ca7-5f4d-99ee-6d9975ce4586"), 0600))
+	appExitedFile := filepath.Join(t.TempDir(), "app-exited")
+	require.NoError(t, ioutil.WriteFile(appExitedFile, nil, 0600))
+
+	ui := cli.NewMockUi()
+	cmd := Command{
+		UI:                  ui,
+		appExitPollInterval: 10 * time.Millisecond,
+	}
+	exitChan := runCommandAsynchronously(&cmd, []string{
+		"-enable-service-registration=false",
+		"-stop-on-app-exit=true",
+		"-app-exited-file", appExitedFile,
+		"-envoy-admin-addr", strings.TrimPrefix(server.URL, "http://"),
+		"-logout-on-app-exit=true",
+		"-http-addr", server.URL,
+		"-token-file", tokenFile,
+	})
+
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, ioutil.WriteFile(appExitedFile, []byte("true"), 0600))
+	select {
+	case exitCode := <-exitChan:
+		require.Equal(t, 0, exitCode, ui.ErrorWriter.String())
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "timeout waiting for command to exit")
+	}
+	require.Equal(t, "b78d37c7-0ca7-5f4d-99ee-6d9975ce4586", loggedOut.Load())
+}
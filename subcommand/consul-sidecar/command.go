@@ -41,11 +41,21 @@ type Command struct {
 	flagServiceMetricsPort   string
 	flagServiceMetricsPath   string
 
+	// Flags to stop the Envoy sidecars when the application exits
+	flagStopOnAppExit   bool
+	flagAppExitedFile   string
+	flagEnvoyAdminAddrs []string
+	flagLogoutOnAppExit bool
+
 	envoyMetricsGetter   metricsGetter
 	serviceMetricsGetter metricsGetter
 
 	consulCommand []string
 
+	// appExitPollInterval is the time between reads of -app-exited-file.
+	// It's a field so that tests can change it.
+	appExitPollInterval time.Duration
+
 	logger hclog.Logger
 	once   sync.Once
 	help   string
@@ -78,6 +88,18 @@ func (c *Command) init() {
 	c.flagSet.StringVar(&c.flagMergedMetricsPort, "merged-metrics-port", "20100", "Port to serve merged Envoy and application metrics. Defaults to 20100.")
 	c.flagSet.StringVar(&c.flagServiceMetricsPort, "service-metrics-port", "0", "Port where application metrics are being served. Defaults to 0.")
 	c.flagSet.StringVar(&c.flagServiceMetricsPath, "service-metrics-path", "/metrics", "Path where application metrics are being served. Defaults to /metrics.")
+	c.flagSet.BoolVar(&c.flagStopOnAppExit, "stop-on-app-exit", false,
+		"Stops the Envoy sidecars and exits once the application containers have exited for good, "+
+			"which is when -app-exited-file contains \"true\". Defaults to false.")
+	c.flagSet.StringVar(&c.flagAppExitedFile, "app-exited-file", "/consul/app-exit/app-exited",
+		"Path to the file that the connect injector's controller sets to \"true\" through a downward API volume "+
+			"once none of the application containers will run again. Defaults to /consul/app-exit/app-exited.")
+	c.flagSet.Var((*flags.AppendSliceValue)(&c.flagEnvoyAdminAddrs), "envoy-admin-addr",
+		"Address of the admin API of an Envoy sidecar to stop when the application exits. May be specified multiple times. "+
+			"Defaults to 127.0.0.1:19000.")
+	c.flagSet.BoolVar(&c.flagLogoutOnAppExit, "logout-on-app-exit", false,
+		"Logs out of Consul with the ACL token in -token-file once the Envoy sidecars have been stopped "+
+			"because the application exited. Requires -stop-on-app-exit. Defaults to false.")
 	c.help = flags.Usage(help, c.flagSet)
 	c.http = &flags.HTTPFlags{}
 	flags.Merge(c.flagSet, c.http.Flags())
@@ -90,6 +112,9 @@ func (c *Command) init() {
 		c.sigCh = make(chan os.Signal, 1)
 		signal.Notify(c.sigCh, syscall.SIGINT, syscall.SIGTERM)
 	}
+	if c.appExitPollInterval == 0 {
+		c.appExitPollInterval = 1 * time.Second
+	}
 }
 
 // Run continually re-registers the service with Consul.
@@ -109,6 +134,10 @@ func (c *Command) Run(args []string) int {
 		return 1
 	}
 
+	if len(c.flagEnvoyAdminAddrs) == 0 {
+		c.flagEnvoyAdminAddrs = []string{"127.0.0.1:19000"}
+	}
+
 	logger, err := common.Logger(c.flagLogLevel)
 	if err != nil {
 		c.UI.Error(err.Error())
@@ -126,6 +155,10 @@ func (c *Command) Run(args []string) int {
 		"merged-metrics-port", c.flagMergedMetricsPort,
 		"service-metrics-port", c.flagServiceMetricsPort,
 		"service-metrics-path", c.flagServiceMetricsPath,
+		"stop-on-app-exit", c.flagStopOnAppExit,
+		"app-exited-file", c.flagAppExitedFile,
+		"envoy-admin-addr", c.flagEnvoyAdminAddrs,
+		"logout-on-app-exit", c.flagLogoutOnAppExit,
 	)
 
 	// signalCtx that we pass in to the main work loop, signal handling is handled in another thread
@@ -193,7 +226,23 @@ func (c *Command) Run(args []string) int {
 		}()
 	}
 
-	// Block and wait for a signal or for the metrics server to exit.
+	// If enabled, stop the Envoy sidecars once the application exits so that
+	// the pods of Jobs can complete.
+	appExitCh := make(chan struct{})
+	if c.flagStopOnAppExit {
+		go func() {
+			if c.waitForAppExit(signalCtx) {
+				c.logger.Info("Application has exited, stopping Envoy.")
+				c.quitEnvoy()
+				if c.flagLogoutOnAppExit {
+					c.logout()
+				}
+				close(appExitCh)
+			}
+		}()
+	}
+
+	// Block and wait for a signal, for the metrics server to exit or for the application to exit.
 	select {
 	case <-signalCtx.Done():
 		// After the signal is received, wait for the merged metrics server
@@ -207,6 +256,14 @@ func (c *Command) Run(args []string) int {
 	case err := <-srvExitCh:
 		c.logger.Error(fmt.Sprintf("Metrics server error: %v", err))
 		return 1
+	case <-appExitCh:
+		// Stop the service registration loop and the merged metrics server.
+		cancelFunc()
+		if c.flagEnableMetricsMerging {
+			c.logger.Info("Attempting to shut down metrics server.")
+			c.shutdownMetricsServer(server)
+		}
+		return 0
 	}
 
 }
@@ -295,9 +352,19 @@ func (c *Command) mergedMetricsHandler(rw http.ResponseWriter, _ *http.Request)
 
 // validateFlags validates the flags.
 func (c *Command) validateFlags() error {
-	if !c.flagEnableServiceRegistration && !c.flagEnableMetricsMerging {
-		return errors.New("at least one of -enable-service-registration or -enable-metrics-merging must be true")
+	if !c.flagEnableServiceRegistration && !c.flagEnableMetricsMerging && !c.flagStopOnAppExit {
+		return errors.New("at least one of -enable-service-registration, -enable-metrics-merging or -stop-on-app-exit must be true")
 	}
+
+	if c.flagLogoutOnAppExit {
+		if !c.flagStopOnAppExit {
+			return errors.New("-logout-on-app-exit requires -stop-on-app-exit")
+		}
+		if c.http.TokenFile() == "" {
+			return errors.New("-logout-on-app-exit requires -token-file")
+		}
+	}
+
 	if c.flagEnableServiceRegistration {
 		if c.flagSyncPeriod == 0 {
 			// if sync period is 0, then the select loop will
@@ -356,6 +423,7 @@ const help = `
 Usage: consul-k8s consul-sidecar [options]
 
   Run as a sidecar to your Connect service. Ensures that your service
-  is registered with the local Consul client.
+  is registered with the local Consul client, serves merged metrics
+  and stops the Envoy sidecars when your service exits.
 
 `
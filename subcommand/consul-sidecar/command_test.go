@@ -342,7 +342,23 @@ func TestRun_FlagValidation(t *testing.T) {
 				"-enable-service-registration=false",
 				"-enable-metrics-merging=false",
 			},
-			ExpErr: " at least one of -enable-service-registration or -enable-metrics-merging must be true",
+			ExpErr: " at least one of -enable-service-registration, -enable-metrics-merging or -stop-on-app-exit must be true",
+		},
+		{
+			Flags: []string{
+				"-enable-service-registration=false",
+				"-enable-metrics-merging=true",
+				"-logout-on-app-exit=true",
+			},
+			ExpErr: "-logout-on-app-exit requires -stop-on-app-exit",
+		},
+		{
+			Flags: []string{
+				"-enable-service-registration=false",
+				"-stop-on-app-exit=true",
+				"-logout-on-app-exit=true",
+			},
+			ExpErr: "-logout-on-app-exit requires -token-file",
 		},
 	}
 
@@ -0,0 +1,201 @@
+package envoylifecycle
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul-k8s/subcommand/common"
+	"github.com/hashicorp/consul-k8s/subcommand/flags"
+	"github.com/hashicorp/go-hclog"
+	"github.com/mitchellh/cli"
+)
+
+const (
+	hookPostStart = "post-start"
+	hookPreStop   = "pre-stop"
+
+	// adminRequestTimeout is the timeout of a single request to Envoy's admin API.
+	adminRequestTimeout = 2 * time.Second
+)
+
+type Command struct {
+	UI cli.Ui
+
+	flagHook                string        // Lifecycle hook to run, either post-start or pre-stop
+	flagAdminAddr           string        // Address of Envoy's admin API
+	flagStartupTimeout      time.Duration // How long post-start waits for Envoy to be ready
+	flagShutdownGracePeriod time.Duration // How long pre-stop waits after draining Envoy
+	flagLogLevel            string
+
+	http    *flags.HTTPFlags
+	flagSet *flag.FlagSet
+
+	// retryInterval is the time between checks of Envoy's readiness. It's a
+	// field so that tests can shorten it.
+	retryInterval time.Duration
+
+	logger hclog.Logger
+	once   sync.Once
+	help   string
+}
+
+func (c *Command) init() {
+	c.flagSet = flag.NewFlagSet("", flag.ContinueOnError)
+	c.flagSet.StringVar(&c.flagHook, "hook", "",
+		fmt.Sprintf("Lifecycle hook of the Envoy container to run. Either %q or %q.", hookPostStart, hookPreStop))
+	c.flagSet.StringVar(&c.flagAdminAddr, "admin-addr", "127.0.0.1:19000",
+		"Address of Envoy's admin API.")
+	c.flagSet.DurationVar(&c.flagStartupTimeout, "startup-timeout", 2*time.Minute,
+		"How long the post-start hook waits for Envoy to be ready before failing.")
+	c.flagSet.DurationVar(&c.flagShutdownGracePeriod, "shutdown-grace-period", 30*time.Second,
+		"How long the pre-stop hook keeps Envoy running after its listeners have been drained.")
+	c.flagSet.StringVar(&c.flagLogLevel, "log-level", "info",
+		"Log verbosity level. Supported values (in order of detail) are \"trace\", "+
+			"\"debug\", \"info\", \"warn\", and \"error\".")
+	c.http = &flags.HTTPFlags{}
+	flags.Merge(c.flagSet, c.http.Flags())
+	c.help = flags.Usage(help, c.flagSet)
+
+	if c.retryInterval == 0 {
+		c.retryInterval = 1 * time.Second
+	}
+}
+
+// Run runs a lifecycle hook of the injected Envoy sidecar. The post-start hook
+// blocks until Envoy is ready, which holds the start of the application containers
+// that come after it in the pod. The pre-stop hook gracefully drains Envoy's
+// inbound listeners and waits for the shutdown grace period so that in-flight
+// requests can complete before Envoy is terminated. If -token-file is set, it
+// logs out of Consul before waiting so that the ACL token the pod logged in for
+// is deleted.
+func (c *Command) Run(args []string) int {
+	c.once.Do(c.init)
+	if err := c.flagSet.Parse(args); err != nil {
+		return 1
+	}
+	if len(c.flagSet.Args()) > 0 {
+		c.UI.Error("Invalid arguments: should have no non-flag arguments")
+		return 1
+	}
+	if c.flagHook != hookPostStart && c.flagHook != hookPreStop {
+		c.UI.Error(fmt.Sprintf("-hook must be one of %q or %q", hookPostStart, hookPreStop))
+		return 1
+	}
+	if c.flagAdminAddr == "" {
+		c.UI.Error("-admin-addr must be set")
+		return 1
+	}
+
+	var err error
+	c.logger, err = common.Logger(c.flagLogLevel)
+	if err != nil {
+		c.UI.Error(err.Error())
+		return 1
+	}
+
+	client := &http.Client{Timeout: adminRequestTimeout}
+	if c.flagHook == hookPostStart {
+		if err := c.waitForEnvoy(client); err != nil {
+			c.logger.Error(err.Error())
+			return 1
+		}
+		c.logger.Info("Envoy is ready")
+		return 0
+	}
+
+	// Draining is best effort. Envoy is about to be stopped either way, so
+	// errors are logged and the grace period is still honored.
+	if err := c.drainEnvoy(client); err != nil {
+		c.logger.Error("unable to drain Envoy listeners", "error", err)
+	} else {
+		c.logger.Info("Envoy listeners draining", "shutdown-grace-period", c.flagShutdownGracePeriod)
+	}
+
+	// Log out before the grace period, since the kubelet kills the container once the pod's
+	// termination grace period is over and the token would be left behind. Envoy keeps serving
+	// with the configuration it already has if its xDS stream is closed once the token is deleted.
+	// Failing to log out doesn't hold the shutdown.
+	if c.http.TokenFile() != "" {
+		if err := c.logout(); err != nil {
+			c.logger.Error("unable to log out of Consul", "error", err)
+		} else {
+			c.logger.Info("Logged out of Consul")
+		}
+	}
+	time.Sleep(c.flagShutdownGracePeriod)
+	return 0
+}
+
+// logout destroys the ACL token in the token file, which was created by logging in with
+// an auth method.
+func (c *Command) logout() error {
+	consulClient, err := c.http.APIClient()
+	if err != nil {
+		return err
+	}
+	_, err = consulClient.ACL().Logout(nil)
+	return err
+}
+
+// waitForEnvoy polls Envoy's ready endpoint until it returns 200, which means
+// Envoy has received its initial configuration and its listeners are up.
+func (c *Command) waitForEnvoy(client *http.Client) error {
+	url := fmt.Sprintf("http://%s/ready", c.flagAdminAddr)
+	deadline := time.Now().Add(c.flagStartupTimeout)
+	for {
+		resp, err := client.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+			c.logger.Info("Envoy is not ready yet", "status", resp.StatusCode)
+		} else {
+			c.logger.Info("Envoy is not ready yet", "error", err)
+		}
+		if time.Now().Add(c.retryInterval).After(deadline) {
+			return fmt.Errorf("timed out after %s waiting for Envoy to be ready", c.flagStartupTimeout)
+		}
+		time.Sleep(c.retryInterval)
+	}
+}
+
+// drainEnvoy gracefully drains Envoy's inbound listeners. New inbound connections
+// are refused while existing ones are allowed to complete. Outbound listeners
+// are left alone so that the application can still reach its upstreams while it
+// shuts down.
+func (c *Command) drainEnvoy(client *http.Client) error {
+	url := fmt.Sprintf("http://%s/drain_listeners?graceful&inboundonly", c.flagAdminAddr)
+	resp, err := client.Post(url, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected response code %d: %s", resp.StatusCode, body)
+	}
+	return nil
+}
+
+func (c *Command) Synopsis() string { return synopsis }
+func (c *Command) Help() string {
+	c.once.Do(c.init)
+	return c.help
+}
+
+const synopsis = "Run lifecycle hooks of the Envoy sidecar."
+const help = `
+Usage: consul-k8s envoy-lifecycle [options]
+
+  Run the post-start or pre-stop hook of the injected Envoy sidecar. The
+  post-start hook waits until Envoy is ready. The pre-stop hook drains
+  Envoy's inbound listeners, logs out of Consul if -token-file is set, and
+  waits for the shutdown grace period.
+  Not intended for stand-alone use.
+
+`
@@ -0,0 +1,164 @@
+package envoylifecycle
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/cli"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun_FlagValidation(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		flags  []string
+		expErr string
+	}{
+		{
+			flags:  []string{},
+			expErr: `-hook must be one of "post-start" or "pre-stop"`,
+		},
+		{
+			flags:  []string{"-hook", "start"},
+			expErr: `-hook must be one of "post-start" or "pre-stop"`,
+		},
+		{
+			flags:  []string{"-hook", "post-start", "-admin-addr", ""},
+			expErr: "-admin-addr must be set",
+		},
+		{
+			flags:  []string{"-hook", "post-start", "-log-level", "invalid"},
+			expErr: "unknown log level: invalid",
+		},
+		{
+			flags:  []string{"-hook", "post-start", "foo"},
+			expErr: "Invalid arguments: should have no non-flag arguments",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.expErr, func(t *testing.T) {
+			ui := cli.NewMockUi()
+			cmd := Command{UI: ui}
+			code := cmd.Run(c.flags)
+			require.Equal(t, 1, code)
+			require.Contains(t, ui.ErrorWriter.String(), c.expErr)
+		})
+	}
+}
+
+// Test that the post-start hook waits until Envoy is ready.
+func TestRun_PostStart(t *testing.T) {
+	t.Parallel()
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/ready", r.URL.Path)
+		// Envoy is ready on the third request.
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	ui := cli.NewMockUi()
+	cmd := Command{UI: ui, retryInterval: 10 * time.Millisecond}
+	code := cmd.Run([]string{"-hook", "post-start", "-admin-addr", strings.TrimPrefix(server.URL, "http://")})
+	require.Equal(t, 0, code, ui.ErrorWriter.String())
+	require.Equal(t, int32(3), atomic.LoadInt32(&requests))
+}
+
+// Test that the post-start hook fails if Envoy isn't ready before the timeout.
+func TestRun_PostStartTimeout(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	ui := cli.NewMockUi()
+	cmd := Command{UI: ui, retryInterval: 10 * time.Millisecond}
+	code := cmd.Run([]string{"-hook", "post-start", "-admin-addr", strings.TrimPrefix(server.URL, "http://"),
+		"-startup-timeout", "100ms"})
+	require.Equal(t, 1, code)
+}
+
+// Test that the pre-stop hook drains Envoy's inbound listeners and waits for the
+// shutdown grace period.
+func TestRun_PreStop(t *testing.T) {
+	t.Parallel()
+	var drained int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "/drain_listeners", r.URL.Path)
+		require.Contains(t, r.URL.Query(), "graceful")
+		require.Contains(t, r.URL.Query(), "inboundonly")
+		atomic.StoreInt32(&drained, 1)
+	}))
+	defer server.Close()
+
+	ui := cli.NewMockUi()
+	cmd := Command{UI: ui}
+	start := time.Now()
+	code := cmd.Run([]string{"-hook", "pre-stop", "-admin-addr", strings.TrimPrefix(server.URL, "http://"),
+		"-shutdown-grace-period", "200ms"})
+	require.Equal(t, 0, code, ui.ErrorWriter.String())
+	require.Equal(t, int32(1), atomic.LoadInt32(&drained))
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(200*time.Millisecond))
+}
+
+// Test that the pre-stop hook still waits for the shutdown grace period and
+// succeeds when Envoy can't be drained.
+func TestRun_PreStopDrainError(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	ui := cli.NewMockUi()
+	cmd := Command{UI: ui}
+	start := time.Now()
+	code := cmd.Run([]string{"-hook", "pre-stop", "-admin-addr", strings.TrimPrefix(server.URL, "http://"),
+		"-shutdown-grace-period", "200ms"})
+	require.Equal(t, 0, code, ui.ErrorWriter.String())
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(200*time.Millisecond))
+}
+
+// Test that the pre-stop hook logs out of Consul with the token in the token file before the
+// shutdown grace period, so that the token isn't left behind if the container is killed during
+// the grace period.
+func TestRun_PreStopLogout(t *testing.T) {
+	t.Parallel()
+	var loggedOut, loggedOutAfter atomic.Value
+	start := time.Now()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/acl/logout" {
+			require.Equal(t, http.MethodPost, r.Method)
+			loggedOut.Store(r.Header.Get("X-Consul-Token"))
+			loggedOutAfter.Store(time.Since(start))
+		}
+	}))
+	defer server.Close()
+
+	tokenFile, err := ioutil.TempFile("", "")
+	require.NoError(t, err)
+	defer os.Remove(tokenFile.Name())
+	_, err = tokenFile.WriteString("b78d37c7-0ca7-5f4d-99ee-6d9975ce4586\n")
+	require.NoError(t, err)
+
+	ui := cli.NewMockUi()
+	cmd := Command{UI: ui}
+	code := cmd.Run([]string{"-hook", "pre-stop", "-admin-addr", strings.TrimPrefix(server.URL, "http://"),
+		"-shutdown-grace-period", "1s", "-http-addr", server.URL, "-token-file", tokenFile.Name()})
+	require.Equal(t, 0, code, ui.ErrorWriter.String())
+	require.Equal(t, "b78d37c7-0ca7-5f4d-99ee-6d9975ce4586", loggedOut.Load())
+	require.Less(t, int64(loggedOutAfter.Load().(time.Duration)), int64(time.Second))
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(time.Second))
+}
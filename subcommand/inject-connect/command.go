@@ -2,6 +2,7 @@ package connectinject
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -11,7 +12,9 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/hashicorp/consul-k8s/api/v1alpha1"
 	connectinject "github.com/hashicorp/consul-k8s/connect-inject"
 	"github.com/hashicorp/consul-k8s/consul"
 	"github.com/hashicorp/consul-k8s/subcommand/common"
@@ -19,6 +22,7 @@ import (
 	"github.com/hashicorp/consul/api"
 	"github.com/mitchellh/cli"
 	"go.uber.org/zap/zapcore"
+	"golang.org/x/time/rate"
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
@@ -59,6 +63,9 @@ type Command struct {
 	flagK8SNSMirroringPrefix       string // Prefix added to Consul namespaces created when mirroring
 	flagCrossNamespaceACLPolicy    string // The name of the ACL policy to add to every created namespace if ACLs are enabled
 
+	// Flags for ProxyInjectionPolicy resources.
+	flagEnableProxyInjectionPolicies bool
+
 	// Flags for endpoints controller.
 	flagReleaseName      string
 	flagReleaseNamespace string
@@ -76,6 +83,16 @@ type Command struct {
 	flagDefaultPrometheusScrapePort string
 	flagDefaultPrometheusScrapePath string
 
+	// Envoy sidecar lifecycle settings.
+	flagDefaultEnableSidecarProxyLifecycle                     bool
+	flagDefaultSidecarProxyLifecycleShutdownGracePeriodSeconds int
+
+	// Envoy sidecar public listener settings.
+	flagDefaultSidecarProxyPublicListenerPort             int
+	flagDefaultSidecarProxyCheckInterval                  time.Duration
+	flagDefaultSidecarProxyCheckTimeout                   time.Duration
+	flagDefaultSidecarProxyDeregisterCriticalServiceAfter time.Duration
+
 	// Consul sidecar resource settings.
 	flagConsulSidecarCPULimit      string
 	flagConsulSidecarCPURequest    string
@@ -92,6 +109,25 @@ type Command struct {
 	flagDefaultEnableTransparentProxy          bool
 	flagTransparentProxyDefaultOverwriteProbes bool
 
+	flagDefaultEnableProbeChecks bool
+
+	flagEnableEndpointSlices bool
+
+	flagEnableRegistrationReadinessGate bool
+
+	flagEnableServicelessPodRegistration bool
+
+	flagEnableServiceDefaultsProtocol bool
+
+	flagDeregistrationDrainDelay time.Duration
+
+	// Orphan sweeper flags.
+	flagOrphanSweepInterval  time.Duration
+	flagOrphanSweepRateLimit float64
+	flagOrphanSweepDryRun    bool
+
+	flagACLTokenCleanupInterval time.Duration
+
 	flagEnableOpenShift bool
 
 	flagSet *flag.FlagSet
@@ -113,120 +149,163 @@ var (
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 	utilruntime.Must(batchv1.AddToScheme(scheme))
+	utilruntime.Must(v1alpha1.AddToScheme(scheme))
 	//+kubebuilder:scaffold:scheme
 }
 
 func (c *Command) init() {
 	c.flagSet = flag.NewFlagSet("", flag.ContinueOnError)
 	c.flagSet.StringVar(&c.flagListen, "listen", ":8080", "Address to bind listener to.")
-	c.flagSet.BoolVar(&c.flagDefaultInject, "default-inject", true, "Inject by default.")
 	c.flagSet.StringVar(&c.flagCertDir, "tls-cert-dir", "",
 		"Directory with PEM-encoded TLS certificate and key to serve.")
-	c.flagSet.StringVar(&c.flagConsulImage, "consul-image", "",
-		"Docker image for Consul.")
-	c.flagSet.StringVar(&c.flagEnvoyImage, "envoy-image", "",
-		"Docker image for Envoy.")
-	c.flagSet.StringVar(&c.flagConsulK8sImage, "consul-k8s-image", "",
-		"Docker image for consul-k8s. Used for the connect sidecar.")
-	c.flagSet.StringVar(&c.flagEnvoyExtraArgs, "envoy-extra-args", "",
-		"Extra envoy command line args to be set when starting envoy (e.g \"--log-level debug --disable-hot-restart\").")
-	c.flagSet.StringVar(&c.flagACLAuthMethod, "acl-auth-method", "",
-		"The name of the Kubernetes Auth Method to use for connectInjection if ACLs are enabled.")
 	c.flagSet.BoolVar(&c.flagWriteServiceDefaults, "enable-central-config", false,
 		"Write a service-defaults config for every Connect service using protocol from -default-protocol or Pod annotation.")
 	c.flagSet.StringVar(&c.flagDefaultProtocol, "default-protocol", "",
 		"The default protocol to use in central config registrations.")
 	c.flagSet.StringVar(&c.flagConsulCACert, "consul-ca-cert", "",
 		"[Deprecated] Please use '-ca-file' flag instead. Path to CA certificate to use if communicating with Consul clients over HTTPS.")
-	c.flagSet.Var((*flags.AppendSliceValue)(&c.flagAllowK8sNamespacesList), "allow-k8s-namespace",
-		"K8s namespaces to explicitly allow. May be specified multiple times.")
-	c.flagSet.Var((*flags.AppendSliceValue)(&c.flagDenyK8sNamespacesList), "deny-k8s-namespace",
-		"K8s namespaces to explicitly deny. Takes precedence over allow. May be specified multiple times.")
 	c.flagSet.StringVar(&c.flagReleaseName, "release-name", "consul", "The Consul Helm installation release name, e.g 'helm install <RELEASE-NAME>'")
 	c.flagSet.StringVar(&c.flagReleaseNamespace, "release-namespace", "default", "The Consul Helm installation namespace, e.g 'helm install <RELEASE-NAME> --namespace <RELEASE-NAMESPACE>'")
-	c.flagSet.BoolVar(&c.flagEnableNamespaces, "enable-namespaces", false,
+	c.flagSet.BoolVar(&c.flagEnableProxyInjectionPolicies, "enable-proxy-injection-policies", false,
+		"Default the injection settings of pods from the ProxyInjectionPolicy resources that select them. "+
+			"Requires the ProxyInjectionPolicy CRD to be installed.")
+	c.flagSet.BoolVar(&c.flagDefaultEnableProbeChecks, "default-enable-probe-checks", false,
+		"Register Consul checks for the HTTP and TCP readiness and liveness probes of application containers by default.")
+	c.flagSet.BoolVar(&c.flagEnableEndpointSlices, "enable-endpoint-slices", false,
+		"Register pods with Consul based on the EndpointSlices of Kubernetes services instead of their Endpoints. "+
+			"Requires Kubernetes 1.20+ and permission to list and watch Services and EndpointSlices.")
+	c.flagSet.BoolVar(&c.flagEnableServicelessPodRegistration, "enable-serviceless-pod-registration", false,
+		"Register injected pods that no Kubernetes service selects as the services in their "+
+			"consul.hashicorp.com/connect-service annotation. Requires permission to list and watch Services.")
+	c.flagSet.BoolVar(&c.flagEnableServiceDefaultsProtocol, "enable-service-defaults-protocol", false,
+		"Manage a ServiceDefaults resource for each Kubernetes service that selects injected pods, with the protocol "+
+			"declared by the appProtocol or the http-, http2-, grpc- or tcp- name prefix of its ports. ServiceDefaults "+
+			"written by users are left alone. Requires the ServiceDefaults CRD and the controller that syncs it to Consul, "+
+			"and permission to manage ServiceDefaults and to update services/status.")
+	c.flagSet.DurationVar(&c.flagDeregistrationDrainDelay, "deregistration-drain-delay", 0,
+		"Duration for which service instances of pods that are no longer endpoints of their service are kept registered "+
+			"with a critical health check so that traffic shifts away from them, unless the pod is deleted earlier. "+
+			"Instances are deregistered right away if 0.")
+	c.flagSet.DurationVar(&c.flagOrphanSweepInterval, "orphan-sweep-interval", 0,
+		"Interval at which service instances registered by the endpoints controller are checked against the pods "+
+			"and endpoints in Kubernetes, and deregistered if they no longer match them. Disabled if 0.")
+	c.flagSet.Float64Var(&c.flagOrphanSweepRateLimit, "orphan-sweep-rate-limit", 10,
+		"Maximum number of orphaned service instances deregistered per second.")
+	c.flagSet.BoolVar(&c.flagOrphanSweepDryRun, "orphan-sweep-dry-run", false,
+		"Only log the orphaned service instances instead of deregistering them.")
+	c.flagSet.DurationVar(&c.flagACLTokenCleanupInterval, "acl-token-cleanup-interval", 0,
+		"Interval at which the ACL tokens created by logins with the -acl-auth-method for pods that no longer exist "+
+			"are deleted. Disabled if 0. Requires acl = \"write\" in the ACL policy of the connect injector, which makes "+
+			"the connect injector an ACL administrator, see -enable-inject-acl-token-cleanup of server-acl-init.")
+	c.flagSet.StringVar(&c.flagLogLevel, "log-level", zapcore.InfoLevel.String(),
+		fmt.Sprintf("Log verbosity level. Supported values (in order of detail) are "+
+			"%q, %q, %q, and %q.", zapcore.DebugLevel.String(), zapcore.InfoLevel.String(), zapcore.WarnLevel.String(), zapcore.ErrorLevel.String()))
+	c.initInjectionFlags(c.flagSet)
+
+	c.http = &flags.HTTPFlags{}
+
+	flags.Merge(c.flagSet, c.http.Flags())
+	// flag.CommandLine is a package level variable representing the default flagSet. The init() function in
+	// "sigs.k8s.io/controller-runtime/pkg/client/config", which is imported by ctrl, registers the flag --kubeconfig to
+	// the default flagSet. That's why we need to merge it to have access with our flagSet.
+	flags.Merge(c.flagSet, flag.CommandLine)
+	c.help = flags.Usage(help, c.flagSet)
+}
+
+// initInjectionFlags registers the flags that configure how pods are mutated on the given flag set.
+// They are shared with the inject-preview command so that a preview matches what the webhook does.
+func (c *Command) initInjectionFlags(flagSet *flag.FlagSet) {
+	flagSet.BoolVar(&c.flagDefaultInject, "default-inject", true, "Inject by default.")
+	flagSet.StringVar(&c.flagConsulImage, "consul-image", "",
+		"Docker image for Consul.")
+	flagSet.StringVar(&c.flagEnvoyImage, "envoy-image", "",
+		"Docker image for Envoy.")
+	flagSet.StringVar(&c.flagConsulK8sImage, "consul-k8s-image", "",
+		"Docker image for consul-k8s. Used for the connect sidecar.")
+	flagSet.StringVar(&c.flagEnvoyExtraArgs, "envoy-extra-args", "",
+		"Extra envoy command line args to be set when starting envoy (e.g \"--log-level debug --disable-hot-restart\").")
+	flagSet.StringVar(&c.flagACLAuthMethod, "acl-auth-method", "",
+		"The name of the Kubernetes Auth Method to use for connectInjection if ACLs are enabled.")
+	flagSet.Var((*flags.AppendSliceValue)(&c.flagAllowK8sNamespacesList), "allow-k8s-namespace",
+		"K8s namespaces to explicitly allow. May be specified multiple times.")
+	flagSet.Var((*flags.AppendSliceValue)(&c.flagDenyK8sNamespacesList), "deny-k8s-namespace",
+		"K8s namespaces to explicitly deny. Takes precedence over allow. May be specified multiple times.")
+	flagSet.BoolVar(&c.flagEnableNamespaces, "enable-namespaces", false,
 		"[Enterprise Only] Enables namespaces, in either a single Consul namespace or mirrored.")
-	c.flagSet.StringVar(&c.flagConsulDestinationNamespace, "consul-destination-namespace", "default",
+	flagSet.StringVar(&c.flagConsulDestinationNamespace, "consul-destination-namespace", "default",
 		"[Enterprise Only] Defines which Consul namespace to register all injected services into. If '-enable-k8s-namespace-mirroring' "+
 			"is true, this is not used.")
-	c.flagSet.BoolVar(&c.flagEnableK8SNSMirroring, "enable-k8s-namespace-mirroring", false, "[Enterprise Only] Enables "+
+	flagSet.BoolVar(&c.flagEnableK8SNSMirroring, "enable-k8s-namespace-mirroring", false, "[Enterprise Only] Enables "+
 		"k8s namespace mirroring.")
-	c.flagSet.StringVar(&c.flagK8SNSMirroringPrefix, "k8s-namespace-mirroring-prefix", "",
+	flagSet.StringVar(&c.flagK8SNSMirroringPrefix, "k8s-namespace-mirroring-prefix", "",
 		"[Enterprise Only] Prefix that will be added to all k8s namespaces mirrored into Consul if mirroring is enabled.")
-	c.flagSet.StringVar(&c.flagCrossNamespaceACLPolicy, "consul-cross-namespace-acl-policy", "",
+	flagSet.StringVar(&c.flagCrossNamespaceACLPolicy, "consul-cross-namespace-acl-policy", "",
 		"[Enterprise Only] Name of the ACL policy to attach to all created Consul namespaces to allow service "+
 			"discovery across Consul namespaces. Only necessary if ACLs are enabled.")
-	c.flagSet.BoolVar(&c.flagDefaultEnableTransparentProxy, "default-enable-transparent-proxy", true,
+	flagSet.BoolVar(&c.flagDefaultEnableTransparentProxy, "default-enable-transparent-proxy", true,
 		"Enable transparent proxy mode for all Consul service mesh applications by default.")
-	c.flagSet.BoolVar(&c.flagTransparentProxyDefaultOverwriteProbes, "transparent-proxy-default-overwrite-probes", true,
+	flagSet.BoolVar(&c.flagTransparentProxyDefaultOverwriteProbes, "transparent-proxy-default-overwrite-probes", true,
 		"Overwrite Kubernetes probes to point to Envoy by default when in Transparent Proxy mode.")
-	c.flagSet.BoolVar(&c.flagEnableOpenShift, "enable-openshift", false,
+	flagSet.BoolVar(&c.flagEnableRegistrationReadinessGate, "enable-registration-readiness-gate", false,
+		"Add a readiness gate to injected pods so that they aren't ready until the endpoints controller has registered "+
+			"their services with Consul. Pods must be selected by a Kubernetes service to be registered, "+
+			"unless -enable-serviceless-pod-registration is set.")
+	flagSet.BoolVar(&c.flagEnableOpenShift, "enable-openshift", false,
 		"Indicates that the command runs in an OpenShift cluster.")
-	c.flagSet.StringVar(&c.flagLogLevel, "log-level", zapcore.InfoLevel.String(),
-		fmt.Sprintf("Log verbosity level. Supported values (in order of detail) are "+
-			"%q, %q, %q, and %q.", zapcore.DebugLevel.String(), zapcore.InfoLevel.String(), zapcore.WarnLevel.String(), zapcore.ErrorLevel.String()))
 
 	// Proxy sidecar resource setting flags.
-	c.flagSet.StringVar(&c.flagDefaultSidecarProxyCPURequest, "default-sidecar-proxy-cpu-request", "", "Default sidecar proxy CPU request.")
-	c.flagSet.StringVar(&c.flagDefaultSidecarProxyCPULimit, "default-sidecar-proxy-cpu-limit", "", "Default sidecar proxy CPU limit.")
-	c.flagSet.StringVar(&c.flagDefaultSidecarProxyMemoryRequest, "default-sidecar-proxy-memory-request", "", "Default sidecar proxy memory request.")
-	c.flagSet.StringVar(&c.flagDefaultSidecarProxyMemoryLimit, "default-sidecar-proxy-memory-limit", "", "Default sidecar proxy memory limit.")
+	flagSet.StringVar(&c.flagDefaultSidecarProxyCPURequest, "default-sidecar-proxy-cpu-request", "", "Default sidecar proxy CPU request.")
+	flagSet.StringVar(&c.flagDefaultSidecarProxyCPULimit, "default-sidecar-proxy-cpu-limit", "", "Default sidecar proxy CPU limit.")
+	flagSet.StringVar(&c.flagDefaultSidecarProxyMemoryRequest, "default-sidecar-proxy-memory-request", "", "Default sidecar proxy memory request.")
+	flagSet.StringVar(&c.flagDefaultSidecarProxyMemoryLimit, "default-sidecar-proxy-memory-limit", "", "Default sidecar proxy memory limit.")
 
 	// Metrics setting flags.
-	c.flagSet.BoolVar(&c.flagDefaultEnableMetrics, "default-enable-metrics", false, "Default for enabling connect service metrics.")
-	c.flagSet.BoolVar(&c.flagDefaultEnableMetricsMerging, "default-enable-metrics-merging", false, "Default for enabling merging of connect service metrics and envoy proxy metrics.")
-	c.flagSet.StringVar(&c.flagDefaultMergedMetricsPort, "default-merged-metrics-port", "20100", "Default port for merged metrics endpoint on the consul-sidecar.")
-	c.flagSet.StringVar(&c.flagDefaultPrometheusScrapePort, "default-prometheus-scrape-port", "20200", "Default port where Prometheus scrapes connect metrics from.")
-	c.flagSet.StringVar(&c.flagDefaultPrometheusScrapePath, "default-prometheus-scrape-path", "/metrics", "Default path where Prometheus scrapes connect metrics from.")
+	flagSet.BoolVar(&c.flagDefaultEnableMetrics, "default-enable-metrics", false, "Default for enabling connect service metrics.")
+	flagSet.BoolVar(&c.flagDefaultEnableMetricsMerging, "default-enable-metrics-merging", false, "Default for enabling merging of connect service metrics and envoy proxy metrics.")
+	flagSet.StringVar(&c.flagDefaultMergedMetricsPort, "default-merged-metrics-port", "20100", "Default port for merged metrics endpoint on the consul-sidecar.")
+	flagSet.StringVar(&c.flagDefaultPrometheusScrapePort, "default-prometheus-scrape-port", "20200", "Default port where Prometheus scrapes connect metrics from.")
+	flagSet.StringVar(&c.flagDefaultPrometheusScrapePath, "default-prometheus-scrape-path", "/metrics", "Default path where Prometheus scrapes connect metrics from.")
+
+	// Envoy sidecar lifecycle flags.
+	flagSet.BoolVar(&c.flagDefaultEnableSidecarProxyLifecycle, "default-enable-sidecar-proxy-lifecycle", false,
+		"Default for holding the start of application containers until the Envoy sidecar is ready and draining the Envoy sidecar on termination.")
+	flagSet.IntVar(&c.flagDefaultSidecarProxyLifecycleShutdownGracePeriodSeconds, "default-sidecar-proxy-lifecycle-shutdown-grace-period-seconds", 30,
+		"Default number of seconds the Envoy sidecar keeps running after its listeners have been drained on termination.")
+
+	// Envoy sidecar public listener flags.
+	flagSet.IntVar(&c.flagDefaultSidecarProxyPublicListenerPort, "default-sidecar-proxy-public-listener-port", 20000,
+		"Default port of the public listener of the Envoy sidecar. Multi-port pods offset it by the index of each service.")
+	flagSet.DurationVar(&c.flagDefaultSidecarProxyCheckInterval, "default-sidecar-proxy-check-interval", 10*time.Second,
+		"Default interval of the Consul check of the public listener of the Envoy sidecar.")
+	flagSet.DurationVar(&c.flagDefaultSidecarProxyCheckTimeout, "default-sidecar-proxy-check-timeout", 0,
+		"Default timeout of the Consul check of the public listener of the Envoy sidecar. If zero, Consul's default is used.")
+	flagSet.DurationVar(&c.flagDefaultSidecarProxyDeregisterCriticalServiceAfter, "default-sidecar-proxy-deregister-critical-service-after", 10*time.Minute,
+		"Default duration the Consul check of the public listener of the Envoy sidecar can be critical before Consul deregisters the proxy.")
 
 	// Init container resource setting flags.
-	c.flagSet.StringVar(&c.flagInitContainerCPURequest, "init-container-cpu-request", "50m", "Init container CPU request.")
-	c.flagSet.StringVar(&c.flagInitContainerCPULimit, "init-container-cpu-limit", "50m", "Init container CPU limit.")
-	c.flagSet.StringVar(&c.flagInitContainerMemoryRequest, "init-container-memory-request", "25Mi", "Init container memory request.")
-	c.flagSet.StringVar(&c.flagInitContainerMemoryLimit, "init-container-memory-limit", "150Mi", "Init container memory limit.")
+	flagSet.StringVar(&c.flagInitContainerCPURequest, "init-container-cpu-request", "50m", "Init container CPU request.")
+	flagSet.StringVar(&c.flagInitContainerCPULimit, "init-container-cpu-limit", "50m", "Init container CPU limit.")
+	flagSet.StringVar(&c.flagInitContainerMemoryRequest, "init-container-memory-request", "25Mi", "Init container memory request.")
+	flagSet.StringVar(&c.flagInitContainerMemoryLimit, "init-container-memory-limit", "150Mi", "Init container memory limit.")
 
 	// Consul sidecar resource setting flags.
-	c.flagSet.StringVar(&c.flagConsulSidecarCPURequest, "consul-sidecar-cpu-request", "20m", "Consul sidecar CPU request.")
-	c.flagSet.StringVar(&c.flagConsulSidecarCPULimit, "consul-sidecar-cpu-limit", "20m", "Consul sidecar CPU limit.")
-	c.flagSet.StringVar(&c.flagConsulSidecarMemoryRequest, "consul-sidecar-memory-request", "25Mi", "Consul sidecar memory request.")
-	c.flagSet.StringVar(&c.flagConsulSidecarMemoryLimit, "consul-sidecar-memory-limit", "50Mi", "Consul sidecar memory limit.")
-
-	c.http = &flags.HTTPFlags{}
-
-	flags.Merge(c.flagSet, c.http.Flags())
-	// flag.CommandLine is a package level variable representing the default flagSet. The init() function in
-	// "sigs.k8s.io/controller-runtime/pkg/client/config", which is imported by ctrl, registers the flag --kubeconfig to
-	// the default flagSet. That's why we need to merge it to have access with our flagSet.
-	flags.Merge(c.flagSet, flag.CommandLine)
-	c.help = flags.Usage(help, c.flagSet)
+	flagSet.StringVar(&c.flagConsulSidecarCPURequest, "consul-sidecar-cpu-request", "20m", "Consul sidecar CPU request.")
+	flagSet.StringVar(&c.flagConsulSidecarCPULimit, "consul-sidecar-cpu-limit", "20m", "Consul sidecar CPU limit.")
+	flagSet.StringVar(&c.flagConsulSidecarMemoryRequest, "consul-sidecar-memory-request", "25Mi", "Consul sidecar memory request.")
+	flagSet.StringVar(&c.flagConsulSidecarMemoryLimit, "consul-sidecar-memory-limit", "50Mi", "Consul sidecar memory limit.")
 }
 
-func (c *Command) Run(args []string) int {
-	c.once.Do(c.init)
-	if err := c.flagSet.Parse(args); err != nil {
-		return 1
-	}
-
-	// Validate flags.
+// injectionHandler validates the injection flags and returns the webhook handler configured from them.
+// The Kubernetes and Consul clients, the Consul CA certificate and the logger are left for the caller to set.
+func (c *Command) injectionHandler() (connectinject.Handler, error) {
 	if c.flagConsulK8sImage == "" {
-		c.UI.Error("-consul-k8s-image must be set")
-		return 1
+		return connectinject.Handler{}, errors.New("-consul-k8s-image must be set")
 	}
 	if c.flagConsulImage == "" {
-		c.UI.Error("-consul-image must be set")
-		return 1
+		return connectinject.Handler{}, errors.New("-consul-image must be set")
 	}
 	if c.flagEnvoyImage == "" {
-		c.UI.Error("-envoy-image must be set")
-		return 1
-	}
-	if c.flagWriteServiceDefaults {
-		c.UI.Error("-enable-central-config is no longer supported")
-		return 1
-	}
-	if c.flagDefaultProtocol != "" {
-		c.UI.Error("-default-protocol is no longer supported")
-		return 1
+		return connectinject.Handler{}, errors.New("-envoy-image must be set")
 	}
 
 	// Proxy resources
@@ -235,59 +314,150 @@ func (c *Command) Run(args []string) int {
 	if c.flagDefaultSidecarProxyCPURequest != "" {
 		sidecarProxyCPURequest, err = resource.ParseQuantity(c.flagDefaultSidecarProxyCPURequest)
 		if err != nil {
-			c.UI.Error(fmt.Sprintf("-default-sidecar-proxy-cpu-request is invalid: %s", err))
-			return 1
+			return connectinject.Handler{}, fmt.Errorf("-default-sidecar-proxy-cpu-request is invalid: %s", err)
 		}
 	}
 	if c.flagDefaultSidecarProxyCPULimit != "" {
 		sidecarProxyCPULimit, err = resource.ParseQuantity(c.flagDefaultSidecarProxyCPULimit)
 		if err != nil {
-			c.UI.Error(fmt.Sprintf("-default-sidecar-proxy-cpu-limit is invalid: %s", err))
-			return 1
+			return connectinject.Handler{}, fmt.Errorf("-default-sidecar-proxy-cpu-limit is invalid: %s", err)
 		}
 	}
 	if sidecarProxyCPULimit.Value() != 0 && sidecarProxyCPURequest.Cmp(sidecarProxyCPULimit) > 0 {
-		c.UI.Error(fmt.Sprintf(
+		return connectinject.Handler{}, fmt.Errorf(
 			"request must be <= limit: -default-sidecar-proxy-cpu-request value of %q is greater than the -default-sidecar-proxy-cpu-limit value of %q",
-			c.flagDefaultSidecarProxyCPURequest, c.flagDefaultSidecarProxyCPULimit))
-		return 1
+			c.flagDefaultSidecarProxyCPURequest, c.flagDefaultSidecarProxyCPULimit)
 	}
 
 	if c.flagDefaultSidecarProxyMemoryRequest != "" {
 		sidecarProxyMemoryRequest, err = resource.ParseQuantity(c.flagDefaultSidecarProxyMemoryRequest)
 		if err != nil {
-			c.UI.Error(fmt.Sprintf("-default-sidecar-proxy-memory-request is invalid: %s", err))
-			return 1
+			return connectinject.Handler{}, fmt.Errorf("-default-sidecar-proxy-memory-request is invalid: %s", err)
 		}
 	}
 	if c.flagDefaultSidecarProxyMemoryLimit != "" {
 		sidecarProxyMemoryLimit, err = resource.ParseQuantity(c.flagDefaultSidecarProxyMemoryLimit)
 		if err != nil {
-			c.UI.Error(fmt.Sprintf("-default-sidecar-proxy-memory-limit is invalid: %s", err))
-			return 1
+			return connectinject.Handler{}, fmt.Errorf("-default-sidecar-proxy-memory-limit is invalid: %s", err)
 		}
 	}
 	if sidecarProxyMemoryLimit.Value() != 0 && sidecarProxyMemoryRequest.Cmp(sidecarProxyMemoryLimit) > 0 {
-		c.UI.Error(fmt.Sprintf(
+		return connectinject.Handler{}, fmt.Errorf(
 			"request must be <= limit: -default-sidecar-proxy-memory-request value of %q is greater than the -default-sidecar-proxy-memory-limit value of %q",
-			c.flagDefaultSidecarProxyMemoryRequest, c.flagDefaultSidecarProxyMemoryLimit))
-		return 1
+			c.flagDefaultSidecarProxyMemoryRequest, c.flagDefaultSidecarProxyMemoryLimit)
 	}
 
 	// Validate ports in metrics flags
 	err = common.ValidateUnprivilegedPort("-default-merged-metrics-port", c.flagDefaultMergedMetricsPort)
 	if err != nil {
-		c.UI.Error(err.Error())
-		return 1
+		return connectinject.Handler{}, err
 	}
 	err = common.ValidateUnprivilegedPort("-default-prometheus-scrape-port", c.flagDefaultPrometheusScrapePort)
 	if err != nil {
-		c.UI.Error(err.Error())
-		return 1
+		return connectinject.Handler{}, err
+	}
+
+	if c.flagDefaultSidecarProxyLifecycleShutdownGracePeriodSeconds < 0 {
+		return connectinject.Handler{}, fmt.Errorf("-default-sidecar-proxy-lifecycle-shutdown-grace-period-seconds must be non-negative, was %d",
+			c.flagDefaultSidecarProxyLifecycleShutdownGracePeriodSeconds)
+	}
+
+	if c.flagDefaultSidecarProxyPublicListenerPort < 1 || c.flagDefaultSidecarProxyPublicListenerPort > 65535 {
+		return connectinject.Handler{}, fmt.Errorf("-default-sidecar-proxy-public-listener-port must be in the range 1-65535, was %d",
+			c.flagDefaultSidecarProxyPublicListenerPort)
+	}
+	if c.flagDefaultSidecarProxyCheckInterval <= 0 {
+		return connectinject.Handler{}, fmt.Errorf("-default-sidecar-proxy-check-interval must be positive, was %s",
+			c.flagDefaultSidecarProxyCheckInterval)
+	}
+	if c.flagDefaultSidecarProxyCheckTimeout < 0 {
+		return connectinject.Handler{}, fmt.Errorf("-default-sidecar-proxy-check-timeout must be non-negative, was %s",
+			c.flagDefaultSidecarProxyCheckTimeout)
+	}
+	if c.flagDefaultSidecarProxyDeregisterCriticalServiceAfter <= 0 {
+		return connectinject.Handler{}, fmt.Errorf("-default-sidecar-proxy-deregister-critical-service-after must be positive, was %s",
+			c.flagDefaultSidecarProxyDeregisterCriticalServiceAfter)
 	}
 
 	// Validate resource request/limit flags and parse into corev1.ResourceRequirements
 	initResources, consulSidecarResources, err := c.parseAndValidateResourceFlags()
+	if err != nil {
+		return connectinject.Handler{}, err
+	}
+
+	return connectinject.Handler{
+		ImageConsul:               c.flagConsulImage,
+		ImageEnvoy:                c.flagEnvoyImage,
+		EnvoyExtraArgs:            c.flagEnvoyExtraArgs,
+		ImageConsulK8S:            c.flagConsulK8sImage,
+		RequireAnnotation:         !c.flagDefaultInject,
+		AuthMethod:                c.flagACLAuthMethod,
+		DefaultProxyCPURequest:    sidecarProxyCPURequest,
+		DefaultProxyCPULimit:      sidecarProxyCPULimit,
+		DefaultProxyMemoryRequest: sidecarProxyMemoryRequest,
+		DefaultProxyMemoryLimit:   sidecarProxyMemoryLimit,
+		MetricsConfig: connectinject.MetricsConfig{
+			DefaultEnableMetrics:        c.flagDefaultEnableMetrics,
+			DefaultEnableMetricsMerging: c.flagDefaultEnableMetricsMerging,
+			DefaultMergedMetricsPort:    c.flagDefaultMergedMetricsPort,
+			DefaultPrometheusScrapePort: c.flagDefaultPrometheusScrapePort,
+			DefaultPrometheusScrapePath: c.flagDefaultPrometheusScrapePath,
+		},
+		LifecycleConfig: connectinject.LifecycleConfig{
+			DefaultEnableProxyLifecycle:       c.flagDefaultEnableSidecarProxyLifecycle,
+			DefaultShutdownGracePeriodSeconds: c.flagDefaultSidecarProxyLifecycleShutdownGracePeriodSeconds,
+		},
+		ProxyConfig: connectinject.ProxyConfig{
+			DefaultPublicListenerPort:             c.flagDefaultSidecarProxyPublicListenerPort,
+			DefaultCheckInterval:                  c.flagDefaultSidecarProxyCheckInterval,
+			DefaultCheckTimeout:                   c.flagDefaultSidecarProxyCheckTimeout,
+			DefaultDeregisterCriticalServiceAfter: c.flagDefaultSidecarProxyDeregisterCriticalServiceAfter,
+		},
+		InitContainerResources:          initResources,
+		ConsulSidecarResources:          consulSidecarResources,
+		AllowK8sNamespacesSet:           flags.ToSet(c.flagAllowK8sNamespacesList),
+		DenyK8sNamespacesSet:            flags.ToSet(c.flagDenyK8sNamespacesList),
+		EnableNamespaces:                c.flagEnableNamespaces,
+		ConsulDestinationNamespace:      c.flagConsulDestinationNamespace,
+		EnableK8SNSMirroring:            c.flagEnableK8SNSMirroring,
+		K8SNSMirroringPrefix:            c.flagK8SNSMirroringPrefix,
+		CrossNamespaceACLPolicy:         c.flagCrossNamespaceACLPolicy,
+		EnableTransparentProxy:          c.flagDefaultEnableTransparentProxy,
+		TProxyOverwriteProbes:           c.flagTransparentProxyDefaultOverwriteProbes,
+		EnableRegistrationReadinessGate: c.flagEnableRegistrationReadinessGate,
+		EnableOpenShift:                 c.flagEnableOpenShift,
+	}, nil
+}
+
+func (c *Command) Run(args []string) int {
+	c.once.Do(c.init)
+	if err := c.flagSet.Parse(args); err != nil {
+		return 1
+	}
+
+	if c.flagWriteServiceDefaults {
+		c.UI.Error("-enable-central-config is no longer supported")
+		return 1
+	}
+	if c.flagDefaultProtocol != "" {
+		c.UI.Error("-default-protocol is no longer supported")
+		return 1
+	}
+	if c.flagOrphanSweepInterval > 0 && c.flagOrphanSweepRateLimit <= 0 {
+		c.UI.Error("-orphan-sweep-rate-limit must be greater than 0")
+		return 1
+	}
+	if c.flagACLTokenCleanupInterval < 0 {
+		c.UI.Error("-acl-token-cleanup-interval must be non-negative")
+		return 1
+	}
+	if c.flagDeregistrationDrainDelay < 0 {
+		c.UI.Error("-deregistration-drain-delay must be non-negative")
+		return 1
+	}
+
+	// Validate the injection flags and build the webhook handler from them.
+	handler, err := c.injectionHandler()
 	if err != nil {
 		c.UI.Error(err.Error())
 		return 1
@@ -349,10 +519,6 @@ func (c *Command) Run(args []string) int {
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	defer cancelFunc()
 
-	// Convert allow/deny lists to sets
-	allowK8sNamespaces := flags.ToSet(c.flagAllowK8sNamespacesList)
-	denyK8sNamespaces := flags.ToSet(c.flagDenyK8sNamespacesList)
-
 	var zapLevel zapcore.Level
 	if err := zapLevel.UnmarshalText([]byte(c.flagLogLevel)); err != nil {
 		c.UI.Error(fmt.Sprintf("Error parsing -log-level %q: %s", c.flagLogLevel, err.Error()))
@@ -388,22 +554,15 @@ func (c *Command) Run(args []string) int {
 		return 1
 	}
 
-	metricsConfig := connectinject.MetricsConfig{
-		DefaultEnableMetrics:        c.flagDefaultEnableMetrics,
-		DefaultEnableMetricsMerging: c.flagDefaultEnableMetricsMerging,
-		DefaultMergedMetricsPort:    c.flagDefaultMergedMetricsPort,
-		DefaultPrometheusScrapePort: c.flagDefaultPrometheusScrapePort,
-		DefaultPrometheusScrapePath: c.flagDefaultPrometheusScrapePath,
-	}
-
-	if err = (&connectinject.EndpointsController{
+	endpointsController := &connectinject.EndpointsController{
 		Client:                     mgr.GetClient(),
 		ConsulClient:               c.consulClient,
 		ConsulScheme:               consulURL.Scheme,
 		ConsulPort:                 consulURL.Port(),
-		AllowK8sNamespacesSet:      allowK8sNamespaces,
-		DenyK8sNamespacesSet:       denyK8sNamespaces,
-		MetricsConfig:              metricsConfig,
+		AllowK8sNamespacesSet:      handler.AllowK8sNamespacesSet,
+		DenyK8sNamespacesSet:       handler.DenyK8sNamespacesSet,
+		MetricsConfig:              handler.MetricsConfig,
+		ProxyConfig:                handler.ProxyConfig,
 		ConsulClientCfg:            cfg,
 		EnableConsulNamespaces:     c.flagEnableNamespaces,
 		ConsulDestinationNamespace: c.flagConsulDestinationNamespace,
@@ -412,48 +571,85 @@ func (c *Command) Run(args []string) int {
 		CrossNSACLPolicy:           c.flagCrossNamespaceACLPolicy,
 		EnableTransparentProxy:     c.flagDefaultEnableTransparentProxy,
 		TProxyOverwriteProbes:      c.flagTransparentProxyDefaultOverwriteProbes,
+		EnableProbeChecks:          c.flagDefaultEnableProbeChecks,
+		EnableEndpointSlices:       c.flagEnableEndpointSlices,
+		DeregistrationDrainDelay:   c.flagDeregistrationDrainDelay,
 		Log:                        ctrl.Log.WithName("controller").WithName("endpoints"),
 		Scheme:                     mgr.GetScheme(),
 		ReleaseName:                c.flagReleaseName,
 		ReleaseNamespace:           c.flagReleaseNamespace,
 		Context:                    ctx,
-	}).SetupWithManager(mgr); err != nil {
+	}
+	if err = endpointsController.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", connectinject.EndpointsController{})
 		return 1
 	}
 
+	// Pods opt in to stopping their sidecars when the application exits with an annotation,
+	// so the controller that tells them when it has exited always runs.
+	if err = (&connectinject.AppExitController{
+		Client: mgr.GetClient(),
+		Log:    ctrl.Log.WithName("controller").WithName("app-exit"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", connectinject.AppExitController{})
+		return 1
+	}
+
+	if c.flagEnableServicelessPodRegistration {
+		if err = (&connectinject.ServicelessPodController{
+			Controller: endpointsController,
+			Log:        ctrl.Log.WithName("controller").WithName("serviceless-pod"),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", connectinject.ServicelessPodController{})
+			return 1
+		}
+	}
+
+	if c.flagEnableServiceDefaultsProtocol {
+		if err = (&connectinject.ServiceProtocolController{
+			Controller: endpointsController,
+			Log:        ctrl.Log.WithName("controller").WithName("service-protocol"),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", connectinject.ServiceProtocolController{})
+			return 1
+		}
+	}
+
+	if c.flagOrphanSweepInterval > 0 {
+		if err = mgr.Add(&connectinject.OrphanSweeper{
+			Controller: endpointsController,
+			Interval:   c.flagOrphanSweepInterval,
+			RateLimit:  rate.Limit(c.flagOrphanSweepRateLimit),
+			DryRun:     c.flagOrphanSweepDryRun,
+			Log:        ctrl.Log.WithName("controller").WithName("orphan-sweeper"),
+		}); err != nil {
+			setupLog.Error(err, "unable to add orphan sweeper")
+			return 1
+		}
+	}
+
+	if c.flagACLAuthMethod != "" && c.flagACLTokenCleanupInterval > 0 {
+		if err = mgr.Add(&connectinject.ACLTokenCleaner{
+			Controller: endpointsController,
+			AuthMethod: c.flagACLAuthMethod,
+			Interval:   c.flagACLTokenCleanupInterval,
+			Log:        ctrl.Log.WithName("controller").WithName("acl-token-cleaner"),
+		}); err != nil {
+			setupLog.Error(err, "unable to add ACL token cleaner")
+			return 1
+		}
+	}
+
 	mgr.GetWebhookServer().CertDir = c.flagCertDir
 
-	mgr.GetWebhookServer().Register("/mutate",
-		&webhook.Admission{Handler: &connectinject.Handler{
-			Clientset:                  c.clientset,
-			ConsulClient:               c.consulClient,
-			ImageConsul:                c.flagConsulImage,
-			ImageEnvoy:                 c.flagEnvoyImage,
-			EnvoyExtraArgs:             c.flagEnvoyExtraArgs,
-			ImageConsulK8S:             c.flagConsulK8sImage,
-			RequireAnnotation:          !c.flagDefaultInject,
-			AuthMethod:                 c.flagACLAuthMethod,
-			ConsulCACert:               string(consulCACert),
-			DefaultProxyCPURequest:     sidecarProxyCPURequest,
-			DefaultProxyCPULimit:       sidecarProxyCPULimit,
-			DefaultProxyMemoryRequest:  sidecarProxyMemoryRequest,
-			DefaultProxyMemoryLimit:    sidecarProxyMemoryLimit,
-			MetricsConfig:              metricsConfig,
-			InitContainerResources:     initResources,
-			ConsulSidecarResources:     consulSidecarResources,
-			AllowK8sNamespacesSet:      allowK8sNamespaces,
-			DenyK8sNamespacesSet:       denyK8sNamespaces,
-			EnableNamespaces:           c.flagEnableNamespaces,
-			ConsulDestinationNamespace: c.flagConsulDestinationNamespace,
-			EnableK8SNSMirroring:       c.flagEnableK8SNSMirroring,
-			K8SNSMirroringPrefix:       c.flagK8SNSMirroringPrefix,
-			CrossNamespaceACLPolicy:    c.flagCrossNamespaceACLPolicy,
-			EnableTransparentProxy:     c.flagDefaultEnableTransparentProxy,
-			TProxyOverwriteProbes:      c.flagTransparentProxyDefaultOverwriteProbes,
-			EnableOpenShift:            c.flagEnableOpenShift,
-			Log:                        ctrl.Log.WithName("handler").WithName("connect"),
-		}})
+	handler.Clientset = c.clientset
+	handler.ConsulClient = c.consulClient
+	handler.ConsulCACert = string(consulCACert)
+	handler.Log = ctrl.Log.WithName("handler").WithName("connect")
+	if c.flagEnableProxyInjectionPolicies {
+		handler.ProxyInjectionPolicyClient = mgr.GetClient()
+	}
+	mgr.GetWebhookServer().Register("/mutate", &webhook.Admission{Handler: &handler})
 
 	if err := mgr.Start(ctx); err != nil {
 		setupLog.Error(err, "problem running manager")
@@ -42,6 +42,16 @@ func TestRun_FlagValidation(t *testing.T) {
 				"-default-protocol", "http"},
 			expErr: "-default-protocol is no longer supported",
 		},
+		{
+			flags: []string{"-consul-k8s-image", "foo", "-consul-image", "foo", "-envoy-image", "envoy:1.16.0",
+				"-orphan-sweep-interval", "5m", "-orphan-sweep-rate-limit", "0"},
+			expErr: "-orphan-sweep-rate-limit must be greater than 0",
+		},
+		{
+			flags: []string{"-consul-k8s-image", "foo", "-consul-image", "foo", "-envoy-image", "envoy:1.16.0",
+				"-deregistration-drain-delay", "-5s"},
+			expErr: "-deregistration-drain-delay must be non-negative",
+		},
 		{
 			flags: []string{"-consul-k8s-image", "foo", "-consul-image", "foo", "-envoy-image", "envoy:1.16.0",
 				"-ca-file", "bar"},
@@ -149,6 +159,31 @@ func TestRun_FlagValidation(t *testing.T) {
 			},
 			expErr: "request must be <= limit: -consul-sidecar-cpu-request value of \"50m\" is greater than the -consul-sidecar-cpu-limit value of \"25m\"",
 		},
+		{
+			flags: []string{"-consul-k8s-image", "foo", "-consul-image", "foo", "-envoy-image", "envoy:1.16.0",
+				"-default-sidecar-proxy-lifecycle-shutdown-grace-period-seconds=-1"},
+			expErr: "-default-sidecar-proxy-lifecycle-shutdown-grace-period-seconds must be non-negative, was -1",
+		},
+		{
+			flags: []string{"-consul-k8s-image", "foo", "-consul-image", "foo", "-envoy-image", "envoy:1.16.0",
+				"-default-sidecar-proxy-public-listener-port=70000"},
+			expErr: "-default-sidecar-proxy-public-listener-port must be in the range 1-65535, was 70000",
+		},
+		{
+			flags: []string{"-consul-k8s-image", "foo", "-consul-image", "foo", "-envoy-image", "envoy:1.16.0",
+				"-default-sidecar-proxy-check-interval=0s"},
+			expErr: "-default-sidecar-proxy-check-interval must be positive, was 0s",
+		},
+		{
+			flags: []string{"-consul-k8s-image", "foo", "-consul-image", "foo", "-envoy-image", "envoy:1.16.0",
+				"-default-sidecar-proxy-check-timeout=-1s"},
+			expErr: "-default-sidecar-proxy-check-timeout must be non-negative, was -1s",
+		},
+		{
+			flags: []string{"-consul-k8s-image", "foo", "-consul-image", "foo", "-envoy-image", "envoy:1.16.0",
+				"-default-sidecar-proxy-deregister-critical-service-after=0s"},
+			expErr: "-default-sidecar-proxy-deregister-critical-service-after must be positive, was 0s",
+		},
 		{
 			flags: []string{"-consul-k8s-image", "hashicorp/consul-k8s", "-consul-image", "foo", "-envoy-image", "envoy:1.16.0",
 				"-http-addr=http://0.0.0.0:9999",
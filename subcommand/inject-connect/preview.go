@@ -0,0 +1,427 @@
+package connectinject
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	connectinject "github.com/hashicorp/consul-k8s/connect-inject"
+	"github.com/hashicorp/consul-k8s/subcommand/flags"
+	"github.com/mitchellh/cli"
+	"go.uber.org/zap/zapcore"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8syaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	previewOutputObject = "object"
+	previewOutputPatch  = "patch"
+
+	// serviceAccountTokenMountPath is where the Kubernetes ServiceAccount admission
+	// controller mounts the service account token into every container.
+	serviceAccountTokenMountPath = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// PreviewCommand runs the connect injector's mutating webhook against manifests
+// on disk, without talking to Consul or Kubernetes, and prints the result.
+type PreviewCommand struct {
+	UI cli.Ui
+
+	flagFile            string   // Path to the manifest to preview, or "-" for stdin
+	flagNamespace       string   // Namespace of objects that don't set one
+	flagNamespaceLabels []string // Labels of the namespace as key=value pairs
+	flagOutput          string   // Either "object" or "patch"
+	flagCACertFile      string   // Path to the CA certificate the injected containers should use
+	flagLogLevel        string
+
+	// inject holds the injection flags shared with the inject-connect command.
+	inject Command
+
+	flagSet *flag.FlagSet
+
+	// stdin is read when -file is "-". It defaults to os.Stdin.
+	stdin io.Reader
+
+	once sync.Once
+	help string
+}
+
+func (c *PreviewCommand) init() {
+	c.flagSet = flag.NewFlagSet("", flag.ContinueOnError)
+	c.flagSet.StringVar(&c.flagFile, "file", "-",
+		"Path to a YAML or JSON manifest containing Pods or workloads with a pod template. Use \"-\" to read from stdin.")
+	c.flagSet.StringVar(&c.flagNamespace, "namespace", corev1.NamespaceDefault,
+		"Kubernetes namespace of the objects in the manifest that don't set one.")
+	c.flagSet.Var((*flags.AppendSliceValue)(&c.flagNamespaceLabels), "namespace-label",
+		"Label of the Kubernetes namespace in key=value form, e.g. to enable transparent proxy for the namespace. "+
+			"May be specified multiple times.")
+	c.flagSet.StringVar(&c.flagOutput, "output", previewOutputObject,
+		fmt.Sprintf("Output format. Either %q to print the mutated objects or %q to print the JSON patch of each pod.",
+			previewOutputObject, previewOutputPatch))
+	c.flagSet.StringVar(&c.flagCACertFile, "ca-file", "",
+		"Path to the CA certificate used to communicate with Consul clients over HTTPS.")
+	c.flagSet.StringVar(&c.flagLogLevel, "log-level", zapcore.WarnLevel.String(),
+		fmt.Sprintf("Log verbosity level. Supported values (in order of detail) are "+
+			"%q, %q, %q, and %q.", zapcore.DebugLevel.String(), zapcore.InfoLevel.String(), zapcore.WarnLevel.String(), zapcore.ErrorLevel.String()))
+	c.inject.initInjectionFlags(c.flagSet)
+
+	c.help = flags.Usage(previewHelp, c.flagSet)
+}
+
+func (c *PreviewCommand) Run(args []string) int {
+	c.once.Do(c.init)
+	if err := c.flagSet.Parse(args); err != nil {
+		return 1
+	}
+	if len(c.flagSet.Args()) > 0 {
+		c.UI.Error("Invalid arguments: should have no non-flag arguments")
+		return 1
+	}
+	if c.flagOutput != previewOutputObject && c.flagOutput != previewOutputPatch {
+		c.UI.Error(fmt.Sprintf("-output must be one of %q or %q", previewOutputObject, previewOutputPatch))
+		return 1
+	}
+	nsLabels, err := parseNamespaceLabels(c.flagNamespaceLabels)
+	if err != nil {
+		c.UI.Error(err.Error())
+		return 1
+	}
+
+	handler, err := c.inject.injectionHandler()
+	if err != nil {
+		c.UI.Error(err.Error())
+		return 1
+	}
+	// Unlike the webhook, which is told which namespaces to inject by the Helm chart,
+	// a preview allows all namespaces unless -allow-k8s-namespace is set.
+	if len(c.inject.flagAllowK8sNamespacesList) == 0 {
+		handler.AllowK8sNamespacesSet.Add("*")
+	}
+	if c.flagCACertFile != "" {
+		caCert, err := ioutil.ReadFile(c.flagCACertFile)
+		if err != nil {
+			c.UI.Error(fmt.Sprintf("error reading Consul's CA cert file %q: %s", c.flagCACertFile, err))
+			return 1
+		}
+		handler.ConsulCACert = string(caCert)
+	}
+
+	var zapLevel zapcore.Level
+	if err := zapLevel.UnmarshalText([]byte(c.flagLogLevel)); err != nil {
+		c.UI.Error(fmt.Sprintf("Error parsing -log-level %q: %s", c.flagLogLevel, err.Error()))
+		return 1
+	}
+	// Logs go to stderr so that stdout only contains the preview.
+	handler.Log = zap.New(zap.UseDevMode(true), zap.Level(zapLevel), zap.WriteTo(os.Stderr)).WithName("handler").WithName("connect")
+
+	// The handler only uses the Kubernetes API to look up the pod's namespace, so
+	// namespaces are served from a fake clientset with the labels given as flags.
+	// There is no Consul client, which means Consul namespaces are not created.
+	handler.Clientset = fake.NewSimpleClientset()
+	decoder, err := admission.NewDecoder(scheme)
+	if err != nil {
+		c.UI.Error(fmt.Sprintf("error creating admission decoder: %s", err))
+		return 1
+	}
+	if err := handler.InjectDecoder(decoder); err != nil {
+		c.UI.Error(fmt.Sprintf("error creating admission decoder: %s", err))
+		return 1
+	}
+
+	manifest, err := c.readManifest()
+	if err != nil {
+		c.UI.Error(err.Error())
+		return 1
+	}
+
+	var out []string
+	reader := k8syaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(manifest)))
+	for {
+		doc, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c.UI.Error(fmt.Sprintf("error reading manifest: %s", err))
+			return 1
+		}
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+
+		result, err := c.preview(&handler, doc, nsLabels)
+		if err != nil {
+			c.UI.Error(err.Error())
+			return 1
+		}
+		if result != "" {
+			out = append(out, result)
+		}
+	}
+
+	c.UI.Output(strings.TrimSuffix(strings.Join(out, "---\n"), "\n"))
+	return 0
+}
+
+// preview runs the handler against the pod or pod template of a single manifest
+// document and returns what should be printed for it.
+func (c *PreviewCommand) preview(handler *connectinject.Handler, doc []byte, nsLabels map[string]string) (string, error) {
+	obj, gvk, err := clientgoscheme.Codecs.UniversalDeserializer().Decode(doc, nil, nil)
+	if err != nil && !runtime.IsNotRegisteredError(err) {
+		return "", fmt.Errorf("error decoding manifest: %s", err)
+	}
+
+	var meta metav1.ObjectMeta
+	var template *corev1.PodTemplateSpec
+	if err == nil {
+		// The deserializer drops the type information, which is needed in the output.
+		obj.GetObjectKind().SetGroupVersionKind(*gvk)
+		meta, template = podTemplate(obj)
+	}
+	if template == nil {
+		// Only Pods and workloads with a pod template are mutated by the webhook.
+		// Anything else is passed through so that whole manifests can be previewed.
+		if c.flagOutput == previewOutputPatch {
+			return "", nil
+		}
+		return string(doc), nil
+	}
+
+	namespace := meta.Namespace
+	if namespace == "" {
+		namespace = c.flagNamespace
+	}
+	if err := ensureNamespace(handler.Clientset, namespace, nsLabels); err != nil {
+		return "", err
+	}
+
+	pod := corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: template.ObjectMeta,
+		Spec:       template.Spec,
+	}
+	if pod.Name == "" && pod.GenerateName == "" {
+		pod.GenerateName = meta.Name + "-"
+	}
+	pod.Namespace = namespace
+	addServiceAccountTokenMount(&pod)
+
+	podJSON, err := json.Marshal(pod)
+	if err != nil {
+		return "", err
+	}
+	resp := handler.Handle(context.Background(), admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Namespace: namespace,
+			Name:      pod.Name,
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: podJSON},
+		},
+	})
+	for _, warning := range resp.Warnings {
+		c.UI.Warn(fmt.Sprintf("%s %q: %s", gvk.Kind, meta.Name, warning))
+	}
+	if !resp.Allowed {
+		return "", fmt.Errorf("%s %q was rejected: %s", gvk.Kind, meta.Name, resp.Result.Message)
+	}
+	if len(resp.Patches) == 0 {
+		c.UI.Warn(fmt.Sprintf("%s %q does not require injection", gvk.Kind, meta.Name))
+		if c.flagOutput == previewOutputPatch {
+			return "[]\n", nil
+		}
+		return string(doc), nil
+	}
+
+	patchJSON, err := json.Marshal(resp.Patches)
+	if err != nil {
+		return "", err
+	}
+	if c.flagOutput == previewOutputPatch {
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, patchJSON, "", "  "); err != nil {
+			return "", err
+		}
+		return indented.String() + "\n", nil
+	}
+
+	patch, err := jsonpatch.DecodePatch(patchJSON)
+	if err != nil {
+		return "", fmt.Errorf("error decoding patch for %s %q: %s", gvk.Kind, meta.Name, err)
+	}
+	mutatedJSON, err := patch.Apply(podJSON)
+	if err != nil {
+		return "", fmt.Errorf("error applying patch to %s %q: %s", gvk.Kind, meta.Name, err)
+	}
+	var mutated corev1.Pod
+	if err := json.Unmarshal(mutatedJSON, &mutated); err != nil {
+		return "", err
+	}
+
+	if _, isPod := obj.(*corev1.Pod); isPod {
+		// Keep the namespace of the manifest rather than the one the pod was previewed in.
+		mutated.Namespace = meta.Namespace
+		mutated.Status = corev1.PodStatus{}
+		obj = &mutated
+	} else {
+		template.ObjectMeta = mutated.ObjectMeta
+		template.Namespace = ""
+		template.Name = ""
+		template.GenerateName = ""
+		template.Spec = mutated.Spec
+	}
+	out, err := yaml.Marshal(obj)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// readManifest returns the contents of the -file flag, reading stdin for "-".
+func (c *PreviewCommand) readManifest() ([]byte, error) {
+	if c.flagFile == "-" {
+		stdin := c.stdin
+		if stdin == nil {
+			stdin = os.Stdin
+		}
+		manifest, err := ioutil.ReadAll(stdin)
+		if err != nil {
+			return nil, fmt.Errorf("error reading manifest from stdin: %s", err)
+		}
+		return manifest, nil
+	}
+	manifest, err := ioutil.ReadFile(c.flagFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest %q: %s", c.flagFile, err)
+	}
+	return manifest, nil
+}
+
+// podTemplate returns the object metadata and a pointer to the pod template of the
+// objects the webhook would mutate pods for. The template of a Pod is a copy of its
+// metadata and spec. A nil template means the object doesn't create pods.
+func podTemplate(obj runtime.Object) (metav1.ObjectMeta, *corev1.PodTemplateSpec) {
+	switch o := obj.(type) {
+	case *corev1.Pod:
+		return o.ObjectMeta, &corev1.PodTemplateSpec{ObjectMeta: o.ObjectMeta, Spec: o.Spec}
+	case *appsv1.Deployment:
+		return o.ObjectMeta, &o.Spec.Template
+	case *appsv1.StatefulSet:
+		return o.ObjectMeta, &o.Spec.Template
+	case *appsv1.DaemonSet:
+		return o.ObjectMeta, &o.Spec.Template
+	case *appsv1.ReplicaSet:
+		return o.ObjectMeta, &o.Spec.Template
+	case *corev1.ReplicationController:
+		return o.ObjectMeta, o.Spec.Template
+	case *batchv1.Job:
+		return o.ObjectMeta, &o.Spec.Template
+	case *batchv1beta1.CronJob:
+		return o.ObjectMeta, &o.Spec.JobTemplate.Spec.Template
+	}
+	return metav1.ObjectMeta{}, nil
+}
+
+// ensureNamespace creates the namespace with the given labels in the fake
+// clientset if it hasn't been created yet.
+func ensureNamespace(clientset kubernetes.Interface, name string, labels map[string]string) error {
+	_, err := clientset.CoreV1().Namespaces().Create(context.Background(), &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+	}, metav1.CreateOptions{})
+	if err != nil && !k8serrors.IsAlreadyExists(err) {
+		return fmt.Errorf("error creating namespace %q: %s", name, err)
+	}
+	return nil
+}
+
+// addServiceAccountTokenMount mounts a service account token into the pod's containers
+// the way the ServiceAccount admission controller does before mutating webhooks run.
+// The injector relies on this mount when ACLs are enabled.
+func addServiceAccountTokenMount(pod *corev1.Pod) {
+	if pod.Spec.AutomountServiceAccountToken != nil && !*pod.Spec.AutomountServiceAccountToken {
+		return
+	}
+	for _, container := range pod.Spec.Containers {
+		for _, vm := range container.VolumeMounts {
+			if vm.MountPath == serviceAccountTokenMountPath {
+				return
+			}
+		}
+	}
+
+	serviceAccount := pod.Spec.ServiceAccountName
+	if serviceAccount == "" {
+		serviceAccount = "default"
+	}
+	volumeName := serviceAccount + "-token"
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+		Name: volumeName,
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{SecretName: volumeName},
+		},
+	})
+	for i := range pod.Spec.Containers {
+		pod.Spec.Containers[i].VolumeMounts = append(pod.Spec.Containers[i].VolumeMounts, corev1.VolumeMount{
+			Name:      volumeName,
+			ReadOnly:  true,
+			MountPath: serviceAccountTokenMountPath,
+		})
+	}
+}
+
+// parseNamespaceLabels parses key=value pairs from the -namespace-label flag.
+func parseNamespaceLabels(raw []string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, l := range raw {
+		parts := strings.SplitN(l, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("-namespace-label %q is invalid: must be in key=value form", l)
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return labels, nil
+}
+
+func (c *PreviewCommand) Synopsis() string { return previewSynopsis }
+func (c *PreviewCommand) Help() string {
+	c.once.Do(c.init)
+	return c.help
+}
+
+const previewSynopsis = "Preview Connect injection for Kubernetes manifests."
+const previewHelp = `
+Usage: consul-k8s inject-preview [options]
+
+  Run the Connect injector's mutating webhook against Pods and workloads
+  in a manifest and print the mutated objects or the JSON patch the
+  webhook would return. It accepts the same injection flags as
+  inject-connect and does not connect to Consul or Kubernetes.
+
+  Pods in all namespaces are injected unless -allow-k8s-namespace is set.
+  They are previewed as the Kubernetes API server would pass them to the
+  webhook, which means a service account token volume is mounted
+  into their containers unless automountServiceAccountToken is false.
+
+`
@@ -0,0 +1,196 @@
+package connectinject
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mitchellh/cli"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const previewDeployment = `apiVersion: v1
+kind: Service
+metadata:
+  name: web
+spec:
+  ports:
+  - port: 80
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  selector:
+    matchLabels:
+      app: web
+  template:
+    metadata:
+      labels:
+        app: web
+    spec:
+      containers:
+      - name: web
+        image: nginx
+        ports:
+        - containerPort: 80
+        readinessProbe:
+          httpGet:
+            port: 80
+            path: /ready
+`
+
+var previewImageFlags = []string{"-consul-k8s-image", "hashicorp/consul-k8s", "-consul-image", "consul", "-envoy-image", "envoy"}
+
+func TestPreviewRun_FlagValidation(t *testing.T) {
+	cases := []struct {
+		flags  []string
+		expErr string
+	}{
+		{
+			flags:  []string{"-output", "json"},
+			expErr: `-output must be one of "object" or "patch"`,
+		},
+		{
+			flags:  []string{"-namespace-label", "foo"},
+			expErr: `-namespace-label "foo" is invalid: must be in key=value form`,
+		},
+		{
+			flags:  []string{},
+			expErr: "-consul-k8s-image must be set",
+		},
+		{
+			flags:  append([]string{"-default-sidecar-proxy-cpu-limit=unparseable"}, previewImageFlags...),
+			expErr: "-default-sidecar-proxy-cpu-limit is invalid",
+		},
+		{
+			flags:  append([]string{"-ca-file", "bar"}, previewImageFlags...),
+			expErr: `error reading Consul's CA cert file "bar"`,
+		},
+		{
+			flags:  append([]string{"-file", "/does/not/exist"}, previewImageFlags...),
+			expErr: `error reading manifest "/does/not/exist"`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.expErr, func(t *testing.T) {
+			ui := cli.NewMockUi()
+			cmd := PreviewCommand{UI: ui}
+			code := cmd.Run(c.flags)
+			require.Equal(t, 1, code)
+			require.Contains(t, ui.ErrorWriter.String(), c.expErr)
+		})
+	}
+}
+
+func TestPreviewRun_Object(t *testing.T) {
+	manifestFile := filepath.Join(t.TempDir(), "manifest.yaml")
+	require.NoError(t, ioutil.WriteFile(manifestFile, []byte(previewDeployment), 0600))
+
+	ui := cli.NewMockUi()
+	cmd := PreviewCommand{UI: ui}
+	code := cmd.Run(append([]string{"-file", manifestFile}, previewImageFlags...))
+	require.Equal(t, 0, code, ui.ErrorWriter.String())
+
+	docs := strings.Split(ui.OutputWriter.String(), "---\n")
+	require.Len(t, docs, 2)
+
+	// Objects that don't create pods are passed through.
+	require.Equal(t, strings.Split(previewDeployment, "---\n")[0], docs[0])
+
+	var deployment appsv1.Deployment
+	require.NoError(t, yaml.Unmarshal([]byte(docs[1]), &deployment))
+	require.Equal(t, "Deployment", deployment.Kind)
+	require.Equal(t, "web", deployment.Name)
+
+	template := deployment.Spec.Template
+	require.Equal(t, "injected", template.Annotations["consul.hashicorp.com/connect-inject-status"])
+	require.Len(t, template.Spec.InitContainers, 2)
+	require.Equal(t, "consul", template.Spec.InitContainers[0].Image)
+	require.Len(t, template.Spec.Containers, 2)
+	require.Equal(t, "envoy-sidecar", template.Spec.Containers[1].Name)
+	require.Equal(t, "envoy", template.Spec.Containers[1].Image)
+
+	// Transparent proxy is enabled by default, so the readiness probe is
+	// redirected to Envoy.
+	require.Equal(t, 20301, template.Spec.Containers[0].ReadinessProbe.HTTPGet.Port.IntValue())
+}
+
+func TestPreviewRun_NamespaceLabels(t *testing.T) {
+	ui := cli.NewMockUi()
+	cmd := PreviewCommand{UI: ui, stdin: strings.NewReader(previewDeployment)}
+	flags := append([]string{"-namespace-label", "consul.hashicorp.com/transparent-proxy=false"}, previewImageFlags...)
+	code := cmd.Run(flags)
+	require.Equal(t, 0, code, ui.ErrorWriter.String())
+
+	docs := strings.Split(ui.OutputWriter.String(), "---\n")
+	require.Len(t, docs, 2)
+	var deployment appsv1.Deployment
+	require.NoError(t, yaml.Unmarshal([]byte(docs[1]), &deployment))
+
+	// Transparent proxy is disabled for the namespace, so probes are left alone.
+	require.Equal(t, 80, deployment.Spec.Template.Spec.Containers[0].ReadinessProbe.HTTPGet.Port.IntValue())
+}
+
+func TestPreviewRun_Patch(t *testing.T) {
+	pod := `apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+  namespace: apps
+spec:
+  containers:
+  - name: web
+    image: nginx
+`
+	ui := cli.NewMockUi()
+	cmd := PreviewCommand{UI: ui, stdin: strings.NewReader(pod)}
+	code := cmd.Run(append([]string{"-output", "patch"}, previewImageFlags...))
+	require.Equal(t, 0, code, ui.ErrorWriter.String())
+
+	var patches []struct {
+		Op    string          `json:"op"`
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	}
+	require.NoError(t, json.Unmarshal(ui.OutputWriter.Bytes(), &patches))
+
+	var paths []string
+	for _, p := range patches {
+		paths = append(paths, p.Path)
+	}
+	require.Contains(t, paths, "/spec/initContainers")
+	require.Contains(t, paths, "/spec/containers/1")
+	require.Contains(t, paths, "/metadata/annotations")
+}
+
+func TestPreviewRun_NotInjected(t *testing.T) {
+	pod := `apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+  annotations:
+    consul.hashicorp.com/connect-inject: "false"
+spec:
+  containers:
+  - name: web
+    image: nginx
+`
+	ui := cli.NewMockUi()
+	cmd := PreviewCommand{UI: ui, stdin: strings.NewReader(pod)}
+	code := cmd.Run(previewImageFlags)
+	require.Equal(t, 0, code, ui.ErrorWriter.String())
+	require.Contains(t, ui.ErrorWriter.String(), `Pod "web" does not require injection`)
+
+	var out corev1.Pod
+	require.NoError(t, yaml.Unmarshal(ui.OutputWriter.Bytes(), &out))
+	require.Len(t, out.Spec.Containers, 1)
+	require.Empty(t, out.Spec.Volumes)
+}
@@ -42,10 +42,11 @@ type Command struct {
 	flagCreateSyncToken    bool
 	flagSyncConsulNodeName string
 
-	flagCreateInjectToken      bool
-	flagCreateInjectAuthMethod bool
-	flagInjectAuthMethodHost   string
-	flagBindingRuleSelector    string
+	flagCreateInjectToken           bool
+	flagCreateInjectAuthMethod      bool
+	flagInjectAuthMethodHost        string
+	flagBindingRuleSelector         string
+	flagEnableInjectACLTokenCleanup bool
 
 	flagCreateControllerToken bool
 
@@ -129,6 +130,11 @@ func (c *Command) init() {
 		"Toggle for creating a connect inject auth method. Deprecated: use -create-inject-token instead.")
 	c.flags.BoolVar(&c.flagCreateInjectToken, "create-inject-token", false,
 		"Toggle for creating a connect inject auth method and an ACL token.")
+	c.flags.BoolVar(&c.flagEnableInjectACLTokenCleanup, "enable-inject-acl-token-cleanup", false,
+		"Toggle for granting the connect injector token acl = \"write\" so that it can delete the ACL tokens "+
+			"created by logins for pods that no longer exist. This makes the connect injector an ACL administrator: "+
+			"its token can create, read and delete every ACL token and policy, including the bootstrap token, and so "+
+			"gain any permission in Consul. Only set it if -acl-token-cleanup-interval is set on the connect injector.")
 	c.flags.StringVar(&c.flagInjectAuthMethodHost, "inject-auth-method-host", "",
 		"Kubernetes Host config parameter for the auth method."+
 			"If not provided, the default cluster Kubernetes service will be used.")
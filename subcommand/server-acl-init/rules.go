@@ -14,6 +14,7 @@ type rulesData struct {
 	InjectConsulDestNS      string
 	InjectEnableNSMirroring bool
 	InjectNSMirroringPrefix string
+	InjectACLTokenCleanup   bool
 	SyncConsulNodeName      string
 }
 
@@ -206,10 +207,16 @@ namespace "{{ .SyncConsulDestNS }}" {
 func (c *Command) injectRules() (string, error) {
 	// The Connect injector needs permissions to create namespaces when namespaces are enabled.
 	// It must also create/update service health checks via the endpoints controller.
+	// Deleting the ACL tokens that pods logged in for once the pods no longer exist needs
+	// acl = "write", which allows managing any token and policy, so it's only granted
+	// when the cleanup is enabled.
 	injectRulesTpl := `
 {{- if .EnableNamespaces }}
 operator = "write"
 {{- end }}
+{{- if .InjectACLTokenCleanup }}
+acl = "write"
+{{- end }}
 node_prefix "" {
   policy = "write"
 }
@@ -286,6 +293,7 @@ func (c *Command) rulesData() rulesData {
 		InjectConsulDestNS:      c.flagConsulInjectDestinationNamespace,
 		InjectEnableNSMirroring: c.flagEnableInjectK8SNSMirroring,
 		InjectNSMirroringPrefix: c.flagInjectK8SNSMirroringPrefix,
+		InjectACLTokenCleanup:   c.flagEnableInjectACLTokenCleanup,
 		SyncConsulNodeName:      c.flagSyncConsulNodeName,
 	}
 }
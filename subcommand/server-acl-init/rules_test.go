@@ -497,8 +497,9 @@ namespace_prefix "prefix-" {
 // Test the inject rules with namespaces enabled or disabled.
 func TestInjectRules(t *testing.T) {
 	cases := []struct {
-		EnableNamespaces bool
-		Expected         string
+		EnableNamespaces      bool
+		InjectACLTokenCleanup bool
+		Expected              string
 	}{
 		{
 			EnableNamespaces: false,
@@ -517,6 +518,33 @@ operator = "write"
 node_prefix "" {
   policy = "write"
 }
+namespace_prefix "" {
+  service_prefix "" {
+    policy = "write"
+  }
+}`,
+		},
+		{
+			EnableNamespaces:      false,
+			InjectACLTokenCleanup: true,
+			Expected: `
+acl = "write"
+node_prefix "" {
+  policy = "write"
+}
+  service_prefix "" {
+    policy = "write"
+  }`,
+		},
+		{
+			EnableNamespaces:      true,
+			InjectACLTokenCleanup: true,
+			Expected: `
+operator = "write"
+acl = "write"
+node_prefix "" {
+  policy = "write"
+}
 namespace_prefix "" {
   service_prefix "" {
     policy = "write"
@@ -526,12 +554,13 @@ namespace_prefix "" {
 	}
 
 	for _, tt := range cases {
-		caseName := fmt.Sprintf("ns=%t", tt.EnableNamespaces)
+		caseName := fmt.Sprintf("ns=%t cleanup=%t", tt.EnableNamespaces, tt.InjectACLTokenCleanup)
 		t.Run(caseName, func(t *testing.T) {
 			require := require.New(t)
 
 			cmd := Command{
-				flagEnableNamespaces: tt.EnableNamespaces,
+				flagEnableNamespaces:            tt.EnableNamespaces,
+				flagEnableInjectACLTokenCleanup: tt.InjectACLTokenCleanup,
 			}
 
 			injectorRules, err := cmd.injectRules()